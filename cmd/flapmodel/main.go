@@ -1,6 +1,7 @@
 package main
  
 import (
+	"context"
 	"fmt"
 	"github.com/richardmorrey/flap/pkg/model"
 	"github.com/richardmorrey/flap/pkg/flap"
@@ -8,19 +9,25 @@ import (
 	"os"
 	"strconv"
 	"time"
+	"os/signal"
+	"syscall"
 )
 
 func ShowHelp() {
 	fmt.Println(
 
 `
-Usage: flapmodel [-configpath=<configpath>] <command>
+Usage: flapmodel [-configpath=<configpath>] [-timeout=<duration>] <command>
 
 where
 
 <configfile> is path to a flapmodel yaml configuration file. Defaults to
 "./config.yaml".
 
+<duration> is the maximum time to allow "build", "run", "warm", "runoneday",
+"backfillworker", "migrate", "verify", "replay", "backup" and "restore" to take, e.g. "90m". Defaults to no limit. These commands can also be stopped
+cleanly at any point with Ctrl-C, saving state for the days completed.
+
 Available commands are as follows.
 
 build
@@ -71,19 +78,84 @@ Resets and then warms for a new model run
 oneday <YYYY-mm-dd>
 Runs model for the specified day. SHould be preceded by a "warm"
 
+backfillworker <name>
+Works as the named worker on the daily backfill of model runs in other processes
+sharing the same database, when distributed backfill is enabled in <configfile>.
+Runs until stopped. Needs a database that can be shared between processes, such
+as SQL.
+
+migrate
+Rewrites traveller records written by older versions, converting balances and
+transactions from kilometres to whole metres. Older records are converted when
+read anyway so this is only needed to convert them all in one go.
+
+verify
+Checks that every traveller's balance equals the total of their transactions,
+that trip histories and promises are consistent and that what was credited to
+travellers each day reconciles with the share of the Daily Total for the day.
+Lists any violations found.
+
+replay [YYYY-mm-dd]
+Rebuilds the state of all travellers from the event log, as it was at the end
+of the given day or, if none is given, as it is now. Needs events to be enabled
+in <configfile> before the model is built. The model's own state, such as the
+days run, is left as it is so use "show" and "transactions" to look at the
+state replayed and replay to the end again before running on.
+
+asof <botspec> <index> <YYYY-mm-dd>
+Works like show but returns the balance, clearance and promises still to be
+cleared for the bot traveller as they stood at the end of the given day,
+rebuilt from the event log. Needs events to be enabled in <configfile> before
+the model is built.
+
 reset
 Deletes all state associated with current model run
 
 destroy
 Destroys all state including the built model
 
+backup <file>
+Writes all state, including the built model, to a single archive file that
+can be restored into any of the supported database types.
+
+restore <file>
+Replaces all state with the contents of an archive file written by "backup".
+The archive is checked in full before any existing state is changed.
+
 `)
 	os.Exit(0)
 }
 
+// newContext returns a context that is cancelled on interrupt or termination
+// of the process, or once the given timeout has passed if it is not zero.
+func newContext(timeout time.Duration) (context.Context,context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx,cancel = context.WithTimeout(context.Background(),timeout)
+	} else {
+		ctx,cancel = context.WithCancel(context.Background())
+	}
+	sigs := make(chan os.Signal,1)
+	signal.Notify(sigs,os.Interrupt,syscall.SIGTERM)
+	go func() {
+		select {
+			case <-sigs:
+				fmt.Printf("\nStopping...\n")
+				cancel()
+			case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx,cancel
+}
+
 func main() {
 	configfile := flag.String("configfile","./config.yaml","File path of yaml config file to use")
+	timeout := flag.Duration("timeout",0,"Maximum duration of long running commands")
 	flag.Parse()
+	ctx,cancel := newContext(*timeout)
+	defer cancel()
 	switch flag.Arg(0){
 		case "destroy":
 			engine,err := model.NewEngine(*configfile)
@@ -113,7 +185,7 @@ func main() {
 				fmt.Printf("\nFailed to initialize model engine with error '%s'\n",err)
 			} else {
 				defer engine.Release()
-	 			err := engine.Build()
+	 			err := engine.Build(ctx)
 	 			if err != nil {
 		 			fmt.Printf("\nFailed to build model with error '%s'\n",err)
 				}
@@ -124,7 +196,7 @@ func main() {
 				fmt.Printf("\nFailed to initialize model engine with error '%s'\n",err)
 			} else {
 				defer engine.Release()
-				err := engine.Run(false,0)
+				err := engine.Run(ctx,false,0)
 				if err != nil {
 					fmt.Printf("\nFailed to run model with error '%s'\n",err)
 				}
@@ -142,7 +214,7 @@ func main() {
 				fmt.Printf("\nFailed to initialize model engine with error '%s'\n",err)
 			} else {
 				defer engine.Release()
-				err := engine.Run(true,startDay)
+				err := engine.Run(ctx,true,startDay)
 				if err != nil {
 					fmt.Printf("\nFailed to warm model with error '%s'\n",err)
 				}
@@ -157,12 +229,72 @@ func main() {
 					fmt.Printf("\nFailed to initialize model engine with error '%s'\n",err)
 				} else {
 					defer engine.Release()
-					err = engine.RunOneDay(flap.EpochTime(startOfDay.Unix()))
+					err = engine.RunOneDay(ctx,flap.EpochTime(startOfDay.Unix()))
 					if err != nil {
 						fmt.Printf("\nFailed to run for one day with error '%s'\n",err)
 					}
 				}
 			}
+		case "backfillworker":
+			engine,err := model.NewEngine(*configfile)
+			if err != nil {
+				fmt.Printf("\nFailed to initialize model engine with error '%s'\n",err)
+			} else {
+				defer engine.Release()
+				err := engine.ServeBackfill(ctx,flag.Arg(1))
+				if err != nil {
+					fmt.Printf("\nBackfill worker failed with error '%s'\n",err)
+				}
+			}
+		case "migrate":
+			engine,err := model.NewEngine(*configfile)
+			if err != nil {
+				fmt.Printf("\nFailed to initialize model engine with error '%s'\n",err)
+			} else {
+				defer engine.Release()
+				migrated,err := engine.MigrateTravellers(ctx)
+				if err != nil {
+					fmt.Printf("\nMigrate failed with error '%s'\n",err)
+				}
+				fmt.Printf("\nMigrated %d travellers\n",migrated)
+			}
+		case "verify":
+			engine,err := model.NewEngine(*configfile)
+			if err != nil {
+				fmt.Printf("\nFailed to initialize model engine with error '%s'\n",err)
+			} else {
+				defer engine.Release()
+				report,err := engine.Verify(ctx)
+				if err != nil {
+					fmt.Printf("\nVerify failed with error '%s'\n",err)
+				}
+				for _,v := range report.Violations {
+					fmt.Println(v)
+				}
+				fmt.Printf("\nVerified %d travellers and %d days (%d days too old to reconcile). %d violations found\n",
+					report.Travellers,report.Days,report.DaysUnchecked,len(report.Violations))
+			}
+		case "replay":
+			until := flap.MaxEpochTime
+			if flag.Arg(1) != "" {
+				day,err := time.Parse("2006-01-02",flag.Arg(1))
+				if err != nil {
+					fmt.Printf("\nFailed to parse time with error '%s'\n",err)
+					break
+				}
+				until = flap.EpochTime(day.Unix()+flap.SecondsInDay-1)
+			}
+			engine,err := model.NewEngine(*configfile)
+			if err != nil {
+				fmt.Printf("\nFailed to initialize model engine with error '%s'\n",err)
+			} else {
+				defer engine.Release()
+				replayed,err := engine.Replay(ctx,until)
+				if err != nil {
+					fmt.Printf("\nReplay failed with error '%s'\n",err)
+				}
+				fmt.Printf("\nReplayed %d events\n",replayed)
+			}
 		case "report":
 			engine,err := model.NewEngine(*configfile)
 			if err != nil {
@@ -223,6 +355,51 @@ func main() {
 			}
 
 
+		case "asof":
+			spec,_ := strconv.ParseUint(flag.Arg(1), 10, 64)
+			index,_ := strconv.ParseUint(flag.Arg(2), 10, 64)
+			day,err := time.Parse("2006-01-02",flag.Arg(3))
+			if err != nil {
+				fmt.Printf("\nFailed to parse time with error '%s'\n",err)
+				break
+			}
+		 	engine,err := model.NewEngine(*configfile)
+			if err != nil {
+				fmt.Printf("\nFailed to initialize model engine with error '%s'\n",err)
+			} else {
+				defer engine.Release()
+				json,err := engine.AccountAsOfJSON(spec,index,flap.EpochTime(day.Unix()+flap.SecondsInDay-1))
+				if err != nil {
+					fmt.Printf("\nFailed to find traveller with error '%s'\n",err)
+				} else {
+					fmt.Printf("\n%s\n",json)
+				}
+			}
+
+		case "backup":
+			engine,err := model.NewEngine(*configfile)
+			if err != nil {
+				fmt.Printf("\nFailed to initialize model engine with error '%s'\n",err)
+			} else {
+				defer engine.Release()
+				err := engine.Backup(ctx,flag.Arg(1))
+				if err != nil {
+					fmt.Printf("\nFailed to backup with error '%s'\n",err)
+				}
+			}
+
+		case "restore":
+			engine,err := model.NewEngine(*configfile)
+			if err != nil {
+				fmt.Printf("\nFailed to initialize model engine with error '%s'\n",err)
+			} else {
+				defer engine.Release()
+				err := engine.Restore(ctx,flag.Arg(1))
+				if err != nil {
+					fmt.Printf("\nFailed to restore with error '%s'\n",err)
+				}
+			}
+
 		case "help":
 		default:
 			ShowHelp()
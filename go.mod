@@ -6,9 +6,11 @@ require (
 	cloud.google.com/go/datastore v1.5.0
 	github.com/coreos/go-oidc v2.2.1+incompatible
 	github.com/gorilla/mux v1.8.0
+	github.com/mattn/go-sqlite3 v1.14.8
 	github.com/pquerna/cachecontrol v0.1.0 // indirect
 	github.com/syndtr/goleveldb v1.0.1-0.20210305035536-64b5b1c73954
 	github.com/twpayne/go-kml v1.5.2
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/net v0.0.0-20210503060351-7fd8e65b6420
 	gonum.org/v1/gonum v0.9.3
 	gonum.org/v1/plot v0.9.0
@@ -0,0 +1,376 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// A backup archive is a header followed by one section for each table and
+// a trailer. All lengths and counts are unsigned varints.
+//
+//	header	"FLAPDB" version(uint16)
+//	table	'T' len name ('R' len key len value)* 'E' count
+//	trailer	'Z' crc32c(uint32) of everything before it
+const backupMagic = "FLAPDB"
+const backupVersion uint16 = 1
+const backupMaxField = 1 << 30
+const (
+	backupTagTable byte = 'T'
+	backupTagRecord byte = 'R'
+	backupTagEnd byte = 'E'
+	backupTagTrailer byte = 'Z'
+)
+const backupBatchSize = 1000
+
+var EBADBACKUP = errors.New("Invalid backup archive")
+var EBACKUPVERSION = errors.New("Unsupported backup archive version")
+var EBACKUPCHECKSUM = errors.New("Backup archive checksum mismatch")
+
+var backupCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// rawValue passes stored values through without interpreting them
+type rawValue struct {
+	b []byte
+}
+
+func (self *rawValue) To(buff *bytes.Buffer) error {
+	buff.Write(self.b)
+	return nil
+}
+
+func (self *rawValue) From(buff *bytes.Buffer) error {
+	self.b = append(self.b[:0],buff.Bytes()...)
+	return nil
+}
+
+// backupWriter writes archive fields whilst keeping a running checksum
+type backupWriter struct {
+	w *bufio.Writer
+	crc hash.Hash32
+	err error
+}
+
+func (self *backupWriter) write(b []byte) {
+	if self.err == nil {
+		_,self.err = self.w.Write(b)
+		self.crc.Write(b)
+	}
+}
+
+func (self *backupWriter) uvarint(n uint64) {
+	var buff [binary.MaxVarintLen64]byte
+	self.write(buff[:binary.PutUvarint(buff[:],n)])
+}
+
+func (self *backupWriter) field(b []byte) {
+	self.uvarint(uint64(len(b)))
+	self.write(b)
+}
+
+// Backup writes the contents of the given tables to w as a single archive. A
+// snapshot of every table is taken before anything is written so that each
+// table is consistent, and tables are as close to the same point in time as the
+// database allows. Tables that do not exist are skipped. Returns the context
+// error if ctx is cancelled part way through, leaving an incomplete archive.
+func Backup(ctx context.Context, database Database, tables []string, w io.Writer) error {
+
+	// Snapshot all tables up front
+	var names []string
+	var snapshots []Snapshot
+	defer func() {
+		for _,ss := range snapshots {
+			ss.Release()
+		}
+	}()
+	for _,name := range tables {
+		table,err := database.OpenTable(name)
+		if err == ETABLENOTFOUND {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		ss,err := table.TakeSnapshot()
+		if err != nil {
+			return err
+		}
+		names = append(names,name)
+		snapshots = append(snapshots,ss)
+	}
+
+	// Write header
+	bw := backupWriter{w:bufio.NewWriter(w),crc:crc32.New(backupCRCTable)}
+	bw.write([]byte(backupMagic))
+	var version [2]byte
+	binary.BigEndian.PutUint16(version[:],backupVersion)
+	bw.write(version[:])
+
+	// Write each table
+	for i,ss := range snapshots {
+		bw.write([]byte{backupTagTable})
+		bw.field([]byte(names[i]))
+		iter,err := ss.NewIterator("")
+		if err != nil {
+			return err
+		}
+		var count uint64
+		var v rawValue
+		for iter.Next() && bw.err == nil {
+			if ctx.Err() != nil {
+				iter.Release()
+				return ctx.Err()
+			}
+			iter.Value(&v)
+			bw.write([]byte{backupTagRecord})
+			bw.field([]byte(iter.Key()))
+			bw.field(v.b)
+			count++
+		}
+		err = iter.Error()
+		iter.Release()
+		if err != nil {
+			return err
+		}
+		bw.write([]byte{backupTagEnd})
+		bw.uvarint(count)
+	}
+
+	// Write trailer
+	bw.write([]byte{backupTagTrailer})
+	if bw.err != nil {
+		return bw.err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:],bw.crc.Sum32())
+	_,err := bw.w.Write(sum[:])
+	if err != nil {
+		return err
+	}
+	return bw.w.Flush()
+}
+
+// backupReader reads archive fields whilst keeping a running checksum
+type backupReader struct {
+	r *bufio.Reader
+	crc hash.Hash32
+}
+
+func (self *backupReader) ReadByte() (byte,error) {
+	b,err := self.r.ReadByte()
+	if err == nil {
+		self.crc.Write([]byte{b})
+	}
+	return b,err
+}
+
+func (self *backupReader) read(n uint64) ([]byte,error) {
+	b := make([]byte,n)
+	_,err := io.ReadFull(self.r,b)
+	if err != nil {
+		return nil,EBADBACKUP
+	}
+	self.crc.Write(b)
+	return b,nil
+}
+
+func (self *backupReader) uvarint() (uint64,error) {
+	n,err := binary.ReadUvarint(self)
+	if err != nil {
+		return 0,EBADBACKUP
+	}
+	return n,nil
+}
+
+func (self *backupReader) field() ([]byte,error) {
+	n,err := self.uvarint()
+	if err != nil {
+		return nil,err
+	}
+	if n > backupMaxField {
+		return nil,EBADBACKUP
+	}
+	return self.read(n)
+}
+
+// readBackup parses an archive, calling startTable at the start of each table
+// section and put for each record. The checksum is only checked once the whole
+// archive has been read.
+func readBackup(ctx context.Context, r io.Reader, startTable func(string) error, put func([]byte,[]byte) error) error {
+
+	// Check header
+	br := backupReader{r:bufio.NewReader(r),crc:crc32.New(backupCRCTable)}
+	magic,err := br.read(uint64(len(backupMagic)))
+	if err != nil || string(magic) != backupMagic {
+		return EBADBACKUP
+	}
+	version,err := br.read(2)
+	if err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint16(version) != backupVersion {
+		return EBACKUPVERSION
+	}
+
+	// Read table sections
+	for {
+		tag,err := br.ReadByte()
+		if err != nil {
+			return EBADBACKUP
+		}
+		if tag == backupTagTrailer {
+			break
+		}
+		if tag != backupTagTable {
+			return EBADBACKUP
+		}
+		name,err := br.field()
+		if err != nil {
+			return err
+		}
+		err = startTable(string(name))
+		if err != nil {
+			return err
+		}
+		var count uint64
+		for {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			tag,err = br.ReadByte()
+			if err != nil {
+				return EBADBACKUP
+			}
+			if tag == backupTagEnd {
+				break
+			}
+			if tag != backupTagRecord {
+				return EBADBACKUP
+			}
+			key,err := br.field()
+			if err != nil {
+				return err
+			}
+			value,err := br.field()
+			if err != nil {
+				return err
+			}
+			err = put(key,value)
+			if err != nil {
+				return err
+			}
+			count++
+		}
+		expected,err := br.uvarint()
+		if err != nil {
+			return err
+		}
+		if expected != count {
+			return EBADBACKUP
+		}
+	}
+
+	// Check trailer
+	var sum [4]byte
+	_,err = io.ReadFull(br.r,sum[:])
+	if err != nil {
+		return EBADBACKUP
+	}
+	if binary.BigEndian.Uint32(sum[:]) != br.crc.Sum32() {
+		return EBACKUPCHECKSUM
+	}
+	_,err = br.r.ReadByte()
+	if err != io.EOF {
+		return EBADBACKUP
+	}
+	return nil
+}
+
+// VerifyBackup reads a whole archive, checking its structure and checksum
+// without writing anything. Returns the names of the tables it holds.
+func VerifyBackup(ctx context.Context, r io.Reader) ([]string,error) {
+	var names []string
+	err := readBackup(ctx,r,
+		func(name string) error {
+			names = append(names,name)
+			return nil
+		},
+		func(key []byte, value []byte) error {
+			return nil
+		})
+	return names,err
+}
+
+// clearTable deletes every entry in a table
+func clearTable(table Table) error {
+	iter,err := table.NewRangeIterator(IteratorOptions{KeysOnly:true})
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for iter.Next() {
+		keys = append(keys,iter.Key())
+	}
+	err = iter.Error()
+	iter.Release()
+	if err != nil {
+		return err
+	}
+	for _,key := range keys {
+		err = table.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore writes the contents of an archive to the given database, replacing
+// the contents of each table in it and creating tables as needed. Tables not in
+// the archive are left alone. As the checksum is only known at the end, use
+// VerifyBackup first to avoid restoring a damaged archive. Returns the names of
+// the tables restored.
+func Restore(ctx context.Context, database Database, r io.Reader) ([]string,error) {
+	var names []string
+	var bw BatchWrite
+	err := readBackup(ctx,r,
+		func(name string) error {
+			if bw != nil {
+				err := bw.Release()
+				bw = nil
+				if err != nil {
+					return err
+				}
+			}
+			table,err := database.OpenTable(name)
+			if err == ETABLENOTFOUND {
+				table,err = database.CreateTable(name)
+			} else if err == nil {
+				err = clearTable(table)
+			}
+			if err != nil {
+				return err
+			}
+			bw,err = table.MakeBatch(backupBatchSize)
+			if err != nil {
+				return err
+			}
+			names = append(names,name)
+			return nil
+		},
+		func(key []byte, value []byte) error {
+			return bw.Put(string(key),&rawValue{b:value})
+		})
+	if bw != nil {
+		errRelease := bw.Release()
+		if err == nil {
+			err = errRelease
+		}
+	}
+	return names,err
+}
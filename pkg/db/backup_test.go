@@ -0,0 +1,92 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+)
+
+func setupBackup(t *testing.T) (*MemoryDB,*bytes.Buffer) {
+	db := NewMemoryDB()
+	songs,_ := db.CreateTable("songs")
+	songs.Put("The Kinks",&Song{title:"Sitting in My Hotel"})
+	songs.Put("Sacred Paws",&Song{title:"Wet Graffiti"})
+	chars,_ := db.CreateTable("chars")
+	putCharacters(chars,"abc")
+	db.CreateTable("empty")
+	var archive bytes.Buffer
+	err := Backup(context.Background(),db,[]string{"songs","missing","chars","empty"},&archive)
+	if err != nil {
+		t.Error("Backup failed",err)
+	}
+	return db,&archive
+}
+
+func TestBackupRestore(t *testing.T) {
+	_,archive := setupBackup(t)
+	target := NewBoltDB(BOLTDBFILE)
+	defer teardownBolt(target)
+	chars,_ := target.CreateTable("chars")
+	putCharacters(chars,"xyz")
+	names,err := Restore(context.Background(),target,bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Error("Restore failed",err)
+	}
+	if !reflect.DeepEqual(names,[]string{"songs","chars","empty"}) {
+		t.Error("Restored wrong tables",names)
+	}
+	songs,err := target.OpenTable("songs")
+	if err != nil {
+		t.Error("Songs table not restored",err)
+		return
+	}
+	var sOut Song
+	err = songs.Get("Sacred Paws",&sOut)
+	if err != nil || sOut.title != "Wet Graffiti" {
+		t.Error("Song not restored",sOut.title,err)
+	}
+	iterator,_ := chars.NewIterator("")
+	if keys := collectKeys(iterator,true,t); keys != "abc" {
+		t.Error("Existing table contents not replaced",keys)
+	}
+	_,err = target.OpenTable("empty")
+	if err != nil {
+		t.Error("Empty table not restored",err)
+	}
+}
+
+func TestBackupVerify(t *testing.T) {
+	_,archive := setupBackup(t)
+	names,err := VerifyBackup(context.Background(),bytes.NewReader(archive.Bytes()))
+	if err != nil || len(names) != 3 {
+		t.Error("Failed to verify good archive",names,err)
+	}
+	corrupt := append([]byte(nil),archive.Bytes()...)
+	corrupt[len(corrupt)/2] ^= 0x01
+	_,err = VerifyBackup(context.Background(),bytes.NewReader(corrupt))
+	if err == nil {
+		t.Error("Verified corrupt archive")
+	}
+	_,err = VerifyBackup(context.Background(),bytes.NewReader(archive.Bytes()[:archive.Len()-1]))
+	if err != EBADBACKUP {
+		t.Error("Verified truncated archive",err)
+	}
+	future := append([]byte(nil),archive.Bytes()...)
+	future[len(backupMagic)+1]++
+	_,err = VerifyBackup(context.Background(),bytes.NewReader(future))
+	if err != EBACKUPVERSION {
+		t.Error("Verified archive with unknown version",err)
+	}
+}
+
+func TestBackupCancelled(t *testing.T) {
+	_,archive := setupBackup(t)
+	ctx,cancel := context.WithCancel(context.Background())
+	cancel()
+	target := NewMemoryDB()
+	_,err := Restore(ctx,target,bytes.NewReader(archive.Bytes()))
+	if err != context.Canceled {
+		t.Error("Restore not cancelled",err)
+	}
+}
@@ -0,0 +1,601 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sync"
+	"time"
+	bolt "go.etcd.io/bbolt"
+)
+
+var EMMAPFULL = errors.New("Bolt file would outgrow its memory map whilst read transactions are open")
+
+// boltInitialMmapSize is the smallest size the bolt file is memory mapped at. Writers
+// need to remap the file as it grows, which blocks until every read transaction - and
+// so every BoltSnapshot and BoltIterator - has ended. Files are mapped at this size, or
+// boltMmapGrowth times their size when opened if larger, so that there is room for them
+// to grow while long running snapshots, such as the one held during backfill, are open.
+const boltInitialMmapSize = 1 << 30
+
+// boltMmapGrowth is how many times its size a file is mapped at when opened. Pages freed
+// while a snapshot is open cant be reused until it ends, so rewriting every record of a
+// table, as a backfill can, may double the file, and each write is checked against the
+// map as if it needed twice its size.
+const boltMmapGrowth = 4
+
+// boltGrowthMargin is the space left spare in the memory map, when deciding whether a
+// write could outgrow it, for the pages bolt allocates on top of the data written
+const boltGrowthMargin = 1 << 20
+
+// boltTxs tracks the read transactions held open by snapshots and iterators
+// so that they can all be rolled back when the database is released. Bolt cannot
+// close a file whilst read transactions are still open. It also knows how large
+// the file was mapped, so that writes that would need it remapped while read
+// transactions are open fail with EMMAPFULL rather than blocking forever.
+type boltTxs struct {
+	mux sync.Mutex
+	open map[*bolt.Tx]bool
+	mmapSize int64
+}
+
+// update runs fn in an update transaction, failing it with EMMAPFULL, so that nothing
+// is written, if read transactions are open and writing the given number of bytes could
+// grow the file beyond its memory map. The check is made within the transaction, and no
+// read transaction can begin until it commits, so concurrent writers never pass it
+// against the same size.
+func (self *boltTxs) update(db *bolt.DB, n int, fn func(*bolt.Tx) error) error {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	return db.Update(func(tx *bolt.Tx) error {
+		if len(self.open) > 0 && tx.Size()+int64(2*n)+boltGrowthMargin >= self.mmapSize {
+			return EMMAPFULL
+		}
+		return fn(tx)
+	})
+}
+
+// begin starts and tracks a new read transaction. It is started with the lock held
+// so that no update can miss it when checking for open read transactions.
+func (self *boltTxs) begin(db *bolt.DB) (*bolt.Tx,error) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	tx,err := db.Begin(false)
+	if err != nil {
+		return nil,err
+	}
+	self.open[tx]=true
+	return tx,nil
+}
+
+// end rolls back a tracked transaction if it is still open
+func (self *boltTxs) end(tx *bolt.Tx) error {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if !self.open[tx] {
+		return nil
+	}
+	delete(self.open,tx)
+	return tx.Rollback()
+}
+
+// endAll rolls back all transactions that are still open
+func (self *boltTxs) endAll() {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	for tx,_ := range self.open {
+		tx.Rollback()
+	}
+	self.open = make(map[*bolt.Tx]bool)
+}
+
+// BoltIterator iterates over a range of keys using a cursor on a read
+// transaction.
+type BoltIterator struct {
+	cursor *bolt.Cursor
+	opts IteratorOptions
+	key []byte
+	value []byte
+	started bool
+	mux *sync.Mutex
+	tx *bolt.Tx
+	txs *boltTxs
+	err error
+}
+
+// last moves the cursor to the last key before the given limit, or
+// the last key in the bucket if there is no limit
+func (self *BoltIterator) last(limit []byte) {
+	if len(limit) == 0 {
+		self.key,self.value = self.cursor.Last()
+		return
+	}
+	self.key,self.value = self.cursor.Seek(limit)
+	if self.key == nil {
+		self.key,self.value = self.cursor.Last()
+	} else {
+		self.key,self.value = self.cursor.Prev()
+	}
+}
+
+// settle checks the cursor is still in range. Iterators created from a table
+// end their transaction once there are no more keys.
+func (self *BoltIterator) settle() (bool) {
+	if self.key != nil && self.opts.inRange(self.key) {
+		return true
+	}
+	self.key,self.value = nil,nil
+	self.cursor = nil
+	if self.txs != nil {
+		self.err = self.txs.end(self.tx)
+	}
+	return false
+}
+
+// Next moves the cursor to the next key in the iterator's range
+func (self *BoltIterator) Next() (bool) {
+	if self.cursor == nil {
+		return false
+	}
+	self.mux.Lock()
+	switch {
+		case !self.started && self.opts.Reverse:
+			self.last([]byte(self.opts.Limit))
+		case !self.started:
+			self.key,self.value = self.cursor.Seek([]byte(self.opts.Start))
+		case self.opts.Reverse:
+			self.key,self.value = self.cursor.Prev()
+		default:
+			self.key,self.value = self.cursor.Next()
+	}
+	self.started = true
+	self.mux.Unlock()
+	return self.settle()
+}
+
+// Seek moves the cursor to the first key at or after the given key, or at
+// or before it for reverse iterators
+func (self *BoltIterator) Seek(key string) (bool) {
+	if self.cursor == nil {
+		return false
+	}
+	self.mux.Lock()
+	if self.opts.Reverse {
+		limit := key+"\x00"
+		if self.opts.Limit != "" && self.opts.Limit < limit {
+			limit = self.opts.Limit
+		}
+		self.last([]byte(limit))
+	} else {
+		if key < self.opts.Start {
+			key = self.opts.Start
+		}
+		self.key,self.value = self.cursor.Seek([]byte(key))
+	}
+	self.started = true
+	self.mux.Unlock()
+	return self.settle()
+}
+
+// Key returns the current key
+func (self *BoltIterator) Key() (string) {
+	return string(self.key)
+}
+
+// Value deserializes the current value into the given struct. The value
+// is copied first as bolt only guarantees it for the life of the transaction.
+func (self *BoltIterator) Value(s Serialize) {
+	if self.opts.KeysOnly {
+		self.err = EKEYSONLY
+		return
+	}
+	if self.value == nil {
+		return
+	}
+	self.err = s.From(bytes.NewBuffer(append([]byte(nil),self.value...)))
+}
+
+// Error reports any error from the last call to Value
+func (self *BoltIterator) Error() error {
+	return self.err
+}
+
+// Release ends the iterator's transaction if it owns one
+func (self *BoltIterator) Release() error {
+	self.cursor = nil
+	if self.txs != nil {
+		err := self.txs.end(self.tx)
+		if err != nil {
+			return err
+		}
+	}
+	return self.err
+}
+
+// BoltSnapshot is a read transaction on a single bucket. Bolt transactions
+// are not safe for concurrent use so cursor movements are serialized.
+type BoltSnapshot struct {
+	tx *bolt.Tx
+	mux sync.Mutex
+	table *BoltTable
+}
+
+// Release ends the snapshot's read transaction
+func (self *BoltSnapshot) Release() error {
+	return self.table.txs.end(self.tx)
+}
+
+// Get retrieves the value for given key as it was when the snapshot was taken
+func (self *BoltSnapshot) Get(key string,s Serialize) error {
+	self.mux.Lock()
+	v := self.tx.Bucket(self.table.name).Get([]byte(key))
+	self.mux.Unlock()
+	if v == nil {
+		return EKEYNOTFOUND
+	}
+	return s.From(bytes.NewBuffer(append([]byte(nil),v...)))
+}
+
+// NewIterator creates an iterator over the snapshot for keys with the given prefix
+func (self *BoltSnapshot) NewIterator(prefix string) (Iterator,error) {
+	return self.NewRangeIterator(PrefixRange(prefix))
+}
+
+// NewRangeIterator creates an iterator over the snapshot for the given range
+func (self *BoltSnapshot) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	iter := new(BoltIterator)
+	self.mux.Lock()
+	iter.cursor = self.tx.Bucket(self.table.name).Cursor()
+	self.mux.Unlock()
+	iter.opts = opts
+	iter.mux = &self.mux
+	return iter,nil
+}
+
+type boltOp struct {
+	key []byte
+	value []byte
+	delete bool
+}
+
+// BoltBatchWrite collects writes and applies them in a single update transaction
+type BoltBatchWrite struct {
+	ops []boltOp
+	table *BoltTable
+	batchSize int
+}
+
+// Put adds a put to the batch
+func (self *BoltBatchWrite) Put(key string, s Serialize) error {
+	var buff bytes.Buffer
+	err := s.To(&buff)
+	if err != nil {
+		return err
+	}
+	self.ops = append(self.ops,boltOp{key:[]byte(key),value:buff.Bytes()})
+	return self.write(false)
+}
+
+// Delete adds a delete to the batch
+func (self* BoltBatchWrite) Delete(key string) error {
+	self.ops = append(self.ops,boltOp{key:[]byte(key),delete:true})
+	return self.write(false)
+}
+
+// Release forces write of any remaining data in the current batch
+func (self* BoltBatchWrite) Release() error {
+	return self.write(true)
+}
+
+// write provides convenient way to write in batches of fixed size
+func (self* BoltBatchWrite) write(flush bool) error {
+	if len(self.ops) == 0 || (!flush && len(self.ops) < self.batchSize) {
+		return nil
+	}
+	var n int
+	for _,op := range self.ops {
+		n += len(op.key)+len(op.value)
+	}
+	err := self.table.txs.update(self.table.db,n,func(tx *bolt.Tx) error {
+		b := tx.Bucket(self.table.name)
+		if b == nil {
+			return ETABLENOTFOUND
+		}
+		for _,op := range self.ops {
+			var err error
+			if op.delete {
+				err = b.Delete(op.key)
+			} else {
+				err = b.Put(op.key,op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	self.ops = self.ops[:0]
+	return err
+}
+
+// BoltTable is a single bucket in a bolt database
+type BoltTable struct {
+	db *bolt.DB
+	name []byte
+	txs *boltTxs
+}
+
+// Get retrieves the value for the given key
+func (self *BoltTable) Get(key string,s Serialize) error {
+	return self.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(self.name)
+		if b == nil {
+			return ETABLENOTFOUND
+		}
+		v := b.Get([]byte(key))
+		if v == nil {
+			return EKEYNOTFOUND
+		}
+		return s.From(bytes.NewBuffer(append([]byte(nil),v...)))
+	})
+}
+
+// Put stores the value for the given key
+func (self *BoltTable) Put(key string, s Serialize) error {
+	var buff bytes.Buffer
+	err := s.To(&buff)
+	if err != nil {
+		return err
+	}
+	return self.txs.update(self.db,len(key)+buff.Len(),func(tx *bolt.Tx) error {
+		b := tx.Bucket(self.name)
+		if b == nil {
+			return ETABLENOTFOUND
+		}
+		return b.Put([]byte(key),buff.Bytes())
+	})
+}
+
+// Swap replaces the value for the given key if it is unchanged, checking and
+// writing in a single update transaction
+func (self *BoltTable) Swap(key string, was Serialize, s Serialize) error {
+	old,err := serialized(was)
+	if err != nil {
+		return err
+	}
+	value,err := serialized(s)
+	if err != nil {
+		return err
+	}
+	return self.txs.update(self.db,len(key)+len(value),func(tx *bolt.Tx) error {
+		b := tx.Bucket(self.name)
+		if b == nil {
+			return ETABLENOTFOUND
+		}
+		stored := b.Get([]byte(key))
+		if !swapped(stored,stored != nil,old,was == nil) {
+			return ESWAPFAILED
+		}
+		return b.Put([]byte(key),value)
+	})
+}
+
+// Delete removes the value for the given key
+func (self *BoltTable) Delete(key string) error {
+	return self.txs.update(self.db,len(key),func(tx *bolt.Tx) error {
+		b := tx.Bucket(self.name)
+		if b == nil {
+			return ETABLENOTFOUND
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// NewIterator creates an iterator over keys with the given prefix
+func (self *BoltTable) NewIterator(prefix string) (Iterator,error) {
+	return self.NewRangeIterator(PrefixRange(prefix))
+}
+
+// NewRangeIterator creates an iterator over the given range of keys. It holds
+// its own read transaction, so sees the table as it was when created, until
+// it is released or runs out of keys.
+func (self *BoltTable) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	tx,err := self.txs.begin(self.db)
+	if err != nil {
+		return nil,err
+	}
+	b := tx.Bucket(self.name)
+	if b == nil {
+		self.txs.end(tx)
+		return nil,ETABLENOTFOUND
+	}
+	iter := new(BoltIterator)
+	iter.cursor = b.Cursor()
+	iter.opts = opts
+	iter.mux = new(sync.Mutex)
+	iter.tx = tx
+	iter.txs = self.txs
+	return iter,nil
+}
+
+// TakeSnapshot maps a snapshot on to a bolt read transaction. Snapshots are refused
+// with EMMAPFULL once the file has no room left to grow in its memory map.
+func (self *BoltTable) TakeSnapshot() (Snapshot,error) {
+	tx,err := self.txs.begin(self.db)
+	if err != nil {
+		return nil,err
+	}
+	if tx.Bucket(self.name) == nil {
+		self.txs.end(tx)
+		return nil,ETABLENOTFOUND
+	}
+	if tx.Size()+boltGrowthMargin >= self.txs.mmapSize {
+		self.txs.end(tx)
+		return nil,EMMAPFULL
+	}
+	ss := new(BoltSnapshot)
+	ss.tx = tx
+	ss.table = self
+	return ss,nil
+}
+
+// MakeBatch creates a new batch object for batch writes
+func (self* BoltTable) MakeBatch(batchSize int) (BatchWrite,error) {
+	bb := new(BoltBatchWrite)
+	bb.table=self
+	bb.batchSize=batchSize
+	if bb.batchSize < 1 {
+		bb.batchSize = 1
+	}
+	bb.ops = make([]boltOp,0,bb.batchSize)
+	return bb,nil
+}
+
+// BoltDB is a Database held in a single bolt file, with one bucket
+// for each table. Suitable for single-node deployments. Writes that could
+// grow the file beyond its memory map while snapshots or iterators are open
+// fail with EMMAPFULL, so should be retried once they are released. The file
+// is mapped at boltMmapGrowth times its size when opened, so that a rewrite of
+// every record while a snapshot is open fits unless the file has already grown
+// to more than twice its opening size.
+type BoltDB struct
+{
+	db *bolt.DB
+	Path string
+	tables map[string]*BoltTable
+	mux sync.Mutex
+	txs boltTxs
+}
+
+// NewBoltDB opens, creating if necessary, the bolt file at the given path.
+// Returns nil if the file cannot be opened.
+func NewBoltDB(path string) *BoltDB {
+	var mmapSize int64 = boltInitialMmapSize
+	fi,err := os.Stat(path)
+	if err == nil && fi.Size()*boltMmapGrowth > mmapSize {
+		mmapSize = fi.Size()*boltMmapGrowth
+	}
+	o := &bolt.Options{Timeout:time.Second,InitialMmapSize:int(mmapSize)}
+	bdb, err := bolt.Open(path,0600,o)
+	if err != nil {
+		return nil
+	}
+	db := new(BoltDB)
+	db.db = bdb
+	db.Path = path
+	db.tables = make(map[string]*BoltTable)
+	db.txs.open = make(map[*bolt.Tx]bool)
+	db.txs.mmapSize = mmapSize
+	return db
+}
+
+// newTable returns the BoltTable instance for the named bucket
+func (self *BoltDB) newTable(name string) *BoltTable {
+	if self.tables[name] == nil {
+		t := new(BoltTable)
+		t.db = self.db
+		t.name = []byte(name)
+		t.txs = &self.txs
+		self.tables[name] = t
+	}
+	return self.tables[name]
+}
+
+// OpenTable returns the table for an existing bucket
+func (self *BoltDB) OpenTable(name string) (Table,error) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	err := self.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(name)) == nil {
+			return ETABLENOTFOUND
+		}
+		return nil
+	})
+	if err != nil {
+		return nil,err
+	}
+	return self.newTable(name),nil
+}
+
+// CloseTable forgets the table instance. The bucket is retained in the file.
+func (self *BoltDB) CloseTable(name string) error {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if self.tables[name] == nil {
+		return ETABLENOTFOUND
+	}
+	delete(self.tables,name)
+	return nil
+}
+
+// DropTable deletes the bucket for the table and all its contents
+func (self *BoltDB) DropTable(name string) error {
+	if name=="" {
+		return EINVALIDTABLENAME
+	}
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	err := self.txs.update(self.db,len(name),func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(name))
+	})
+	switch (err) {
+		case nil:
+			delete(self.tables,name)
+			return nil
+		case bolt.ErrBucketNotFound:
+			return ETABLENOTFOUND
+		default:
+			return err
+	}
+}
+
+// Release ends any open snapshots and iterators and closes the bolt file. To
+// ensure resource clean-up it must be called once the BoltDB instance is finished with.
+func (self *BoltDB) Release() error {
+	self.txs.endAll()
+	return self.db.Close()
+}
+
+// CreateTable creates a new bucket for the table
+func (self *BoltDB) CreateTable(name string) (Table,error) {
+	if name=="" {
+		return nil,EINVALIDTABLENAME
+	}
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	err := self.txs.update(self.db,len(name),func(tx *bolt.Tx) error {
+		_,err := tx.CreateBucket([]byte(name))
+		return err
+	})
+	switch (err) {
+		case nil:
+			return self.newTable(name),nil
+		case bolt.ErrBucketExists:
+			return nil,ETABLEALREADYEXISTS
+		default:
+			return nil,EFAILED
+	}
+}
+
+// CompactTable is not supported. Bolt reuses the space freed in its file but
+// only shrinks it when copied to a new file, which must be done offline.
+func (self *BoltDB) CompactTable(name string) error {
+	return ENOTIMPLEMENTED
+}
+
+// TableStats reports the number of keys in a table's bucket and the bytes
+// used by the pages holding them
+func (self *BoltDB) TableStats(name string) (TableStats,error) {
+	var stats TableStats
+	err := self.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		if b == nil {
+			return ETABLENOTFOUND
+		}
+		bs := b.Stats()
+		stats.Entries = int64(bs.KeyN)
+		stats.Size = int64(bs.BranchInuse+bs.LeafInuse+bs.InlineBucketInuse)
+		return nil
+	})
+	return stats,err
+}
@@ -0,0 +1,244 @@
+package db
+
+import (
+	"testing"
+	"os"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+)
+
+var BOLTDBFILE="bolttest.db"
+
+func setupBolt(t *testing.T) *BoltDB {
+	db := NewBoltDB(BOLTDBFILE)
+	if db == nil {
+		t.Error("Failed to create db object")
+	}
+	return db
+}
+
+func teardownBolt(db *BoltDB) {
+	db.Release()
+	os.Remove(BOLTDBFILE)
+}
+
+func TestBoltCreateTable(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestCreateTable(db,t)
+}
+
+func TestBoltOpenTable(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestOpenTable(db,t)
+}
+
+func TestBoltPutGet(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestPutGet(db,t)
+}
+
+func TestBoltDropTable(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestDropTable(db,t)
+	_,err := db.OpenTable("songs")
+	if err == nil {
+		t.Error("Dropped table is still there")
+	}
+}
+
+func TestBoltDelete(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestDelete(db,t)
+}
+
+func TestBoltIterate(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestIterate(db,t)
+}
+
+func TestBoltIterateSnapshot(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestIterateSnapshot(db,t)
+}
+
+func TestBoltIterateSnapshotPrefixEmpty(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestIterateSnapshotPrefixEmpty(db,t)
+}
+
+func TestBoltIterateSnapshotASCII(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestIterateSnapshotASCII(db,t)
+}
+
+func TestBoltIteratePrefix(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestIteratePrefix(db,t)
+}
+
+func TestBoltIteratePrefixEmpty(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestIteratePrefixEmpty(db,t)
+}
+
+func TestBoltBatchWrite(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestBatchWrite(db,t)
+}
+
+func TestBoltReopen(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	table,_ := db.CreateTable("songs")
+	table.Put("The Kinks",&Song{title:"Sitting in My Hotel"})
+	db.Release()
+	db = setupBolt(t)
+	table,err := db.OpenTable("songs")
+	if err != nil {
+		t.Error("Failed to reopen table",err)
+	}
+	var sOut Song
+	err = table.Get("The Kinks",&sOut)
+	if err != nil || sOut.title != "Sitting in My Hotel" {
+		t.Error("Value not persisted",sOut.title,err)
+	}
+}
+
+func TestBoltIterateRange(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestIterateRange(db,t)
+}
+
+func TestBoltIterateRangeSnapshot(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestIterateRangeSnapshot(db,t)
+}
+
+func TestBoltIterateSeek(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestIterateSeek(db,t)
+}
+
+func TestBoltIterateKeysOnly(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestIterateKeysOnly(db,t)
+}
+
+func TestBoltCompactStats(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestCompactStats(db,t)
+}
+
+func TestBoltSwap(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	dotestSwap(db,t)
+}
+
+func TestBoltMmapFull(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	table,_ := db.CreateTable("songs")
+	var size int64
+	db.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	db.txs.mmapSize = size+boltGrowthMargin+1000
+	ss,err := table.TakeSnapshot()
+	if err != nil {
+		t.Error("Snapshot refused with room to grow",err)
+		return
+	}
+	err = table.Put("The Kinks",&Song{title:"Lola"})
+	if err != nil {
+		t.Error("Small write refused while snapshot open",err)
+	}
+	err = table.Put("The Who",&Song{title:string(make([]byte,1000))})
+	if err != EMMAPFULL {
+		t.Error("Write that could outgrow memory map allowed while snapshot open",err)
+	}
+	bw,_ := table.MakeBatch(10)
+	bw.Put("The Who",&Song{title:string(make([]byte,1000))})
+	if bw.Release() != EMMAPFULL {
+		t.Error("Batch that could outgrow memory map allowed while snapshot open")
+	}
+	ss.Release()
+	err = table.Put("The Who",&Song{title:string(make([]byte,1000))})
+	if err != nil {
+		t.Error("Write refused with no snapshot open",err)
+	}
+	db.txs.mmapSize = size+boltGrowthMargin
+	_,err = table.TakeSnapshot()
+	if err != EMMAPFULL {
+		t.Error("Snapshot allowed with no room to grow",err)
+	}
+}
+
+func TestBoltMmapFullConcurrent(t *testing.T) {
+	db := setupBolt(t)
+	defer teardownBolt(db)
+	table,_ := db.CreateTable("songs")
+	var size int64
+	db.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	db.txs.mmapSize = size+boltGrowthMargin+100000
+	ss,err := table.TakeSnapshot()
+	if err != nil {
+		t.Error("Snapshot refused with room to grow",err)
+		return
+	}
+	defer ss.Release()
+
+	// Writers together outgrowing the map must not all pass the check
+	errs := make(chan error,50)
+	for i:=0; i < 50; i++ {
+		go func(i int) {
+			bw,_ := table.MakeBatch(10)
+			var err error
+			for j:=0; j < 10 && err == nil; j++ {
+				err = bw.Put(fmt.Sprintf("%02d%02d",i,j),&Song{title:string(make([]byte,1000))})
+			}
+			if err == nil {
+				err = bw.Release()
+			}
+			errs <- err
+		}(i)
+	}
+	full := 0
+	for i:=0; i < 50; i++ {
+		if <-errs == EMMAPFULL {
+			full++
+		}
+	}
+	if full == 0 {
+		t.Error("Concurrent writes outgrew memory map while snapshot open")
+	}
+	var grown int64
+	db.db.View(func(tx *bolt.Tx) error {
+		grown = tx.Size()
+		return nil
+	})
+	if grown >= db.txs.mmapSize {
+		t.Error("File grew beyond memory map",grown,db.txs.mmapSize)
+	}
+}
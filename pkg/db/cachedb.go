@@ -0,0 +1,342 @@
+package db
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+)
+
+// cacheEntry is an encoded value held in a tableCache
+type cacheEntry struct {
+	key string
+	value []byte
+}
+
+// tableCache is a least recently used cache of encoded values for a
+// single table. Values are decoded afresh for each get so that callers never
+// share the contents of a cached value, such as a slice. A generation count,
+// bumped on every invalidation, stops values read before a write being cached
+// after it.
+type tableCache struct {
+	mux sync.Mutex
+	size int
+	entries map[string]*list.Element
+	order *list.List
+	pending map[string]int
+	generation uint64
+	hits uint64
+	misses uint64
+}
+
+func newTableCache(size int) *tableCache {
+	c := new(tableCache)
+	c.size = size
+	c.entries = make(map[string]*list.Element)
+	c.order = list.New()
+	c.pending = make(map[string]int)
+	return c
+}
+
+// get decodes the cached value for the key into s, returning false if it
+// is not cached along with the generation to pass to put
+func (self *tableCache) get(key string, s Serialize) (bool,uint64,error) {
+	self.mux.Lock()
+	e,exists := self.entries[key]
+	if !exists {
+		self.misses++
+		generation := self.generation
+		self.mux.Unlock()
+		return false,generation,nil
+	}
+	self.order.MoveToFront(e)
+	self.hits++
+	v := e.Value.(*cacheEntry).value
+	self.mux.Unlock()
+	return true,0,s.From(bytes.NewBuffer(append([]byte(nil),v...)))
+}
+
+// put caches the encoded value for the key if nothing has been
+// invalidated since the given generation and no batch write to the key
+// is pending
+func (self *tableCache) put(key string, s Serialize, generation uint64) {
+	v,err := serialized(s)
+	if err != nil {
+		return
+	}
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if generation != self.generation || self.pending[key] > 0 {
+		return
+	}
+	if e,exists := self.entries[key]; exists {
+		e.Value.(*cacheEntry).value = v
+		self.order.MoveToFront(e)
+		return
+	}
+	self.entries[key] = self.order.PushFront(&cacheEntry{key:key,value:v})
+	for self.order.Len() > self.size {
+		oldest := self.order.Back()
+		self.order.Remove(oldest)
+		delete(self.entries,oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// invalidate removes the key from the cache
+func (self *tableCache) invalidate(key string) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	self.generation++
+	if e,exists := self.entries[key]; exists {
+		self.order.Remove(e)
+		delete(self.entries,key)
+	}
+}
+
+// hold invalidates the key and stops it being cached until released
+func (self *tableCache) hold(key string) {
+	self.mux.Lock()
+	self.pending[key]++
+	self.mux.Unlock()
+	self.invalidate(key)
+}
+
+// release allows a held key to be cached again
+func (self *tableCache) release(key string) {
+	self.mux.Lock()
+	self.pending[key]--
+	if self.pending[key] <= 0 {
+		delete(self.pending,key)
+	}
+	self.mux.Unlock()
+	self.invalidate(key)
+}
+
+// CacheBatchWrite holds keys written through it out of the cache until
+// the batch is released, as it cannot tell when its writes are applied
+type CacheBatchWrite struct {
+	batch BatchWrite
+	cache *tableCache
+	keys map[string]bool
+}
+
+// Put adds a put to the batch
+func (self *CacheBatchWrite) Put(key string, s Serialize) error {
+	self.hold(key)
+	return self.batch.Put(key,s)
+}
+
+// Delete adds a delete to the batch
+func (self *CacheBatchWrite) Delete(key string) error {
+	self.hold(key)
+	return self.batch.Delete(key)
+}
+
+// hold keeps the key out of the cache until the batch is released
+func (self *CacheBatchWrite) hold(key string) {
+	if !self.keys[key] {
+		self.keys[key] = true
+		self.cache.hold(key)
+	}
+}
+
+// Release writes any remaining data and lets the keys written be cached again
+func (self *CacheBatchWrite) Release() error {
+	err := self.batch.Release()
+	for key,_ := range self.keys {
+		self.cache.release(key)
+	}
+	self.keys = make(map[string]bool)
+	return err
+}
+
+// CacheTable caches values read from a table. Iterators and
+// snapshots read the underlying table directly.
+type CacheTable struct {
+	table Table
+	cache *tableCache
+}
+
+// Get decodes a cached value if there is one and otherwise reads and
+// caches the value from the underlying table
+func (self *CacheTable) Get(key string, s Serialize) error {
+	found,generation,err := self.cache.get(key,s)
+	if found {
+		return err
+	}
+	err = self.table.Get(key,s)
+	if err != nil {
+		return err
+	}
+	self.cache.put(key,s,generation)
+	return nil
+}
+
+// Put writes to the underlying table and invalidates any cached value
+func (self *CacheTable) Put(key string, s Serialize) error {
+	err := self.table.Put(key,s)
+	self.cache.invalidate(key)
+	return err
+}
+
+// Swap swaps on the underlying table and invalidates any cached value
+func (self *CacheTable) Swap(key string, was Serialize, s Serialize) error {
+	err := self.table.Swap(key,was,s)
+	self.cache.invalidate(key)
+	return err
+}
+
+// Delete deletes from the underlying table and invalidates any cached value
+func (self *CacheTable) Delete(key string) error {
+	err := self.table.Delete(key)
+	self.cache.invalidate(key)
+	return err
+}
+
+// NewIterator creates an iterator on the underlying table
+func (self *CacheTable) NewIterator(prefix string) (Iterator,error) {
+	return self.table.NewIterator(prefix)
+}
+
+// NewRangeIterator creates a range iterator on the underlying table
+func (self *CacheTable) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	return self.table.NewRangeIterator(opts)
+}
+
+// TakeSnapshot takes a snapshot of the underlying table, bypassing the cache
+func (self *CacheTable) TakeSnapshot() (Snapshot,error) {
+	return self.table.TakeSnapshot()
+}
+
+// MakeBatch creates a batch on the underlying table that invalidates
+// the cache for the keys it writes
+func (self *CacheTable) MakeBatch(batchSize int) (BatchWrite,error) {
+	batch,err := self.table.MakeBatch(batchSize)
+	if err != nil {
+		return nil,err
+	}
+	cb := new(CacheBatchWrite)
+	cb.batch = batch
+	cb.cache = self.cache
+	cb.keys = make(map[string]bool)
+	return cb,nil
+}
+
+// Changes passes through to the underlying table's change feed
+func (self *CacheTable) Changes(after uint64, max int) ([]Change,error) {
+	if feed,ok := self.table.(ChangeFeed); ok {
+		return feed.Changes(after,max)
+	}
+	return nil,ENOTIMPLEMENTED
+}
+
+// LastSeq passes through to the underlying table's change feed
+func (self *CacheTable) LastSeq() (uint64,error) {
+	if feed,ok := self.table.(ChangeFeed); ok {
+		return feed.LastSeq()
+	}
+	return 0,ENOTIMPLEMENTED
+}
+
+// Trim passes through to the underlying table's change feed
+func (self *CacheTable) Trim(upTo uint64) error {
+	if feed,ok := self.table.(ChangeFeed); ok {
+		return feed.Trim(upTo)
+	}
+	return ENOTIMPLEMENTED
+}
+
+// Stats returns the number of cache hits and misses for the table
+func (self *CacheTable) Stats() (uint64,uint64) {
+	self.cache.mux.Lock()
+	defer self.cache.mux.Unlock()
+	return self.cache.hits,self.cache.misses
+}
+
+// CacheDB wraps another Database, caching up to a given number of encoded
+// values for each table it opens, saving reads from the underlying database.
+// All writes must go through the CacheDB for cached values to stay current, so
+// it cannot be used where other processes write to the same database.
+type CacheDB struct {
+	db Database
+	size int
+	tables map[string]*CacheTable
+	mux sync.Mutex
+}
+
+// NewCacheDB creates a CacheDB caching up to size values for each table
+// of the given database
+func NewCacheDB(database Database, size int) *CacheDB {
+	db := new(CacheDB)
+	db.db = database
+	db.size = size
+	if db.size < 1 {
+		db.size = 1
+	}
+	db.tables = make(map[string]*CacheTable)
+	return db
+}
+
+// wrap returns the CacheTable for the named table
+func (self *CacheDB) wrap(name string, table Table) *CacheTable {
+	ct := self.tables[name]
+	if ct == nil || ct.table != table {
+		ct = new(CacheTable)
+		ct.table = table
+		ct.cache = newTableCache(self.size)
+		self.tables[name] = ct
+	}
+	return ct
+}
+
+// OpenTable opens the underlying table and wraps it with a cache
+func (self *CacheDB) OpenTable(name string) (Table,error) {
+	table,err := self.db.OpenTable(name)
+	if err != nil {
+		return nil,err
+	}
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	return self.wrap(name,table),nil
+}
+
+// CreateTable creates the underlying table and wraps it with a cache
+func (self *CacheDB) CreateTable(name string) (Table,error) {
+	table,err := self.db.CreateTable(name)
+	if err != nil {
+		return nil,err
+	}
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	return self.wrap(name,table),nil
+}
+
+// CloseTable closes the underlying table and discards its cache
+func (self *CacheDB) CloseTable(name string) error {
+	self.mux.Lock()
+	delete(self.tables,name)
+	self.mux.Unlock()
+	return self.db.CloseTable(name)
+}
+
+// DropTable drops the underlying table and discards its cache
+func (self *CacheDB) DropTable(name string) error {
+	self.mux.Lock()
+	delete(self.tables,name)
+	self.mux.Unlock()
+	return self.db.DropTable(name)
+}
+
+// Release releases the underlying database
+func (self *CacheDB) Release() error {
+	return self.db.Release()
+}
+
+// CompactTable compacts the underlying table
+func (self *CacheDB) CompactTable(name string) error {
+	return self.db.CompactTable(name)
+}
+
+// TableStats reports the storage used by the underlying table
+func (self *CacheDB) TableStats(name string) (TableStats,error) {
+	return self.db.TableStats(name)
+}
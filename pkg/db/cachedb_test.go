@@ -0,0 +1,221 @@
+package db
+
+import (
+	"testing"
+	"bytes"
+	"strings"
+)
+
+func TestCacheCreateTable(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestCreateTable(db,t)
+}
+
+func TestCacheOpenTable(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestOpenTable(db,t)
+}
+
+func TestCachePutGet(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestPutGet(db,t)
+}
+
+func TestCacheDropTable(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestDropTable(db,t)
+}
+
+func TestCacheDelete(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestDelete(db,t)
+}
+
+func TestCacheIterate(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestIterate(db,t)
+}
+
+func TestCacheIterateSnapshot(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestIterateSnapshot(db,t)
+}
+
+func TestCacheIterateSnapshotPrefixEmpty(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestIterateSnapshotPrefixEmpty(db,t)
+}
+
+func TestCacheIterateSnapshotASCII(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestIterateSnapshotASCII(db,t)
+}
+
+func TestCacheIteratePrefix(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestIteratePrefix(db,t)
+}
+
+func TestCacheIteratePrefixEmpty(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestIteratePrefixEmpty(db,t)
+}
+
+func TestCacheBatchWrite(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestBatchWrite(db,t)
+}
+
+func TestCacheIterateRange(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestIterateRange(db,t)
+}
+
+func TestCacheIterateRangeSnapshot(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestIterateRangeSnapshot(db,t)
+}
+
+func TestCacheIterateSeek(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestIterateSeek(db,t)
+}
+
+func TestCacheIterateKeysOnly(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestIterateKeysOnly(db,t)
+}
+
+func TestCacheCompactStats(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestCompactStats(db,t)
+}
+
+func TestCacheSwap(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	dotestSwap(db,t)
+}
+
+func TestCacheHits(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	table,_ := db.CreateTable("songs")
+	table.Put("The Kinks",&Song{title:"Sitting in My Hotel"})
+	var sOut Song
+	table.Get("The Kinks",&sOut)
+	table.Get("The Kinks",&sOut)
+	hits,misses := table.(*CacheTable).Stats()
+	if hits != 1 || misses != 1 || sOut.title != "Sitting in My Hotel" {
+		t.Error("Second get not served from cache",hits,misses,sOut.title)
+	}
+	table.Put("The Kinks",&Song{title:"Lola"})
+	table.Get("The Kinks",&sOut)
+	if sOut.title != "Lola" {
+		t.Error("Put didnt invalidate cache",sOut.title)
+	}
+	table.Delete("The Kinks")
+	if table.Get("The Kinks",&sOut) == nil {
+		t.Error("Delete didnt invalidate cache")
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	table,_ := db.CreateTable("chars")
+	putCharacters(table,"abc")
+	var cOut Character
+	for _,c := range []string{"a","b","a","c","a","b"} {
+		table.Get(c,&cOut)
+		if cOut.char != c {
+			t.Error("Get returned wrong value",c,cOut.char)
+		}
+	}
+	hits,misses := table.(*CacheTable).Stats()
+	if hits != 2 || misses != 4 {
+		t.Error("Least recently used value not evicted",hits,misses)
+	}
+}
+
+func TestCacheBatchWriteInvalidates(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	table,_ := db.CreateTable("songs")
+	table.Put("The Kinks",&Song{title:"Sitting in My Hotel"})
+	var sOut Song
+	table.Get("The Kinks",&sOut)
+	bw,_ := table.MakeBatch(10)
+	bw.Put("The Kinks",&Song{title:"Lola"})
+	table.Get("The Kinks",&sOut)
+	bw.Release()
+	table.Get("The Kinks",&sOut)
+	if sOut.title != "Lola" {
+		t.Error("Value read during batch was cached",sOut.title)
+	}
+}
+
+func TestCacheSnapshotBypass(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	table,_ := db.CreateTable("songs")
+	table.Put("The Kinks",&Song{title:"Sitting in My Hotel"})
+	ss,_ := table.TakeSnapshot()
+	defer ss.Release()
+	table.Put("The Kinks",&Song{title:"Lola"})
+	var sOut Song
+	table.Get("The Kinks",&sOut)
+	ss.Get("The Kinks",&sOut)
+	if sOut.title != "Sitting in My Hotel" {
+		t.Error("Snapshot read from cache",sOut.title)
+	}
+}
+
+// Tags is a value holding a slice, to check cached values arent shared
+type Tags struct {
+	tags []string
+}
+
+func (self *Tags) To(buff *bytes.Buffer) error {
+	buff.WriteString(strings.Join(self.tags,","))
+	return nil
+}
+
+func (self *Tags) From(buff *bytes.Buffer) error {
+	self.tags = strings.Split(buff.String(),",")
+	return nil
+}
+
+func TestCacheValuesNotShared(t *testing.T) {
+	db := NewCacheDB(NewMemoryDB(),2)
+	defer db.Release()
+	table,_ := db.CreateTable("tags")
+	table.Put("The Kinks",&Tags{tags:[]string{"rock","pop"}})
+	var first,second Tags
+	table.Get("The Kinks",&first)
+	first.tags[0] = "jazz"
+	table.Get("The Kinks",&second)
+	first.tags[1] = "folk"
+	table.Get("The Kinks",&first)
+	hits,_ := table.(*CacheTable).Stats()
+	if hits != 2 || second.tags[0] != "rock" || first.tags[0] != "rock" || first.tags[1] != "pop" {
+		t.Error("Cached value shared with caller",hits,first.tags,second.tags)
+	}
+}
@@ -0,0 +1,272 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var ECHANGESTRIMMED = errors.New("Changes no longer available")
+
+// Change is a single put or delete made to a table. Changes are numbered
+// from 1 in the order they were applied.
+type Change struct {
+	Seq uint64
+	Key string
+	Value []byte
+	Delete bool
+}
+
+// Decode deserializes the value written by a put
+func (self *Change) Decode(s Serialize) error {
+	return s.From(bytes.NewBuffer(self.Value))
+}
+
+// ChangeFeed is an optional capability of a Table, reporting each change
+// made to the table so that others can follow it. Use a type assertion on
+// the Table to find out if it is supported. Tables that support it only for
+// some configurations return ENOTIMPLEMENTED otherwise.
+type ChangeFeed interface {
+
+	// Changes returns up to max changes after the given sequence number,
+	// oldest first. Returns ECHANGESTRIMMED if some have been discarded.
+	Changes(after uint64, max int) ([]Change,error)
+
+	// LastSeq returns the sequence number of the latest change
+	LastSeq() (uint64,error)
+
+	// Trim discards changes up to and including the given sequence number
+	Trim(upTo uint64) error
+}
+
+const replicationTableName = "replication"
+const replicationBatchSize = 1000
+
+// replicationCursor records how far a table has been replicated
+type replicationCursor struct {
+	seq uint64
+}
+
+func (self *replicationCursor) To(buff *bytes.Buffer) error {
+	return binary.Write(buff,binary.BigEndian,self.seq)
+}
+
+func (self *replicationCursor) From(buff *bytes.Buffer) error {
+	return binary.Read(buff,binary.BigEndian,&self.seq)
+}
+
+// Replicator follows the change feeds of tables in one database, applying
+// the changes to the same tables in another. How far each table has got is
+// kept in the target database so that replication resumes where it left off.
+// Tables are first copied in full from a snapshot, and again if the changes
+// needed have been trimmed. Changes are trimmed from the source once they have
+// been applied, so that its feed doesnt grow without bound, which means each
+// table can only be followed by one replicator.
+type Replicator struct {
+	source Database
+	target Database
+	tables []string
+	cursors Table
+}
+
+// NewReplicator creates a replicator from the source to the target database
+// for the named tables, each of which must support ChangeFeed in the source
+func NewReplicator(source Database, target Database, tables []string) (*Replicator,error) {
+	cursors,err := target.OpenTable(replicationTableName)
+	if err == ETABLENOTFOUND {
+		cursors,err = target.CreateTable(replicationTableName)
+	}
+	if err != nil {
+		return nil,err
+	}
+	r := new(Replicator)
+	r.source = source
+	r.target = target
+	r.tables = tables
+	r.cursors = cursors
+	return r,nil
+}
+
+// Sync applies all changes made since the last sync to the target database
+// and returns how many there were
+func (self *Replicator) Sync(ctx context.Context) (int,error) {
+	total := 0
+	for _,name := range self.tables {
+		n,err := self.syncTable(ctx,name)
+		total += n
+		if err != nil {
+			return total,err
+		}
+	}
+	return total,nil
+}
+
+// Run syncs every interval until ctx is cancelled, returning the first error
+func (self *Replicator) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		_,err := self.Sync(ctx)
+		if err != nil {
+			return err
+		}
+		select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+		}
+	}
+}
+
+// openTables opens the named table in the source and target, creating
+// it in the target if necessary
+func (self *Replicator) openTables(name string) (ChangeFeed,Table,Table,error) {
+	source,err := self.source.OpenTable(name)
+	if err != nil {
+		return nil,nil,nil,err
+	}
+	feed,ok := source.(ChangeFeed)
+	if !ok {
+		return nil,nil,nil,ENOTIMPLEMENTED
+	}
+	target,err := self.target.OpenTable(name)
+	if err == ETABLENOTFOUND {
+		target,err = self.target.CreateTable(name)
+	}
+	if err != nil {
+		return nil,nil,nil,err
+	}
+	return feed,source,target,nil
+}
+
+// syncTable applies changes to a single table, starting with a full copy if
+// it has not been replicated before or has fallen too far behind
+func (self *Replicator) syncTable(ctx context.Context, name string) (int,error) {
+	feed,source,target,err := self.openTables(name)
+	if err != nil {
+		return 0,err
+	}
+
+	// A table without a cursor has not been copied yet. Backends report
+	// missing keys differently so any failure to read it is treated the same.
+	var cursor replicationCursor
+	copied := self.cursors.Get(name,&cursor) == nil
+	total := 0
+	for ctx.Err() == nil {
+		var changes []Change
+		if copied {
+			changes,err = feed.Changes(cursor.seq,replicationBatchSize)
+		}
+		if !copied || err == ECHANGESTRIMMED {
+			copied = true
+			cursor.seq,err = self.copyTable(ctx,feed,source,target)
+			if err != nil {
+				return total,err
+			}
+			err = self.advance(feed,name,&cursor)
+			if err != nil {
+				return total,err
+			}
+			continue
+		}
+		if err != nil {
+			return total,err
+		}
+		if len(changes) == 0 {
+			return total,nil
+		}
+		err = applyChanges(target,changes)
+		if err != nil {
+			return total,err
+		}
+		cursor.seq = changes[len(changes)-1].Seq
+		err = self.advance(feed,name,&cursor)
+		if err != nil {
+			return total,err
+		}
+		total += len(changes)
+	}
+	return total,ctx.Err()
+}
+
+// advance stores the cursor for the named table and trims the changes it has
+// got past from the source
+func (self *Replicator) advance(feed ChangeFeed, name string, cursor *replicationCursor) error {
+	err := self.cursors.Put(name,cursor)
+	if err != nil {
+		return err
+	}
+	return feed.Trim(cursor.seq)
+}
+
+// copyTable replaces the contents of the target with a snapshot of the source,
+// returning the sequence number to follow changes from. The number is read before
+// the snapshot is taken so no change is missed; replaying changes already in the
+// snapshot is harmless.
+func (self *Replicator) copyTable(ctx context.Context, feed ChangeFeed, source Table, target Table) (uint64,error) {
+	seq,err := feed.LastSeq()
+	if err != nil {
+		return 0,err
+	}
+	ss,err := source.TakeSnapshot()
+	if err != nil {
+		return 0,err
+	}
+	defer ss.Release()
+	err = clearTable(target)
+	if err != nil {
+		return 0,err
+	}
+	iter,err := ss.NewIterator("")
+	if err != nil {
+		return 0,err
+	}
+	defer iter.Release()
+	bw,err := target.MakeBatch(replicationBatchSize)
+	if err != nil {
+		return 0,err
+	}
+	var v rawValue
+	for iter.Next() {
+		if ctx.Err() != nil {
+			bw.Release()
+			return 0,ctx.Err()
+		}
+		iter.Value(&v)
+		err = bw.Put(iter.Key(),&v)
+		if err != nil {
+			bw.Release()
+			return 0,err
+		}
+	}
+	err = bw.Release()
+	if err != nil {
+		return 0,err
+	}
+	return seq,iter.Error()
+}
+
+// applyChanges writes changes to a table in order, batching runs of puts
+func applyChanges(table Table, changes []Change) error {
+	bw,err := table.MakeBatch(len(changes))
+	if err != nil {
+		return err
+	}
+	for _,change := range changes {
+		if change.Delete {
+			err = bw.Release()
+			if err == nil {
+				err = table.Delete(change.Key)
+			}
+		} else {
+			err = bw.Put(change.Key,&rawValue{b:change.Value})
+		}
+		if err != nil {
+			bw.Release()
+			return err
+		}
+	}
+	return bw.Release()
+}
@@ -0,0 +1,197 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func setupChangeFeed(t *testing.T) (*LevelDB,Table,ChangeFeed) {
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
+	db.EnableChangeFeed("chars")
+	table,err := db.CreateTable("chars")
+	if err != nil {
+		t.Error("Failed to create table",err)
+		return db,nil,nil
+	}
+	feed,ok := table.(ChangeFeed)
+	if !ok {
+		t.Error("LevelTable doesnt support ChangeFeed")
+	}
+	return db,table,feed
+}
+
+func changeKeys(changes []Change) string {
+	keys := ""
+	for _,c := range changes {
+		if c.Delete {
+			keys += "-"
+		}
+		keys += c.Key
+	}
+	return keys
+}
+
+func TestChangeFeedChanges(t *testing.T) {
+	db,table,feed := setupChangeFeed(t)
+	defer teardown(db)
+	putCharacters(table,"abc")
+	table.Delete("b")
+	bw,_ := table.MakeBatch(10)
+	bw.Put("d",&Character{char:"d"})
+	bw.Delete("a")
+	bw.Release()
+	changes,err := feed.Changes(0,10)
+	if err != nil || changeKeys(changes) != "abc-bd-a" {
+		t.Error("Changes not reported in order",changeKeys(changes),err)
+	}
+	for i,c := range changes {
+		if c.Seq != uint64(i+1) {
+			t.Error("Changes not numbered in sequence",c.Seq,i+1)
+		}
+	}
+	var cOut Character
+	if changes[4].Decode(&cOut); cOut.char != "d" {
+		t.Error("Failed to decode change",cOut.char)
+	}
+	changes,_ = feed.Changes(3,2)
+	if changeKeys(changes) != "-bd" {
+		t.Error("Changes not resumed from cursor",changeKeys(changes))
+	}
+	seq,_ := feed.LastSeq()
+	if seq != 6 {
+		t.Error("Wrong last sequence number",seq)
+	}
+}
+
+func TestChangeFeedTrim(t *testing.T) {
+	db,table,feed := setupChangeFeed(t)
+	defer teardown(db)
+	putCharacters(table,"abcd")
+	err := feed.Trim(2)
+	if err != nil {
+		t.Error("Trim failed",err)
+	}
+	_,err = feed.Changes(1,10)
+	if err != ECHANGESTRIMMED {
+		t.Error("Trimmed changes not reported",err)
+	}
+	changes,_ := feed.Changes(2,10)
+	if changeKeys(changes) != "cd" {
+		t.Error("Changes after trim wrong",changeKeys(changes))
+	}
+	feed.Trim(4)
+	db.Release()
+	db = NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
+	db.EnableChangeFeed("chars")
+	table,_ = db.OpenTable("chars")
+	table.Put("e",&Character{char:"e"})
+	changes,_ = table.(ChangeFeed).Changes(4,10)
+	if changeKeys(changes) != "e" || changes[0].Seq != 5 {
+		t.Error("Sequence not continued after reopen",changes)
+	}
+}
+
+func TestChangeFeedReplay(t *testing.T) {
+	db,table,_ := setupChangeFeed(t)
+	defer teardown(db)
+	putCharacters(table,"ab")
+
+	// Log a write without applying it, as if the process stopped part way
+	lt := table.(*LevelTable)
+	batch := new(leveldb.Batch)
+	batch.Put([]byte("c"),[]byte("c"))
+	batch.Delete([]byte("a"))
+	wb := walBatch{wal:lt.wal,first:lt.wal.seq+1,records:new(leveldb.Batch)}
+	batch.Replay(&wb)
+	lt.wal.db.Write(wb.records,nil)
+	db.Release()
+
+	db = NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
+	db.EnableChangeFeed("chars")
+	table,_ = db.OpenTable("chars")
+	iterator,_ := table.NewIterator("")
+	if keys := collectKeys(iterator,true,t); keys != "bc" {
+		t.Error("Last write not replayed on open",keys)
+	}
+}
+
+func TestChangeFeedDisabled(t *testing.T) {
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
+	defer teardown(db)
+	table,_ := db.CreateTable("chars")
+	_,err := table.(ChangeFeed).Changes(0,10)
+	if err != ENOTIMPLEMENTED {
+		t.Error("Table without change feed reported changes",err)
+	}
+	r,_ := NewReplicator(db,NewMemoryDB(),[]string{"chars"})
+	_,err = r.Sync(context.Background())
+	if err != ENOTIMPLEMENTED {
+		t.Error("Replicated table without change feed",err)
+	}
+}
+
+func TestReplicator(t *testing.T) {
+	db,table,feed := setupChangeFeed(t)
+	defer teardown(db)
+	putCharacters(table,"abc")
+	feed.Trim(2)
+	target := NewMemoryDB()
+	r,err := NewReplicator(db,target,[]string{"chars"})
+	if err != nil {
+		t.Error("Failed to create replicator",err)
+		return
+	}
+	check := func(expected string) {
+		replica,err := target.OpenTable("chars")
+		if err != nil {
+			t.Error("Table not replicated",err)
+			return
+		}
+		iterator,_ := replica.NewIterator("")
+		if keys := collectKeys(iterator,true,t); keys != expected {
+			t.Error("Replica doesnt match",keys,expected)
+		}
+	}
+
+	// First sync copies table
+	_,err = r.Sync(context.Background())
+	if err != nil {
+		t.Error("Sync failed",err)
+	}
+	check("abc")
+
+	// Later syncs apply changes
+	table.Delete("a")
+	putCharacters(table,"de")
+	n,err := r.Sync(context.Background())
+	if err != nil || n != 3 {
+		t.Error("Sync didnt apply changes",n,err)
+	}
+	check("bcde")
+	seq,_ := feed.LastSeq()
+	_,err = feed.Changes(seq-1,10)
+	if err != ECHANGESTRIMMED {
+		t.Error("Applied changes not trimmed",err)
+	}
+
+	// Replication resumes from stored cursor
+	table.Delete("e")
+	r,_ = NewReplicator(db,target,[]string{"chars"})
+	n,_ = r.Sync(context.Background())
+	if n != 1 {
+		t.Error("Replication didnt resume from cursor",n)
+	}
+	check("bcd")
+
+	// Falling behind trimmed changes forces a new copy
+	putCharacters(table,"f")
+	table.Delete("b")
+	seq,_ = feed.LastSeq()
+	feed.Trim(seq)
+	_,err = r.Sync(context.Background())
+	if err != nil {
+		t.Error("Sync failed after trim",err)
+	}
+	check("cdf")
+}
@@ -8,22 +8,38 @@ import (
 	"google.golang.org/api/iterator"
 )
 const dataStoreMaxBatch = 500
-// buildDatastoreQuery emulates querying with a prefix by building a
-// quuery for all keys greater than the given prefix but less than
-// the given prefix with the larged possbile unicode character 
-// appended
-func buildDatastoreQuery(kind string, prefix string) *datastore.Query {
-	
-	var q *datastore.Query
-
-	if prefix != "" {
-		keystart := datastore.NameKey(kind, prefix, nil)
-		keyendstr := prefix+"\ufffd"
-		keyend := datastore.NameKey(kind, keyendstr, nil)
-		q = datastore.NewQuery(kind).Filter("__key__  >=", keystart).
-		Filter("__key__  <", keyend)
-	} else {
-		q = datastore.NewQuery(kind)
+// datastorePrefixRange emulates querying with a prefix by ranging over
+// all keys greater than the given prefix but less than the given prefix
+// with the larged possbile unicode character appended
+func datastorePrefixRange(prefix string) IteratorOptions {
+	if prefix == "" {
+		return IteratorOptions{}
+	}
+	return IteratorOptions{Start:prefix,Limit:prefix+"\ufffd"}
+}
+
+// buildDatastoreQuery builds a query for all keys in the given range. If
+// seek is given it replaces the start of the range, or for reverse ranges
+// the end, inclusively.
+func buildDatastoreQuery(kind string, opts IteratorOptions, seek string) *datastore.Query {
+	q := datastore.NewQuery(kind)
+	start := opts.Start
+	if seek != "" && !opts.Reverse && seek > start {
+		start = seek
+	}
+	if start != "" {
+		q = q.Filter("__key__ >=", datastore.NameKey(kind, start, nil))
+	}
+	if seek != "" && opts.Reverse && (opts.Limit == "" || seek < opts.Limit) {
+		q = q.Filter("__key__ <=", datastore.NameKey(kind, seek, nil))
+	} else if opts.Limit != "" {
+		q = q.Filter("__key__ <", datastore.NameKey(kind, opts.Limit, nil))
+	}
+	if opts.Reverse {
+		q = q.Order("-__key__")
+	}
+	if opts.KeysOnly {
+		q = q.KeysOnly()
 	}
 	return q
 }
@@ -32,11 +48,24 @@ func buildDatastoreQuery(kind string, prefix string) *datastore.Query {
 // It is effectively the factory function for the DatastoreIterator
 // struct.
 func (self *DatastoreTable) NewIterator(prefix string) (Iterator,error) {
+	return self.NewRangeIterator(datastorePrefixRange(prefix))
+}
+
+// NewRangeIterator creates an iterator over all keys in the given range
+func (self *DatastoreTable) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	return newDatastoreIterator(self,nil,opts),nil
+}
+
+// newDatastoreIterator creates an iterator over the given range, within
+// the given transaction if there is one
+func newDatastoreIterator(table *DatastoreTable, tx *datastore.Transaction, opts IteratorOptions) *DatastoreIterator {
 	iter := new(DatastoreIterator)
-	iter.q = buildDatastoreQuery(self.kind,prefix)
-	iter.i = self.client.Run(self.ctx, iter.q)
+	iter.table = table
+	iter.tx = tx
+	iter.opts = opts
 	iter.e = new(DatastoreEntity)
-	return iter,nil
+	iter.run("")
+	return iter
 }
 
 type DatastoreIterator struct {
@@ -44,21 +73,45 @@ type DatastoreIterator struct {
 	q  *datastore.Query
 	e  *DatastoreEntity
 	k  *datastore.Key
+	table *DatastoreTable
+	tx *datastore.Transaction
+	opts IteratorOptions
 	err  error
 }
 
+// run starts the query for the iterator's range from the given seek key
+func (self *DatastoreIterator) run(seek string) {
+	self.q = buildDatastoreQuery(self.table.kind,self.opts,seek)
+	if self.tx != nil {
+		self.q = self.q.Transaction(self.tx)
+	}
+	self.i = self.table.client.Run(self.table.ctx, self.q)
+}
+
 // Thin wrapper on DatastoreDB method
 func (self *DatastoreIterator) Next() (bool) {
     if self.i != nil {
 	var err error
 	self.k, err = self.i.Next(self.e)
-	if err != iterator.Done {
+	if err == nil {
         	return true
 	}
+	if err != iterator.Done {
+		self.err = err
+	}
     }
     return false
 }
 
+// Seek reruns the query from the given key and moves to the first result
+func (self *DatastoreIterator) Seek(key string) (bool) {
+	if key == "" {
+		key = self.opts.Start
+	}
+	self.run(key)
+	return self.Next()
+}
+
 // Thin wrapper on DatastoreDB method
 func (self *DatastoreIterator) Key() (string) {
 	return self.k.Name
@@ -66,6 +119,10 @@ func (self *DatastoreIterator) Key() (string) {
 
 // Thin wrapper on DatastoreDB method
 func (self *DatastoreIterator) Value(s Serialize) {
+	if self.opts.KeysOnly {
+		self.err = EKEYSONLY
+		return
+	}
 	buff := bytes.NewBuffer(self.e.Blob)
 	self.err = s.From(buff)
 }
@@ -118,12 +175,13 @@ func (self *DatastoreSnapshot) Get(key string,s Serialize) error {
 // It is effectively the factory function for the DatastoreIterator
 // struct	.
 func (self *DatastoreSnapshot) NewIterator(prefix string) (Iterator,error) {
-	iter := new(DatastoreIterator)
-	q := buildDatastoreQuery(self.table.kind,prefix)
-	iter.q = q.Transaction(self.tx)
-	iter.i = self.table.client.Run(self.table.ctx, iter.q)
-	iter.e = new(DatastoreEntity)
-	return iter,nil
+	return self.NewRangeIterator(datastorePrefixRange(prefix))
+}
+
+// NewRangeIterator creates an iterator over the given range within the
+// snapshot's transaction
+func (self *DatastoreSnapshot) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	return newDatastoreIterator(self.table,self.tx,opts),nil
 }
 
 // Thin wrapper on DatastoreDB batch writer
@@ -216,6 +274,33 @@ func (self *DatastoreTable) Put(key string, s Serialize) error {
 	return err
 }
 
+// Swap replaces the value for the given key if it is unchanged, checking and
+// writing in a single transaction
+func (self *DatastoreTable) Swap(key string, was Serialize, s Serialize) error {
+	old,err := serialized(was)
+	if err != nil {
+		return err
+	}
+	value,err := serialized(s)
+	if err != nil {
+		return err
+	}
+	k := datastore.NameKey(self.kind, key, nil)
+	_,err = self.client.RunInTransaction(self.ctx, func(tx *datastore.Transaction) error {
+		var e DatastoreEntity
+		err := tx.Get(k, &e)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if !swapped(e.Blob,err == nil,old,was == nil) {
+			return ESWAPFAILED
+		}
+		_,err = tx.Put(k, &DatastoreEntity{value})
+		return err
+	})
+	return err
+}
+
 // Delete is thin wrapper on DatastoreDB.Delete
 func (self *DatastoreTable) Delete(key string) error {
 	
@@ -341,3 +426,14 @@ func (self *DatastoreDB) CreateTable(name string) (Table,error) {
 	}
 	return self.OpenTable(name)
 }
+
+// CompactTable is not needed as datastore manages its own storage
+func (self *DatastoreDB) CompactTable(name string) error {
+	return ENOTIMPLEMENTED
+}
+
+// TableStats is not supported as datastore only publishes statistics
+// for kinds periodically
+func (self *DatastoreDB) TableStats(name string) (TableStats,error) {
+	return TableStats{},ENOTIMPLEMENTED
+}
@@ -126,3 +126,52 @@ func TestDatastoreBatchWrite(t *testing.T) {
 	dotestBatchWrite(db,t)
 }
 
+
+func TestDatastoreIterateRange(t *testing.T) {
+	db := setupDatastore(t)
+	if db == nil {
+		return
+	}
+
+	defer teardownDatastore(db)
+	dotestIterateRange(db,t)
+}
+
+func TestDatastoreIterateRangeSnapshot(t *testing.T) {
+	db := setupDatastore(t)
+	if db == nil {
+		return
+	}
+
+	defer teardownDatastore(db)
+	dotestIterateRangeSnapshot(db,t)
+}
+
+func TestDatastoreIterateSeek(t *testing.T) {
+	db := setupDatastore(t)
+	if db == nil {
+		return
+	}
+
+	defer teardownDatastore(db)
+	dotestIterateSeek(db,t)
+}
+
+func TestDatastoreIterateKeysOnly(t *testing.T) {
+	db := setupDatastore(t)
+	if db == nil {
+		return
+	}
+
+	defer teardownDatastore(db)
+	dotestIterateKeysOnly(db,t)
+}
+
+func TestDatastoreSwap(t *testing.T) {
+	db := setupDatastore(t)
+	if db == nil {
+		return
+	}
+	defer teardownDatastore(db)
+	dotestSwap(db,t)
+}
@@ -4,6 +4,8 @@ import (
 	"testing"
 	"reflect"
 	"bytes"
+	"strconv"
+	"sync"
 )
 
 type Song struct {
@@ -339,3 +341,226 @@ func dotestBatchWrite(db Database,t *testing.T) {
 }
 
 
+
+func putCharacters(table Table, chars string) {
+	for _,c := range chars {
+		table.Put(string(c),&Character{char:string(c)})
+	}
+}
+
+func collectKeys(iterator Iterator, withValues bool, t *testing.T) string {
+	keys := ""
+	var cOut Character
+	for iterator.Next() {
+		if withValues {
+			iterator.Value(&cOut)
+			if cOut.char != iterator.Key() {
+				t.Error("Value doesnt match key",iterator.Key(),cOut.char)
+			}
+		}
+		keys += iterator.Key()
+	}
+	if iterator.Error() != nil {
+		t.Error("Reporting error at end of successful iteration",iterator.Error())
+	}
+	iterator.Release()
+	return keys
+}
+
+func dotestIterateRange(db Database,t *testing.T) {
+	table,_ := db.CreateTable("chars")
+	putCharacters(table,"hgfedcba")
+	for _,c := range []struct{opts IteratorOptions; keys string} {
+		{IteratorOptions{},"abcdefgh"},
+		{IteratorOptions{Start:"c"},"cdefgh"},
+		{IteratorOptions{Limit:"c"},"ab"},
+		{IteratorOptions{Start:"b",Limit:"f"},"bcde"},
+		{IteratorOptions{Start:"bb",Limit:"ee"},"cde"},
+		{IteratorOptions{Start:"f",Limit:"b"},""},
+		{IteratorOptions{Reverse:true},"hgfedcba"},
+		{IteratorOptions{Start:"b",Limit:"f",Reverse:true},"edcb"},
+	} {
+		iterator,err := table.NewRangeIterator(c.opts)
+		if err != nil {
+			t.Error("Failed to create Iterator", err)
+			continue
+		}
+		keys := collectKeys(iterator,true,t)
+		if keys != c.keys {
+			t.Error("Range iteration returned wrong keys",c.opts,keys,c.keys)
+		}
+	}
+}
+
+func dotestIterateRangeSnapshot(db Database,t *testing.T) {
+	table,_ := db.CreateTable("chars")
+	putCharacters(table,"abcdef")
+	ss,err := table.TakeSnapshot()
+	if err != nil {
+		t.Error("Failed to create snapshot",err)
+		return
+	}
+	defer ss.Release()
+	putCharacters(table,"cz")
+	iterator,err := ss.NewRangeIterator(IteratorOptions{Start:"b",Reverse:true})
+	if err != nil {
+		t.Error("Failed to create Iterator", err)
+		return
+	}
+	keys := collectKeys(iterator,true,t)
+	if keys != "fedcb" {
+		t.Error("Snapshot range iteration returned wrong keys",keys)
+	}
+}
+
+func dotestIterateSeek(db Database,t *testing.T) {
+	table,_ := db.CreateTable("chars")
+	putCharacters(table,"acegi")
+	iterator,_ := table.NewRangeIterator(IteratorOptions{Start:"b",Limit:"h"})
+	if !iterator.Seek("d") || iterator.Key() != "e" {
+		t.Error("Seek to missing key didnt move to next key",iterator.Key())
+	}
+	if !iterator.Seek("c") || iterator.Key() != "c" {
+		t.Error("Seek to existing key failed",iterator.Key())
+	}
+	if keys := collectKeys(iterator,true,t); keys != "eg" {
+		t.Error("Next after Seek returned wrong keys",keys)
+	}
+	iterator,_ = table.NewRangeIterator(IteratorOptions{Start:"b",Limit:"h"})
+	if !iterator.Seek("a") || iterator.Key() != "c" {
+		t.Error("Seek before start didnt move to start",iterator.Key())
+	}
+	if iterator.Seek("h") {
+		t.Error("Seek beyond limit succeeded",iterator.Key())
+	}
+	iterator.Release()
+	iterator,_ = table.NewRangeIterator(IteratorOptions{Start:"b",Limit:"h",Reverse:true})
+	if !iterator.Seek("f") || iterator.Key() != "e" {
+		t.Error("Reverse seek to missing key didnt move to previous key",iterator.Key())
+	}
+	if keys := collectKeys(iterator,true,t); keys != "c" {
+		t.Error("Next after reverse Seek returned wrong keys",keys)
+	}
+	iterator,_ = table.NewRangeIterator(IteratorOptions{Start:"b",Limit:"h",Reverse:true})
+	if !iterator.Seek("z") || iterator.Key() != "g" {
+		t.Error("Reverse seek beyond limit didnt move to last key",iterator.Key())
+	}
+	if iterator.Seek("a") {
+		t.Error("Reverse seek before start succeeded",iterator.Key())
+	}
+	iterator.Release()
+}
+
+func dotestIterateKeysOnly(db Database,t *testing.T) {
+	table,_ := db.CreateTable("chars")
+	putCharacters(table,"abc")
+	iterator,_ := table.NewRangeIterator(IteratorOptions{KeysOnly:true,Reverse:true})
+	keys := ""
+	for iterator.Next() {
+		keys += iterator.Key()
+	}
+	if keys != "cba" {
+		t.Error("Keys only iteration returned wrong keys",keys)
+	}
+	if iterator.Error() != nil {
+		t.Error("Reporting error at end of successful iteration",iterator.Error())
+	}
+	iterator.Seek("a")
+	var cOut Character
+	iterator.Value(&cOut)
+	if iterator.Error() != EKEYSONLY {
+		t.Error("Value didnt report keys only iterator",iterator.Error())
+	}
+	iterator.Release()
+}
+
+func dotestCompactStats(db Database,t *testing.T) {
+	table,_ := db.CreateTable("chars")
+	putCharacters(table,"abcdefgh")
+	table.Delete("c")
+	table.Delete("d")
+	err := db.CompactTable("chars")
+	if err != nil && err != ENOTIMPLEMENTED {
+		t.Error("CompactTable failed",err)
+	}
+	iterator,_ := table.NewIterator("")
+	if keys := collectKeys(iterator,true,t); keys != "abefgh" {
+		t.Error("CompactTable changed table contents",keys)
+	}
+	stats,err := db.TableStats("chars")
+	if err != nil {
+		t.Error("TableStats failed",err)
+	}
+	if stats.Entries != -1 && stats.Entries != 6 {
+		t.Error("TableStats reported wrong number of entries",stats.Entries)
+	}
+	if stats.Size <= 0 {
+		t.Error("TableStats reported no storage used",stats.Size)
+	}
+	_,err = db.TableStats("songs")
+	if err == nil {
+		t.Error("TableStats succeeded for table that doesnt exist")
+	}
+	if db.CompactTable("songs") == nil {
+		t.Error("CompactTable succeeded for table that doesnt exist")
+	}
+}
+
+func dotestSwap(db Database,t *testing.T) {
+	table,_ := db.CreateTable("songs")
+	err := table.Swap("The Kinks",nil,&Song{title:"Lola"})
+	if err != nil {
+		t.Error("Swap of missing value failed",err)
+	}
+	if table.Swap("The Kinks",nil,&Song{title:"Victoria"}) != ESWAPFAILED {
+		t.Error("Swap succeeded for value that exists")
+	}
+	if table.Swap("The Kinks",&Song{title:"Waterloo Sunset"},&Song{title:"Victoria"}) != ESWAPFAILED {
+		t.Error("Swap succeeded for wrong previous value")
+	}
+	err = table.Swap("The Kinks",&Song{title:"Lola"},&Song{title:"Victoria"})
+	if err != nil {
+		t.Error("Swap failed",err)
+	}
+	err = table.Swap("The Kinks",&Song{title:"Victoria"},&Song{title:"Victoria"})
+	if err != nil {
+		t.Error("Swap to same value failed",err)
+	}
+	var sOut Song
+	table.Get("The Kinks",&sOut)
+	if sOut.title != "Victoria" {
+		t.Error("Swap stored wrong value",sOut.title)
+	}
+
+	// Count with concurrent swaps, retrying each that fails
+	const threads,increments = 4,25
+	var wg sync.WaitGroup
+	for i:=0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j:=0; j < increments; {
+				var was Song
+				err := table.Get("count",&was)
+				var err2 error
+				if err != nil {
+					err2 = table.Swap("count",nil,&Song{title:"1"})
+				} else {
+					n,_ := strconv.Atoi(was.title)
+					err2 = table.Swap("count",&was,&Song{title:strconv.Itoa(n+1)})
+				}
+				if err2 == nil {
+					j++
+				} else if err2 != ESWAPFAILED {
+					t.Error("Concurrent swap failed",err2)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	table.Get("count",&sOut)
+	if sOut.title != strconv.Itoa(threads*increments) {
+		t.Error("Concurrent swaps lost updates",sOut.title)
+	}
+}
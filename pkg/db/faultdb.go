@@ -0,0 +1,425 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var EINJECTEDFAULT = errors.New("Injected fault")
+
+// FaultOp identifies the kind of operation a FaultRule applies to
+type FaultOp uint8
+const (
+	FOGet FaultOp = iota
+	FOPut
+	FODelete
+	FOBatchPut
+	FOBatchDelete
+	FOBatchFlush
+	FOIterNext
+	FOSnapshot
+	FOSwap
+)
+
+// FaultRule scripts a fault for operations of one kind, optionally limited
+// to a single table and to keys with a given prefix. The first After matching
+// operations succeed, then the next Times fail, or all of them if Times is 0.
+// Only those that fail, or would fail given an Err, are first delayed by
+// Latency. A rule with a Latency and no Err only adds the delay.
+type FaultRule struct {
+	Op FaultOp
+	Table string
+	Prefix string
+	After int
+	Times int
+	Latency time.Duration
+	Err error
+	matched int
+}
+
+// apply records a matching operation, returning whether it should fail
+func (self *FaultRule) apply() bool {
+	self.matched++
+	if self.matched <= self.After {
+		return false
+	}
+	return self.Times == 0 || self.matched <= self.After+self.Times
+}
+
+// FaultDB wraps another Database, failing or delaying operations on its
+// tables as scripted by the rules added to it. Writes that fail are not
+// applied, so tests can check how callers recover from partial failures.
+type FaultDB struct {
+	db Database
+	mux sync.Mutex
+	rules []*FaultRule
+	faults int
+	tables map[string]*FaultTable
+}
+
+// NewFaultDB creates a FaultDB, initially with no rules, over the given database
+func NewFaultDB(database Database) *FaultDB {
+	db := new(FaultDB)
+	db.db = database
+	db.tables = make(map[string]*FaultTable)
+	return db
+}
+
+// AddRule adds a rule. Rules are checked in the order they are added and
+// the first that fails an operation decides its error.
+func (self *FaultDB) AddRule(rule FaultRule) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if rule.Err == nil && rule.Latency == 0 {
+		rule.Err = EINJECTEDFAULT
+	}
+	self.rules = append(self.rules,&rule)
+}
+
+// ClearRules removes all rules, leaving operations to succeed
+func (self *FaultDB) ClearRules() {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	self.rules = nil
+}
+
+// Faults returns the number of operations that have been failed
+func (self *FaultDB) Faults() int {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	return self.faults
+}
+
+// check applies the rules to an operation, sleeping for any latency they add
+// and returning the error it should fail with, if any
+func (self *FaultDB) check(op FaultOp, table string, key string) error {
+	var latency time.Duration
+	var err error
+	self.mux.Lock()
+	for _,rule := range self.rules {
+		if rule.Op != op || (rule.Table != "" && rule.Table != table) || !strings.HasPrefix(key,rule.Prefix) {
+			continue
+		}
+		if rule.apply() {
+			latency += rule.Latency
+			if err == nil {
+				err = rule.Err
+			}
+		}
+	}
+	if err != nil {
+		self.faults++
+	}
+	self.mux.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return err
+}
+
+// wrap returns a FaultTable for the named table
+func (self *FaultDB) wrap(name string, table Table) *FaultTable {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	ft := self.tables[name]
+	if ft == nil || ft.table != table {
+		ft = new(FaultTable)
+		ft.table = table
+		ft.name = name
+		ft.db = self
+		self.tables[name] = ft
+	}
+	return ft
+}
+
+// OpenTable opens the underlying table and wraps it
+func (self *FaultDB) OpenTable(name string) (Table,error) {
+	table,err := self.db.OpenTable(name)
+	if err != nil {
+		return nil,err
+	}
+	return self.wrap(name,table),nil
+}
+
+// CreateTable creates the underlying table and wraps it
+func (self *FaultDB) CreateTable(name string) (Table,error) {
+	table,err := self.db.CreateTable(name)
+	if err != nil {
+		return nil,err
+	}
+	return self.wrap(name,table),nil
+}
+
+// CloseTable closes the underlying table
+func (self *FaultDB) CloseTable(name string) error {
+	self.mux.Lock()
+	delete(self.tables,name)
+	self.mux.Unlock()
+	return self.db.CloseTable(name)
+}
+
+// DropTable drops the underlying table
+func (self *FaultDB) DropTable(name string) error {
+	self.mux.Lock()
+	delete(self.tables,name)
+	self.mux.Unlock()
+	return self.db.DropTable(name)
+}
+
+// Release releases the underlying database
+func (self *FaultDB) Release() error {
+	return self.db.Release()
+}
+
+// FaultTable applies the rules of its FaultDB to operations on a table
+type FaultTable struct {
+	table Table
+	name string
+	db *FaultDB
+}
+
+// Get reads from the underlying table unless failed by a rule
+func (self *FaultTable) Get(key string, s Serialize) error {
+	if err := self.db.check(FOGet,self.name,key); err != nil {
+		return err
+	}
+	return self.table.Get(key,s)
+}
+
+// Put writes to the underlying table unless failed by a rule
+func (self *FaultTable) Put(key string, s Serialize) error {
+	if err := self.db.check(FOPut,self.name,key); err != nil {
+		return err
+	}
+	return self.table.Put(key,s)
+}
+
+// Swap swaps on the underlying table unless failed by a rule
+func (self *FaultTable) Swap(key string, was Serialize, s Serialize) error {
+	if err := self.db.check(FOSwap,self.name,key); err != nil {
+		return err
+	}
+	return self.table.Swap(key,was,s)
+}
+
+// Delete deletes from the underlying table unless failed by a rule
+func (self *FaultTable) Delete(key string) error {
+	if err := self.db.check(FODelete,self.name,key); err != nil {
+		return err
+	}
+	return self.table.Delete(key)
+}
+
+// NewIterator creates an iterator on the underlying table whose steps may be failed
+func (self *FaultTable) NewIterator(prefix string) (Iterator,error) {
+	it,err := self.table.NewIterator(prefix)
+	if err != nil {
+		return nil,err
+	}
+	return &FaultIterator{iterator:it,table:self},nil
+}
+
+// NewRangeIterator creates a range iterator on the underlying table whose steps may be failed
+func (self *FaultTable) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	it,err := self.table.NewRangeIterator(opts)
+	if err != nil {
+		return nil,err
+	}
+	return &FaultIterator{iterator:it,table:self},nil
+}
+
+// TakeSnapshot takes a snapshot of the underlying table unless failed by a rule
+func (self *FaultTable) TakeSnapshot() (Snapshot,error) {
+	if err := self.db.check(FOSnapshot,self.name,""); err != nil {
+		return nil,err
+	}
+	ss,err := self.table.TakeSnapshot()
+	if err != nil {
+		return nil,err
+	}
+	return &FaultSnapshot{snapshot:ss,table:self},nil
+}
+
+// MakeBatch creates a batch whose writes and flushes may be failed
+func (self *FaultTable) MakeBatch(batchSize int) (BatchWrite,error) {
+	batch,err := self.table.MakeBatch(batchSize)
+	if err != nil {
+		return nil,err
+	}
+	fb := new(FaultBatchWrite)
+	fb.batch = batch
+	fb.table = self
+	fb.batchSize = batchSize
+	return fb,nil
+}
+
+// FaultSnapshot applies the rules of its FaultDB to reads from a snapshot
+type FaultSnapshot struct {
+	snapshot Snapshot
+	table *FaultTable
+}
+
+// Release releases the underlying snapshot
+func (self *FaultSnapshot) Release() error {
+	return self.snapshot.Release()
+}
+
+// Get reads from the underlying snapshot unless failed by a rule
+func (self *FaultSnapshot) Get(key string, s Serialize) error {
+	if err := self.table.db.check(FOGet,self.table.name,key); err != nil {
+		return err
+	}
+	return self.snapshot.Get(key,s)
+}
+
+// NewIterator creates an iterator on the underlying snapshot whose steps may be failed
+func (self *FaultSnapshot) NewIterator(prefix string) (Iterator,error) {
+	it,err := self.snapshot.NewIterator(prefix)
+	if err != nil {
+		return nil,err
+	}
+	return &FaultIterator{iterator:it,table:self.table},nil
+}
+
+// NewRangeIterator creates a range iterator on the underlying snapshot whose steps may be failed
+func (self *FaultSnapshot) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	it,err := self.snapshot.NewRangeIterator(opts)
+	if err != nil {
+		return nil,err
+	}
+	return &FaultIterator{iterator:it,table:self.table},nil
+}
+
+// FaultIterator applies the rules of its FaultDB to each step of an iterator,
+// matching them against the key stepped to. A failed step ends the iteration
+// with the error reported by Error.
+type FaultIterator struct {
+	iterator Iterator
+	table *FaultTable
+	err error
+}
+
+// step checks the rules once the underlying iterator has moved
+func (self *FaultIterator) step(ok bool) bool {
+	if !ok {
+		return false
+	}
+	self.err = self.table.db.check(FOIterNext,self.table.name,self.iterator.Key())
+	return self.err == nil
+}
+
+// Next moves to the next key unless failed by a rule
+func (self *FaultIterator) Next() (bool) {
+	if self.err != nil {
+		return false
+	}
+	return self.step(self.iterator.Next())
+}
+
+// Seek moves to the given key unless failed by a rule
+func (self *FaultIterator) Seek(key string) (bool) {
+	if self.err != nil {
+		return false
+	}
+	return self.step(self.iterator.Seek(key))
+}
+
+// Key returns the current key
+func (self *FaultIterator) Key() (string) {
+	return self.iterator.Key()
+}
+
+// Value deserializes the current value into the given struct
+func (self *FaultIterator) Value(s Serialize) {
+	self.iterator.Value(s)
+}
+
+// Error returns any injected fault, or otherwise the underlying iterator's error
+func (self *FaultIterator) Error() error {
+	if self.err != nil {
+		return self.err
+	}
+	return self.iterator.Error()
+}
+
+// Release releases the underlying iterator
+func (self *FaultIterator) Release() error {
+	return self.iterator.Release()
+}
+
+// FaultBatchWrite collects writes itself, handing them to the underlying batch
+// and flushing it each time batchSize are held and on Release. A flush failed by
+// a rule discards the writes collected since the last one, as a failed write to
+// the underlying store would.
+type FaultBatchWrite struct {
+	batch BatchWrite
+	table *FaultTable
+	batchSize int
+	ops []memoryOp
+}
+
+// Put adds a put to the batch unless failed by a rule
+func (self *FaultBatchWrite) Put(key string, s Serialize) error {
+	if err := self.table.db.check(FOBatchPut,self.table.name,key); err != nil {
+		return err
+	}
+	var buff bytes.Buffer
+	err := s.To(&buff)
+	if err != nil {
+		return err
+	}
+	self.ops = append(self.ops,memoryOp{key:key,value:buff.Bytes()})
+	return self.write(false)
+}
+
+// Delete adds a delete to the batch unless failed by a rule
+func (self *FaultBatchWrite) Delete(key string) error {
+	if err := self.table.db.check(FOBatchDelete,self.table.name,key); err != nil {
+		return err
+	}
+	self.ops = append(self.ops,memoryOp{key:key,delete:true})
+	return self.write(false)
+}
+
+// Release flushes any remaining writes
+func (self *FaultBatchWrite) Release() error {
+	return self.write(true)
+}
+
+// write flushes the collected writes when forced or when batchSize are held.
+// Flush rules are matched against the first key of the writes being flushed.
+func (self *FaultBatchWrite) write(flush bool) error {
+	if len(self.ops) == 0 || (!flush && len(self.ops) < self.batchSize) {
+		return nil
+	}
+	ops := self.ops
+	self.ops = nil
+	if err := self.table.db.check(FOBatchFlush,self.table.name,ops[0].key); err != nil {
+		return err
+	}
+	for _,op := range ops {
+		var err error
+		if op.delete {
+			err = self.batch.Delete(op.key)
+		} else {
+			err = self.batch.Put(op.key,&rawValue{b:op.value})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return self.batch.Release()
+}
+
+// CompactTable compacts the underlying table
+func (self *FaultDB) CompactTable(name string) error {
+	return self.db.CompactTable(name)
+}
+
+// TableStats reports the storage used by the underlying table
+func (self *FaultDB) TableStats(name string) (TableStats,error) {
+	return self.db.TableStats(name)
+}
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFaultCreateTable(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestCreateTable(db,t)
+}
+
+func TestFaultOpenTable(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestOpenTable(db,t)
+}
+
+func TestFaultPutGet(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestPutGet(db,t)
+}
+
+func TestFaultDropTable(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestDropTable(db,t)
+}
+
+func TestFaultDelete(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestDelete(db,t)
+}
+
+func TestFaultIterate(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestIterate(db,t)
+}
+
+func TestFaultIterateSnapshot(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestIterateSnapshot(db,t)
+}
+
+func TestFaultIterateSnapshotPrefixEmpty(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestIterateSnapshotPrefixEmpty(db,t)
+}
+
+func TestFaultIterateSnapshotASCII(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestIterateSnapshotASCII(db,t)
+}
+
+func TestFaultIteratePrefix(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestIteratePrefix(db,t)
+}
+
+func TestFaultIteratePrefixEmpty(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestIteratePrefixEmpty(db,t)
+}
+
+func TestFaultBatchWrite(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestBatchWrite(db,t)
+}
+
+func TestFaultIterateRange(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestIterateRange(db,t)
+}
+
+func TestFaultIterateRangeSnapshot(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestIterateRangeSnapshot(db,t)
+}
+
+func TestFaultIterateSeek(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestIterateSeek(db,t)
+}
+
+func TestFaultIterateKeysOnly(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestIterateKeysOnly(db,t)
+}
+
+func TestFaultCompactStats(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestCompactStats(db,t)
+}
+
+func TestFaultSwap(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	dotestSwap(db,t)
+}
+
+func TestFaultGetPut(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	table,_ := db.CreateTable("chars")
+	db.AddRule(FaultRule{Op:FOPut,Prefix:"b",Times:1})
+	db.AddRule(FaultRule{Op:FOGet,Table:"chars",After:1,Times:1})
+	if table.Put("a",&Character{char:"a"}) != nil {
+		t.Error("Put failed without matching rule")
+	}
+	if table.Put("b",&Character{char:"b"}) != EINJECTEDFAULT {
+		t.Error("Put not failed by rule")
+	}
+	if table.Put("b",&Character{char:"b"}) != nil {
+		t.Error("Put failed more times than scripted")
+	}
+	var cOut Character
+	if table.Get("a",&cOut) != nil {
+		t.Error("Get failed before rule applied")
+	}
+	if table.Get("a",&cOut) != EINJECTEDFAULT {
+		t.Error("Get not failed by rule")
+	}
+	if db.Faults() != 2 {
+		t.Error("Wrong number of faults reported",db.Faults())
+	}
+}
+
+func TestFaultBatchFlush(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	table,_ := db.CreateTable("chars")
+	db.AddRule(FaultRule{Op:FOBatchFlush,After:1,Times:1})
+	bw,_ := table.MakeBatch(2)
+	for _,c := range "abcdef" {
+		err := bw.Put(string(c),&Character{char:string(c)})
+		if (c == 'd') != (err == EINJECTEDFAULT) {
+			t.Error("Wrong flush failed",string(c),err)
+		}
+	}
+	bw.Release()
+	iterator,_ := table.NewIterator("")
+	if keys := collectKeys(iterator,true,t); keys != "abef" {
+		t.Error("Failed flush not discarded",keys)
+	}
+}
+
+func TestFaultIterator(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	table,_ := db.CreateTable("chars")
+	putCharacters(table,"abcde")
+	db.AddRule(FaultRule{Op:FOIterNext,Prefix:"c"})
+	ss,_ := table.TakeSnapshot()
+	defer ss.Release()
+	iterator,_ := ss.NewIterator("")
+	keys := ""
+	for iterator.Next() {
+		keys += iterator.Key()
+	}
+	if keys != "ab" || iterator.Error() != EINJECTEDFAULT {
+		t.Error("Iteration not stopped by rule",keys,iterator.Error())
+	}
+	iterator.Release()
+	db.ClearRules()
+	iterator,_ = ss.NewIterator("")
+	if keys := collectKeys(iterator,true,t); keys != "abcde" {
+		t.Error("Iteration failed after rules cleared",keys)
+	}
+}
+
+func TestFaultLatency(t *testing.T) {
+	db := NewFaultDB(NewMemoryDB())
+	defer db.Release()
+	table,_ := db.CreateTable("chars")
+	db.AddRule(FaultRule{Op:FOPut,After:1,Latency:200*time.Millisecond})
+	start := time.Now()
+	err := table.Put("a",&Character{char:"a"})
+	if err != nil || time.Since(start) >= 200*time.Millisecond {
+		t.Error("Latency added before After",err,time.Since(start))
+	}
+	start = time.Now()
+	err = table.Put("b",&Character{char:"b"})
+	if err != nil || time.Since(start) < 200*time.Millisecond {
+		t.Error("Latency not added",err,time.Since(start))
+	}
+	if db.Faults() != 0 {
+		t.Error("Latency counted as fault")
+	}
+}
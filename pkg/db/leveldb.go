@@ -7,17 +7,22 @@ import (
 	"errors"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/filter"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/util"
 	"path/filepath"
 	"bytes"
 	"os"
+	"sync"
 )
 var ENOTIMPLEMENTED = errors.New("Not implemented")
 var ETABLEALREADYEXISTS = errors.New("Table already exists")
 var ETABLENOTFOUND  = errors.New("Table not found")
 var EFAILED = errors.New("Operation failed")
 var EINVALIDTABLENAME = errors.New("Invalid table name")
+var EKEYNOTFOUND = errors.New("Key not found")
+var EKEYSONLY = errors.New("Iterator is keys only")
+var ESWAPFAILED = errors.New("Value changed before swap")
 
 type Database interface
 {
@@ -26,6 +31,15 @@ type Database interface
 	DropTable(string) error
 	CreateTable(string) (Table,error)
 	Release() error
+	CompactTable(string) error
+	TableStats(string) (TableStats,error)
+}
+
+// TableStats reports the storage used by a table. Backends that cannot
+// count entries cheaply report -1 for Entries.
+type TableStats struct {
+	Entries		int64	// Number of keys
+	Size		int64	// Approximate bytes used by keys and values
 }
 
 type Reader interface 
@@ -39,13 +53,40 @@ type Writer interface
 	Delete(string) error
 }
 
+// Table is a set of key value pairs. Swap atomically replaces the value for a
+// key, but only if it is still the given previous value - or only if there is
+// no value if the previous value is nil - returning ESWAPFAILED otherwise.
 type Table interface
 {
 	Reader
 	Writer
 	NewIterator(string) (Iterator,error)
+	NewRangeIterator(IteratorOptions) (Iterator,error)
 	TakeSnapshot() (Snapshot,error)
 	MakeBatch(int) (BatchWrite,error)
+	Swap(key string, was Serialize, s Serialize) error
+}
+
+// serialized returns the serialized form of a value, or nil for a nil value
+func serialized(s Serialize) ([]byte,error) {
+	if s == nil {
+		return nil,nil
+	}
+	var buff bytes.Buffer
+	err := s.To(&buff)
+	if err != nil {
+		return nil,err
+	}
+	return buff.Bytes(),nil
+}
+
+// swapped reports whether a stored value, and whether it exists, matches the
+// previous value given to Swap
+func swapped(stored []byte, exists bool, was []byte, wasNil bool) bool {
+	if wasNil {
+		return !exists
+	}
+	return exists && bytes.Equal(stored,was)
 }
 
 type Snapshot interface
@@ -53,6 +94,7 @@ type Snapshot interface
 	Reader
 	Release() error
 	NewIterator(string) (Iterator,error)
+	NewRangeIterator(IteratorOptions) (Iterator,error)
 }
 
 type BatchWrite interface
@@ -61,8 +103,12 @@ type BatchWrite interface
 	Release() error
 }
 
+// Iterator visits keys in order. Seek moves to the first key at or after
+// the given key - or at or before it for a reverse iterator - and reports
+// whether there is one. Next then carries on from there.
 type Iterator interface {
 	Next() (bool)
+	Seek(string) (bool)
 	Key() (string)
 	Value(s Serialize)
 	Error() (error)
@@ -74,13 +120,100 @@ type Serialize interface {
 	From(*bytes.Buffer) error
 }
 
+// IteratorOptions specifies the keys visited by a range iterator
+type IteratorOptions struct {
+	Start		string	// First key included. Empty for the start of the table.
+	Limit		string	// Key to stop before. Empty for the end of the table.
+	Reverse		bool	// Visit keys from last to first
+	KeysOnly	bool	// Skip loading values. Value reports EKEYSONLY.
+}
+
+// PrefixRange returns options for iterating over all keys with the given prefix
+func PrefixRange(prefix string) IteratorOptions {
+	return IteratorOptions{Start:prefix,Limit:string(prefixEnd([]byte(prefix)))}
+}
+
+// prefixEnd returns the smallest key greater than all keys with the given prefix,
+// or nil if there is no such key
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil),prefix...)
+	for i := len(end)-1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// inRange reports whether the given key lies between the start and
+// limit of the options
+func (self *IteratorOptions) inRange(key []byte) bool {
+	if bytes.Compare(key,[]byte(self.Start)) < 0 {
+		return false
+	}
+	return self.Limit == "" || bytes.Compare(key,[]byte(self.Limit)) < 0
+}
+
+// levelRange converts options to a LevelDB range
+func (self *IteratorOptions) levelRange() *util.Range {
+	if self.Start == "" && self.Limit == "" {
+		return nil
+	}
+	r := new(util.Range)
+	if self.Start != "" {
+		r.Start = []byte(self.Start)
+	}
+	if self.Limit != "" {
+		r.Limit = []byte(self.Limit)
+	}
+	return r
+}
+
 type LevelIterator struct {
 	iterator iterator.Iterator
+	reverse bool
+	keysOnly bool
+	started bool
+	err error
 }
 
-// Thin wrapper on LevelDB method
+// newLevelIterator wraps a LevelDB iterator with the given options
+func newLevelIterator(it iterator.Iterator, opts IteratorOptions) *LevelIterator {
+	iter := new(LevelIterator)
+	iter.iterator = it
+	iter.reverse = opts.Reverse
+	iter.keysOnly = opts.KeysOnly
+	return iter
+}
+
+// Thin wrapper on LevelDB method. Reverse iterators start from the last key.
 func (self *LevelIterator) Next() (bool) {
-	return self.iterator.Next() 
+	if !self.reverse {
+		return self.iterator.Next()
+	}
+	if !self.started {
+		self.started = true
+		return self.iterator.Last()
+	}
+	return self.iterator.Prev()
+}
+
+// Seek wraps the LevelDB method, stepping back one key for reverse
+// iterators if the seek lands after the given key
+func (self *LevelIterator) Seek(key string) (bool) {
+	self.started = true
+	found := self.iterator.Seek([]byte(key))
+	if !self.reverse {
+		return found
+	}
+	if !found {
+		return self.iterator.Last()
+	}
+	if string(self.iterator.Key()) != key {
+		return self.iterator.Prev()
+	}
+	return true
 }
 
 // Thin wrapper on LevelDB method
@@ -90,12 +223,19 @@ func (self *LevelIterator) Key() (string) {
 
 // Thin wrapper on LevelDB method
 func (self *LevelIterator) Value(s Serialize) {
+	if self.keysOnly {
+		self.err = EKEYSONLY
+		return
+	}
 	buff := bytes.NewBuffer(self.iterator.Value())
 	s.From(buff)
 }
 
 // Thin wrapper on LevelIDB method
 func (self *LevelIterator) Error() error {
+	if self.err != nil {
+		return self.err
+	}
 	return self.iterator.Error()
 }
 
@@ -138,6 +278,11 @@ func (self *LevelSnapshot) NewIterator(prefix string) (Iterator,error) {
 	return iter,nil
 }
 
+// NewRangeIterator creates an iterator over the snapshot for the given range
+func (self *LevelSnapshot) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	return newLevelIterator(self.snapshot.NewIterator(opts.levelRange(),nil),opts),nil
+}
+
 // Thin wrapper on LevelDB batch writer
 type LevelBatchWrite struct {
 	batch *leveldb.Batch
@@ -171,7 +316,7 @@ func (self* LevelBatchWrite) Release() error {
 func (self* LevelBatchWrite) write(flush bool) error {
 	var err error
 	if flush || ((self.batch.Len() % self.batchSize)==0) {
-		err = self.table.db.Write(self.batch,nil)
+		err = self.table.write(self.batch)
 		self.batch.Reset()
 	}
 	return err
@@ -190,6 +335,25 @@ func newLevelTable(db *leveldb.DB) *LevelTable {
 type LevelTable struct
 {
 	db *leveldb.DB
+	wal *levelWAL
+	writeMux sync.Mutex
+}
+
+// write applies a batch to the table under the write lock, so that it
+// cannot land between the check and the write of a Swap
+func (self *LevelTable) write(batch *leveldb.Batch) error {
+	self.writeMux.Lock()
+	defer self.writeMux.Unlock()
+	return self.apply(batch)
+}
+
+// apply applies a batch to the table, through the write-ahead log if
+// the table has a change feed
+func (self *LevelTable) apply(batch *leveldb.Batch) error {
+	if self.wal != nil {
+		return self.wal.write(self.db,batch)
+	}
+	return self.db.Write(batch,nil)
 }
 
 // Get is thin wrapper on LevelDB.Get
@@ -209,12 +373,69 @@ func (self *LevelTable) Put(key string, s Serialize) error {
 	if err != nil {
 		return err
 	}
-	return self.db.Put([]byte(key),buff.Bytes(),nil)
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(key),buff.Bytes())
+	return self.write(batch)
+}
+
+// Swap replaces the value for the given key if it is unchanged. LevelDB is
+// only ever open in one process so holding the write lock makes swaps atomic
+// with every other write to the table.
+func (self *LevelTable) Swap(key string, was Serialize, s Serialize) error {
+	old,err := serialized(was)
+	if err != nil {
+		return err
+	}
+	value,err := serialized(s)
+	if err != nil {
+		return err
+	}
+	self.writeMux.Lock()
+	defer self.writeMux.Unlock()
+	stored,err := self.db.Get([]byte(key),nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	if !swapped(stored,err == nil,old,was == nil) {
+		return ESWAPFAILED
+	}
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(key),value)
+	return self.apply(batch)
 }
 
 // Delete is thin wrapper on LevelDB.Delete
 func (self *LevelTable) Delete(key string) error {
-	return self.db.Delete([]byte(key),nil)
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(key))
+	return self.write(batch)
+}
+
+// Changes returns up to max changes after the given sequence number if
+// the table has a change feed
+func (self *LevelTable) Changes(after uint64, max int) ([]Change,error) {
+	if self.wal == nil {
+		return nil,ENOTIMPLEMENTED
+	}
+	return self.wal.Changes(after,max)
+}
+
+// LastSeq returns the sequence number of the latest change if the table
+// has a change feed
+func (self *LevelTable) LastSeq() (uint64,error) {
+	if self.wal == nil {
+		return 0,ENOTIMPLEMENTED
+	}
+	return self.wal.LastSeq()
+}
+
+// Trim discards changes up to and including the given sequence number if
+// the table has a change feed
+func (self *LevelTable) Trim(upTo uint64) error {
+	if self.wal == nil {
+		return ENOTIMPLEMENTED
+	}
+	return self.wal.Trim(upTo)
 }
 
 // NewIterator creates a thin wrapper around leveldb.Iterator
@@ -230,6 +451,12 @@ func (self *LevelTable) NewIterator(prefix string) (Iterator,error) {
 	return iter,nil
 }
 
+// NewRangeIterator creates an iterator over the given range of keys. Values
+// are still read from disk alongside keys for KeysOnly iterators, but are not decoded.
+func (self *LevelTable) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	return newLevelIterator(self.db.NewIterator(opts.levelRange(),nil),opts),nil
+}
+
 // TakeSnapshot creates a thin wrapper around leveldb.Iterator
 // It is effectively the factory function for the LevelSnapshot
 func (self *LevelTable) TakeSnapshot() (Snapshot,error) {
@@ -249,22 +476,82 @@ func (self* LevelTable) MakeBatch(batchSize int) (BatchWrite,error) {
 }
 
 func (self *LevelTable) close() {
+	if self.wal != nil {
+		self.wal.close()
+	}
 	self.db.Close()
 }
 
+// LevelDBOptions tunes the LevelDB instance opened for each table. Zero
+// values leave the LevelDB defaults in place.
+type LevelDBOptions struct {
+	BlockCacheMB		int	// Block cache size in MiB. Default is 8.
+	WriteBufferMB		int	// Size in MiB of writes held in memory before flushing to disk. Default is 4.
+	BloomFilterBits		int	// Bits per key of a bloom filter to speed up reads of missing keys. Default is none.
+	NoCompression		bool	// Store blocks uncompressed instead of with snappy
+}
+
+// levelOptions converts options to those for opening a LevelDB instance
+func (self *LevelDBOptions) levelOptions() *opt.Options {
+	o := new(opt.Options)
+	o.BlockCacheCapacity = self.BlockCacheMB*opt.MiB
+	o.WriteBuffer = self.WriteBufferMB*opt.MiB
+	if self.BloomFilterBits > 0 {
+		o.Filter = filter.NewBloomFilter(self.BloomFilterBits)
+	}
+	if self.NoCompression {
+		o.Compression = opt.NoCompression
+	}
+	return o
+}
+
 type LevelDB struct
 {
 	tables map[string]*LevelTable
+	changeFeeds map[string]bool
+	options LevelDBOptions
 	Path string
 }
 
+// walPath returns the folder holding the write-ahead log for a table
+func (self *LevelDB) walPath(name string) string {
+	return filepath.Join(self.Path,name+".wal")
+}
+
+// EnableChangeFeed gives the named table a change feed, backed by a write-ahead
+// log held alongside it. It takes effect the next time the table is opened or
+// created, and must be enabled each time the LevelDB instance is created for
+// changes to be recorded.
+func (self *LevelDB) EnableChangeFeed(name string) {
+	self.changeFeeds[name] = true
+}
+
+// newTable creates the LevelTable for an open LevelDB instance, opening
+// its write-ahead log if it has a change feed
+func (self *LevelDB) newTable(name string, db *leveldb.DB) (*LevelTable,error) {
+	table := newLevelTable(db)
+	if self.changeFeeds[name] {
+		wal,err := openLevelWAL(self.walPath(name),db)
+		if err != nil {
+			db.Close()
+			return nil,EFAILED
+		}
+		table.wal = wal
+	}
+	self.tables[name] = table
+	return table,nil
+}
+
 // NewLevelIDB creates a new LevelDB struct to support
 // Database operations. It manages a map of zero or more LevelTable
-// instances, one for each Table be used by the wider system.
-func NewLevelDB(path string) *LevelDB {
+// instances, one for each Table be used by the wider system, each
+// opened with the given options.
+func NewLevelDB(path string, options LevelDBOptions) *LevelDB {
 	db := new(LevelDB)
 	db.Path=path
+	db.options=options
 	db.tables = make(map[string]*LevelTable)
+	db.changeFeeds = make(map[string]bool)
 	return db
 }
 
@@ -279,14 +566,16 @@ func (self *LevelDB) OpenTable(name string) (Table,error) {
 	}
 
 	dbpath := filepath.Join(self.Path,name)
-	o := &opt.Options{
-		ErrorIfMissing:true,
-	}
+	o := self.options.levelOptions()
+	o.ErrorIfMissing = true
 	db, err := leveldb.OpenFile(dbpath,o)
 	switch (err) {
 		case nil:
-			self.tables[name] = newLevelTable(db)
-			return self.tables[name],nil
+			table,err := self.newTable(name,db)
+			if err != nil {
+				return nil,err
+			}
+			return table,nil
 		case os.ErrNotExist:
 			return nil, ETABLENOTFOUND
 		default:
@@ -322,6 +611,7 @@ func (self *LevelDB) DropTable(name string) error {
 	if !src.IsDir() {
 		return EINVALIDTABLENAME
 	}
+	os.RemoveAll(self.walPath(name))
 	return os.RemoveAll(tablepath)
 }
 
@@ -344,15 +634,17 @@ func (self *LevelDB) CreateTable(name string) (Table,error) {
 	}
 
 	dbpath := filepath.Join(self.Path,name)
-	o := &opt.Options{
-			ErrorIfExist:true,
-		}
+	o := self.options.levelOptions()
+	o.ErrorIfExist = true
 	db, err := leveldb.OpenFile(dbpath, o)
 
 	switch (err) {
 		case nil:
-			self.tables[name] = newLevelTable(db)
-			return self.tables[name],nil
+			table,err := self.newTable(name,db)
+			if err != nil {
+				return nil,err
+			}
+			return table,nil
 		case os.ErrExist:
 			return nil, ETABLEALREADYEXISTS
 		default:
@@ -360,3 +652,28 @@ func (self *LevelDB) CreateTable(name string) (Table,error) {
 	}
 }
 
+
+// CompactTable compacts the whole of an open table, discarding deleted and
+// overwritten values and merging its files
+func (self *LevelDB) CompactTable(name string) error {
+	table := self.tables[name]
+	if table == nil {
+		return ETABLENOTFOUND
+	}
+	return table.db.CompactRange(util.Range{})
+}
+
+// TableStats reports the size on disk of an open table. LevelDB does not
+// keep a count of its keys so Entries is always -1.
+func (self *LevelDB) TableStats(name string) (TableStats,error) {
+	table := self.tables[name]
+	if table == nil {
+		return TableStats{},ETABLENOTFOUND
+	}
+	var stats leveldb.DBStats
+	err := table.db.Stats(&stats)
+	if err != nil {
+		return TableStats{},err
+	}
+	return TableStats{Entries:-1,Size:stats.LevelSizes.Sum()},nil
+}
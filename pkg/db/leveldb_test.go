@@ -17,32 +17,32 @@ func teardown(db *LevelDB) {
 }
 
 func TestNewLevelDB(t *testing.T) {
-	db := NewLevelDB(LEVELDBFOLDER)
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
 	if  db.Path != LEVELDBFOLDER {
 		t.Error("Path != \"leveldbtest\"", db)
 	}
 }
 
 func TestCreateTable(t *testing.T) {
-	db := NewLevelDB(LEVELDBFOLDER)
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
 	defer teardown(db)
 	dotestCreateTable(db,t)
 }
 
 func TestOpenTable(t *testing.T) {
-	db := NewLevelDB(LEVELDBFOLDER)
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
 	defer teardown(db)
 	dotestOpenTable(db,t)
 }
 
 func TestPutGet(t *testing.T) {
-	db := NewLevelDB(LEVELDBFOLDER)
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
 	defer teardown(db)
 	dotestPutGet(db,t)
 }
 
 func TestDropTable(t *testing.T) {
-	db := NewLevelDB(LEVELDBFOLDER)
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
 	defer teardown(db)
 	dotestDropTable(db,t)
 	tablepath := filepath.Join(LEVELDBFOLDER,"songs")
@@ -60,49 +60,105 @@ func TestDropTable(t *testing.T) {
 }
 
 func TestDelete(t *testing.T) {
-	db  := NewLevelDB(LEVELDBFOLDER)
+	db  := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
 	defer teardown(db)
 	dotestDelete(db,t) 
 }
 
 func TestIterate(t *testing.T) {
-	db := NewLevelDB(LEVELDBFOLDER)
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
 	defer teardown(db)
 	dotestIterate(db,t)
 }
 
 func TestIterateSnapshot(t *testing.T) {
-	db := NewLevelDB(LEVELDBFOLDER)
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
 	defer teardown(db)
 	dotestIterateSnapshot(db,t)
 }
 
 func TestIterateSnapshotPrefixEmpty(t *testing.T) {
-	db := NewLevelDB(LEVELDBFOLDER)
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
 	defer teardown(db)
 	dotestIterateSnapshotPrefixEmpty(db,t)
 }
 func TestIterateSnapshotASCII(t *testing.T) {
-	db := NewLevelDB(LEVELDBFOLDER)
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
 	defer teardown(db)
 	dotestIterateSnapshotASCII(db,t)
 }
 
 func TestIteratePrefix(t *testing.T) {
-	db := NewLevelDB(LEVELDBFOLDER)
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
 	defer teardown(db)
 	dotestIteratePrefix(db,t)
 }
 
 func TestIteratePrefixEmpty(t *testing.T) {
-	db := NewLevelDB(LEVELDBFOLDER)
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
 	defer teardown(db)
 	dotestIteratePrefixEmpty(db,t)
 }
 
 func TestBatchWrite(t *testing.T) {
-	db := NewLevelDB(LEVELDBFOLDER)
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
 	defer teardown(db)
 	dotestBatchWrite(db,t)
 }
 
+
+func TestIterateRange(t *testing.T) {
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
+	defer teardown(db)
+	dotestIterateRange(db,t)
+}
+
+func TestIterateRangeSnapshot(t *testing.T) {
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
+	defer teardown(db)
+	dotestIterateRangeSnapshot(db,t)
+}
+
+func TestIterateSeek(t *testing.T) {
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
+	defer teardown(db)
+	dotestIterateSeek(db,t)
+}
+
+func TestIterateKeysOnly(t *testing.T) {
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
+	defer teardown(db)
+	dotestIterateKeysOnly(db,t)
+}
+
+func TestCompactStats(t *testing.T) {
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
+	defer teardown(db)
+	dotestCompactStats(db,t)
+}
+
+func TestSwap(t *testing.T) {
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{})
+	defer teardown(db)
+	dotestSwap(db,t)
+}
+
+func TestLevelDBOptions(t *testing.T) {
+	db := NewLevelDB(LEVELDBFOLDER,LevelDBOptions{BlockCacheMB:16,WriteBufferMB:1,BloomFilterBits:10,NoCompression:true})
+	defer teardown(db)
+	dotestPutGet(db,t)
+	db.Release()
+	db = NewLevelDB(LEVELDBFOLDER,LevelDBOptions{BloomFilterBits:10})
+	table,err := db.OpenTable("songs")
+	if err != nil {
+		t.Error("Failed to reopen table with different options",err)
+		return
+	}
+	var sOut Song
+	if table.Get("The Mountain Goats",&sOut) != nil || sOut.title != "Waylon Jennings Live" {
+		t.Error("Failed to get entry after reopening",sOut.title)
+	}
+	if table.Get("The Kinks",&sOut) == nil {
+		t.Error("Found key that was never written")
+	}
+}
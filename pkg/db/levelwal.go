@@ -0,0 +1,220 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// walTrimKey holds the sequence number changes have been trimmed up to. It
+// sorts before all change records, which are keyed by 8-byte sequence number.
+var walTrimKey = []byte{0}
+
+const (
+	walOpPut byte = iota
+	walOpDelete
+)
+
+// levelWAL is a write-ahead log for a LevelTable, held in a LevelDB instance
+// of its own. Each write to the table is first recorded in the log, then applied.
+// Each record holds the sequence number of the first record written with it so
+// that on opening the last write can be replayed in case it was never applied.
+type levelWAL struct {
+	db *leveldb.DB
+	mux sync.Mutex
+	seq uint64
+	trimmed uint64
+}
+
+func walKey(seq uint64) []byte {
+	var k [8]byte
+	binary.BigEndian.PutUint64(k[:],seq)
+	return k[:]
+}
+
+// walRecord encodes a change along with the first sequence number of its write
+func walRecord(first uint64, key []byte, value []byte, delete bool) []byte {
+	var buff bytes.Buffer
+	var n [binary.MaxVarintLen64]byte
+	buff.Write(n[:binary.PutUvarint(n[:],first)])
+	if delete {
+		buff.WriteByte(walOpDelete)
+	} else {
+		buff.WriteByte(walOpPut)
+	}
+	buff.Write(n[:binary.PutUvarint(n[:],uint64(len(key)))])
+	buff.Write(key)
+	buff.Write(value)
+	return buff.Bytes()
+}
+
+// parseWALRecord decodes a record written by walRecord
+func parseWALRecord(seq uint64, record []byte) (uint64,Change,error) {
+	buff := bytes.NewBuffer(record)
+	first,err := binary.ReadUvarint(buff)
+	if err != nil {
+		return 0,Change{},EFAILED
+	}
+	op,err := buff.ReadByte()
+	if err != nil {
+		return 0,Change{},EFAILED
+	}
+	n,err := binary.ReadUvarint(buff)
+	if err != nil || n > uint64(buff.Len()) {
+		return 0,Change{},EFAILED
+	}
+	c := Change{Seq:seq,Key:string(buff.Next(int(n))),Delete:op==walOpDelete}
+	if !c.Delete {
+		c.Value = append([]byte(nil),buff.Bytes()...)
+	}
+	return first,c,nil
+}
+
+// walBatch records the changes in a LevelDB batch as WAL records
+type walBatch struct {
+	wal *levelWAL
+	first uint64
+	records *leveldb.Batch
+}
+
+func (self *walBatch) Put(key []byte, value []byte) {
+	self.wal.seq++
+	self.records.Put(walKey(self.wal.seq),walRecord(self.first,key,value,false))
+}
+
+func (self *walBatch) Delete(key []byte) {
+	self.wal.seq++
+	self.records.Put(walKey(self.wal.seq),walRecord(self.first,key,nil,true))
+}
+
+// openLevelWAL opens, creating if necessary, the WAL at the given path and
+// replays the last write it holds into the table's LevelDB instance
+func openLevelWAL(path string, table *leveldb.DB) (*levelWAL,error) {
+	db,err := leveldb.OpenFile(path,nil)
+	if err != nil {
+		return nil,err
+	}
+	wal := new(levelWAL)
+	wal.db = db
+	if trimmed,err := db.Get(walTrimKey,nil); err == nil && len(trimmed) == 8 {
+		wal.trimmed = binary.BigEndian.Uint64(trimmed)
+	}
+	wal.seq = wal.trimmed
+	iter := db.NewIterator(&util.Range{Start:walKey(0)},nil)
+	defer iter.Release()
+	if !iter.Last() {
+		return wal,iter.Error()
+	}
+	wal.seq = binary.BigEndian.Uint64(iter.Key())
+	first,_,err := parseWALRecord(wal.seq,iter.Value())
+	if err != nil {
+		db.Close()
+		return nil,err
+	}
+	if first <= wal.trimmed {
+		first = wal.trimmed+1
+	}
+	replay := new(leveldb.Batch)
+	for ok := iter.Seek(walKey(first)); ok; ok = iter.Next() {
+		_,c,err := parseWALRecord(binary.BigEndian.Uint64(iter.Key()),iter.Value())
+		if err != nil {
+			db.Close()
+			return nil,err
+		}
+		if c.Delete {
+			replay.Delete([]byte(c.Key))
+		} else {
+			replay.Put([]byte(c.Key),c.Value)
+		}
+	}
+	err = table.Write(replay,nil)
+	if err != nil {
+		db.Close()
+		return nil,err
+	}
+	return wal,iter.Error()
+}
+
+// write logs and then applies a batch of changes to the table. Writes are
+// serialized so that they are applied in sequence order.
+func (self *levelWAL) write(table *leveldb.DB, batch *leveldb.Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	seq := self.seq
+	wb := walBatch{wal:self,first:seq+1,records:new(leveldb.Batch)}
+	err := batch.Replay(&wb)
+	if err == nil {
+		err = self.db.Write(wb.records,nil)
+	}
+	if err != nil {
+		self.seq = seq
+		return err
+	}
+	return table.Write(batch,nil)
+}
+
+// Changes returns up to max changes after the given sequence number
+func (self *levelWAL) Changes(after uint64, max int) ([]Change,error) {
+	self.mux.Lock()
+	last := self.seq
+	trimmed := self.trimmed
+	self.mux.Unlock()
+	if after < trimmed {
+		return nil,ECHANGESTRIMMED
+	}
+	var changes []Change
+	iter := self.db.NewIterator(&util.Range{Start:walKey(after+1),Limit:walKey(last+1)},nil)
+	defer iter.Release()
+	for len(changes) < max && iter.Next() {
+		_,c,err := parseWALRecord(binary.BigEndian.Uint64(iter.Key()),iter.Value())
+		if err != nil {
+			return nil,err
+		}
+		changes = append(changes,c)
+	}
+	return changes,iter.Error()
+}
+
+// LastSeq returns the sequence number of the latest change
+func (self *levelWAL) LastSeq() (uint64,error) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	return self.seq,nil
+}
+
+// Trim deletes records up to and including the given sequence number
+func (self *levelWAL) Trim(upTo uint64) error {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if upTo > self.seq {
+		upTo = self.seq
+	}
+	if upTo <= self.trimmed {
+		return nil
+	}
+	batch := new(leveldb.Batch)
+	iter := self.db.NewIterator(&util.Range{Start:walKey(self.trimmed+1),Limit:walKey(upTo+1)},nil)
+	for iter.Next() {
+		batch.Delete(append([]byte(nil),iter.Key()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	batch.Put(walTrimKey,walKey(upTo))
+	err := self.db.Write(batch,nil)
+	if err != nil {
+		return err
+	}
+	self.trimmed = upTo
+	return nil
+}
+
+func (self *levelWAL) close() {
+	self.db.Close()
+}
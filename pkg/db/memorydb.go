@@ -0,0 +1,458 @@
+package db
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// memoryState holds the contents of a MemoryTable at a point in time. Once
+// shared with a snapshot or iterator it is never modified again; the table
+// copies it before its next write instead.
+type memoryState struct {
+	values map[string][]byte
+	keys []string
+	sorted bool
+	mux sync.Mutex
+}
+
+// newMemoryState creates an empty memoryState
+func newMemoryState() *memoryState {
+	ms := new(memoryState)
+	ms.values = make(map[string][]byte)
+	return ms
+}
+
+// clone returns a private copy of the state that can be written to
+func (self *memoryState) clone() *memoryState {
+	ms := new(memoryState)
+	ms.values = make(map[string][]byte,len(self.values))
+	for k,v := range self.values {
+		ms.values[k]=v
+	}
+	return ms
+}
+
+// get retrieves and deserializes the value for the given key
+func (self *memoryState) get(key string, s Serialize) error {
+	blob,exists := self.values[key]
+	if !exists {
+		return EKEYNOTFOUND
+	}
+	return s.From(bytes.NewBuffer(blob))
+}
+
+// rangeKeys returns all keys in the given range in ascending byte order.
+// Keys are sorted at most once for each state.
+func (self *memoryState) rangeKeys(opts IteratorOptions) []string {
+	self.mux.Lock()
+	if !self.sorted {
+		self.keys = make([]string,0,len(self.values))
+		for k,_ := range self.values {
+			self.keys = append(self.keys,k)
+		}
+		sort.Strings(self.keys)
+		self.sorted = true
+	}
+	self.mux.Unlock()
+	start := sort.SearchStrings(self.keys,opts.Start)
+	end := len(self.keys)
+	if opts.Limit != "" {
+		end = sort.SearchStrings(self.keys,opts.Limit)
+	}
+	if end < start {
+		end = start
+	}
+	return self.keys[start:end]
+}
+
+// newIterator creates an iterator over all entries in the state with
+// the given prefix
+func (self *memoryState) newIterator(prefix string) *MemoryIterator {
+	return self.newRangeIterator(PrefixRange(prefix))
+}
+
+// newRangeIterator creates an iterator over all entries in the given range.
+// Keys are held in the order they are visited.
+func (self *memoryState) newRangeIterator(opts IteratorOptions) *MemoryIterator {
+	iter := new(MemoryIterator)
+	iter.state = self
+	iter.keys = self.rangeKeys(opts)
+	if opts.Reverse {
+		reversed := make([]string,len(iter.keys))
+		for i,k := range iter.keys {
+			reversed[len(iter.keys)-1-i] = k
+		}
+		iter.keys = reversed
+	}
+	iter.reverse = opts.Reverse
+	iter.keysOnly = opts.KeysOnly
+	iter.index = -1
+	return iter
+}
+
+type MemoryIterator struct {
+	state *memoryState
+	keys []string
+	index int
+	reverse bool
+	keysOnly bool
+	err error
+}
+
+// Next moves to the next key in ascending order, or descending order
+// for reverse iterators
+func (self *MemoryIterator) Next() (bool) {
+	if self.index+1 < len(self.keys) {
+		self.index++
+		return true
+	}
+	self.index = len(self.keys)
+	return false
+}
+
+// Seek moves to the first key at or after the given key in iteration order
+func (self *MemoryIterator) Seek(key string) (bool) {
+	if self.reverse {
+		self.index = sort.Search(len(self.keys),func(i int) bool { return self.keys[i] <= key })
+	} else {
+		self.index = sort.SearchStrings(self.keys,key)
+	}
+	return self.index < len(self.keys)
+}
+
+// Key returns the current key
+func (self *MemoryIterator) Key() (string) {
+	if self.index < 0 || self.index >= len(self.keys) {
+		return ""
+	}
+	return self.keys[self.index]
+}
+
+// Value deserializes the current value into given struct
+func (self *MemoryIterator) Value(s Serialize) {
+	if self.keysOnly {
+		self.err = EKEYSONLY
+		return
+	}
+	if self.index < 0 || self.index >= len(self.keys) {
+		return
+	}
+	self.err = self.state.get(self.keys[self.index],s)
+}
+
+// Error reports any error from the last call to Value
+func (self *MemoryIterator) Error() error {
+	return self.err
+}
+
+// Release releases the state held by the iterator
+func (self *MemoryIterator) Release() error {
+	self.state = nil
+	self.keys = nil
+	return self.err
+}
+
+type MemorySnapshot struct {
+	state *memoryState
+}
+
+// Release releases the state held by the snapshot
+func (self *MemorySnapshot) Release() error {
+	self.state = nil
+	return nil
+}
+
+// Get retrieves value for given key as it was when the snapshot was taken
+func (self *MemorySnapshot) Get(key string,s Serialize) error {
+	if self.state == nil {
+		return EFAILED
+	}
+	return self.state.get(key,s)
+}
+
+// NewIterator creates an iterator over entries as they were when the
+// snapshot was taken
+func (self *MemorySnapshot) NewIterator(prefix string) (Iterator,error) {
+	if self.state == nil {
+		return nil,EFAILED
+	}
+	return self.state.newIterator(prefix),nil
+}
+
+// NewRangeIterator creates an iterator over entries in the given range as
+// they were when the snapshot was taken
+func (self *MemorySnapshot) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	if self.state == nil {
+		return nil,EFAILED
+	}
+	return self.state.newRangeIterator(opts),nil
+}
+
+type memoryOp struct {
+	key string
+	value []byte
+	delete bool
+}
+
+// MemoryBatchWrite collects writes and applies them to the table together
+type MemoryBatchWrite struct {
+	ops []memoryOp
+	table *MemoryTable
+	batchSize int
+}
+
+// Put adds a put to the batch
+func (self *MemoryBatchWrite) Put(key string, s Serialize) error {
+	var buff bytes.Buffer
+	err := s.To(&buff)
+	if err != nil {
+		return err
+	}
+	self.ops = append(self.ops,memoryOp{key:key,value:buff.Bytes()})
+	return self.write(false)
+}
+
+// Delete adds a delete to the batch
+func (self* MemoryBatchWrite) Delete(key string) error {
+	self.ops = append(self.ops,memoryOp{key:key,delete:true})
+	return self.write(false)
+}
+
+// Release forces write of any remaining data in the current batch
+func (self* MemoryBatchWrite) Release() error {
+	return self.write(true)
+}
+
+// write provides convenient way to write in batches of fixed size
+func (self* MemoryBatchWrite) write(flush bool) error {
+	if flush || len(self.ops) >= self.batchSize {
+		self.table.apply(self.ops)
+		self.ops = self.ops[:0]
+	}
+	return nil
+}
+
+type MemoryTable struct {
+	mux sync.RWMutex
+	state *memoryState
+	shared bool
+}
+
+// newMemoryTable creates a new, empty MemoryTable
+func newMemoryTable() *MemoryTable {
+	table := new(MemoryTable)
+	table.state = newMemoryState()
+	return table
+}
+
+// share returns the current state for reading by a snapshot or iterator,
+// ensuring the table copies it before making any further changes
+func (self *MemoryTable) share() *memoryState {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	self.shared = true
+	return self.state
+}
+
+// apply applies the given writes to the table as a single atomic change,
+// first copying the current state if it is shared
+func (self *MemoryTable) apply(ops []memoryOp) {
+	if len(ops) == 0 {
+		return
+	}
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	self.applyLocked(ops)
+}
+
+// applyLocked applies the given writes with the lock already held
+func (self *MemoryTable) applyLocked(ops []memoryOp) {
+	if self.shared {
+		self.state = self.state.clone()
+		self.shared = false
+	}
+	for _,op := range ops {
+		_,exists := self.state.values[op.key]
+		if op.delete {
+			delete(self.state.values,op.key)
+			self.state.sorted = self.state.sorted && !exists
+		} else {
+			self.state.values[op.key] = op.value
+			self.state.sorted = self.state.sorted && exists
+		}
+	}
+}
+
+// Get retrieves and deserializes the value for the given key
+func (self *MemoryTable) Get(key string,s Serialize) error {
+	self.mux.RLock()
+	blob,exists := self.state.values[key]
+	self.mux.RUnlock()
+	if !exists {
+		return EKEYNOTFOUND
+	}
+	return s.From(bytes.NewBuffer(blob))
+}
+
+// Put serializes and stores the value for the given key
+func (self *MemoryTable) Put(key string, s Serialize) error {
+	var buff bytes.Buffer
+	err := s.To(&buff)
+	if err != nil {
+		return err
+	}
+	self.apply([]memoryOp{memoryOp{key:key,value:buff.Bytes()}})
+	return nil
+}
+
+// Swap replaces the value for the given key if it is unchanged
+func (self *MemoryTable) Swap(key string, was Serialize, s Serialize) error {
+	old,err := serialized(was)
+	if err != nil {
+		return err
+	}
+	value,err := serialized(s)
+	if err != nil {
+		return err
+	}
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	stored,exists := self.state.values[key]
+	if !swapped(stored,exists,old,was == nil) {
+		return ESWAPFAILED
+	}
+	self.applyLocked([]memoryOp{memoryOp{key:key,value:value}})
+	return nil
+}
+
+// Delete removes the value for the given key
+func (self *MemoryTable) Delete(key string) error {
+	self.apply([]memoryOp{memoryOp{key:key,delete:true}})
+	return nil
+}
+
+// NewIterator creates an iterator over all entries with the given prefix.
+// As with LevelDB the iterator sees the table as it was when created.
+func (self *MemoryTable) NewIterator(prefix string) (Iterator,error) {
+	return self.share().newIterator(prefix),nil
+}
+
+// NewRangeIterator creates an iterator over all entries in the given range
+func (self *MemoryTable) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	return self.share().newRangeIterator(opts),nil
+}
+
+// TakeSnapshot creates a copy-on-write snapshot of the table
+func (self *MemoryTable) TakeSnapshot() (Snapshot,error) {
+	ss := new(MemorySnapshot)
+	ss.state = self.share()
+	return ss,nil
+}
+
+// MakeBatch creates a new batch object for batch writes
+func (self* MemoryTable) MakeBatch(batchSize int) (BatchWrite,error) {
+	mb := new(MemoryBatchWrite)
+	mb.table=self
+	mb.batchSize=batchSize
+	if mb.batchSize < 1 {
+		mb.batchSize = 1
+	}
+	mb.ops = make([]memoryOp,0,mb.batchSize)
+	return mb,nil
+}
+
+// MemoryDB is a Database held entirely in memory, for use in tests and
+// quick experiments. Contents are lost when the instance is discarded.
+type MemoryDB struct
+{
+	mux sync.Mutex
+	tables map[string]*MemoryTable
+}
+
+// NewMemoryDB creates a new, empty MemoryDB
+func NewMemoryDB() *MemoryDB {
+	db := new(MemoryDB)
+	db.tables = make(map[string]*MemoryTable)
+	return db
+}
+
+// OpenTable returns the table with the given name if it exists
+func (self *MemoryDB) OpenTable(name string) (Table,error) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if self.tables[name] == nil {
+		return nil, ETABLENOTFOUND
+	}
+	return self.tables[name],nil
+}
+
+// CloseTable checks the table exists. As with LevelDB the contents of the table
+// are retained.
+func (self *MemoryDB) CloseTable(name string) error {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if self.tables[name] == nil {
+		return ETABLENOTFOUND
+	}
+	return nil
+}
+
+// DropTable deletes the table and all its contents
+func (self *MemoryDB) DropTable(name string) error {
+	if name=="" {
+		return EINVALIDTABLENAME
+	}
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if self.tables[name] == nil {
+		return ETABLENOTFOUND
+	}
+	delete(self.tables,name)
+	return nil
+}
+
+// Release has nothing to release for an in-memory database
+func (self *MemoryDB) Release() error {
+	return nil
+}
+
+// CreateTable creates a new, empty table with the given name
+func (self *MemoryDB) CreateTable(name string) (Table,error) {
+	if name=="" {
+		return nil,EINVALIDTABLENAME
+	}
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if self.tables[name] != nil {
+		return nil,ETABLEALREADYEXISTS
+	}
+	self.tables[name] = newMemoryTable()
+	return self.tables[name],nil
+}
+
+// CompactTable has nothing to do for an in-memory table other than check it exists
+func (self *MemoryDB) CompactTable(name string) error {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if self.tables[name] == nil {
+		return ETABLENOTFOUND
+	}
+	return nil
+}
+
+// TableStats counts the entries in a table and the bytes held by their keys and values
+func (self *MemoryDB) TableStats(name string) (TableStats,error) {
+	self.mux.Lock()
+	table := self.tables[name]
+	self.mux.Unlock()
+	if table == nil {
+		return TableStats{},ETABLENOTFOUND
+	}
+	state := table.share()
+	stats := TableStats{Entries:int64(len(state.values))}
+	for k,v := range state.values {
+		stats.Size += int64(len(k)+len(v))
+	}
+	return stats,nil
+}
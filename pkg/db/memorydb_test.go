@@ -0,0 +1,144 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestMemoryCreateTable(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestCreateTable(db,t)
+}
+
+func TestMemoryOpenTable(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestOpenTable(db,t)
+}
+
+func TestMemoryPutGet(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestPutGet(db,t)
+}
+
+func TestMemoryDropTable(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestDropTable(db,t)
+	_,err := db.OpenTable("songs")
+	if err == nil {
+		t.Error("Dropped table is still there")
+	}
+}
+
+func TestMemoryDelete(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestDelete(db,t)
+}
+
+func TestMemoryIterate(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestIterate(db,t)
+}
+
+func TestMemoryIterateSnapshot(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestIterateSnapshot(db,t)
+}
+
+func TestMemoryIterateSnapshotPrefixEmpty(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestIterateSnapshotPrefixEmpty(db,t)
+}
+
+func TestMemoryIterateSnapshotASCII(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestIterateSnapshotASCII(db,t)
+}
+
+func TestMemoryIteratePrefix(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestIteratePrefix(db,t)
+}
+
+func TestMemoryIteratePrefixEmpty(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestIteratePrefixEmpty(db,t)
+}
+
+func TestMemoryBatchWrite(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestBatchWrite(db,t)
+}
+
+func TestMemorySnapshotCopyOnWrite(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	table,_ := db.CreateTable("songs")
+	table.Put("The Kinks",&Song{title:"Sitting in My Hotel"})
+	ss,err := table.TakeSnapshot()
+	if err != nil {
+		t.Error("Failed to create snapshot",err)
+	}
+	defer ss.Release()
+	table.Put("The Kinks",&Song{title:"Lola"})
+	table.Put("Sacred Paws",&Song{title:"Wet Graffiti"})
+	var sOut Song
+	err = ss.Get("The Kinks",&sOut)
+	if err != nil || sOut.title != "Sitting in My Hotel" {
+		t.Error("Snapshot sees later put",sOut.title,err)
+	}
+	err = ss.Get("Sacred Paws",&sOut)
+	if err == nil {
+		t.Error("Snapshot sees later new key",sOut.title)
+	}
+	err = table.Get("The Kinks",&sOut)
+	if err != nil || sOut.title != "Lola" {
+		t.Error("Table doesnt see put after snapshot",sOut.title,err)
+	}
+}
+
+func TestMemoryIterateRange(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestIterateRange(db,t)
+}
+
+func TestMemoryIterateRangeSnapshot(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestIterateRangeSnapshot(db,t)
+}
+
+func TestMemoryIterateSeek(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestIterateSeek(db,t)
+}
+
+func TestMemoryIterateKeysOnly(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestIterateKeysOnly(db,t)
+}
+
+func TestMemoryCompactStats(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestCompactStats(db,t)
+}
+
+func TestMemorySwap(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	dotestSwap(db,t)
+}
@@ -0,0 +1,122 @@
+package db
+
+// mergeIterator merges iterators into a single ordered iterator. Keys found by
+// more than one iterator are visited once, with the value from the first.
+type mergeIterator struct {
+	iters []Iterator
+	valid []bool
+	current int
+	started bool
+	reverse bool
+}
+
+// newMergeIterator creates an iterator over the given iterators. If there is
+// only one it is returned as it is.
+func newMergeIterator(iters []Iterator, reverse bool) Iterator {
+	if len(iters) == 1 {
+		return iters[0]
+	}
+	iter := new(mergeIterator)
+	iter.iters = iters
+	iter.valid = make([]bool,len(iters))
+	iter.current = -1
+	iter.reverse = reverse
+	return iter
+}
+
+// pick makes the iterator with the lowest key, or highest for reverse
+// iterators, the current one
+func (self *mergeIterator) pick() (bool) {
+	self.current = -1
+	for i,it := range self.iters {
+		if !self.valid[i] {
+			continue
+		}
+		if self.current < 0 {
+			self.current = i
+			continue
+		}
+		k, best := it.Key(), self.iters[self.current].Key()
+		if (!self.reverse && k < best) || (self.reverse && k > best) {
+			self.current = i
+		}
+	}
+	return self.current >= 0
+}
+
+// MergeIterators merges iterators over ordered keys, such as those over
+// several tables, into one. Keys found by more than one iterator are visited
+// once, with the value from the first of them. All iterators must have the same
+// direction. Releasing the merged iterator releases them all.
+func MergeIterators(iters []Iterator, reverse bool) Iterator {
+	return newMergeIterator(iters,reverse)
+}
+
+// Next moves to the next key across all iterators, skipping any
+// iterators that are on the key just visited
+func (self *mergeIterator) Next() (bool) {
+	if !self.started {
+		self.started = true
+		for i,it := range self.iters {
+			self.valid[i] = it.Next()
+		}
+		return self.pick()
+	}
+	if self.current < 0 {
+		return false
+	}
+	last := self.Key()
+	self.valid[self.current] = self.iters[self.current].Next()
+	for self.pick() {
+		if self.Key() != last {
+			return true
+		}
+		self.valid[self.current] = self.iters[self.current].Next()
+	}
+	return false
+}
+
+// Seek seeks each shard and moves to the first key found across them
+func (self *mergeIterator) Seek(key string) (bool) {
+	self.started = true
+	for i,it := range self.iters {
+		self.valid[i] = it.Seek(key)
+	}
+	return self.pick()
+}
+
+// Key returns the current key
+func (self *mergeIterator) Key() (string) {
+	if self.current < 0 {
+		return ""
+	}
+	return self.iters[self.current].Key()
+}
+
+// Value deserializes the current value into the given struct
+func (self *mergeIterator) Value(s Serialize) {
+	if self.current >= 0 {
+		self.iters[self.current].Value(s)
+	}
+}
+
+// Error reports the first error from any shard
+func (self *mergeIterator) Error() error {
+	for _,it := range self.iters {
+		if err := it.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release releases the iterators for all shards
+func (self *mergeIterator) Release() error {
+	var err error
+	for _,it := range self.iters {
+		if e := it.Release(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
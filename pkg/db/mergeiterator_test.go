@@ -0,0 +1,37 @@
+package db
+
+import (
+	"testing"
+)
+
+func TestMergeIterators(t *testing.T) {
+	db := NewMemoryDB()
+	defer db.Release()
+	var tables []Table
+	for _,c := range []struct{name string; chars string} {{"one","adf"},{"two","bdg"},{"three","cdfh"}} {
+		table,_ := db.CreateTable(c.name)
+		putCharacters(table,c.chars)
+		tables = append(tables,table)
+	}
+	merged := func(opts IteratorOptions) Iterator {
+		var iters []Iterator
+		for _,table := range tables {
+			it,_ := table.NewRangeIterator(opts)
+			iters = append(iters,it)
+		}
+		return MergeIterators(iters,opts.Reverse)
+	}
+	if keys := collectKeys(merged(IteratorOptions{}),true,t); keys != "abcdfgh" {
+		t.Error("Merged keys wrong or repeated",keys)
+	}
+	if keys := collectKeys(merged(IteratorOptions{Reverse:true}),true,t); keys != "hgfdcba" {
+		t.Error("Reverse merged keys wrong or repeated",keys)
+	}
+	iterator := merged(IteratorOptions{})
+	if !iterator.Seek("d") || iterator.Key() != "d" {
+		t.Error("Seek failed",iterator.Key())
+	}
+	if keys := collectKeys(iterator,true,t); keys != "fgh" {
+		t.Error("Merged keys after seek wrong or repeated",keys)
+	}
+}
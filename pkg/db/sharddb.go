@@ -0,0 +1,346 @@
+package db
+
+import (
+	"sync"
+)
+
+const maxShards = 16
+
+// shardIndex returns the shard for a key with n shards. Keys are spread by
+// their leading hex digit, as used by traveller keys, so that each shard holds
+// a contiguous range of them. Keys not starting with a hex digit are held in
+// the first shard.
+func shardIndex(key string, n int) int {
+	nibble,ok := leadingNibble(key)
+	if !ok {
+		return 0
+	}
+	return nibble*n/16
+}
+
+// leadingNibble returns the value of the key's leading hex digit, if it has one
+func leadingNibble(key string) (int,bool) {
+	if len(key) == 0 {
+		return 0,false
+	}
+	switch c := key[0]; {
+		case c >= '0' && c <= '9':
+			return int(c-'0'),true
+		case c >= 'a' && c <= 'f':
+			return int(c-'a')+10,true
+	}
+	return 0,false
+}
+
+// shardIterators creates a merged iterator from per shard iterators, using
+// only the shard holding the given prefix if it determines one
+func shardIterators(n int, prefix string, reverse bool, create func(int) (Iterator,error)) (Iterator,error) {
+	first, last := 0, n-1
+	if _,ok := leadingNibble(prefix); ok {
+		first = shardIndex(prefix,n)
+		last = first
+	}
+	var iters []Iterator
+	for i := first; i <= last; i++ {
+		it,err := create(i)
+		if err != nil {
+			for _,it := range iters {
+				it.Release()
+			}
+			return nil,err
+		}
+		iters = append(iters,it)
+	}
+	return newMergeIterator(iters,reverse),nil
+}
+
+// ShardSnapshot holds a snapshot of each shard. Snapshots are taken one after
+// another so are only consistent within each shard.
+type ShardSnapshot struct {
+	snapshots []Snapshot
+}
+
+// Release releases the snapshots of all shards
+func (self *ShardSnapshot) Release() error {
+	var err error
+	for _,ss := range self.snapshots {
+		if e := ss.Release(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Get retrieves the value for the given key from the snapshot of its shard
+func (self *ShardSnapshot) Get(key string, s Serialize) error {
+	return self.snapshots[shardIndex(key,len(self.snapshots))].Get(key,s)
+}
+
+// NewIterator creates an iterator over the snapshots for keys with the given prefix
+func (self *ShardSnapshot) NewIterator(prefix string) (Iterator,error) {
+	return shardIterators(len(self.snapshots),prefix,false,func(i int) (Iterator,error) {
+		return self.snapshots[i].NewIterator(prefix)
+	})
+}
+
+// NewRangeIterator creates an iterator over the snapshots for the given range
+func (self *ShardSnapshot) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	return shardIterators(len(self.snapshots),"",opts.Reverse,func(i int) (Iterator,error) {
+		return self.snapshots[i].NewRangeIterator(opts)
+	})
+}
+
+// ShardBatchWrite holds a batch for each shard, created when first needed
+type ShardBatchWrite struct {
+	table *ShardTable
+	batches []BatchWrite
+	batchSize int
+}
+
+// batch returns the batch for the shard holding the given key
+func (self *ShardBatchWrite) batch(key string) (BatchWrite,error) {
+	i := shardIndex(key,len(self.batches))
+	if self.batches[i] == nil {
+		b,err := self.table.tables[i].MakeBatch(self.batchSize)
+		if err != nil {
+			return nil,err
+		}
+		self.batches[i] = b
+	}
+	return self.batches[i],nil
+}
+
+// Put adds a put to the batch for the key's shard
+func (self *ShardBatchWrite) Put(key string, s Serialize) error {
+	b,err := self.batch(key)
+	if err != nil {
+		return err
+	}
+	return b.Put(key,s)
+}
+
+// Delete adds a delete to the batch for the key's shard
+func (self *ShardBatchWrite) Delete(key string) error {
+	b,err := self.batch(key)
+	if err != nil {
+		return err
+	}
+	return b.Delete(key)
+}
+
+// Release writes any remaining data in the batches for all shards
+func (self *ShardBatchWrite) Release() error {
+	var err error
+	for _,b := range self.batches {
+		if b == nil {
+			continue
+		}
+		if e := b.Release(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ShardTable is a table split across shards by key
+type ShardTable struct {
+	tables []Table
+}
+
+// Get retrieves the value for the given key from its shard
+func (self *ShardTable) Get(key string, s Serialize) error {
+	return self.tables[shardIndex(key,len(self.tables))].Get(key,s)
+}
+
+// Put stores the value for the given key in its shard
+func (self *ShardTable) Put(key string, s Serialize) error {
+	return self.tables[shardIndex(key,len(self.tables))].Put(key,s)
+}
+
+// Swap replaces the value for the given key in its shard if it is unchanged
+func (self *ShardTable) Swap(key string, was Serialize, s Serialize) error {
+	return self.tables[shardIndex(key,len(self.tables))].Swap(key,was,s)
+}
+
+// Delete removes the value for the given key from its shard
+func (self *ShardTable) Delete(key string) error {
+	return self.tables[shardIndex(key,len(self.tables))].Delete(key)
+}
+
+// NewIterator creates an iterator for keys with the given prefix, merging
+// iterators across shards unless the prefix falls within just one
+func (self *ShardTable) NewIterator(prefix string) (Iterator,error) {
+	return shardIterators(len(self.tables),prefix,false,func(i int) (Iterator,error) {
+		return self.tables[i].NewIterator(prefix)
+	})
+}
+
+// NewRangeIterator creates an iterator for the given range, merging
+// iterators across all shards
+func (self *ShardTable) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	return shardIterators(len(self.tables),"",opts.Reverse,func(i int) (Iterator,error) {
+		return self.tables[i].NewRangeIterator(opts)
+	})
+}
+
+// TakeSnapshot takes a snapshot of each shard
+func (self *ShardTable) TakeSnapshot() (Snapshot,error) {
+	ss := new(ShardSnapshot)
+	for _,t := range self.tables {
+		s,err := t.TakeSnapshot()
+		if err != nil {
+			ss.Release()
+			return nil,err
+		}
+		ss.snapshots = append(ss.snapshots,s)
+	}
+	return ss,nil
+}
+
+// MakeBatch creates a batch that writes to each shard in batches of the given size
+func (self *ShardTable) MakeBatch(batchSize int) (BatchWrite,error) {
+	sb := new(ShardBatchWrite)
+	sb.table = self
+	sb.batches = make([]BatchWrite,len(self.tables))
+	sb.batchSize = batchSize
+	return sb,nil
+}
+
+// ShardDB splits every table across a number of underlying databases by the
+// leading hex digit of each key, so that traveller records, and backfill threads
+// working through them, are spread across separate stores. Each shard holds a
+// contiguous range of keys, so with as many backfill threads as shards each thread
+// works on one store. Up to 16 shards are supported.
+type ShardDB struct {
+	shards []Database
+	tables map[string]*ShardTable
+	mux sync.Mutex
+}
+
+// NewShardDB creates a ShardDB over the given databases. Returns nil if there
+// are none or more than 16.
+func NewShardDB(shards []Database) *ShardDB {
+	if len(shards) == 0 || len(shards) > maxShards {
+		return nil
+	}
+	db := new(ShardDB)
+	db.shards = shards
+	db.tables = make(map[string]*ShardTable)
+	return db
+}
+
+// table returns the ShardTable for the named table, getting the table
+// from each shard with the given function
+func (self *ShardDB) table(name string, get func(Database) (Table,error)) (Table,error) {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	st := new(ShardTable)
+	for _,shard := range self.shards {
+		t,err := get(shard)
+		if err != nil {
+			return nil,err
+		}
+		st.tables = append(st.tables,t)
+	}
+	if existing := self.tables[name]; existing != nil && equalTables(existing.tables,st.tables) {
+		return existing,nil
+	}
+	self.tables[name] = st
+	return st,nil
+}
+
+// equalTables returns true if two lists of tables are the same
+func equalTables(a []Table, b []Table) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// OpenTable opens the named table in every shard
+func (self *ShardDB) OpenTable(name string) (Table,error) {
+	return self.table(name,func(shard Database) (Table,error) {
+		return shard.OpenTable(name)
+	})
+}
+
+// CreateTable creates the named table in every shard
+func (self *ShardDB) CreateTable(name string) (Table,error) {
+	return self.table(name,func(shard Database) (Table,error) {
+		return shard.CreateTable(name)
+	})
+}
+
+// CloseTable closes the named table in every shard
+func (self *ShardDB) CloseTable(name string) error {
+	return self.each(name,func(shard Database) error {
+		return shard.CloseTable(name)
+	})
+}
+
+// DropTable drops the named table from every shard
+func (self *ShardDB) DropTable(name string) error {
+	return self.each(name,func(shard Database) error {
+		return shard.DropTable(name)
+	})
+}
+
+// each applies an operation on the named table to every shard, returning
+// the first error
+func (self *ShardDB) each(name string, op func(Database) error) error {
+	self.mux.Lock()
+	delete(self.tables,name)
+	self.mux.Unlock()
+	var err error
+	for _,shard := range self.shards {
+		if e := op(shard); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// CompactTable compacts the named table in every shard
+func (self *ShardDB) CompactTable(name string) error {
+	var err error
+	for _,shard := range self.shards {
+		if e := shard.CompactTable(name); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// TableStats adds up the storage used by the named table in every shard
+func (self *ShardDB) TableStats(name string) (TableStats,error) {
+	var total TableStats
+	for _,shard := range self.shards {
+		stats,err := shard.TableStats(name)
+		if err != nil {
+			return TableStats{},err
+		}
+		if stats.Entries < 0 || total.Entries < 0 {
+			total.Entries = -1
+		} else {
+			total.Entries += stats.Entries
+		}
+		total.Size += stats.Size
+	}
+	return total,nil
+}
+
+// Release releases every shard
+func (self *ShardDB) Release() error {
+	var err error
+	for _,shard := range self.shards {
+		if e := shard.Release(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"testing"
+)
+
+func setupShard() *ShardDB {
+	return NewShardDB([]Database{NewMemoryDB(),NewMemoryDB(),NewMemoryDB(),NewMemoryDB()})
+}
+
+func TestShardCreateTable(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestCreateTable(db,t)
+}
+
+func TestShardOpenTable(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestOpenTable(db,t)
+}
+
+func TestShardPutGet(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestPutGet(db,t)
+}
+
+func TestShardDropTable(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestDropTable(db,t)
+}
+
+func TestShardDelete(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestDelete(db,t)
+}
+
+func TestShardIterate(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestIterate(db,t)
+}
+
+func TestShardIterateSnapshot(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestIterateSnapshot(db,t)
+}
+
+func TestShardIterateSnapshotPrefixEmpty(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestIterateSnapshotPrefixEmpty(db,t)
+}
+
+func TestShardIterateSnapshotASCII(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestIterateSnapshotASCII(db,t)
+}
+
+func TestShardIteratePrefix(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestIteratePrefix(db,t)
+}
+
+func TestShardIteratePrefixEmpty(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestIteratePrefixEmpty(db,t)
+}
+
+func TestShardBatchWrite(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestBatchWrite(db,t)
+}
+
+func TestShardIterateRange(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestIterateRange(db,t)
+}
+
+func TestShardIterateRangeSnapshot(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestIterateRangeSnapshot(db,t)
+}
+
+func TestShardIterateSeek(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestIterateSeek(db,t)
+}
+
+func TestShardIterateKeysOnly(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestIterateKeysOnly(db,t)
+}
+
+func TestShardCompactStats(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestCompactStats(db,t)
+}
+
+func TestShardSwap(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	dotestSwap(db,t)
+}
+
+func TestShardRouting(t *testing.T) {
+	shards := []Database{NewMemoryDB(),NewMemoryDB(),NewMemoryDB(),NewMemoryDB()}
+	db := NewShardDB(shards)
+	defer db.Release()
+	table,_ := db.CreateTable("chars")
+	putCharacters(table,"0f3e48cx")
+	for i,expected := range []string{"03x","4","8","cef"} {
+		shard,_ := shards[i].OpenTable("chars")
+		iterator,_ := shard.NewIterator("")
+		if keys := collectKeys(iterator,true,t); keys != expected {
+			t.Error("Keys in wrong shard",i,keys,expected)
+		}
+	}
+	iterator,_ := table.NewIterator("")
+	if keys := collectKeys(iterator,true,t); keys != "0348cefx" {
+		t.Error("Merged iteration out of order",keys)
+	}
+	iterator,_ = table.NewRangeIterator(IteratorOptions{Start:"1",Limit:"f",Reverse:true})
+	if keys := collectKeys(iterator,true,t); keys != "ec843" {
+		t.Error("Merged reverse iteration out of order",keys)
+	}
+	iterator,_ = table.NewRangeIterator(IteratorOptions{})
+	if !iterator.Seek("5") || iterator.Key() != "8" {
+		t.Error("Merged seek failed",iterator.Key())
+	}
+	iterator.Release()
+}
+
+func TestShardPrefixSingleShard(t *testing.T) {
+	db := setupShard()
+	defer db.Release()
+	table,_ := db.CreateTable("chars")
+	iterator,_ := table.NewIterator("a")
+	if _,merged := iterator.(*mergeIterator); merged {
+		t.Error("Iterator for hex prefix not limited to one shard")
+	}
+	iterator.Release()
+	iterator,_ = table.NewIterator("x")
+	if _,merged := iterator.(*mergeIterator); !merged {
+		t.Error("Iterator for non-hex prefix not merged")
+	}
+	iterator.Release()
+}
+
+func TestShardCount(t *testing.T) {
+	if NewShardDB(nil) != nil {
+		t.Error("Created ShardDB with no shards")
+	}
+	if NewShardDB(make([]Database,17)) != nil {
+		t.Error("Created ShardDB with more than 16 shards")
+	}
+}
@@ -0,0 +1,628 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// sqlMaxRowsPerStatement limits the rows in a single multi-row statement so
+// that the number of bound parameters stays within the limits of all
+// supported engines
+const sqlMaxRowsPerStatement = 400
+
+// sqliteOptions are added to sqlite3 data source names that dont set them. Backfill
+// keeps a snapshot transaction open while batches commit on other connections, which
+// in SQLite's default rollback journal mode fail with the database locked.
+var sqliteOptions = []string{"_journal_mode=WAL","_busy_timeout=5000"}
+
+var validSQLTableName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// sqlDialect captures the differences between SQL engines that matter for
+// storing each table as (key,value blob) pairs
+type sqlDialect struct {
+	numbered bool
+	keyType string
+	valueType string
+	upsert string
+	compact string
+}
+
+// sqlDialects maps driver names to dialects. Drivers not listed use sqlite3.
+var sqlDialects = map[string]sqlDialect {
+	"sqlite3": sqlDialect{false,"BLOB","BLOB","ON CONFLICT(k) DO UPDATE SET v=excluded.v","VACUUM"},
+	"postgres": sqlDialect{true,"BYTEA","BYTEA","ON CONFLICT(k) DO UPDATE SET v=excluded.v","VACUUM %s"},
+	"pgx": sqlDialect{true,"BYTEA","BYTEA","ON CONFLICT(k) DO UPDATE SET v=excluded.v","VACUUM %s"},
+	"mysql": sqlDialect{false,"VARBINARY(255)","LONGBLOB","ON DUPLICATE KEY UPDATE v=VALUES(v)","OPTIMIZE TABLE %s"},
+}
+
+// placeholders returns a comma separated list of n placeholders starting
+// at the given 1-based position, each group of size "group" wrapped in brackets
+// if group is greater than 1
+func (self *sqlDialect) placeholders(start int, n int, group int) string {
+	var sb strings.Builder
+	for i:=0; i < n; i++ {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		if group > 1 && i % group == 0 {
+			sb.WriteString("(")
+		}
+		if self.numbered {
+			sb.WriteString(fmt.Sprintf("$%d",start+i))
+		} else {
+			sb.WriteString("?")
+		}
+		if group > 1 && i % group == group-1 {
+			sb.WriteString(")")
+		}
+	}
+	return sb.String()
+}
+
+// sqlQuerier is satisfied by both sql.DB and sql.Tx
+type sqlQuerier interface {
+	QueryContext(context.Context,string,...interface{}) (*sql.Rows,error)
+	QueryRowContext(context.Context,string,...interface{}) *sql.Row
+}
+
+// sqlGet retrieves and deserializes the value for the given key
+func sqlGet(q sqlQuerier, table *SQLTable, key string, s Serialize) error {
+	var v []byte
+	query := "SELECT v FROM "+table.name+" WHERE k = "+table.dialect.placeholders(1,1,1)
+	err := q.QueryRowContext(table.ctx,query,[]byte(key)).Scan(&v)
+	if err == sql.ErrNoRows {
+		return EKEYNOTFOUND
+	}
+	if err != nil {
+		return err
+	}
+	return s.From(bytes.NewBuffer(v))
+}
+
+// sqlNewIterator translates a range iteration into a query
+func sqlNewIterator(q sqlQuerier, table *SQLTable, opts IteratorOptions) (Iterator,error) {
+	iter := new(SQLIterator)
+	iter.q = q
+	iter.table = table
+	iter.opts = opts
+	err := iter.query([]byte(opts.Start),[]byte(opts.Limit),false)
+	if err != nil {
+		return nil,err
+	}
+	return iter,nil
+}
+
+type SQLIterator struct {
+	q sqlQuerier
+	table *SQLTable
+	opts IteratorOptions
+	rows *sql.Rows
+	key []byte
+	value []byte
+	err error
+}
+
+// query runs the query for keys from start up to end, ending at end if
+// inclusive is set. Empty start and end are unbounded.
+func (self *SQLIterator) query(start []byte, end []byte, inclusive bool) error {
+	query := "SELECT k,v FROM "+self.table.name
+	if self.opts.KeysOnly {
+		query = "SELECT k FROM "+self.table.name
+	}
+	var conds []string
+	var args []interface{}
+	if len(start) > 0 {
+		args = append(args,start)
+		conds = append(conds,"k >= "+self.table.dialect.placeholders(len(args),1,1))
+	}
+	if len(end) > 0 {
+		args = append(args,end)
+		op := "k < "
+		if inclusive {
+			op = "k <= "
+		}
+		conds = append(conds,op+self.table.dialect.placeholders(len(args),1,1))
+	}
+	if len(conds) > 0 {
+		query += " WHERE "+strings.Join(conds," AND ")
+	}
+	query += " ORDER BY k"
+	if self.opts.Reverse {
+		query += " DESC"
+	}
+	rows,err := self.q.QueryContext(self.table.ctx,query,args...)
+	if err != nil {
+		return err
+	}
+	self.rows = rows
+	return nil
+}
+
+// Next moves to the next row, closing the result set once there are no more
+func (self *SQLIterator) Next() (bool) {
+	if self.rows == nil {
+		return false
+	}
+	if self.rows.Next() {
+		if self.opts.KeysOnly {
+			self.err = self.rows.Scan(&self.key)
+		} else {
+			self.err = self.rows.Scan(&self.key,&self.value)
+		}
+		return self.err == nil
+	}
+	self.err = self.rows.Err()
+	self.rows.Close()
+	self.rows = nil
+	self.key,self.value = nil,nil
+	return false
+}
+
+// Seek runs a new query starting from the given key and moves to its first row
+func (self *SQLIterator) Seek(key string) (bool) {
+	if self.rows != nil {
+		self.rows.Close()
+		self.rows = nil
+	}
+	var err error
+	switch {
+		case self.opts.Reverse && (self.opts.Limit == "" || key < self.opts.Limit):
+			err = self.query([]byte(self.opts.Start),[]byte(key),true)
+		case self.opts.Reverse:
+			err = self.query([]byte(self.opts.Start),[]byte(self.opts.Limit),false)
+		case key > self.opts.Start:
+			err = self.query([]byte(key),[]byte(self.opts.Limit),false)
+		default:
+			err = self.query([]byte(self.opts.Start),[]byte(self.opts.Limit),false)
+	}
+	if err != nil {
+		self.err = err
+		return false
+	}
+	return self.Next()
+}
+
+// Key returns the current key
+func (self *SQLIterator) Key() (string) {
+	return string(self.key)
+}
+
+// Value deserializes the current value into the given struct
+func (self *SQLIterator) Value(s Serialize) {
+	if self.opts.KeysOnly {
+		self.err = EKEYSONLY
+		return
+	}
+	if self.value == nil {
+		return
+	}
+	self.err = s.From(bytes.NewBuffer(self.value))
+}
+
+// Error reports any error from the query or last call to Value
+func (self *SQLIterator) Error() error {
+	return self.err
+}
+
+// Release closes the result set
+func (self *SQLIterator) Release() error {
+	if self.rows != nil {
+		self.rows.Close()
+		self.rows = nil
+	}
+	return self.err
+}
+
+// SQLSnapshot is a read-only repeatable read transaction
+type SQLSnapshot struct {
+	tx *sql.Tx
+	table *SQLTable
+}
+
+// Release ends the transaction
+func (self *SQLSnapshot) Release() error {
+	return self.tx.Rollback()
+}
+
+// Get retrieves value for given key as it was when the snapshot was taken
+func (self *SQLSnapshot) Get(key string,s Serialize) error {
+	return sqlGet(self.tx,self.table,key,s)
+}
+
+// NewIterator creates an iterator over entries as they were when the snapshot was taken
+func (self *SQLSnapshot) NewIterator(prefix string) (Iterator,error) {
+	return sqlNewIterator(self.tx,self.table,PrefixRange(prefix))
+}
+
+// NewRangeIterator creates an iterator over the given range as it was when the snapshot was taken
+func (self *SQLSnapshot) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	return sqlNewIterator(self.tx,self.table,opts)
+}
+
+type sqlOp struct {
+	key []byte
+	value []byte
+	delete bool
+}
+
+// SQLBatchWrite collects writes and applies them in a single transaction
+// using multi-row statements
+type SQLBatchWrite struct {
+	ops []sqlOp
+	table *SQLTable
+	batchSize int
+}
+
+// Put adds a put to the batch
+func (self *SQLBatchWrite) Put(key string, s Serialize) error {
+	var buff bytes.Buffer
+	err := s.To(&buff)
+	if err != nil {
+		return err
+	}
+	self.ops = append(self.ops,sqlOp{key:[]byte(key),value:buff.Bytes()})
+	return self.write(false)
+}
+
+// Delete adds a delete to the batch
+func (self* SQLBatchWrite) Delete(key string) error {
+	self.ops = append(self.ops,sqlOp{key:[]byte(key),delete:true})
+	return self.write(false)
+}
+
+// Release forces write of any remaining data in the current batch
+func (self* SQLBatchWrite) Release() error {
+	return self.write(true)
+}
+
+// write provides convenient way to write in batches of fixed size
+func (self* SQLBatchWrite) write(flush bool) error {
+	if len(self.ops) == 0 || (!flush && len(self.ops) < self.batchSize) {
+		return nil
+	}
+	err := self.table.apply(self.ops)
+	self.ops = self.ops[:0]
+	return err
+}
+
+// SQLTable stores a table as an SQL table of (key,value) rows
+type SQLTable struct {
+	ctx context.Context
+	db *sql.DB
+	name string
+	dialect sqlDialect
+}
+
+// apply applies the given writes in order in a single transaction. Consecutive
+// puts and consecutive deletes are combined into multi-row statements.
+func (self *SQLTable) apply(ops []sqlOp) error {
+	tx,err := self.db.BeginTx(self.ctx,nil)
+	if err != nil {
+		return err
+	}
+	for i:=0; i < len(ops); {
+
+		// Find run of operations of the same kind, keeping only the
+		// last put for each key
+		j := i
+		seen := make(map[string]int)
+		var args []interface{}
+		width := 2
+		if ops[i].delete {
+			width = 1
+		}
+		for ; j < len(ops) && ops[j].delete == ops[i].delete && len(args) < sqlMaxRowsPerStatement*width; j++ {
+			if n,exists := seen[string(ops[j].key)]; exists {
+				if !ops[j].delete {
+					args[n+1] = ops[j].value
+				}
+				continue
+			}
+			if ops[j].delete {
+				seen[string(ops[j].key)] = len(args)
+				args = append(args,ops[j].key)
+			} else {
+				seen[string(ops[j].key)] = len(args)
+				args = append(args,ops[j].key,ops[j].value)
+			}
+		}
+
+		// Build and run statement
+		var query string
+		if ops[i].delete {
+			query = "DELETE FROM "+self.name+" WHERE k IN ("+self.dialect.placeholders(1,len(args),1)+")"
+		} else {
+			query = "INSERT INTO "+self.name+" (k,v) VALUES "+self.dialect.placeholders(1,len(args),2)+" "+self.dialect.upsert
+		}
+		_,err = tx.ExecContext(self.ctx,query,args...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		i = j
+	}
+	return tx.Commit()
+}
+
+// Get retrieves and deserializes the value for the given key
+func (self *SQLTable) Get(key string,s Serialize) error {
+	return sqlGet(self.db,self,key,s)
+}
+
+// Put stores the value for the given key, replacing any existing value
+func (self *SQLTable) Put(key string, s Serialize) error {
+	var buff bytes.Buffer
+	err := s.To(&buff)
+	if err != nil {
+		return err
+	}
+	return self.apply([]sqlOp{sqlOp{key:[]byte(key),value:buff.Bytes()}})
+}
+
+// Swap replaces the value for the given key if it is unchanged. An update
+// conditional on the previous value, or an insert that fails if the key
+// already exists, makes the swap atomic on every engine.
+func (self *SQLTable) Swap(key string, was Serialize, s Serialize) error {
+	old,err := serialized(was)
+	if err != nil {
+		return err
+	}
+	value,err := serialized(s)
+	if err != nil {
+		return err
+	}
+	if was == nil {
+		query := "INSERT INTO "+self.name+" (k,v) VALUES "+self.dialect.placeholders(1,2,2)
+		_,err = self.db.ExecContext(self.ctx,query,[]byte(key),value)
+		if err != nil && sqlGet(self.db,self,key,&rawValue{}) == nil {
+			return ESWAPFAILED
+		}
+		return err
+	}
+	query := "UPDATE "+self.name+" SET v = "+self.dialect.placeholders(1,1,1)+" WHERE k = "+
+		self.dialect.placeholders(2,1,1)+" AND v = "+self.dialect.placeholders(3,1,1)
+	result,err := self.db.ExecContext(self.ctx,query,value,[]byte(key),old)
+	if err != nil {
+		return err
+	}
+	n,err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// Some engines report no rows affected when the value is unchanged
+		var stored rawValue
+		if bytes.Equal(old,value) && sqlGet(self.db,self,key,&stored) == nil && bytes.Equal(stored.b,old) {
+			return nil
+		}
+		return ESWAPFAILED
+	}
+	return nil
+}
+
+// Delete removes the value for the given key
+func (self *SQLTable) Delete(key string) error {
+	return self.apply([]sqlOp{sqlOp{key:[]byte(key),delete:true}})
+}
+
+// NewIterator creates an iterator over all entries with the given prefix
+func (self *SQLTable) NewIterator(prefix string) (Iterator,error) {
+	return sqlNewIterator(self.db,self,PrefixRange(prefix))
+}
+
+// NewRangeIterator creates an iterator over all entries in the given range
+func (self *SQLTable) NewRangeIterator(opts IteratorOptions) (Iterator,error) {
+	return sqlNewIterator(self.db,self,opts)
+}
+
+// TakeSnapshot maps a snapshot on to a read-only repeatable read transaction. A
+// first read is made straight away as some engines only fix the view of the data
+// at that point.
+func (self *SQLTable) TakeSnapshot() (Snapshot,error) {
+	tx,err := self.db.BeginTx(self.ctx,&sql.TxOptions{Isolation:sql.LevelRepeatableRead,ReadOnly:true})
+	if err != nil {
+		return nil,err
+	}
+	var n int
+	err = tx.QueryRowContext(self.ctx,"SELECT COUNT(*) FROM "+self.name+" WHERE 1=0").Scan(&n)
+	if err != nil {
+		tx.Rollback()
+		return nil,err
+	}
+	ss := new(SQLSnapshot)
+	ss.tx = tx
+	ss.table = self
+	return ss,nil
+}
+
+// MakeBatch creates a new batch object for batch writes
+func (self* SQLTable) MakeBatch(batchSize int) (BatchWrite,error) {
+	sb := new(SQLBatchWrite)
+	sb.table=self
+	sb.batchSize=batchSize
+	if sb.batchSize < 1 {
+		sb.batchSize = 1
+	}
+	sb.ops = make([]sqlOp,0,sb.batchSize)
+	return sb,nil
+}
+
+// SQLDB is a Database on any engine with a database/sql driver. Each table
+// is an SQL table of the same name holding (key,value blob) rows.
+type SQLDB struct
+{
+	ctx context.Context
+	db *sql.DB
+	dialect sqlDialect
+	tables map[string]*SQLTable
+	mux sync.Mutex
+}
+
+// NewSQLDB connects to the database with the given driver and data source
+// name. The driver must be registered by the program, for example with a blank
+// import. SQLite databases are opened in WAL mode with a busy timeout unless the
+// data source name says otherwise. Returns nil if the database cannot be reached.
+func NewSQLDB(driverName string, dataSourceName string) *SQLDB {
+	if driverName == "sqlite3" {
+		dataSourceName = sqliteDataSource(dataSourceName)
+	}
+	sdb,err := sql.Open(driverName,dataSourceName)
+	if err != nil {
+		return nil
+	}
+	db := new(SQLDB)
+	db.ctx = context.Background()
+	err = sdb.PingContext(db.ctx)
+	if err != nil {
+		sdb.Close()
+		return nil
+	}
+	db.db = sdb
+	db.dialect = sqlDialects["sqlite3"]
+	if d,exists := sqlDialects[driverName]; exists {
+		db.dialect = d
+	}
+	db.tables = make(map[string]*SQLTable)
+	return db
+}
+
+// sqliteDataSource returns the given sqlite3 data source name with any of
+// sqliteOptions it doesnt set added
+func sqliteDataSource(dsn string) string {
+	for _,o := range sqliteOptions {
+		if strings.Contains(dsn,o[:strings.Index(o,"=")+1]) {
+			continue
+		}
+		if strings.Contains(dsn,"?") {
+			dsn += "&"+o
+		} else {
+			dsn += "?"+o
+		}
+	}
+	return dsn
+}
+
+// exists returns true if the named table exists
+func (self *SQLDB) exists(name string) bool {
+	rows,err := self.db.QueryContext(self.ctx,"SELECT k FROM "+name+" WHERE 1=0")
+	if err != nil {
+		return false
+	}
+	rows.Close()
+	return true
+}
+
+// newTable returns the SQLTable instance for the named table
+func (self *SQLDB) newTable(name string) *SQLTable {
+	if self.tables[name] == nil {
+		t := new(SQLTable)
+		t.ctx = self.ctx
+		t.db = self.db
+		t.name = name
+		t.dialect = self.dialect
+		self.tables[name] = t
+	}
+	return self.tables[name]
+}
+
+// OpenTable returns the table with the given name if it exists
+func (self *SQLDB) OpenTable(name string) (Table,error) {
+	if !validSQLTableName.MatchString(name) {
+		return nil,EINVALIDTABLENAME
+	}
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if self.tables[name] == nil && !self.exists(name) {
+		return nil,ETABLENOTFOUND
+	}
+	return self.newTable(name),nil
+}
+
+// CloseTable forgets the table instance. The table is retained in the database.
+func (self *SQLDB) CloseTable(name string) error {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if self.tables[name] == nil {
+		return ETABLENOTFOUND
+	}
+	delete(self.tables,name)
+	return nil
+}
+
+// DropTable drops the table and all its contents
+func (self *SQLDB) DropTable(name string) error {
+	if !validSQLTableName.MatchString(name) {
+		return EINVALIDTABLENAME
+	}
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if !self.exists(name) {
+		return ETABLENOTFOUND
+	}
+	_,err := self.db.ExecContext(self.ctx,"DROP TABLE "+name)
+	if err != nil {
+		return err
+	}
+	delete(self.tables,name)
+	return nil
+}
+
+// Release closes the connection pool. To ensure resource clean-up it must be
+// called once the SQLDB instance is finished with.
+func (self *SQLDB) Release() error {
+	return self.db.Close()
+}
+
+// CreateTable creates a new SQL table for the given table name
+func (self *SQLDB) CreateTable(name string) (Table,error) {
+	if !validSQLTableName.MatchString(name) {
+		return nil,EINVALIDTABLENAME
+	}
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	if self.exists(name) {
+		return nil,ETABLEALREADYEXISTS
+	}
+	ddl := "CREATE TABLE "+name+" (k "+self.dialect.keyType+" PRIMARY KEY, v "+self.dialect.valueType+" NOT NULL)"
+	_,err := self.db.ExecContext(self.ctx,ddl)
+	if err != nil {
+		return nil,EFAILED
+	}
+	return self.newTable(name),nil
+}
+
+// CompactTable reclaims space freed by deletes and updates. SQLite can only
+// vacuum the whole database file.
+func (self *SQLDB) CompactTable(name string) error {
+	if !validSQLTableName.MatchString(name) {
+		return EINVALIDTABLENAME
+	}
+	if !self.exists(name) {
+		return ETABLENOTFOUND
+	}
+	stmt := self.dialect.compact
+	if strings.Contains(stmt,"%s") {
+		stmt = fmt.Sprintf(stmt,name)
+	}
+	_,err := self.db.ExecContext(self.ctx,stmt)
+	return err
+}
+
+// TableStats counts the rows in a table and the bytes held by their keys and values
+func (self *SQLDB) TableStats(name string) (TableStats,error) {
+	if !validSQLTableName.MatchString(name) {
+		return TableStats{},EINVALIDTABLENAME
+	}
+	if !self.exists(name) {
+		return TableStats{},ETABLENOTFOUND
+	}
+	var stats TableStats
+	row := self.db.QueryRowContext(self.ctx,"SELECT COUNT(*), COALESCE(SUM(LENGTH(k)+LENGTH(v)),0) FROM "+name)
+	err := row.Scan(&stats.Entries,&stats.Size)
+	return stats,err
+}
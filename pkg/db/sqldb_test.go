@@ -0,0 +1,196 @@
+package db
+
+import (
+	"testing"
+	"os"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var SQLDBFILE="sqltest.db"
+
+func setupSQL(t *testing.T) *SQLDB {
+	db := NewSQLDB("sqlite3","file:"+SQLDBFILE)
+	if db == nil {
+		t.Error("Failed to create db object")
+	}
+	return db
+}
+
+func teardownSQL(db *SQLDB) {
+	db.Release()
+	os.Remove(SQLDBFILE)
+	os.Remove(SQLDBFILE+"-wal")
+	os.Remove(SQLDBFILE+"-shm")
+}
+
+func TestSQLCreateTable(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestCreateTable(db,t)
+}
+
+func TestSQLOpenTable(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestOpenTable(db,t)
+}
+
+func TestSQLPutGet(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestPutGet(db,t)
+}
+
+func TestSQLDropTable(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestDropTable(db,t)
+	_,err := db.OpenTable("songs")
+	if err == nil {
+		t.Error("Dropped table is still there")
+	}
+}
+
+func TestSQLDelete(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestDelete(db,t)
+}
+
+func TestSQLIterate(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestIterate(db,t)
+}
+
+func TestSQLIterateSnapshot(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestIterateSnapshot(db,t)
+}
+
+func TestSQLIterateSnapshotPrefixEmpty(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestIterateSnapshotPrefixEmpty(db,t)
+}
+
+func TestSQLIterateSnapshotASCII(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestIterateSnapshotASCII(db,t)
+}
+
+func TestSQLIteratePrefix(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestIteratePrefix(db,t)
+}
+
+func TestSQLIteratePrefixEmpty(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestIteratePrefixEmpty(db,t)
+}
+
+func TestSQLBatchWrite(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestBatchWrite(db,t)
+}
+
+func TestSQLInvalidTableName(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	_,err := db.CreateTable("songs; DROP TABLE songs")
+	if err != EINVALIDTABLENAME {
+		t.Error("Accepted invalid table name",err)
+	}
+}
+
+func TestSQLBatchWriteSameKey(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	table,_ := db.CreateTable("songs")
+	bw,_ := table.MakeBatch(10)
+	bw.Put("The Kinks",&Song{title:"Lola"})
+	bw.Put("The Kinks",&Song{title:"Waterloo Sunset"})
+	bw.Delete("The Kinks")
+	bw.Put("The Kinks",&Song{title:"Sitting in My Hotel"})
+	err := bw.Release()
+	if err != nil {
+		t.Error("Failed to write batch",err)
+	}
+	var sOut Song
+	err = table.Get("The Kinks",&sOut)
+	if err != nil || sOut.title != "Sitting in My Hotel" {
+		t.Error("Batch not applied in order",sOut.title,err)
+	}
+}
+
+func TestSQLBatchDeleteSameKey(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	table,_ := db.CreateTable("songs")
+	table.Put("The Kinks",&Song{title:"Lola"})
+	bw,_ := table.MakeBatch(50000)
+	for i:=0; i < 40000; i++ {
+		bw.Delete("The Kinks")
+	}
+	err := bw.Release()
+	if err != nil {
+		t.Error("Failed to write batch of repeated deletes",err)
+	}
+	var sOut Song
+	err = table.Get("The Kinks",&sOut)
+	if err != EKEYNOTFOUND {
+		t.Error("Repeated deletes not applied",err)
+	}
+}
+
+func TestSQLiteDataSource(t *testing.T) {
+	for _,c := range []struct{dsn string; expected string}{
+		{"file:flap.sqlite","file:flap.sqlite?_journal_mode=WAL&_busy_timeout=5000"},
+		{"file:flap.sqlite?cache=shared","file:flap.sqlite?cache=shared&_journal_mode=WAL&_busy_timeout=5000"},
+		{"file:flap.sqlite?_journal_mode=DELETE","file:flap.sqlite?_journal_mode=DELETE&_busy_timeout=5000"}} {
+		if dsn := sqliteDataSource(c.dsn); dsn != c.expected {
+			t.Error("Wrong sqlite data source name",c.dsn,dsn)
+		}
+	}
+}
+
+func TestSQLIterateRange(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestIterateRange(db,t)
+}
+
+func TestSQLIterateRangeSnapshot(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestIterateRangeSnapshot(db,t)
+}
+
+func TestSQLIterateSeek(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestIterateSeek(db,t)
+}
+
+func TestSQLIterateKeysOnly(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestIterateKeysOnly(db,t)
+}
+
+func TestSQLCompactStats(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestCompactStats(db,t)
+}
+
+func TestSQLSwap(t *testing.T) {
+	db := setupSQL(t)
+	defer teardownSQL(db)
+	dotestSwap(db,t)
+}
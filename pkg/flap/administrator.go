@@ -10,6 +10,7 @@ type Administrator struct {
 	predictor predictor
 	pc promisesCorrection
 	bs backfillState
+	events *EventLog
 }
 
 // newAdministrators creates an instance of Administrator, for
@@ -117,13 +118,6 @@ func (self *Administrator) SetParams(params FlapParams) error {
 	if (params.Promises.Algo != paNone && params.Promises.MaxPoints <=0) {
 		return EINVALIDFLAPPARAMS
 	}
-	var bits int
-	for n:=params.Threads; n != 0 ; n=n & (n-1) {
-		bits++;
-	}
-	if bits >  1 || params.Threads > 16 {
-		return EINVALIDFLAPPARAMS
-	}
 
 	// Check for promises config change and create new predictor
 	algoOld := self.params.Promises.Algo
@@ -131,7 +125,7 @@ func (self *Administrator) SetParams(params FlapParams) error {
 	if params.Promises.Algo != algoOld {
 		self.createPredictor()
 	}
-	return nil
+	return self.events.record(Event{Type:ETSetParams,Params:params})
 }
 
 // createPredictor creates predictor of the configured type
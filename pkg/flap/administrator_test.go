@@ -13,7 +13,7 @@ func setupAdmin(t *testing.T) *db.LevelDB{
 	if err := os.Mkdir(ADMINTESTFOLDER, 0700); err != nil {
 		t.Error("Failed to create test dir", err)
 	}
-	return db.NewLevelDB(ADMINTESTFOLDER)
+	return db.NewLevelDB(ADMINTESTFOLDER,db.LevelDBOptions{})
 } 
 
 func teardownAdmin(db *db.LevelDB) {
@@ -190,3 +190,38 @@ func TestPolyBestFitPredictor(t *testing.T) {
 	}
 }
 
+
+func TestSaveFault(t *testing.T) {
+
+	fdb := db.NewFaultDB(db.NewMemoryDB())
+	defer fdb.Release()
+
+	admin := newAdministrator(fdb)
+	if admin == nil {
+		t.Error("Failed to create administrator")
+		return
+	}
+
+	// Fail the write of the backfill state after the params have been saved
+	fdb.AddRule(db.FaultRule{Op:db.FOPut,Table:adminTableName,Prefix:backfillRecordKey,Times:1})
+	admin.params.DailyTotal=50
+	admin.bs.totalGrounded=10
+	err := admin.Save()
+	if err != db.EINJECTEDFAULT {
+		t.Error("Save didnt report failed write",err)
+	}
+	admin2 := newAdministrator(fdb)
+	if admin2.params.DailyTotal != 50 || admin2.bs.totalGrounded != 0 {
+		t.Error("Wrong state loaded after failed save",admin2.params.DailyTotal,admin2.bs.totalGrounded)
+	}
+
+	// Saving again stores everything
+	err = admin.Save()
+	if err != nil {
+		t.Error("Save failed after fault",err)
+	}
+	admin2 = newAdministrator(fdb)
+	if admin2.params.DailyTotal != 50 || admin2.bs.totalGrounded != 10 {
+		t.Error("Failed to load state saved after fault",admin2.params.DailyTotal,admin2.bs.totalGrounded)
+	}
+}
@@ -14,7 +14,7 @@ func setup(t *testing.T) *db.LevelDB{
 	if err := os.Mkdir(AIRPORTSTESTFOLDER, 0700); err != nil {
 		t.Error("Failed to create test dir", err)
 	}
-	return db.NewLevelDB(AIRPORTSTESTFOLDER)
+	return db.NewLevelDB(AIRPORTSTESTFOLDER,db.LevelDBOptions{})
 } 
 
 func teardown(db *db.LevelDB) {
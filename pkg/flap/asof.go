@@ -0,0 +1,139 @@
+package flap
+
+import (
+	"github.com/richardmorrey/flap/pkg/db"
+	"errors"
+)
+
+var ENOEVENTLOG = errors.New("Engine isnt recording events")
+var ENODAYLEDGER = errors.New("No ledger for day backfilled")
+
+// TravellerState is a traveller's account as it stood at a given time, with the
+// clearance they had then and the promises not yet cleared
+type TravellerState struct {
+	Traveller
+	At		EpochTime
+	Clearance	ClearanceReason
+	Active		[]Promise
+}
+
+// TravellerAsOf reconstructs the account of the traveller with the given passport as it stood
+// at the given time. The traveller's record only keeps their most recent transactions, flights
+// and promises, so instead the commands recorded for the traveller in the event log are carried
+// out again in order on an empty record, crediting the share recorded in the ledger for each day
+// backfilled. The engine must have been recording events from the start. Returns
+// db.EKEYNOTFOUND if the traveller didnt exist at the time.
+func (self *Engine) TravellerAsOf(passport Passport, at EpochTime) (TravellerState,error) {
+	var ts TravellerState
+	if self.events == nil {
+		return ts,ENOEVENTLOG
+	}
+	events,err := self.events.travellerEvents(passport,at)
+	if err != nil {
+		return ts,err
+	}
+
+	// Carry out the traveller's commands, and the daily update for each day they were
+	// listed in an index
+	var t *Traveller
+	var params FlapParams
+	var exemptions []Exemption
+	var backfilled EpochTime
+	listed := false
+	for _,e := range events {
+		day := EpochTime(0)
+		wrote := true
+		if !e.wellFormed() {
+			logInfo("Event ",e.Seq," is malformed")
+			return ts,EREPLAYDIVERGED
+		}
+		switch e.Type {
+			case ETSetParams:
+				params = e.Params
+				wrote = false
+			case ETPropose,ETSetHousehold:
+				wrote = false
+			case ETGrantExemption:
+				exemptions = append(exemptions,e.Exemption)
+				wrote = false
+			case ETRevokeExemption:
+				id := e.Exemption.ID
+				if id == 0 || id > uint64(len(exemptions)) {
+					err = ENOEXEMPTION
+				} else {
+					revoke(&exemptions[id-1],e.Time)
+				}
+				wrote = false
+			case ETSubmitFlights:
+				if t == nil {
+					t = &Traveller{passport:passport,Created:e.Time}
+				}
+				err = t.submitFlights(e.Flights,e.Time,&params,e.Debit,nil,activeExemption(exemptions,e.Time))
+			case ETMake:
+				if t == nil {
+					t = &Traveller{passport:passport,Created:e.Time}
+				}
+				copy(t.Promises.entries[:],e.Promises)
+			case ETAllocate,ETSubmitHouseholdFlights,ETTransfer:
+				i := e.member(passport)
+				if i < 0 {
+					continue
+				}
+				if t == nil {
+					t = &Traveller{passport:passport,Created:e.Time}
+				}
+				if e.Amounts[i] != 0 {
+					tt := TTHouseholdPool
+					switch e.Type {
+						case ETAllocate:
+							tt = TTHouseholdAllocation
+						case ETTransfer:
+							tt = TTTransfer
+					}
+					t.transact(e.Amounts[i],e.Time,tt)
+				}
+				if e.Type == ETSubmitHouseholdFlights {
+					err = t.submitFlights(e.Flights,e.Time,&params,e.Debit,nil,activeExemption(exemptions,e.Time))
+				}
+			case ETBackfill:
+				if t == nil || !listed || e.Time == backfilled {
+					continue
+				}
+				backfilled = e.Time
+				var dl dayLedger
+				err = self.Administrator.table.Get(dayLedgerKey(e.Time),&dl)
+				if err == db.EKEYNOTFOUND {
+					return ts,ENODAYLEDGER
+				}
+				if err != nil {
+					return ts,logError(err)
+				}
+				var us UpdateBackfillStats
+				t.dailyUpdate(&params,dl.Share,e.Time,&us)
+				day = e.Time
+		}
+		if err != nil {
+			logInfo("Replay of event ",e.Seq," failed: ",err)
+			return ts,EREPLAYDIVERGED
+		}
+		if wrote && t != nil {
+			listed = t.listed(day)
+		}
+	}
+	if t == nil {
+		return ts,db.EKEYNOTFOUND
+	}
+
+	// Report clearance and promises still to be cleared at the time
+	ts.Traveller = *t
+	ts.At = at
+	ts.Clearance = ts.Traveller.clearedWithin(at,params.Overdraft.limit(activeExemption(exemptions,at)))
+	it := ts.Traveller.Promises.NewIterator()
+	for it.Next() {
+		p := it.Value()
+		if p.Clearance > at {
+			ts.Active = append(ts.Active,p)
+		}
+	}
+	return ts,nil
+}
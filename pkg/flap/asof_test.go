@@ -0,0 +1,108 @@
+package flap
+
+import (
+	"testing"
+	"github.com/richardmorrey/flap/pkg/db"
+	"reflect"
+)
+
+func TestTravellerAsOfNow(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports,_ := recordEvents(t,database,NewEventLog(database))
+	for _,passport := range passports {
+		ts,err := engine.TravellerAsOf(passport,MaxEpochTime)
+		if err != nil {
+			t.Error("TravellerAsOf failed",err)
+		}
+		traveller,_ := engine.Travellers.GetTraveller(passport)
+		if !reflect.DeepEqual(ts.Traveller,traveller) {
+			t.Error("Traveller as of now differs from record",passport.ToString())
+		}
+		if ts.Clearance != traveller.Cleared(MaxEpochTime) {
+			t.Error("Clearance as of now differs",ts.Clearance)
+		}
+	}
+}
+
+func TestTravellerAsOfPast(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports,balances := recordEvents(t,database,NewEventLog(database))
+	at := EpochTime(SecondsInDay*7-1)
+	for _,passport := range passports {
+		ts,err := engine.TravellerAsOf(passport,at)
+		if err != nil {
+			t.Error("TravellerAsOf failed",err)
+		}
+		if ts.Balance != balances[passport] || ts.At != at {
+			t.Error("Balance as of day 6 wrong",passport.ToString(),ts.Balance,balances[passport])
+		}
+		if len(ts.Active) != 0 {
+			t.Error("Promise active before it was made",ts.Active)
+		}
+	}
+	ts,_ := engine.TravellerAsOf(passports[0],SecondsInDay*8)
+	if len(ts.Active) != 1 {
+		t.Error("Promises made on day 7 not active on day 8",ts.Active)
+	}
+	_,err := engine.TravellerAsOf(passports[0],SecondsInDay-1)
+	if err != db.EKEYNOTFOUND {
+		t.Error("Traveller found before they were created",err)
+	}
+}
+
+func TestTravellerAsOfRolledOver(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports,balances := recordEvents(t,database,NewEventLog(database))
+
+	// Fly enough to roll over every transaction kept in the record
+	for i:=0; i < MaxTransactions; i++ {
+		start := SecondsInDay*9+i*2
+		err := engine.SubmitFlights(passports[1],[]Flight{*createFlight(1,start,start+1)},SecondsInDay*9,true)
+		if err != nil {
+			t.Error("SubmitFlights failed",err)
+		}
+	}
+	traveller,_ := engine.Travellers.GetTraveller(passports[1])
+	if traveller.Transactions.entries[MaxTransactions-1].Date <= SecondsInDay*7 {
+		t.Error("Transactions didnt roll over")
+	}
+	ts,err := engine.TravellerAsOf(passports[1],SecondsInDay*7-1)
+	if err != nil || ts.Balance != balances[passports[1]] {
+		t.Error("Balance as of day 6 wrong after transactions rolled over",ts.Balance,balances[passports[1]],err)
+	}
+	if ts.Transactions.total() != ts.Balance {
+		t.Error("Transactions as of day 6 dont add up to balance",ts.Transactions.total(),ts.Balance)
+	}
+}
+
+func TestTravellerAsOfNoEvents(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine := NewEngine(database,0,"")
+	_,err := engine.TravellerAsOf(NewPassport("111111111","uk"),MaxEpochTime)
+	if err != ENOEVENTLOG {
+		t.Error("TravellerAsOf without event log didnt fail",err)
+	}
+}
+
+func TestTravellerAsOfUnknownExemption(t *testing.T) {
+	passport := NewPassport("111111111","uk")
+	for _,id := range []uint64{0,1} {
+		database := db.NewMemoryDB()
+		engine := NewEngine(database,0,"")
+		log := NewEventLog(database)
+		engine.RecordEvents(log)
+		err := log.append(Event{Type:ETRevokeExemption,Time:SecondsInDay,Passport:passport,Exemption:Exemption{ID:id}})
+		if err != nil {
+			t.Error("append failed",err)
+		}
+		_,err = engine.TravellerAsOf(passport,MaxEpochTime)
+		if err != EREPLAYDIVERGED {
+			t.Error("Revoking unknown exemption didnt report divergence",id,err)
+		}
+		database.Release()
+	}
+}
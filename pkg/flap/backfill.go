@@ -0,0 +1,374 @@
+package flap
+
+import (
+	"github.com/richardmorrey/flap/pkg/db"
+	"encoding/gob"
+	"encoding/hex"
+	"bytes"
+	"errors"
+	"context"
+	"sync"
+	"time"
+)
+
+var ENOBACKFILLRUN = errors.New("No distributed backfill in progress")
+
+// A distributed backfill splits the daily update and backfill between processes sharing
+// a database. The travellers are split into ranges by the first two hex digits of their
+// keys, each with a lease record in the administrator table. Workers claim a lease for a
+// limited time, update and backfill the range and then record it as done along with its
+// stats. If a worker dies its leases expire and the ranges are claimed by other workers.
+// Travellers are credited at most once a day so a range done twice does no harm. A worker
+// redoing a range finds its travellers already updated, so the stats of the first worker
+// to finish updating a range are kept, whether or not it still holds the lease.
+const backfillRunRecordKey="backfillrun"
+const backfillLeaseKeyPrefix="backfilllease"
+const backfillRanges=256
+
+// backfillRun describes the distributed backfill in progress
+type backfillRun struct {
+	Day	EpochTime
+	Params	FlapParams
+	Stats	UpdateBackfillStats
+}
+
+// To implements db/Serialize
+func (self* backfillRun) To(b *bytes.Buffer) error {
+	return gob.NewEncoder(b).Encode(self)
+}
+
+// From implements db/Serialize
+func (self* backfillRun) From(b *bytes.Buffer) error {
+	return gob.NewDecoder(b).Decode(self)
+}
+
+// backfillLease records the worker, if any, holding the lease on a range of
+// travellers and the stats for the range once Reported
+type backfillLease struct {
+	Day		EpochTime
+	Owner		string
+	Expires		int64
+	Done		bool
+	Reported	bool
+	Stats		UpdateBackfillStats
+}
+
+// To implements db/Serialize
+func (self* backfillLease) To(b *bytes.Buffer) error {
+	return gob.NewEncoder(b).Encode(self)
+}
+
+// From implements db/Serialize
+func (self* backfillLease) From(b *bytes.Buffer) error {
+	return gob.NewDecoder(b).Decode(self)
+}
+
+// storedLease is a lease as read from the administrator table. Swaps compare the
+// bytes stored, as gob encodings of the same lease can differ between processes.
+type storedLease struct {
+	raw []byte
+	backfillLease
+}
+
+// To implements db/Serialize
+func (self* storedLease) To(b *bytes.Buffer) error {
+	_,err := b.Write(self.raw)
+	return err
+}
+
+// From implements db/Serialize
+func (self* storedLease) From(b *bytes.Buffer) error {
+	self.raw = append(self.raw[:0],b.Bytes()...)
+	self.backfillLease = backfillLease{}
+	return self.backfillLease.From(bytes.NewBuffer(self.raw))
+}
+
+// claimable returns true if the lease can be claimed for the given run at the given time
+func (self *backfillLease) claimable(day EpochTime, at time.Time) bool {
+	return self.Day == day && !self.Done && (self.Owner == "" || self.Expires <= at.UnixNano())
+}
+
+// leaseKey returns the key of the lease record for the range of travellers with the given prefix
+func leaseKey(prefix byte) string {
+	return backfillLeaseKeyPrefix+hex.EncodeToString([]byte{prefix})
+}
+
+// BeginBackfill starts a backfill for the given day that workers in any process sharing
+// the database can take part in with WorkBackfill, calculating the backfill share as
+// UpdateTripsAndBackfill does. If a backfill for the same day has already been begun it
+// is carried on with, keeping any ranges already done.
+func (self *Engine) BeginBackfill(now EpochTime) (UpdateBackfillStats,error) {
+
+	// Check we are at start of day
+	ut := *NewUpdateBackfillStats()
+	if now % SecondsInDay != 0 {
+		return ut,EINVALIDARGUMENT
+	}
+
+	// Carry on with a backfill for the same day
+	var run backfillRun
+	err := self.Administrator.table.Get(backfillRunRecordKey,&run)
+	if err == nil && run.Day == now {
+		return run.Stats,nil
+	}
+
+	// Calculate backfill share
+	err = self.backfillShare(now,&ut)
+	if err != nil {
+		return ut,err
+	}
+
+	// Write leases and then the run, so that workers only see the run once
+	// all its leases are ready
+	for pc:=0; pc < backfillRanges; pc++ {
+		err = self.Administrator.table.Put(leaseKey(byte(pc)),&backfillLease{Day:now})
+		if err != nil {
+			return ut,logError(err)
+		}
+	}
+	run = backfillRun{Day:now,Params:self.Administrator.params,Stats:ut}
+	err = self.Administrator.table.Put(backfillRunRecordKey,&run)
+	if err != nil {
+		return ut,logError(err)
+	}
+	logInfo("Began distributed backfill for ",now.ToTime())
+	return ut,nil
+}
+
+// WorkBackfill claims leases on ranges of the backfill in progress, holding each for the
+// given time, and updates and backfills them until there are none left to claim, using
+// the number of threads in the FLAP parameters. It returns the number of ranges done.
+// A range must take less than the lease time or it may be claimed by another worker.
+func (self *Engine) WorkBackfill(ctx context.Context, worker string, lease time.Duration) (int,error) {
+
+	// Find backfill in progress
+	var run backfillRun
+	err := self.Administrator.table.Get(backfillRunRecordKey,&run)
+	if err == db.EKEYNOTFOUND {
+		return 0,ENOBACKFILLRUN
+	}
+	if err != nil {
+		return 0,logError(err)
+	}
+
+	// Claim ranges on each thread, starting at different ranges to avoid contention
+	threads := run.Params.backfillThreads()
+	type result struct {
+		done int
+		err error
+	}
+	results := make(chan result,threads)
+	var wg sync.WaitGroup
+	for i := uint(0); i < threads; i++ {
+		wg.Add(1)
+		go func(start int) {
+			done,err := self.workRanges(ctx,&run,worker,lease,start)
+			results <- result{done,err}
+			wg.Done()
+		}(int(i)*backfillRanges/int(threads))
+	}
+	wg.Wait()
+	close(results)
+
+	// Add up ranges done
+	var done int
+	for r := range results {
+		done += r.done
+		if r.err != nil {
+			err = r.err
+		}
+	}
+	return done,err
+}
+
+// workRanges makes a pass through the ranges, starting at the given one, claiming,
+// updating and backfilling each that is free
+func (self *Engine) workRanges(ctx context.Context, run *backfillRun, worker string, lease time.Duration, start int) (int,error) {
+	done := 0
+	for i:=0; i < backfillRanges && ctx.Err() == nil; i++ {
+
+		// Claim range if free
+		pc := byte((start+i) % backfillRanges)
+		key := leaseKey(pc)
+		var free storedLease
+		err := self.Administrator.table.Get(key,&free)
+		if err != nil {
+			return done,logError(err)
+		}
+		if !free.claimable(run.Day,time.Now()) {
+			continue
+		}
+		claimed := free.backfillLease
+		claimed.Owner = worker
+		claimed.Expires = time.Now().Add(lease).UnixNano()
+		err = self.Administrator.table.Swap(key,&free,&claimed)
+		if err == db.ESWAPFAILED {
+			continue
+		}
+		if err != nil {
+			return done,logError(err)
+		}
+
+		// Update and backfill range
+		ss,err := self.Travellers.TakeSnapshot()
+		if err != nil {
+			return done,logError(err)
+		}
+		prefixes := make(chan byte,1)
+		prefixes <- pc
+		close(prefixes)
+		us := self.updateSomeTravellers(ctx,prefixes,&run.Params,run.Stats.Share,run.Day,ss)
+		ss.Release()
+		if us.Err != nil {
+			return done,us.Err
+		}
+		if ctx.Err() != nil {
+			return done,ctx.Err()
+		}
+
+		// Record range as done, unless the lease expired and was claimed by another worker
+		held,err := self.reportRange(key,run.Day,us)
+		if err != nil {
+			return done,err
+		}
+		if held.Day != claimed.Day || held.Owner != claimed.Owner || held.Expires != claimed.Expires || held.Done {
+			logInfo("Lease lost by ",worker," for range ",key)
+			continue
+		}
+		completed := held.backfillLease
+		completed.Done = true
+		err = self.Administrator.table.Swap(key,&held,&completed)
+		if err == db.ESWAPFAILED {
+			logInfo("Lease lost by ",worker," for range ",key)
+			continue
+		}
+		if err != nil {
+			return done,logError(err)
+		}
+		done++
+	}
+	return done,ctx.Err()
+}
+
+// reportRange records the given stats in the lease for a range just updated, unless stats
+// for it have already been reported, returning the lease as it then is. A swap that fails
+// because the lease changed meanwhile is tried again.
+func (self *Engine) reportRange(key string, day EpochTime, us UpdateBackfillStats) (storedLease,error) {
+	for {
+		var held storedLease
+		err := self.Administrator.table.Get(key,&held)
+		if err != nil {
+			return held,logError(err)
+		}
+		if held.Day != day || held.Reported {
+			return held,nil
+		}
+		reported := held.backfillLease
+		reported.Reported = true
+		reported.Stats = us
+		err = self.Administrator.table.Swap(key,&held,&reported)
+		if err != nil && err != db.ESWAPFAILED {
+			return held,logError(err)
+		}
+	}
+}
+
+// CompleteBackfill works on the backfill in progress until every range is done, polling
+// at the given interval for ranges held by other workers and claiming any whose leases
+// expire. It then adds up the stats for all the ranges, stores the total number of grounded
+// travellers and the ledger for the day as UpdateTripsAndBackfill does and ends the backfill. If ctx is done first, or
+// if working on a range fails, the backfill is left in progress to be completed later.
+func (self *Engine) CompleteBackfill(ctx context.Context, worker string, lease time.Duration, poll time.Duration) (UpdateBackfillStats,error) {
+
+	// Find backfill in progress
+	var run backfillRun
+	err := self.Administrator.table.Get(backfillRunRecordKey,&run)
+	if err == db.EKEYNOTFOUND {
+		return UpdateBackfillStats{},ENOBACKFILLRUN
+	}
+	if err != nil {
+		return UpdateBackfillStats{},logError(err)
+	}
+
+	for {
+		// Work on any free ranges
+		_,err = self.WorkBackfill(ctx,worker,lease)
+		if err != nil {
+			return run.Stats,err
+		}
+
+		// Add up stats for ranges done
+		ut := run.Stats
+		ut.ClearedDistanceDeltas = nil
+		ut.ClearedDaysDeltas = nil
+		complete := true
+		for pc:=0; pc < backfillRanges; pc++ {
+			var l backfillLease
+			err = self.Administrator.table.Get(leaseKey(byte(pc)),&l)
+			if err != nil {
+				return run.Stats,logError(err)
+			}
+			if l.Day != run.Day || !l.Done {
+				complete = false
+				break
+			}
+			ut.add(&l.Stats)
+		}
+
+		// Store total grounded and end backfill once all ranges are done
+		if complete {
+			self.Administrator.bs.totalGrounded=ut.Grounded
+			err = self.Administrator.saveDayLedger(run.Day,&ut)
+			if err != nil {
+				return ut,logError(err)
+			}
+			err = self.Administrator.table.Delete(backfillRunRecordKey)
+			if err != nil {
+				return ut,logError(err)
+			}
+			logInfo("Completed distributed backfill for ",run.Day.ToTime())
+			return ut,self.events.record(Event{Type:ETBackfill,Time:run.Day})
+		}
+
+		// Wait for other workers
+		select {
+			case <-ctx.Done():
+				return run.Stats,ctx.Err()
+			case <-time.After(poll):
+		}
+	}
+}
+
+// UpdateTripsAndBackfillDistributed carries out UpdateTripsAndBackfill as a distributed
+// backfill, beginning it and then working on it alongside any other workers until it is
+// complete. Workers in other processes take part with ServeBackfill.
+func (self *Engine) UpdateTripsAndBackfillDistributed(ctx context.Context, now EpochTime, worker string, lease time.Duration, poll time.Duration) (UpdateBackfillStats,error) {
+	if ctx.Err() != nil {
+		return *NewUpdateBackfillStats(),ctx.Err()
+	}
+	ut,err := self.BeginBackfill(now)
+	if err != nil {
+		return ut,err
+	}
+	return self.CompleteBackfill(ctx,worker,lease,poll)
+}
+
+// ServeBackfill works on each distributed backfill as it is begun, polling at the
+// given interval, until ctx is done or working on a range fails
+func (self *Engine) ServeBackfill(ctx context.Context, worker string, lease time.Duration, poll time.Duration) error {
+	for {
+		done,err := self.WorkBackfill(ctx,worker,lease)
+		if err != nil && err != ENOBACKFILLRUN {
+			return err
+		}
+		if done > 0 {
+			logInfo(worker," completed ",done," backfill ranges")
+			continue
+		}
+		select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(poll):
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package flap
+
+import (
+	"testing"
+	"github.com/richardmorrey/flap/pkg/db"
+	"context"
+	"encoding/hex"
+	"math"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const BACKFILLTESTDB="backfilltest.sqlite"
+const backfillWorkerEnv="FLAP_BACKFILL_WORKER"
+
+// expectedBackfill returns the stats and balances from a backfill of the test travellers
+// in a single process
+func expectedBackfill(t *testing.T, n int, now EpochTime) (UpdateBackfillStats,map[Passport]Metres) {
+	engine,passports := backfillTravellers(t,db.NewMemoryDB(),n)
+	ut,err := engine.UpdateTripsAndBackfill(context.Background(),now)
+	if err != nil {
+		t.Error("UpdateTripsAndBackfill failed",err)
+	}
+	balances := make(map[Passport]Metres)
+	for _,passport := range passports {
+		traveller,_ := engine.Travellers.GetTraveller(passport)
+		balances[passport] = traveller.Balance
+	}
+	return ut,balances
+}
+
+// checkBackfill checks a distributed backfill matches a backfill in a single process
+func checkBackfill(t *testing.T, engine *Engine, ut UpdateBackfillStats, expectedUt UpdateBackfillStats, expected map[Passport]Metres, now EpochTime) {
+	if ut.Grounded != expectedUt.Grounded || ut.Processed != expectedUt.Processed || ut.Distance != expectedUt.Distance ||
+	   ut.Flights != expectedUt.Flights || ut.Share != expectedUt.Share {
+		t.Error("Distributed backfill returned wrong stats",ut,expectedUt)
+	}
+	if engine.Administrator.bs.totalGrounded != expectedUt.Grounded {
+		t.Error("Distributed backfill set wrong total grounded",engine.Administrator.bs.totalGrounded)
+	}
+	for passport,balance := range expected {
+		traveller,_ := engine.Travellers.GetTraveller(passport)
+		if dailyShares(&traveller,now) != 1 || traveller.Balance != balance {
+			t.Error("Traveller not credited exactly once",passport.ToString(),traveller.Balance,balance)
+		}
+	}
+	var run backfillRun
+	if engine.Administrator.table.Get(backfillRunRecordKey,&run) != db.EKEYNOTFOUND {
+		t.Error("Completed backfill still in progress")
+	}
+}
+
+func TestDistributedBackfill(t *testing.T) {
+	const n = 64
+	now := EpochTime(SecondsInDay*5)
+	expectedUt,expected := expectedBackfill(t,n,now)
+
+	// Backfill with a coordinator and two workers sharing a database
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,_ := backfillTravellers(t,database,n)
+	ctx,cancel := context.WithCancel(context.Background())
+	workers := make(chan error,2)
+	for _,worker := range []string{"worker1","worker2"} {
+		go func(worker string) {workers <- NewEngine(database,0,"").ServeBackfill(ctx,worker,time.Minute,time.Millisecond)}(worker)
+	}
+	ut,err := engine.UpdateTripsAndBackfillDistributed(context.Background(),now,"coordinator",time.Minute,time.Millisecond)
+	cancel()
+	for i:=0; i < 2; i++ {
+		if err := <-workers; err != context.Canceled {
+			t.Error("Worker failed",err)
+		}
+	}
+	if err != nil {
+		t.Error("UpdateTripsAndBackfillDistributed failed",err)
+	}
+	checkBackfill(t,engine,ut,expectedUt,expected,now)
+}
+
+func TestDistributedBackfillLeaseExpiry(t *testing.T) {
+	const n = 64
+	now := EpochTime(SecondsInDay*5)
+	expectedUt,expected := expectedBackfill(t,n,now)
+	engine,_ := backfillTravellers(t,db.NewMemoryDB(),n)
+	_,err := engine.BeginBackfill(now)
+	if err != nil {
+		t.Error("BeginBackfill failed",err)
+	}
+
+	// Claim a range for a worker that then dies
+	free := backfillLease{Day:now}
+	dead := backfillLease{Day:now,Owner:"dead",Expires:time.Now().Add(time.Hour).UnixNano()}
+	err = engine.Administrator.table.Swap(leaseKey(0x42),&free,&dead)
+	if err != nil {
+		t.Error("Failed to claim lease",err)
+	}
+	done,err := engine.WorkBackfill(context.Background(),"worker",time.Minute)
+	if err != nil || done != backfillRanges-1 {
+		t.Error("WorkBackfill claimed wrong ranges",done,err)
+	}
+
+	// Check the backfill cant complete until the lease expires
+	ctx,cancel := context.WithTimeout(context.Background(),time.Millisecond*20)
+	defer cancel()
+	_,err = engine.CompleteBackfill(ctx,"coordinator",time.Minute,time.Millisecond)
+	if err != context.DeadlineExceeded {
+		t.Error("CompleteBackfill didnt wait for leased range",err)
+	}
+	expired := dead
+	expired.Expires = time.Now().UnixNano()
+	err = engine.Administrator.table.Swap(leaseKey(0x42),&dead,&expired)
+	if err != nil {
+		t.Error("Failed to expire lease",err)
+	}
+	ut,err := engine.CompleteBackfill(context.Background(),"coordinator",time.Minute,time.Millisecond)
+	if err != nil {
+		t.Error("CompleteBackfill failed",err)
+	}
+	checkBackfill(t,engine,ut,expectedUt,expected,now)
+}
+
+func TestDistributedBackfillLeaseLost(t *testing.T) {
+	const n = 64
+	now := EpochTime(SecondsInDay*4)
+
+	// Short trips so that yesterday's flights end them, leaving nothing for a
+	// second update of a traveller to report
+	params := FlapParams{DailyTotal:100, MinGrounded:1,FlightInterval:1,FlightsInTrip:50,TripLength:2,Threads:4}
+	expectedEngine,_ := backfillTravellers(t,db.NewMemoryDB(),n)
+	expectedEngine.Administrator.SetParams(params)
+	expectedUt,err := expectedEngine.UpdateTripsAndBackfill(context.Background(),now)
+	if err != nil {
+		t.Error("UpdateTripsAndBackfill failed",err)
+	}
+	engine,passports := backfillTravellers(t,db.NewMemoryDB(),n)
+	engine.Administrator.SetParams(params)
+	_,err = engine.BeginBackfill(now)
+	if err != nil {
+		t.Error("BeginBackfill failed",err)
+	}
+
+	// A worker updates the range of a traveller and reports it, but its lease
+	// expires before it is marked done
+	key,_ := passports[0].generateKey()
+	prefix,_ := hex.DecodeString(key[:2])
+	free := backfillLease{Day:now}
+	slow := backfillLease{Day:now,Owner:"slow",Expires:time.Now().UnixNano()}
+	err = engine.Administrator.table.Swap(leaseKey(prefix[0]),&free,&slow)
+	if err != nil {
+		t.Error("Failed to claim lease",err)
+	}
+	var run backfillRun
+	engine.Administrator.table.Get(backfillRunRecordKey,&run)
+	ss,_ := engine.Travellers.TakeSnapshot()
+	prefixes := make(chan byte,1)
+	prefixes <- prefix[0]
+	close(prefixes)
+	us := engine.updateSomeTravellers(context.Background(),prefixes,&run.Params,run.Stats.Share,now,ss)
+	ss.Release()
+	if us.Err != nil || us.Processed == 0 {
+		t.Error("Range not updated",us.Processed,us.Err)
+	}
+	_,err = engine.reportRange(leaseKey(prefix[0]),now,us)
+	if err != nil {
+		t.Error("reportRange failed",err)
+	}
+
+	// Check the stats from the first update are kept when the range is redone
+	ut,err := engine.CompleteBackfill(context.Background(),"coordinator",time.Minute,time.Millisecond)
+	if err != nil {
+		t.Error("CompleteBackfill failed",err)
+	}
+	if ut.Travellers != expectedUt.Travellers || math.Abs(float64(ut.Distance-expectedUt.Distance)) > 1e-6 || ut.Flights != expectedUt.Flights ||
+	   ut.Processed != expectedUt.Processed || expectedUt.Travellers == 0 {
+		t.Error("Stats for redone range lost",ut,expectedUt)
+	}
+}
+
+func TestDistributedBackfillRepeated(t *testing.T) {
+	const n = 64
+	now := EpochTime(SecondsInDay*5)
+	expectedUt,expected := expectedBackfill(t,n,now)
+	fdb := db.NewFaultDB(db.NewMemoryDB())
+	defer fdb.Release()
+	engine,_ := backfillTravellers(t,fdb,n)
+
+	// Fail claiming or marking a range done part way through, with leases that
+	// expire straight away so that the range can be claimed again
+	fdb.AddRule(db.FaultRule{Op:db.FOSwap,Table:adminTableName,After:backfillRanges,Times:1})
+	_,err := engine.UpdateTripsAndBackfillDistributed(context.Background(),now,"coordinator",0,time.Millisecond)
+	if err != db.EINJECTEDFAULT {
+		t.Error("Injected fault not reported",err)
+	}
+	if engine.Administrator.bs.totalGrounded != 0 {
+		t.Error("Failed backfill changed total grounded",engine.Administrator.bs.totalGrounded)
+	}
+
+	// Carry on with the same backfill
+	fdb.ClearRules()
+	ut,err := engine.UpdateTripsAndBackfillDistributed(context.Background(),now,"coordinator",time.Minute,time.Millisecond)
+	if err != nil {
+		t.Error("Repeated distributed backfill failed",err)
+	}
+	checkBackfill(t,engine,ut,expectedUt,expected,now)
+}
+
+func TestNoDistributedBackfill(t *testing.T) {
+	engine := NewEngine(db.NewMemoryDB(),0,"")
+	_,err := engine.WorkBackfill(context.Background(),"worker",time.Minute)
+	if err != ENOBACKFILLRUN {
+		t.Error("WorkBackfill worked without a backfill",err)
+	}
+	_,err = engine.CompleteBackfill(context.Background(),"worker",time.Minute,time.Millisecond)
+	if err != ENOBACKFILLRUN {
+		t.Error("CompleteBackfill completed without a backfill",err)
+	}
+	_,err = engine.BeginBackfill(SecondsInDay+1)
+	if err != EINVALIDARGUMENT {
+		t.Error("BeginBackfill accepted time that isnt start of day",err)
+	}
+}
+
+// TestBackfillWorkerProcess is run as a worker process by TestDistributedBackfillProcesses
+func TestBackfillWorkerProcess(t *testing.T) {
+	worker := os.Getenv(backfillWorkerEnv)
+	if worker == "" {
+		return
+	}
+	database := db.NewSQLDB("sqlite3","file:"+BACKFILLTESTDB)
+	if database == nil {
+		t.Fatal("Failed to open database")
+	}
+	defer database.Release()
+	_,err := NewEngine(database,0,"").WorkBackfill(context.Background(),worker,time.Minute)
+	if err != nil {
+		t.Fatal("WorkBackfill failed",err)
+	}
+}
+
+func TestDistributedBackfillProcesses(t *testing.T) {
+	const n = 64
+	now := EpochTime(SecondsInDay*5)
+	expectedUt,expected := expectedBackfill(t,n,now)
+	os.Remove(BACKFILLTESTDB)
+	database := db.NewSQLDB("sqlite3","file:"+BACKFILLTESTDB)
+	if database == nil {
+		t.Error("Failed to create db object")
+		return
+	}
+	defer func() {
+		database.Release()
+		os.Remove(BACKFILLTESTDB)
+		os.Remove(BACKFILLTESTDB+"-wal")
+		os.Remove(BACKFILLTESTDB+"-shm")
+	}()
+	engine,_ := backfillTravellers(t,database,n)
+	_,err := engine.BeginBackfill(now)
+	if err != nil {
+		t.Error("BeginBackfill failed",err)
+	}
+
+	// Work on the backfill in three other processes
+	var cmds []*exec.Cmd
+	for _,worker := range []string{"worker1","worker2","worker3"} {
+		cmd := exec.Command(os.Args[0],"-test.run=^TestBackfillWorkerProcess$")
+		cmd.Env = append(os.Environ(),backfillWorkerEnv+"="+worker)
+		err = cmd.Start()
+		if err != nil {
+			t.Error("Failed to start worker",err)
+			return
+		}
+		cmds = append(cmds,cmd)
+	}
+	for _,cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Error("Worker process failed",err)
+		}
+	}
+	done,err := engine.WorkBackfill(context.Background(),"coordinator",time.Minute)
+	if err != nil || done != 0 {
+		t.Error("Worker processes left ranges undone",done,err)
+	}
+	ut,err := engine.CompleteBackfill(context.Background(),"coordinator",time.Minute,time.Millisecond)
+	if err != nil {
+		t.Error("CompleteBackfill failed",err)
+	}
+	checkBackfill(t,engine,ut,expectedUt,expected,now)
+}
@@ -25,6 +25,7 @@ type predictor interface
 	version() predictVersion
 	backfilled(epochDays,epochDays) (Kilometres,error)
 	state() ([]float64,[]float64,error)
+	residuals(epochDays) []float64
 	db.Serialize
 }
 
@@ -107,6 +108,20 @@ func (self* bestFit) state() ([]float64,[]float64,error) {
 	return self.ys,[]float64{self.c,self.m},nil
 }
 
+// residuals returns the difference between each smoothed point and the best fit line,
+// taking the last point to be for the given day
+func (self *bestFit) residuals(xmax epochDays) []float64 {
+	if self.c < 0 {
+		return nil
+	}
+	xorigin := float64(xmax) - float64(len(self.ys)-1)
+	rs := make([]float64,len(self.ys))
+	for x,y := range self.ys {
+		rs[x] = y - self.calcY(xorigin+float64(x))
+	}
+	return rs
+}
+
 // version returns number indicating current version of the best fit line.
 // number is incremented each time value of m or c changes.
 func (self *bestFit) version() predictVersion {
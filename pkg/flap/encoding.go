@@ -0,0 +1,123 @@
+package flap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+var ECORRUPTRECORD = errors.New("Record is corrupt or of an unknown version")
+
+// compactWriter writes the variable length fields of compact record encodings
+type compactWriter struct {
+	buff *bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func newCompactWriter(buff *bytes.Buffer) *compactWriter {
+	return &compactWriter{buff:buff}
+}
+
+// uvarint writes an unsigned integer in as few bytes as it needs
+func (self *compactWriter) uvarint(u uint64) {
+	self.buff.Write(self.scratch[:binary.PutUvarint(self.scratch[:],u)])
+}
+
+// varint writes a signed integer, such as the difference between two times, in
+// as few bytes as it needs
+func (self *compactWriter) varint(i int64) {
+	self.buff.Write(self.scratch[:binary.PutVarint(self.scratch[:],i)])
+}
+
+// float writes a floating point number in full
+func (self *compactWriter) float(f float64) {
+	binary.LittleEndian.PutUint64(self.scratch[:8],math.Float64bits(f))
+	self.buff.Write(self.scratch[:8])
+}
+
+// byte writes a single byte
+func (self *compactWriter) byte(b byte) {
+	self.buff.WriteByte(b)
+}
+
+// bytes writes a fixed length field
+func (self *compactWriter) bytes(b []byte) {
+	self.buff.Write(b)
+}
+
+// compactReader reads fields written by a compactWriter. The first error is
+// kept and all later reads return zero values, so it need only be checked once
+// a whole record has been read.
+type compactReader struct {
+	buff *bytes.Buffer
+	err error
+}
+
+func newCompactReader(buff *bytes.Buffer) *compactReader {
+	return &compactReader{buff:buff}
+}
+
+// fail records the first error
+func (self *compactReader) fail(err error) {
+	if self.err == nil {
+		self.err = err
+	}
+}
+
+func (self *compactReader) uvarint() uint64 {
+	if self.err != nil {
+		return 0
+	}
+	u,err := binary.ReadUvarint(self.buff)
+	self.fail(err)
+	return u
+}
+
+func (self *compactReader) varint() int64 {
+	if self.err != nil {
+		return 0
+	}
+	i,err := binary.ReadVarint(self.buff)
+	self.fail(err)
+	return i
+}
+
+func (self *compactReader) float() float64 {
+	var b [8]byte
+	self.bytes(b[:])
+	return math.Float64frombits(binary.LittleEndian.Uint64(b[:]))
+}
+
+func (self *compactReader) byte() byte {
+	if self.err != nil {
+		return 0
+	}
+	b,err := self.buff.ReadByte()
+	self.fail(err)
+	return b
+}
+
+func (self *compactReader) bytes(b []byte) {
+	if self.err != nil {
+		return
+	}
+	_,err := io.ReadFull(self.buff,b)
+	self.fail(err)
+}
+
+// count reads the number of entries in a list, failing if there are more than max
+func (self *compactReader) count(max int) int {
+	n := self.uvarint()
+	if n > uint64(max) {
+		self.fail(ECORRUPTRECORD)
+		return 0
+	}
+	return int(n)
+}
+
+// since returns the time written as a difference from the given time
+func (self *compactReader) since(t EpochTime) EpochTime {
+	return EpochTime(int64(t)+self.varint())
+}
@@ -9,6 +9,7 @@ import (
 	"math"
 	"errors"
 	"sync"
+	"context"
 	//"fmt"
 )
 
@@ -44,7 +45,46 @@ type FlapParams struct {
 	MinGrounded		uint64
 	Promises		PromisesConfig
 	TaxiOverhead		Kilometres
-	Threads			byte
+	Threads			uint
+	Transfers		TransfersConfig
+	Overdraft		OverdraftConfig
+}
+
+// backfillThreads returns the number of threads to backfill with. There is never
+// more than one thread per key prefix, so at most 256, and always at least one.
+func (self *FlapParams) backfillThreads() uint {
+	if self.Threads == 0 {
+		return 1
+	}
+	if self.Threads > backfillRanges {
+		return backfillRanges
+	}
+	return self.Threads
+}
+
+// OverdraftConfig sets how far into debit travellers can go and still be cleared
+// to travel. Travellers holding an exemption are allowed the overdraft for its
+// category instead, if one is set. Overdrafts are repaid by the daily share like
+// any other debit.
+type OverdraftConfig struct {
+	Limit		Kilometres
+	Medical		Kilometres
+	Diplomatic	Kilometres
+	Humanitarian	Kilometres
+}
+
+// limit returns the overdraft allowed for a traveller holding the given exemption, if any
+func (self *OverdraftConfig) limit(ex *Exemption) Metres {
+	overdraft := self.Limit
+	if ex != nil {
+		for _,c := range []struct{ec ExemptionCategory; limit Kilometres}{
+				{ECMedical,self.Medical},{ECDiplomatic,self.Diplomatic},{ECHumanitarian,self.Humanitarian}} {
+			if ex.Category == c.ec && c.limit > 0 {
+				overdraft = c.limit
+			}
+		}
+	}
+	return overdraft.Metres()
 }
 
 func (self* FlapParams) To(b *bytes.Buffer) error {
@@ -76,6 +116,10 @@ type Engine struct
 	Administrator 		*Administrator
 	Travellers		*Travellers
 	Airports		*Airports
+	Households		*Households
+	Transfers		*Transfers
+	Exemptions		*Exemptions
+	events			*EventLog
 }
 
 // NewEngine creates an instance of an Engine object, which can be used
@@ -89,9 +133,18 @@ func NewEngine(database db.Database, logLevel LogLevel,logFolder string) *Engine
 	engine.Travellers = NewTravellers(database)
 	engine.Airports   = NewAirports(database)
 	engine.Administrator = newAdministrator(database)
+	engine.Households = NewHouseholds(database)
+	engine.Transfers = NewTransfers(database)
+	engine.Exemptions = NewExemptions(database)
 	return engine
 }
 
+// TableNames returns the names of all FLAP tables, for use in whole
+// database operations such as backup
+func TableNames() []string {
+	return append([]string{adminTableName,travellersTableName,airportsTableName,eventsTableName,householdsTableName,transfersTableName,exemptionsTableName},travellerIndexNames[:]...)
+}
+
 // Reset drops ALL FLAP tables from given database
 // holding state related to travellers. If destroy is true
 // all tables are dropped
@@ -104,6 +157,22 @@ func Reset(database db.Database, destroy bool) error {
 	if err != nil && err != db.ETABLENOTFOUND {
 		return err
 	}
+	err = dropEvents(database)
+	if err != nil && err != db.ETABLENOTFOUND {
+		return err
+	}
+	err = dropHouseholds(database)
+	if err != nil && err != db.ETABLENOTFOUND {
+		return err
+	}
+	err = dropTransfers(database)
+	if err != nil && err != db.ETABLENOTFOUND {
+		return err
+	}
+	err = dropExemptions(database)
+	if err != nil && err != db.ETABLENOTFOUND {
+		return err
+	}
 	if destroy {
 		err = DropAirports(database)
 		if err != nil && err != db.ETABLENOTFOUND {
@@ -133,7 +202,7 @@ func (self *Engine) getCreateTraveller(passport Passport, now EpochTime)  *Trave
 // and the function returned with EGROUNDED. Ths is in effect an instruciton
 // to the carrier to refuse the check-in.
 // If "debit" is true the distance of all flights is deducted from the travellers
-// balance.
+// balance. Any exemption the traveller holds is applied.
 func (self *Engine) SubmitFlights(passport Passport, flights []Flight, now EpochTime,debit bool) error {
 
 	// Check args
@@ -141,40 +210,52 @@ func (self *Engine) SubmitFlights(passport Passport, flights []Flight, now Epoch
 		return EINVALIDARGUMENT
 	}
 
-	// Retrieve traveller record
+	// Retrieve traveller record and any exemption
 	t := self.getCreateTraveller(passport,now)
+	ex,err := self.Exemptions.active(passport,now)
+	if err != nil {
+		return logError(err)
+	}
 
-	
 	// Add flights to traveller's flight history
-	for _,flight := range flights {
-
-		// Update traveller with the new flight
-		bac,pd,err := t.submitFlight(&flight,now,self.Administrator.params.TaxiOverhead,debit)
-		if err != nil {
-			return err
-		}
-
-		// Apply any configured balance adjustment
-		self.Administrator.pc.change(bac,pd) 
-		if (self.Administrator.params.Promises.Algo & pamCorrectBalances == pamCorrectBalances) &&
-				   (bac < 0) {
-			t.transact(-bac,now,TTBalanceAdjustment)
-		}
+	err = t.submitFlights(flights,now,&self.Administrator.params,debit,&self.Administrator.pc,ex)
+	if err != nil {
+		return err
 	}
 
 	// Store updated traveller
-	err := self.Travellers.PutTraveller(*t)
+	err = self.Travellers.PutTraveller(*t)
+	if err == nil {
+		err = self.events.record(Event{Type:ETSubmitFlights,Time:now,Passport:passport,Flights:flights,Debit:debit})
+	}
 	return err
 }
 
+// ClearedWithinOverdraft returns whether the given traveller is cleared to travel at the
+// given time, allowing them the overdraft configured for any exemption they hold
+func (self *Engine) ClearedWithinOverdraft(t *Traveller, now EpochTime) (ClearanceReason,error) {
+	ex,err := self.Exemptions.active(t.passport,now)
+	if err != nil {
+		return CRGrounded,logError(err)
+	}
+	return t.clearedWithin(now,self.Administrator.params.Overdraft.limit(ex)),nil
+}
+
 // UpdateTripsAndBackfill iterates through all Traveller records, carrying out
 // two key FLAP processes for each traveller:
 // (1) Update the trip history, applying FLAP parameters and the provided date time to end journeys and trips
 // (2) Backfilling with a share of the DailyTotal if the traveller is grounded.
 // Note it counts and stores the total number of grounded travellers over the course of the iteration to use
-// for calculation of the backfill share for the next invocation.
+// for calculation of the backfill share for the next invocation, and a ledger of how the Daily Total was
+// shared out for Verify to reconcile.
 // It must be invoked once a day with a datetime that is the start of that UTC day.
-func (self *Engine) UpdateTripsAndBackfill(now EpochTime) (UpdateBackfillStats,error) {
+// If ctx is cancelled or its deadline passes all threads stop at the next traveller, flushing any
+// changes already made, and the stats for the travellers processed so far are returned along with
+// the context error. In that case, or if a thread fails to read or write travellers, the total number
+// of grounded travellers is left unchanged. Travellers are credited at most once a day, and the share
+// worked out for a day is kept, so a run that failed or was stopped can safely be repeated with the
+// same datetime to finish the job.
+func (self *Engine) UpdateTripsAndBackfill(ctx context.Context, now EpochTime) (UpdateBackfillStats,error) {
 	
 	// Check we are at start of day
 	ut := *NewUpdateBackfillStats()
@@ -182,24 +263,15 @@ func (self *Engine) UpdateTripsAndBackfill(now EpochTime) (UpdateBackfillStats,e
 		return ut,EINVALIDARGUMENT
 	}
 
-	// Retrieve and cycle promises correction if enabled
-	var pc Kilometres
-	if self.Administrator.params.Promises.Algo & pamCorrectDailyTotal == pamCorrectDailyTotal {
-		pc = self.Administrator.pc.cycle(self.Administrator.params.Promises.CorrectionSmoothWindow)
-		logDebug("DailyTotal=",self.Administrator.params.DailyTotal,"PromisesCorrection=",pc)
+	// Check we havent been cancelled before changing any state
+	if ctx.Err() != nil {
+		return ut,ctx.Err()
 	}
 
 	// Calculate backfill share
-	backfillers := 	Kilometres(math.Max(float64(self.Administrator.params.MinGrounded),float64(self.Administrator.bs.totalGrounded)))
-	if backfillers > 0 {
-		ut.Share = (self.Administrator.params.DailyTotal+pc) / backfillers
-
-		// Add calculated share to predictor algorithm
-		if self.Administrator.validPredictor() {
-			self.Administrator.predictor.add(now.toEpochDays(false),ut.Share)
-			ut.BestFitPoints,ut.BestFitConsts,_ = self.Administrator.predictor.state()
-			logInfo("Added predictior data point:",now.toEpochDays(false),ut.Share)
-		}
+	err := self.backfillShare(now,&ut)
+	if err != nil {
+		return ut,err
 	}
 
 	// Create snapshot for faster multithreaded reads
@@ -209,47 +281,63 @@ func (self *Engine) UpdateTripsAndBackfill(now EpochTime) (UpdateBackfillStats,e
 	}
 	defer ss.Release()
 
-	// Update all travellers
-	threads := uint(self.Administrator.params.Threads)
-	if threads == 0 {
-		threads = 1
-	}
+	// Update all travellers, with each thread taking the next of the two hex digit key
+	// prefixes from a queue so that no thread sits idle while a slow prefix is worked on
+	threads := self.Administrator.params.backfillThreads()
 	logDebug("Backfilling with ", threads," threads")
+	prefixes := make(chan byte, backfillRanges)
+	for pc:=0; pc < backfillRanges; pc++ {
+		prefixes <- byte(pc)
+	}
+	close(prefixes)
 	stats := make(chan UpdateBackfillStats, threads)
 	var wg sync.WaitGroup
-	delta := 16/threads
-	for i := uint(0); i < 16; i+=delta {
+	for i := uint(0); i < threads; i++ {
 		wg.Add(1)
-		t :=  func(s byte,e byte) {stats <- self.updateSomeTravellers(s,e,ut.Share,now,ss);wg.Done()}
-		go t(byte(i),byte(i+delta-1))
+		go func() {stats <- self.updateSomeTravellers(ctx,prefixes,&self.Administrator.params,ut.Share,now,ss);wg.Done()}()
 	}
 	wg.Wait()
 
 	// Add up the stats
 	close(stats)
 	for elem := range stats {
-		ut.Grounded += elem.Grounded
-		ut.Travellers += elem.Travellers
-		ut.Distance += elem.Distance
-		ut.Flights += elem.Flights
-		ut.ClearedDistanceDeltas = append(ut.ClearedDistanceDeltas,elem.ClearedDistanceDeltas...)
-		ut.ClearedDaysDeltas = append(ut.ClearedDaysDeltas,elem.ClearedDaysDeltas...)
-		if (elem.Err != nil) {
-			ut.Err = elem.Err
-		}
+		ut.add(&elem)
 	}
 
-	// Update total grounded and return
+	// Update total grounded, unless the run was stopped part way through, and return
+	if ctx.Err() != nil {
+		logInfo("Backfill stopped after ",ut.Processed," travellers: ",ctx.Err())
+		ut.Err = ctx.Err()
+		return ut,ut.Err
+	}
+	if ut.Err != nil {
+		logInfo("Backfill failed after ",ut.Processed," travellers: ",ut.Err)
+		return ut,ut.Err
+	}
 	self.Administrator.bs.totalGrounded=ut.Grounded
+	err = self.Administrator.saveDayLedger(now,&ut)
+	if err != nil {
+		return ut,logError(err)
+	}
+	err = self.events.record(Event{Type:ETBackfill,Time:now})
+	if err != nil {
+		return ut,err
+	}
 	return ut,ut.Err
 }
 
 type UpdateBackfillStats struct {
 	Grounded 		uint64
 	Travellers 		uint64
+	Processed		uint64
 	Distance  		Kilometres
 	Flights			uint64
-	Share			Kilometres
+	Share			Metres
+	Pool			Metres
+	Backfillers		uint64
+	ExemptFlights		uint64
+	OverdraftFlights	uint64
+	Overdrawn		Metres
 	ClearedDistanceDeltas	[]Kilometres
 	ClearedDaysDeltas	[]Days
 	BestFitPoints		[]float64
@@ -264,88 +352,221 @@ func NewUpdateBackfillStats() *UpdateBackfillStats {
 	return ubs
 }
 
-func (self *Engine) updateSomeTravellers(prefixStart byte, prefixEnd byte, share Kilometres,now EpochTime, ss *TravellersSnapshot) UpdateBackfillStats {
+// add adds the stats for some travellers to the totals, keeping any error
+func (self *UpdateBackfillStats) add(elem *UpdateBackfillStats) {
+	self.Grounded += elem.Grounded
+	self.Travellers += elem.Travellers
+	self.Processed += elem.Processed
+	self.Distance += elem.Distance
+	self.Flights += elem.Flights
+	self.ExemptFlights += elem.ExemptFlights
+	self.OverdraftFlights += elem.OverdraftFlights
+	self.Overdrawn += elem.Overdrawn
+	self.ClearedDistanceDeltas = append(self.ClearedDistanceDeltas,elem.ClearedDistanceDeltas...)
+	self.ClearedDaysDeltas = append(self.ClearedDaysDeltas,elem.ClearedDaysDeltas...)
+	if (elem.Err != nil) {
+		self.Err = elem.Err
+	}
+}
 
-	us := *NewUpdateBackfillStats()
-	var prefix [1]byte
+// backfillShareRecordKey is the key of the record of the share worked out for the
+// latest day backfilled
+const backfillShareRecordKey="backfillshare"
+
+// backfillShare calculates the share of the Daily Total for each grounded traveller
+// on the given day, adding it to the promises predictor if enabled. The share is
+// recorded, along with the administrative state it changes, before any traveller is
+// credited with it, and reused if asked for the same day again so that a repeated
+// backfill shares out the same as the first attempt.
+func (self *Engine) backfillShare(now EpochTime, ut *UpdateBackfillStats) error {
+
+	// Reuse the share worked out by an earlier attempt at the same day
+	var dl dayLedger
+	err := self.Administrator.table.Get(backfillShareRecordKey,&dl)
+	if err == nil && dl.Day == now {
+		ut.Pool,ut.Backfillers,ut.Share = dl.Pool,dl.Backfillers,dl.Share
+		if self.Administrator.validPredictor() {
+			ut.BestFitPoints,ut.BestFitConsts,_ = self.Administrator.predictor.state()
+		}
+		return nil
+	}
 
-	// Iterate through all keys with a first byte in the given
-	// range
-	logDebug("Backfilling from ",prefixStart," to ",prefixEnd)
+	// Retrieve and cycle promises correction if enabled
+	var pc Kilometres
+	if self.Administrator.params.Promises.Algo & pamCorrectDailyTotal == pamCorrectDailyTotal {
+		pc = self.Administrator.pc.cycle(self.Administrator.params.Promises.CorrectionSmoothWindow)
+		logDebug("DailyTotal=",self.Administrator.params.DailyTotal,"PromisesCorrection=",pc)
+	}
+
+	// Calculate backfill share in whole metres, rounded towards zero so that no
+	// more than the Daily Total is ever shared out
+	backfillers := 	uint64(math.Max(float64(self.Administrator.params.MinGrounded),float64(self.Administrator.bs.totalGrounded)))
+	ut.Pool = (self.Administrator.params.DailyTotal+pc).Metres()
+	ut.Backfillers = backfillers
+	if backfillers > 0 {
+		ut.Share = ut.Pool.divide(backfillers)
+
+		// Add calculated share to predictor algorithm
+		if self.Administrator.validPredictor() {
+			self.Administrator.predictor.add(now.toEpochDays(false),ut.Share.Kilometres())
+			ut.BestFitPoints,ut.BestFitConsts,_ = self.Administrator.predictor.state()
+			logInfo("Added predictior data point:",now.toEpochDays(false),ut.Share)
+		}
+	}
+
+	// Record share
+	dl = dayLedger{Day:now,Pool:ut.Pool,Backfillers:ut.Backfillers,Share:ut.Share}
+	err = self.Administrator.table.Put(backfillShareRecordKey,&dl)
+	if err != nil {
+		return logError(err)
+	}
+	return self.Administrator.Save()
+}
+
+// dailyUpdate updates the traveller's trip history, backfills them with the given share if
+// grounded and keeps any promise matching a trip just ended, adding to the given stats.
+// It returns true if the traveller has changed.
+func (self *Traveller) dailyUpdate(params *FlapParams, share Metres, now EpochTime, us *UpdateBackfillStats) bool {
+
+	// Update trip history
+	changed := false
+	distanceYesterday,flightsYesterday,err := self.tripHistory.Update(params,now) 
+	if err == nil {
+		if distanceYesterday > 0 {
+			us.Distance += distanceYesterday
+			us.Travellers ++
+			us.Flights += flightsYesterday
+		}
+		changed = true
+	}
+
+	// Count flights taken yesterday under an exemption or overdraft, and how
+	// far travellers who used an overdraft are still overdrawn
+	overdrawn := false
+	for i:=0; i < MaxTransactions && self.Transactions.entries[i].Date >= now-SecondsInDay; i++ {
+		tr := &self.Transactions.entries[i]
+		if tr.Date >= now {
+			continue
+		}
+		switch tr.TT {
+			case TTExemption:
+				us.ExemptFlights++
+			case TTOverdraft:
+				us.OverdraftFlights++
+				overdrawn = true
+		}
+	}
+	if overdrawn && self.Balance < 0 {
+		us.Overdrawn -= self.Balance
+	}
+	
+	// Report any clearance deltas if appropriate
+	if (self.Kept.Clearance > 0 && self.Kept.StackIndex==0) {
+		nowDays := Days(now.toEpochDays(false))
+		clearDays := Days(self.Kept.Clearance.toEpochDays(false))
+		if (nowDays == clearDays) {
+			us.ClearedDistanceDeltas = append(us.ClearedDistanceDeltas,self.Balance.Kilometres())
+		}
+		if (self.Balance + share >= 0) {
+			us.ClearedDaysDeltas = append(us.ClearedDaysDeltas,nowDays-clearDays)
+		}
+	}
+
+	// Backfill if not travelling and balance is negative. A traveller already
+	// backfilled by an earlier run for the same day that failed part way
+	// through is counted but not credited again.
+	if !self.MidTrip() {
+		if self.Transactions.made(TTDailyShare,now) {
+			us.Grounded++
+		} else if self.Balance < 0 {
+			self.transact(share,now,TTDailyShare)
+			us.Grounded++
+			changed = true
+		}
+	}
+
+	// Check for a promise to keep
+	kept := self.keep()
+	if kept {
+		changed = true
+	}
+	return changed
+}
+
+// updateSomeTravellers updates and backfills all travellers with keys starting with each
+// of the two hex digit prefixes taken from the given queue until it is empty. Only travellers
+// listed in the grounded, mid-trip or kept indices are visited, as no others need updating.
+// It stops early if ctx is done, always flushing the batch of changes made so far before returning.
+func (self *Engine) updateSomeTravellers(ctx context.Context, prefixes <-chan byte, params *FlapParams, share Metres,now EpochTime, ss *TravellersSnapshot) (us UpdateBackfillStats) {
+
+	us = *NewUpdateBackfillStats()
+	var prefix [1]byte
 	bw,err := self.Travellers.MakeBatch(10000)
 	if err != nil {
+		bw.Release()
 		us.Err = logError(err)
 		return us
 	}
-	defer bw.Release();
+	bw.day = now
+	defer func() {
+		err := bw.Release()
+		if err != nil && us.Err == nil {
+			us.Err = logError(err)
+		}
+	}()
 
-	for pc:=int(prefixStart); pc <= int(prefixEnd); pc++ {
+	for pc := range prefixes {
+		if ctx.Err() != nil {
+			break
+		}
 
-		// Iterate over current start byte
-		prefix[0]=byte(pc)
-		prefixstr := hex.EncodeToString(prefix[:])
-		it,err := ss.NewIterator(prefixstr[1:])
+		// Iterate over current prefix
+		prefix[0]=pc
+		it,err := ss.newIndexedIterator(hex.EncodeToString(prefix[:]))
 		if err != nil {
 			us.Err= logError(err)
 			return us
 		}
-		for it.Next() {
+		for ctx.Err() == nil && it.Next() {
 
 			// Retrieve traveller
-			changed:=false
-			traveller := it.Value()
-
-			// Update trip history
-			distanceYesterday,flightsYesterday,err := traveller.tripHistory.Update(&self.Administrator.params,now) 
-			if err == nil {
-				if distanceYesterday > 0 {
-					us.Distance += distanceYesterday
-					us.Travellers ++
-					us.Flights += flightsYesterday
-				}
-				changed = true
-			}
-			
-			// Report any clearance deltas if appropriate
-			if (traveller.Kept.Clearance > 0 && traveller.Kept.StackIndex==0) {
-				nowDays := Days(now.toEpochDays(false))
-				clearDays := Days(traveller.Kept.Clearance.toEpochDays(false))
-				if (nowDays == clearDays) {
-					us.ClearedDistanceDeltas = append(us.ClearedDistanceDeltas,traveller.Balance)
-				}
-				if (traveller.Balance + share >= 0) {
-					us.ClearedDaysDeltas = append(us.ClearedDaysDeltas,nowDays-clearDays)
-				}
+			traveller,err := ss.getByKey(it.Key())
+			if err != nil {
+				us.Err = logError(err)
+				break
 			}
+			us.Processed++
 
-			// Backfill if not travelling and balance is negative
-			if !traveller.MidTrip() && traveller.Balance < 0 {
-				traveller.transact(share,now,TTDailyShare)
-				us.Grounded++
-				changed = true
-			}
-
-			// Check for a promise to keep
-			kept := traveller.keep()
-			if kept {
-				changed = true
-			}
+			// Update trip history, backfill and keep promises
+			changed := traveller.dailyUpdate(params,share,now,&us)
 
-			// Save changes if necessary
+			// Save changes if necessary, otherwise just update the indices
 			if changed {
-				bw.Put(traveller)
+				err = bw.Put(traveller)
+			} else {
+				err = bw.Index(traveller)
+			}
+			if err != nil {
+				us.Err = logError(err)
+				break
 			}
 
 		}
 
 		// Release interface
-		us.Err = it.Error()
+		if us.Err == nil {
+			us.Err = it.Error()
+		}
 		it.Release()
 		if us.Err != nil {
 			return us
 		}
 	}
-	logDebug("Finished backfilling from ",prefixStart," to ",prefixEnd)
+	if ctx.Err() != nil {
+		logDebug("Stopped backfilling after ",us.Processed," travellers")
+		return us
+	}
+	logDebug("Finished backfilling ",us.Processed," travellers")
 	return us
 }
 
@@ -367,13 +588,11 @@ func (self *Engine) Propose(passport Passport,flights [] Flight, tripEnd EpochTi
 	}
 
 	// Determine trip start, end, distance to backfill and distance travelled
-	var distance Kilometres
 	var travelled Kilometres
 	ts := MaxEpochTime
 	te := tripEnd
 	for i:=0; i < len(flights); i++ {
 		travelled += flights[i].Distance
-		distance += flights[i].Distance + self.Administrator.params.TaxiOverhead
 		if flights[i].Start < ts {
 			ts=flights[i].Start
 		}
@@ -387,14 +606,58 @@ func (self *Engine) Propose(passport Passport,flights [] Flight, tripEnd EpochTi
 		return nil,ETRIPTOOFARAHEAD
 	}
 
-	// Adjust distance for mean balance at clearance if so configured
-	if self.Administrator.params.Promises.Algo & pamCorrectPromiseDistance == pamCorrectPromiseDistance{
+	// Ask for proposal and return the result
+	distance := self.promiseDistance(travelled,len(flights))
+	return self.getCreateTraveller(passport,now).Promises.propose(ts,te,distance,travelled,now,self.Administrator.predictor,
+								     self.Administrator.params.Promises.MaxStackSize)
+}
+
+// promiseDistance returns the distance to backfill for a trip of the given number of
+// flights travelling the given distance, adding the taxi overhead for each flight and
+// adjusting for mean balance at clearance if so configured
+func (self *Engine) promiseDistance(travelled Kilometres, flights int) Kilometres {
+	distance := travelled + Kilometres(flights)*self.Administrator.params.TaxiOverhead
+	if self.Administrator.params.Promises.Algo & pamCorrectPromiseDistance == pamCorrectPromiseDistance {
 		distance -= self.Administrator.pc.getBACPerKm()*distance
 	}
+	return distance
+}
 
-	// Ask for proposal and return the result
-	return self.getCreateTraveller(passport,now).Promises.propose(ts,te,distance,travelled,now,self.Administrator.predictor,
-								  self.Administrator.params.Promises.MaxStackSize)
+// ProposeAlternatives searches for trips of the given length and distance within the given
+// window that the traveller could be promised clearance for, returning up to max of them
+// ranked as best first, each with the proposal that would make its promise. The distance is
+// treated as a single flight. Trips starting before now, or too far ahead to be promised, are
+// not considered.
+// The traveller's promises are unchanged.
+func (self *Engine) ProposeAlternatives(passport Passport, tripLength Days, distance Kilometres, from EpochTime, to EpochTime, max int, now EpochTime) ([]Alternative,error) {
+
+	// Validate args
+	if tripLength <= 0 || distance <= 0 || to <= from || max <= 0 {
+		return nil,EINVALIDARGUMENT
+	}
+
+	// Check promises are active
+	if !self.Administrator.validPredictor() {
+		return nil,EPROMISESNOTENABLED
+	}
+
+	// Limit window to trips that can be promised
+	params := &self.Administrator.params
+	if from < now {
+		from = now
+	}
+	latest := (now.toEpochDays(false)+epochDays(params.Promises.MaxDays)).toEpochTime()+EpochTime(tripLength)*SecondsInDay
+	if to > latest {
+		to = latest
+	}
+
+	// Search
+	alts := self.getCreateTraveller(passport,now).Promises.alternatives(from,to,EpochTime(tripLength)*SecondsInDay,self.promiseDistance(distance,1),distance,now,
+									      self.Administrator.predictor,params.Promises.MaxStackSize)
+	if len(alts) > max {
+		alts = alts[:max]
+	}
+	return alts,nil
 }
 
 // Make attempts to apply a proposal for changes to a traveller's set of clearance promises.
@@ -414,7 +677,10 @@ func (self *Engine) Make(passport Passport, proposal *Proposal, now EpochTime) e
 	t := self.getCreateTraveller(passport,now)
 	err := t.Promises.make(proposal,self.Administrator.predictor)
 	if (err == nil) {
-		self.Travellers.PutTraveller(*t)
+		err = self.Travellers.PutTraveller(*t)
+	}
+	if (err == nil) {
+		err = self.events.record(Event{Type:ETMake,Time:now,Passport:passport,Promises:proposal.entries[:],Version:uint64(proposal.version)})
 	}
 	return err
 }
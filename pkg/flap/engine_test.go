@@ -5,6 +5,9 @@ import (
 	"os"
 	"github.com/richardmorrey/flap/pkg/db"
 	"reflect"
+	"context"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
 	//"fmt"
 )
 
@@ -14,7 +17,7 @@ func enginesetup(t *testing.T) *db.LevelDB{
 	if err := os.Mkdir(ENGINETESTFOLDER, 0700); err != nil {
 		t.Error("Failed to create test dir", err)
 	}
-	return db.NewLevelDB(ENGINETESTFOLDER)
+	return db.NewLevelDB(ENGINETESTFOLDER,db.LevelDBOptions{})
 } 
 
 func engineteardown(db *db.LevelDB) {
@@ -116,7 +119,7 @@ func TestEngineSubmitFlightsTaxiOverhead(t *testing.T) {
 	if err != nil {
 		t.Error("SubmitFlights failed to create traveller")
 	}
-	if traveller.Balance != -110 {
+	if traveller.Balance != Kilometres(-110).Metres() {
 		t.Error("SubmitFlights didnt result in correct balance for traveller",traveller.Balance)
 	}
 }
@@ -235,11 +238,11 @@ func TestUpdateTripsAndBackfillEmpty(t  *testing.T) {
 	db:= enginesetup(t)
 	defer engineteardown(db)
 	engine := NewEngine(db,0,"")
-	us,err := engine.UpdateTripsAndBackfill(1)
+	us,err := engine.UpdateTripsAndBackfill(context.Background(),1)
 	if (err == nil) {
 		t.Error("Update accepted now that isnt the start of a day")
 	}
-	us,err = engine.UpdateTripsAndBackfill(SecondsInDay)
+	us,err = engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay)
 	if err != nil {
 		t.Error("Update failed with empty Travellers table",err)
 	}
@@ -269,7 +272,7 @@ func TestUpdateTripsAndBackfillOne(t  *testing.T) {
 	flights = append(flights,*createFlight(1,SecondsInDay,SecondsInDay+1),*createFlight(1,SecondsInDay*3,SecondsInDay*3+1))
 	passport := NewPassport("987654321","uk")
 	err := engine.SubmitFlights(passport,flights,SecondsInDay,true)
-	us,err := engine.UpdateTripsAndBackfill(SecondsInDay*5)
+	us,err := engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*5)
 	if err != nil {
 		t.Error("Update failed for one Traveller",err)
 	}
@@ -277,7 +280,7 @@ func TestUpdateTripsAndBackfillOne(t  *testing.T) {
 	if traveller.tripHistory.entries[0].et != etTripEnd {
 		t.Error("UpdateTripsAndBackfill failed to end trip of one traveller",traveller.tripHistory.AsJSON())
 	}
-	expectedBalance := 100 - (flights[0].Distance+flights[1].Distance)
+	expectedBalance := Kilometres(100).Metres() - flights[0].Distance.Metres() - flights[1].Distance.Metres()
 	if traveller.Balance !=  expectedBalance {
 		t.Error("UpdateTripsAndBackfill didnt backfill correctly", traveller.Balance)
 	}
@@ -301,6 +304,41 @@ func TestUpdateTripsAndBackfillOne(t  *testing.T) {
 
 }
 
+func TestUpdateTripsAndBackfillCancelled(t  *testing.T) {
+	db:= enginesetup(t)
+	defer engineteardown(db)
+	engine := NewEngine(db,0,"")
+	paramsIn := FlapParams{DailyTotal:100, MinGrounded:1,FlightInterval:1,FlightsInTrip:50,TripLength:365,Threads:4}
+	engine.Administrator.SetParams(paramsIn)
+	var flights []Flight
+	flights = append(flights,*createFlight(1,SecondsInDay,SecondsInDay+1),*createFlight(1,SecondsInDay*3,SecondsInDay*3+1))
+	passport := NewPassport("987654321","uk")
+	engine.SubmitFlights(passport,flights,SecondsInDay,true)
+	ctx,cancel := context.WithCancel(context.Background())
+	cancel()
+	us,err := engine.UpdateTripsAndBackfill(ctx,SecondsInDay*5)
+	if err != context.Canceled {
+		t.Error("Update didnt report cancellation",err)
+	}
+	if us.Processed != 0 {
+		t.Error("Update processed travellers after cancellation",us.Processed)
+	}
+	traveller,_ := engine.Travellers.GetTraveller(passport) 
+	if traveller.tripHistory.entries[0].et == etTripEnd {
+		t.Error("UpdateTripsAndBackfill ended trip after cancellation",traveller.tripHistory.AsJSON())
+	}
+	if engine.Administrator.bs.totalGrounded != 0 {
+		t.Error("UpdateTripsAndBackfill changed totalGrounded after cancellation", engine.Administrator.bs.totalGrounded)
+	}
+	us,err = engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*5)
+	if err != nil {
+		t.Error("Update failed after earlier cancellation",err)
+	}
+	if us.Processed != 1 {
+		t.Error("Update reported wrong number of travellers processed",us.Processed)
+	}
+}
+
 func TestUpdateTripsAndBackfillThreadedDatastore(t *testing.T) {
 	for threads:=1; threads <= 16; threads *=2 {
 		db := db.NewDatastoreDB("flaptest")
@@ -313,6 +351,75 @@ func TestUpdateTripsAndBackfillThreadedDatastore(t *testing.T) {
 	}
 }
 
+func TestUpdateTripsAndBackfillThreadedMemory(t *testing.T) {
+	for threads:=1; threads <= 16; threads *=2 {
+		db := db.NewMemoryDB()
+		testUpdateTripsThreaded(t,threads,db)
+		db.Release()
+	}
+}
+
+func TestUpdateTripsAndBackfillThreadedBolt(t *testing.T) {
+	for threads:=1; threads <= 16; threads *=2 {
+		db := db.NewBoltDB("enginetest.db")
+		if db == nil {
+			t.Error("Failed to create db object")
+			return
+		}
+		testUpdateTripsThreaded(t,threads,db)
+		db.Release()
+		os.Remove("enginetest.db")
+	}
+}
+
+func TestUpdateTripsAndBackfillThreadedSQL(t *testing.T) {
+	for threads:=1; threads <= 16; threads *=2 {
+		db := db.NewSQLDB("sqlite3","file:enginetest.sqlite")
+		if db == nil {
+			t.Error("Failed to create db object")
+			return
+		}
+		testUpdateTripsThreaded(t,threads,db)
+		db.Release()
+		os.Remove("enginetest.sqlite")
+		os.Remove("enginetest.sqlite-wal")
+		os.Remove("enginetest.sqlite-shm")
+	}
+}
+
+func TestBackfillThreads(t *testing.T) {
+	for _,c := range []struct{threads uint; expected uint}{{0,1},{1,1},{7,7},{backfillRanges,backfillRanges},{1000,backfillRanges}} {
+		params := FlapParams{Threads:c.threads}
+		if params.backfillThreads() != c.expected {
+			t.Error("Wrong number of backfill threads",c.threads,params.backfillThreads())
+		}
+	}
+}
+
+func TestUpdateTripsAndBackfillAnyThreads(t *testing.T) {
+	for _,threads := range []int{3,7,24,300} {
+		db := db.NewMemoryDB()
+		testUpdateTripsThreaded(t,threads,db)
+		db.Release()
+	}
+}
+
+func TestUpdateTripsAndBackfillThreadedCache(t *testing.T) {
+	for threads:=1; threads <= 16; threads *=2 {
+		db := db.NewCacheDB(db.NewMemoryDB(),10)
+		testUpdateTripsThreaded(t,threads,db)
+		db.Release()
+	}
+}
+
+func TestUpdateTripsAndBackfillThreadedShards(t *testing.T) {
+	for threads:=1; threads <= 16; threads *=2 {
+		db := db.NewShardDB([]db.Database{db.NewMemoryDB(),db.NewMemoryDB(),db.NewMemoryDB(),db.NewMemoryDB()})
+		testUpdateTripsThreaded(t,threads,db)
+		db.Release()
+	}
+}
+
 func TestUpdateTripsAndBackfillThreaded(t *testing.T) {
 	for threads:=1; threads <= 16; threads *=2 {
 		db := enginesetup(t)
@@ -323,7 +430,7 @@ func TestUpdateTripsAndBackfillThreaded(t *testing.T) {
 
 func testUpdateTripsThreaded(t *testing.T,threads int, db db.Database) {
 	engine := NewEngine(db,3,".")
-	paramsIn := FlapParams{DailyTotal:100, MinGrounded:1,FlightInterval:1,FlightsInTrip:50,TripLength:365,Threads:byte(threads)}
+	paramsIn := FlapParams{DailyTotal:100, MinGrounded:1,FlightInterval:1,FlightsInTrip:50,TripLength:365,Threads:uint(threads)}
 	err := engine.Administrator.SetParams(paramsIn)
 	if err != nil {
 		t.Error("SetParams failed",err)
@@ -337,7 +444,7 @@ func testUpdateTripsThreaded(t *testing.T,threads int, db db.Database) {
 	err = engine.SubmitFlights(passport2,flights2,SecondsInDay,true)
 	passport3 := NewPassport("333333333","uk")
 	err = engine.SubmitFlights(passport3,flights13,SecondsInDay,true)
-	us,err := engine.UpdateTripsAndBackfill(SecondsInDay*5)
+	us,err := engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*5)
 	if err != nil {
 		t.Error("Update failed for three travellers",err)
 	}
@@ -345,7 +452,7 @@ func testUpdateTripsThreaded(t *testing.T,threads int, db db.Database) {
 	if traveller.tripHistory.entries[0].et != etTripEnd {
 		t.Error("UpdateTripsAndBackfill failed to end trip of traveller 1",traveller.tripHistory.AsJSON())
 	}
-	expectedBalance := 100 - (flights13[0].Distance+flights13[1].Distance)
+	expectedBalance := Kilometres(100).Metres() - flights13[0].Distance.Metres() - flights13[1].Distance.Metres()
 	if traveller.Balance !=  expectedBalance {
 		t.Error("UpdateTripsAndBackfill didnt backfill traveller 1correctly", expectedBalance,traveller.Balance)
 	}
@@ -360,7 +467,7 @@ func testUpdateTripsThreaded(t *testing.T,threads int, db db.Database) {
 	if traveller.tripHistory.entries[0].et != etFlight {
 		t.Error("UpdateTripsAndBackfill ended trip of traveller 2",traveller.tripHistory.AsJSON())
 	}
-	expectedBalance = -(flights2[0].Distance+flights2[1].Distance)
+	expectedBalance = -flights2[0].Distance.Metres() - flights2[1].Distance.Metres()
 	if traveller.Balance !=  expectedBalance {
 		t.Error("UpdateTripsAndBackfill backfilled traveller 2", traveller.Balance)
 	}
@@ -392,7 +499,7 @@ func TestUpdateTripsAndBackfillPromises(t  *testing.T) {
 	flights = append(flights,*createFlight(1,SecondsInDay,SecondsInDay+1),*createFlight(1,SecondsInDay*3,SecondsInDay*3+1))
 	passport := NewPassport("987654321","uk")
 	err := engine.SubmitFlights(passport,flights,SecondsInDay,true)
-	_,err = engine.UpdateTripsAndBackfill(SecondsInDay*5)
+	_,err = engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*5)
 	if err != nil {
 		t.Error("Update failed for one Traveller",err)
 	}
@@ -403,7 +510,7 @@ func TestUpdateTripsAndBackfillPromises(t  *testing.T) {
 		t.Error("predictor has more than one point after one call to Update")
 	}
 	pexpected := engine.Administrator.predictor
-	_,err = engine.UpdateTripsAndBackfill(SecondsInDay*6)
+	_,err = engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*6)
 	if err != nil {
 		t.Error("Second Update failed with promises activated",err)
 	}
@@ -446,7 +553,7 @@ func TestUpdateTripsAndBackfillKeepPromises(t  *testing.T) {
 	err = engine.SubmitFlights(passport,flights,SecondsInDay,true)
 
 	// Carry out Update on date when promise should be enforced
-	_,err = engine.UpdateTripsAndBackfill(SecondsInDay*4)
+	_,err = engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*4)
 	if err != nil {
 		t.Error("Update failed when trying to test keep",err)
 	}
@@ -462,7 +569,7 @@ func TestUpdateTripsAndBackfillKeepPromises(t  *testing.T) {
 
 	// Check traveller is backfilled even though they are cleared to fly
 	startbalance := traveller.Balance
-	_,err = engine.UpdateTripsAndBackfill(SecondsInDay*4)
+	_,err = engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*4)
 	if err != nil {
 		t.Error("Update failed when trying to test keep",err)
 	}
@@ -470,7 +577,7 @@ func TestUpdateTripsAndBackfillKeepPromises(t  *testing.T) {
 	if err != nil {
 		t.Error("Failed to get traveller when testing keep")
 	}
-	if traveller.Balance != startbalance+20 {
+	if traveller.Balance != startbalance+Kilometres(20).Metres() {
 		t.Error("Failed to backfill cleared traveller with negative balance",startbalance,traveller.Balance)
 	}
 	if traveller.Kept.Clearance != SecondsInDay*4 {
@@ -506,7 +613,7 @@ func TestUpdateTripsAndBackfillGap(t  *testing.T) {
 	err = engine.SubmitFlights(passport,flights,SecondsInDay,true)
 
 	// Carry out Update on date when promise should be enforced
-	_,err = engine.UpdateTripsAndBackfill(SecondsInDay*4)
+	_,err = engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*4)
 	if err != nil {
 		t.Error("Update failed when trying to test keep",err)
 	}
@@ -527,26 +634,54 @@ func TestPromisesCorrectBalances(t *testing.T) {
 				Promises:PromisesConfig{Algo:paLinearBestFit,MaxPoints:100}}
 	engine.Administrator.SetParams(paramsIn)
 	engine.Administrator.pc.change(-25,0)
-	us,err := engine.UpdateTripsAndBackfill(SecondsInDay*4)
+	us,err := engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*4)
 	if err != nil {
 		t.Error("Update failed when testing promises correction",err)
 	}
-	if us.Share != 100 {
+	if us.Share != Kilometres(100).Metres() {
 		t.Error("Miscalculated share when not correcting promises",us.Share)
 	}
 
 	paramsIn.Promises.Algo = paLinearBestFit | pamCorrectDailyTotal
 	engine.Administrator.SetParams(paramsIn)
-	us,err = engine.UpdateTripsAndBackfill(SecondsInDay*4)
+	us,err = engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*5)
 	if err != nil {
 		t.Error("Update failed when testing promises correction",err)
 	}
-	if us.Share != 75 {
+	if us.Share != Kilometres(75).Metres() {
 		t.Error("Miscalculated share when correcting promises",us.Share)
 	}
 
 }
 
+func TestBackfillRepeatReusesShare(t *testing.T) {
+
+	db:= enginesetup(t)
+	defer engineteardown(db)
+	engine := NewEngine(db,0,"")
+	paramsIn := FlapParams{DailyTotal:100, MinGrounded:1,FlightInterval:1,FlightsInTrip:50,TripLength:365,
+				Promises:PromisesConfig{Algo:paLinearBestFit|pamCorrectDailyTotal,MaxPoints:100}}
+	engine.Administrator.SetParams(paramsIn)
+	engine.Administrator.pc.change(-25,0)
+	first,err := engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*4)
+	if err != nil {
+		t.Error("Update failed",err)
+	}
+	ys := len(*engine.Administrator.predictor.(*bestFit).GetYs())
+	version := engine.Administrator.predictor.version()
+
+	// Repeat with fresh engine, as after a failure, and a different correction due
+	engine = NewEngine(db,0,"")
+	engine.Administrator.pc.change(-50,0)
+	again,err := engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*4)
+	if err != nil || again.Share != first.Share || again.Pool != first.Pool {
+		t.Error("Repeated backfill shared out differently",first.Share,again.Share,err)
+	}
+	if len(*engine.Administrator.predictor.(*bestFit).GetYs()) != ys || engine.Administrator.predictor.version() != version {
+		t.Error("Repeated backfill added predictor point again")
+	}
+}
+
 func TestProposePromisesActive(t *testing.T) {
 	
 	db:= enginesetup(t)
@@ -667,6 +802,57 @@ func TestProposePromisesInactive(t *testing.T) {
 	}
 }
 
+func TestProposeAlternatives(t *testing.T) {
+
+	db:= enginesetup(t)
+	defer engineteardown(db)
+	engine := NewEngine(db,0,"")
+	paramsIn := FlapParams{DailyTotal:100, MinGrounded:1,FlightInterval:1,FlightsInTrip:50,TripLength:365}
+	engine.Administrator.SetParams(paramsIn)
+	passport := NewPassport("987654321","uk")
+	_,err := engine.ProposeAlternatives(passport,1,100,SecondsInDay*2,SecondsInDay*30,3,SecondsInDay)
+	if err != EPROMISESNOTENABLED  {
+		t.Error("ProposeAlternatives succeding when promises aren't enabled",err)
+	}
+
+	paramsIn.Promises = PromisesConfig{Algo:paLinearBestFit,MaxPoints:10,MaxDays:5}
+	engine.Administrator.SetParams(paramsIn)
+	_,err = engine.ProposeAlternatives(passport,1,100,SecondsInDay*30,SecondsInDay*2,3,SecondsInDay)
+	if err != EINVALIDARGUMENT {
+		t.Error("ProposeAlternatives accepted window ending before it starts",err)
+	}
+	alts,err := engine.ProposeAlternatives(passport,1,100,SecondsInDay*2,SecondsInDay*30,10,SecondsInDay)
+	if err != nil || len(alts) != 5 {
+		t.Error("ProposeAlternatives didnt limit window to trips that can be promised",len(alts),err)
+	}
+	alts,err = engine.ProposeAlternatives(passport,1,100,0,SecondsInDay*30,10,SecondsInDay)
+	if err != nil || len(alts) != 6 {
+		t.Error("ProposeAlternatives didnt start window from now",len(alts),err)
+	}
+	alts,err = engine.ProposeAlternatives(passport,1,100,SecondsInDay*2,SecondsInDay*30,3,SecondsInDay)
+	if err != nil || len(alts) != 3 {
+		t.Error("ProposeAlternatives returned wrong number of alternatives",len(alts),err)
+		return
+	}
+	if alts[0].TripStart != SecondsInDay*2 || alts[0].TripEnd != SecondsInDay*3 || alts[0].Clearance != SecondsInDay*4 {
+		t.Error("ProposeAlternatives returned wrong best alternative",alts[0])
+	}
+	err = engine.Make(passport,alts[0].Proposal,SecondsInDay)
+	if err != nil {
+		t.Error("Make failed for alternative proposal",err)
+	}
+}
+
+func TestPromiseDistance(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine := NewEngine(database,0,"")
+	engine.Administrator.SetParams(FlapParams{TaxiOverhead:10})
+	if d := engine.promiseDistance(100,2); d != 120 {
+		t.Error("Wrong promise distance with taxi overhead",d)
+	}
+}
+
 func TestMakePromisesInactive(t *testing.T) {
 	db:= enginesetup(t)
 	defer engineteardown(db)
@@ -737,3 +923,201 @@ func TestMakeOldProposal(t *testing.T) {
 	}
 }
 
+
+// backfillTravellers creates an engine with a number of travellers, each with
+// flights on days 1 and 3 so that they are grounded and backfilled on day 5
+// balancesEngine returns an engine with the given params, recording events, and a
+// traveller created on the first day with each of the given balances. If tripEnded
+// the travellers are also back from a trip.
+func balancesEngine(t *testing.T, database db.Database, params FlapParams, tripEnded bool, balances ...Metres) (*Engine,[]Passport) {
+	engine := NewEngine(database,0,"")
+	engine.RecordEvents(NewEventLog(database))
+	err := engine.Administrator.SetParams(params)
+	if err != nil {
+		t.Error("SetParams failed",err)
+	}
+	var passports []Passport
+	for i,balance := range balances {
+		passport := NewPassport(fmt.Sprintf("%09d",i),"uk")
+		traveller := Traveller{passport:passport,Created:SecondsInDay}
+		if tripEnded {
+			traveller.tripHistory.entries[0] = *createFlight(5,SecondsInDay/2,SecondsInDay/2+1)
+			traveller.tripHistory.entries[0].et = etTripEnd
+		}
+		traveller.transact(balance,SecondsInDay,TTBalanceAdjustment)
+		err = engine.Travellers.PutTraveller(traveller)
+		if err != nil {
+			t.Error("PutTraveller failed",err)
+		}
+		passports = append(passports,passport)
+	}
+	return engine,passports
+}
+
+func backfillTravellers(t *testing.T, database db.Database, n int) (*Engine,[]Passport) {
+	engine := NewEngine(database,0,"")
+	paramsIn := FlapParams{DailyTotal:100, MinGrounded:1,FlightInterval:1,FlightsInTrip:50,TripLength:365,Threads:4}
+	err := engine.Administrator.SetParams(paramsIn)
+	if err != nil {
+		t.Error("SetParams failed",err)
+	}
+	var passports []Passport
+	for i:=0; i < n; i++ {
+		passport := NewPassport(fmt.Sprintf("%09d",i),"uk")
+		flights := []Flight{*createFlight(1+i%10,SecondsInDay,SecondsInDay+1),*createFlight(1+i%10,SecondsInDay*3,SecondsInDay*3+1)}
+		err = engine.SubmitFlights(passport,flights,SecondsInDay,true)
+		if err != nil {
+			t.Error("SubmitFlights failed",err)
+		}
+		passports = append(passports,passport)
+	}
+	return engine,passports
+}
+
+// dailyShares returns the number of daily shares credited to the traveller at the given time
+func dailyShares(traveller *Traveller, now EpochTime) int {
+	n := 0
+	for it := traveller.Transactions.NewIterator(); it.Next(); {
+		if tr := it.Value(); tr.TT == TTDailyShare && tr.Date == now {
+			n++
+		}
+	}
+	return n
+}
+
+func TestUpdateTripsAndBackfillIndexed(t *testing.T) {
+	const n = 16
+	engine,passports := backfillTravellers(t,db.NewMemoryDB(),n)
+
+	// Add travellers that need no daily update
+	for i:=0; i < n; i++ {
+		var traveller Traveller
+		traveller.passport = NewPassport(fmt.Sprintf("9%08d",i),"uk")
+		traveller.transact(10,SecondsInDay,TTDailyShare)
+		engine.Travellers.PutTraveller(traveller)
+	}
+
+	// Only those that travelled are visited
+	for day:=0; day < 2; day++ {
+		us,err := engine.UpdateTripsAndBackfill(context.Background(),EpochTime(SecondsInDay*(5+day)))
+		if err != nil {
+			t.Error("UpdateTripsAndBackfill failed",day,err)
+		}
+		if us.Processed != n || us.Grounded != n {
+			t.Error("UpdateTripsAndBackfill visited wrong travellers",day,us.Processed,us.Grounded)
+		}
+	}
+	for _,passport := range passports {
+		traveller,_ := engine.Travellers.GetTraveller(passport)
+		if dailyShares(&traveller,SecondsInDay*5) != 1 || dailyShares(&traveller,SecondsInDay*6) != 1 {
+			t.Error("Traveller not backfilled",passport.ToString())
+		}
+	}
+}
+
+func TestUpdateTripsAndBackfillFaults(t *testing.T) {
+	const n = 64
+	now := EpochTime(SecondsInDay*5)
+
+	// Find balances after a backfill without faults
+	engine,passports := backfillTravellers(t,db.NewMemoryDB(),n)
+	_,err := engine.UpdateTripsAndBackfill(context.Background(),now)
+	if err != nil {
+		t.Error("UpdateTripsAndBackfill failed without faults",err)
+	}
+	expected := make(map[Passport]Metres)
+	for _,passport := range passports {
+		traveller,_ := engine.Travellers.GetTraveller(passport)
+		expected[passport] = traveller.Balance
+	}
+
+	for _,rule := range []db.FaultRule {
+		{Op:db.FOSnapshot,Table:travellersTableName,Times:1},
+		{Op:db.FOSnapshot,Table:travellerIndexNames[numTravellerIndices-1],Times:1},
+		{Op:db.FOIterNext,Table:travellerIndexNames[tiMidTrip],After:n/2,Times:1},
+		{Op:db.FOGet,Table:travellersTableName,After:n/2,Times:1},
+		{Op:db.FOBatchPut,Table:travellersTableName,After:n/2,Times:1},
+		{Op:db.FOBatchFlush,Table:travellersTableName,Times:1},
+	} {
+		fdb := db.NewFaultDB(db.NewMemoryDB())
+		engine,passports = backfillTravellers(t,fdb,n)
+		fdb.AddRule(rule)
+		totalGrounded := engine.Administrator.bs.totalGrounded
+		_,err = engine.UpdateTripsAndBackfill(context.Background(),now)
+		if err != db.EINJECTEDFAULT {
+			t.Error("Injected fault not reported",rule.Op,err)
+		}
+		if engine.Administrator.bs.totalGrounded != totalGrounded {
+			t.Error("Failed backfill changed total grounded",rule.Op,engine.Administrator.bs.totalGrounded)
+		}
+
+		// Check every traveller is either untouched or fully backfilled
+		credited := 0
+		for _,passport := range passports {
+			traveller,err := engine.Travellers.GetTraveller(passport)
+			if err != nil {
+				t.Error("Traveller lost after failed backfill",rule.Op,err)
+				continue
+			}
+			switch dailyShares(&traveller,now) {
+				case 0:
+				case 1:
+					credited++
+					if traveller.Balance != expected[passport] {
+						t.Error("Traveller credited wrong amount",rule.Op,traveller.Balance,expected[passport])
+					}
+				default:
+					t.Error("Traveller credited more than once",rule.Op)
+			}
+		}
+		if credited == n {
+			t.Error("Fault didnt stop any traveller being backfilled",rule.Op)
+		}
+
+		// Repeat the backfill and check every traveller is credited exactly once
+		fdb.ClearRules()
+		us,err := engine.UpdateTripsAndBackfill(context.Background(),now)
+		if err != nil || us.Grounded != n {
+			t.Error("Repeated backfill failed",rule.Op,us.Grounded,err)
+		}
+		for _,passport := range passports {
+			traveller,err := engine.Travellers.GetTraveller(passport)
+			if err != nil {
+				t.Error("Traveller lost after repeated backfill",rule.Op,err)
+				continue
+			}
+			if dailyShares(&traveller,now) != 1 || traveller.Balance != expected[passport] {
+				t.Error("Traveller not credited exactly once",rule.Op,traveller.Balance,expected[passport])
+			}
+		}
+		if engine.Administrator.bs.totalGrounded != n {
+			t.Error("Total grounded not updated by repeated backfill",engine.Administrator.bs.totalGrounded)
+		}
+		fdb.Release()
+	}
+}
+
+func TestSubmitFlightsFault(t *testing.T) {
+	fdb := db.NewFaultDB(db.NewMemoryDB())
+	defer fdb.Release()
+	engine := NewEngine(fdb,0,"")
+	fdb.AddRule(db.FaultRule{Op:db.FOPut,Table:travellersTableName,Times:1})
+	passport := NewPassport("987654321","uk")
+	flights := []Flight{*createFlight(1,SecondsInDay,SecondsInDay+1)}
+	err := engine.SubmitFlights(passport,flights,SecondsInDay,true)
+	if err != db.EINJECTEDFAULT {
+		t.Error("SubmitFlights didnt report failed write",err)
+	}
+	_,err = engine.Travellers.GetTraveller(passport)
+	if err == nil {
+		t.Error("Failed SubmitFlights stored traveller")
+	}
+	err = engine.SubmitFlights(passport,flights,SecondsInDay,true)
+	if err != nil {
+		t.Error("SubmitFlights failed after fault",err)
+	}
+	traveller,_ := engine.Travellers.GetTraveller(passport)
+	if traveller.Balance != -flights[0].Distance.Metres() {
+		t.Error("Resubmitted flight debited wrong amount",traveller.Balance,-flights[0].Distance)
+	}
+}
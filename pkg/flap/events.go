@@ -0,0 +1,361 @@
+package flap
+
+import (
+	"github.com/richardmorrey/flap/pkg/db"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var EREPLAYDIVERGED = errors.New("Replayed event failed when the original succeeded")
+
+// EventType identifies the engine command recorded by an event
+type EventType uint8
+const (
+	ETSetParams	EventType = iota
+	ETSubmitFlights
+	ETPropose
+	ETMake
+	ETBackfill
+	ETSetHousehold
+	ETAllocate
+	ETSubmitHouseholdFlights
+	ETTransfer
+	ETGrantExemption
+	ETRevokeExemption
+)
+
+// Event records a single engine command that succeeded, with the arguments needed to
+// carry it out again. Time is the time given to the command, or zero for commands
+// that dont take one. Logged is the wall clock time it was recorded. Commands that
+// change more than one traveller list them in Members, with the distance moved to or
+// from each in Amounts.
+type Event struct {
+	Seq		uint64
+	Type		EventType
+	Time		EpochTime
+	Logged		int64
+	Passport	Passport
+	Flights		[]Flight
+	TripEnd		EpochTime
+	Debit		bool
+	Promises	[]Promise
+	Version		uint64
+	Params		FlapParams
+	Members		[]Passport
+	Amounts		[]Metres
+	Pooled		bool
+	Exemption	Exemption
+}
+
+// To implements db/Serialize
+func (self* Event) To(b *bytes.Buffer) error {
+	return gob.NewEncoder(b).Encode(self)
+}
+
+// From implements db/Serialize
+func (self* Event) From(b *bytes.Buffer) error {
+	return gob.NewDecoder(b).Decode(self)
+}
+
+// eventSeq is the sequence number of the last event logged. It is written in
+// a fixed encoding so that it can be swapped in place by any process.
+type eventSeq uint64
+
+// To implements db/Serialize
+func (self *eventSeq) To(buff *bytes.Buffer) error {
+	return binary.Write(buff,binary.BigEndian,self)
+}
+
+// From implements db/Serialize
+func (self *eventSeq) From(buff *bytes.Buffer) error {
+	return binary.Read(buff,binary.BigEndian,self)
+}
+
+// EventLog is a table of engine commands in the order they were carried out, from which
+// the travellers and administrator tables can be rebuilt as they were at any time. Events
+// are keyed by sequence number so that they iterate in order, and the last number used is
+// kept alongside them so that processes sharing the table number them in turn. Each event
+// is also listed under the key of each traveller it is for, or as global if it is for no
+// traveller, so that the events needed to rebuild one traveller can be found quickly.
+const eventsTableName="events"
+const eventKeyPrefix="e"
+const eventSeqKey="seq"
+const eventTravellerPrefix="t"
+const eventGlobalPrefix="g"
+type EventLog struct {
+	table db.Table
+	mux sync.Mutex
+}
+
+// NewEventLog opens the event log in the given database, creating it if it doesnt exist
+func NewEventLog(database db.Database) *EventLog {
+	table,err := database.OpenTable(eventsTableName)
+	if err == db.ETABLENOTFOUND {
+		table,err = database.CreateTable(eventsTableName)
+	}
+	if err != nil {
+		logError(err)
+		return nil
+	}
+	return &EventLog{table:table}
+}
+
+// dropEvents drops the event log from the given database
+func dropEvents(database db.Database) error {
+	return database.DropTable(eventsTableName)
+}
+
+// eventKey returns the key for the event with the given sequence number
+func eventKey(seq uint64) string {
+	return eventKeyPrefix+eventSeqHex(seq)
+}
+
+// eventSeqHex returns the sequence number in a fixed width hex encoding that sorts in order
+func eventSeqHex(seq uint64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],seq)
+	return hex.EncodeToString(b[:])
+}
+
+// eventListKeys returns the keys listing the event under each traveller it is for,
+// or as global if it isnt for a traveller
+func eventListKeys(e *Event) ([]string,error) {
+	if e.Passport == (Passport{}) {
+		return []string{eventGlobalPrefix+eventSeqHex(e.Seq)},nil
+	}
+	var keys []string
+	for _,p := range append([]Passport{e.Passport},e.Members...) {
+		key,err := p.generateKey()
+		if err != nil {
+			return nil,err
+		}
+		lk := eventTravellerPrefix+key+eventSeqHex(e.Seq)
+		if len(keys) == 0 || keys[0] != lk {
+			keys = append(keys,lk)
+		}
+	}
+	return keys,nil
+}
+
+// member returns the position of the given traveller in the event's members, or -1
+func (self *Event) member(passport Passport) int {
+	for i,p := range self.Members {
+		if p == passport {
+			return i
+		}
+	}
+	return -1
+}
+
+// wellFormed returns false if the event lists fewer members or amounts than its type needs,
+// as in a truncated or hand edited log
+func (self *Event) wellFormed() bool {
+	switch self.Type {
+		case ETAllocate,ETTransfer:
+			return len(self.Members) == 2 && len(self.Amounts) == 2
+		case ETSubmitHouseholdFlights:
+			return len(self.Amounts) == len(self.Members)
+	}
+	return true
+}
+
+// append numbers the event and adds it to the end of the log
+func (self *EventLog) append(e Event) error {
+	self.mux.Lock()
+	defer self.mux.Unlock()
+	for {
+		var was eventSeq
+		var wasp db.Serialize = &was
+		err := self.table.Get(eventSeqKey,&was)
+		if err == db.EKEYNOTFOUND {
+			wasp = nil
+		} else if err != nil {
+			return logError(err)
+		}
+		seq := was+1
+		err = self.table.Swap(eventSeqKey,wasp,&seq)
+		if err == db.ESWAPFAILED {
+			continue
+		}
+		if err != nil {
+			return logError(err)
+		}
+		e.Seq = uint64(seq)
+		e.Logged = time.Now().UnixNano()
+
+		// List the event before adding it so that it is never missed. A listing
+		// for an event that wasnt added is skipped.
+		lks,err := eventListKeys(&e)
+		if err != nil {
+			return logError(err)
+		}
+		for _,lk := range lks {
+			err = self.table.Put(lk,&indexEntry{})
+			if err != nil {
+				return logError(err)
+			}
+		}
+		return self.table.Put(eventKey(e.Seq),&e)
+	}
+}
+
+// record appends the event to the log if there is one. An error means the command
+// it records has been carried out but is missing from the log, so couldnt be replayed.
+func (self *EventLog) record(e Event) error {
+	if self == nil {
+		return nil
+	}
+	return self.append(e)
+}
+
+// travellerEvents returns in order the events for the traveller with the given passport,
+// and the global events, up to the first after the given time
+func (self *EventLog) travellerEvents(passport Passport, until EpochTime) ([]Event,error) {
+	key,err := passport.generateKey()
+	if err != nil {
+		return nil,logError(err)
+	}
+
+	// Collect the sequence numbers listed for the traveller and as global
+	var seqs []string
+	for _,prefix := range []string{eventTravellerPrefix+key,eventGlobalPrefix} {
+		it,err := self.table.NewIterator(prefix)
+		if err != nil {
+			return nil,logError(err)
+		}
+		for it.Next() {
+			seqs = append(seqs,strings.TrimPrefix(it.Key(),prefix))
+		}
+		err = it.Error()
+		it.Release()
+		if err != nil {
+			return nil,logError(err)
+		}
+	}
+	sort.Strings(seqs)
+
+	// Retrieve the events
+	var events []Event
+	for _,seq := range seqs {
+		var e Event
+		err = self.table.Get(eventKeyPrefix+seq,&e)
+		if err == db.EKEYNOTFOUND {
+			continue
+		}
+		if err != nil {
+			return nil,logError(err)
+		}
+		if e.Time > until {
+			break
+		}
+		events = append(events,e)
+	}
+	return events,nil
+}
+
+// RecordEvents appends every command that changes state the engine carries out successfully
+// from now on to the given log. To be able to replay from the log it must be recorded from
+// the start, with the engine's tables empty.
+func (self *Engine) RecordEvents(log *EventLog) {
+	self.events = log
+	self.Administrator.events = log
+}
+
+// Replay rebuilds the travellers, households, transfers, exemptions and administrator tables in the target database by
+// carrying out again, in order, the commands in the log up to the first after the given
+// time. Any existing tables are replaced. It returns the number of events replayed,
+// and EREPLAYDIVERGED if a command that succeeded originally fails when replayed.
+func Replay(ctx context.Context, log *EventLog, target db.Database, until EpochTime) (int,error) {
+
+	// Replace existing tables, leaving the log in place in case it is in the same database
+	for _,drop := range []func(db.Database) error{dropAdministrator,dropTravellers,dropHouseholds,dropTransfers,dropExemptions} {
+		err := drop(target)
+		if err != nil && err != db.ETABLENOTFOUND {
+			return 0,logError(err)
+		}
+	}
+	engine := new(Engine)
+	engine.Travellers = NewTravellers(target)
+	engine.Administrator = newAdministrator(target)
+	engine.Households = NewHouseholds(target)
+	engine.Transfers = NewTransfers(target)
+	engine.Exemptions = NewExemptions(target)
+	if engine.Travellers == nil || engine.Administrator == nil || engine.Households == nil || engine.Transfers == nil ||
+	   engine.Exemptions == nil {
+		return 0,logError(EINVALIDARGUMENT)
+	}
+
+	// Carry out each command again
+	it,err := log.table.NewIterator(eventKeyPrefix)
+	if err != nil {
+		return 0,logError(err)
+	}
+	defer it.Release()
+	replayed := 0
+	var backfilled EpochTime
+	for ctx.Err() == nil && it.Next() {
+		var e Event
+		it.Value(&e)
+		if e.Time > until {
+			break
+		}
+		if !e.wellFormed() {
+			logInfo("Event ",e.Seq," is malformed")
+			return replayed,EREPLAYDIVERGED
+		}
+		switch e.Type {
+			case ETSetParams:
+				err = engine.Administrator.SetParams(e.Params)
+			case ETSubmitFlights:
+				err = engine.SubmitFlights(e.Passport,e.Flights,e.Time,e.Debit)
+			case ETPropose:
+				// Proposals, recorded only by older logs, change nothing until made
+			case ETMake:
+				pp := Proposal{version:predictVersion(e.Version)}
+				copy(pp.entries[:],e.Promises)
+				err = engine.Make(e.Passport,&pp,e.Time)
+			case ETBackfill:
+				// A backfill completed by more than one process is only replayed once
+				if e.Time != backfilled {
+					_,err = engine.UpdateTripsAndBackfill(ctx,e.Time)
+					backfilled = e.Time
+				}
+			case ETSetHousehold:
+				err = engine.SetHousehold(e.Passport,e.Members,e.Pooled)
+			case ETAllocate:
+				err = engine.Allocate(e.Passport,e.Members[1],e.Amounts[1],e.Time)
+			case ETSubmitHouseholdFlights:
+				err = engine.SubmitHouseholdFlights(e.Passport,e.Flights,e.Time,e.Debit)
+			case ETTransfer:
+				err = engine.Transfer(e.Passport,e.Members[1],e.Amounts[1],e.Time)
+			case ETGrantExemption:
+				_,err = engine.GrantExemption(e.Passport,e.Exemption)
+			case ETRevokeExemption:
+				err = engine.RevokeExemption(e.Passport,e.Exemption.ID,e.Time)
+		}
+		if ctx.Err() != nil {
+			return replayed,ctx.Err()
+		}
+		if err != nil {
+			logInfo("Replay of event ",e.Seq," failed: ",err)
+			return replayed,EREPLAYDIVERGED
+		}
+		replayed++
+	}
+	if ctx.Err() != nil {
+		return replayed,ctx.Err()
+	}
+	err = it.Error()
+	if err != nil {
+		return replayed,logError(err)
+	}
+	return replayed,engine.Administrator.Save()
+}
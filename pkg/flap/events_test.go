@@ -0,0 +1,235 @@
+package flap
+
+import (
+	"testing"
+	"github.com/richardmorrey/flap/pkg/db"
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// recordEvents runs a few days of commands on an engine recording events, returning
+// the passports of the travellers and their balances after the backfill on day 6
+func recordEvents(t *testing.T, database db.Database, log *EventLog) (*Engine,[]Passport,map[Passport]Metres) {
+	engine := NewEngine(database,0,"")
+	engine.RecordEvents(log)
+	paramsIn := FlapParams{DailyTotal:100, MinGrounded:1,FlightInterval:1,FlightsInTrip:50,TripLength:365,Threads:4,
+		Promises:PromisesConfig{Algo:paLinearBestFit,MaxPoints:10,MaxDays:100}}
+	err := engine.Administrator.SetParams(paramsIn)
+	if err != nil {
+		t.Error("SetParams failed",err)
+	}
+	var passports []Passport
+	for i:=0; i < 8; i++ {
+		passport := NewPassport(fmt.Sprintf("%09d",i),"uk")
+		flights := []Flight{*createFlight(1+i%10,SecondsInDay,SecondsInDay+1),*createFlight(1+i%10,SecondsInDay*3,SecondsInDay*3+1)}
+		err = engine.SubmitFlights(passport,flights,SecondsInDay,true)
+		if err != nil {
+			t.Error("SubmitFlights failed",err)
+		}
+		passports = append(passports,passport)
+	}
+	balances := make(map[Passport]Metres)
+	for day:=5; day < 9; day++ {
+		_,err = engine.UpdateTripsAndBackfill(context.Background(),EpochTime(SecondsInDay*day))
+		if err != nil {
+			t.Error("UpdateTripsAndBackfill failed",err)
+		}
+		if day == 6 {
+			for _,passport := range passports {
+				traveller,_ := engine.Travellers.GetTraveller(passport)
+				balances[passport] = traveller.Balance
+			}
+		}
+		if day == 7 {
+			planned := []Flight{*createFlight(2,SecondsInDay*20,SecondsInDay*20+1),*createFlight(3,SecondsInDay*21,SecondsInDay*21+1)}
+			pp,err := engine.Propose(passports[0],planned,0,SecondsInDay*7)
+			if err != nil {
+				t.Error("Propose failed",err)
+				continue
+			}
+			err = engine.Make(passports[0],pp,SecondsInDay*7)
+			if err != nil {
+				t.Error("Make failed",err)
+			}
+		}
+	}
+	return engine,passports,balances
+}
+
+// sameState checks the travellers and administrator state of two engines match
+func sameState(t *testing.T, engine *Engine, replayed *Engine, passports []Passport) {
+	for _,passport := range passports {
+		traveller,_ := engine.Travellers.GetTraveller(passport)
+		traveller2,err := replayed.Travellers.GetTraveller(passport)
+		if err != nil || !reflect.DeepEqual(traveller,traveller2) {
+			t.Error("Replayed traveller differs",passport.ToString(),err)
+		}
+	}
+	if replayed.Administrator.bs != engine.Administrator.bs || replayed.Administrator.params != engine.Administrator.params {
+		t.Error("Replayed administrator state differs",replayed.Administrator.bs,replayed.Administrator.params)
+	}
+	if !reflect.DeepEqual(*engine.Administrator.predictor.(*bestFit),*replayed.Administrator.predictor.(*bestFit)) {
+		t.Error("Replayed predictor differs")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	log := NewEventLog(database)
+	engine,passports,_ := recordEvents(t,database,log)
+	engine.Release()
+
+	target := db.NewMemoryDB()
+	defer target.Release()
+	replayed,err := Replay(context.Background(),log,target,MaxEpochTime)
+	if err != nil {
+		t.Error("Replay failed",err)
+	}
+	if replayed != 1+8+4+1 {
+		t.Error("Replayed wrong number of events",replayed)
+	}
+	sameState(t,engine,NewEngine(target,0,""),passports)
+}
+
+func TestReplayUntil(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	log := NewEventLog(database)
+	_,passports,balances := recordEvents(t,database,log)
+
+	target := db.NewMemoryDB()
+	defer target.Release()
+	replayed,err := Replay(context.Background(),log,target,SecondsInDay*6)
+	if err != nil || replayed != 1+8+2 {
+		t.Error("Replay until day 6 failed",replayed,err)
+	}
+	engine := NewEngine(target,0,"")
+	for _,passport := range passports {
+		traveller,_ := engine.Travellers.GetTraveller(passport)
+		if traveller.Balance != balances[passport] {
+			t.Error("Replayed balance differs from balance at the time",passport.ToString(),traveller.Balance,balances[passport])
+		}
+	}
+}
+
+func TestReplayInPlace(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	log := NewEventLog(database)
+	engine,passports,_ := recordEvents(t,database,log)
+	engine.Release()
+	expected := db.NewMemoryDB()
+	defer expected.Release()
+	_,err := Replay(context.Background(),log,expected,MaxEpochTime)
+	if err != nil {
+		t.Error("Replay failed",err)
+	}
+
+	// Rebuild from the log kept in the same database
+	_,err = Replay(context.Background(),log,database,MaxEpochTime)
+	if err != nil {
+		t.Error("Replay in place failed",err)
+	}
+	sameState(t,NewEngine(expected,0,""),NewEngine(database,0,""),passports)
+}
+
+func TestReplayDiverged(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	log := NewEventLog(database)
+	err := log.append(Event{Type:ETSubmitFlights,Time:SecondsInDay,Passport:NewPassport("987654321","uk")})
+	if err != nil {
+		t.Error("append failed",err)
+	}
+	_,err = Replay(context.Background(),log,db.NewMemoryDB(),MaxEpochTime)
+	if err != EREPLAYDIVERGED {
+		t.Error("Replay of failing event didnt report divergence",err)
+	}
+}
+
+func TestEventLogSequence(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	logs := []*EventLog{NewEventLog(database),NewEventLog(database)}
+	for i:=0; i < 10; i++ {
+		err := logs[i%2].append(Event{Type:ETBackfill,Time:EpochTime(i)})
+		if err != nil {
+			t.Error("append failed",err)
+		}
+	}
+	it,_ := logs[0].table.NewIterator(eventKeyPrefix)
+	defer it.Release()
+	seq := uint64(0)
+	for it.Next() {
+		var e Event
+		it.Value(&e)
+		seq++
+		if e.Seq != seq || e.Time != EpochTime(seq-1) {
+			t.Error("Events out of sequence",e.Seq,e.Time)
+		}
+	}
+	if seq != 10 {
+		t.Error("Events lost",seq)
+	}
+}
+
+func TestRecordFault(t *testing.T) {
+	fdb := db.NewFaultDB(db.NewMemoryDB())
+	defer fdb.Release()
+	engine := NewEngine(fdb,0,"")
+	engine.RecordEvents(NewEventLog(fdb))
+	err := engine.Administrator.SetParams(FlapParams{DailyTotal:100,MinGrounded:1,FlightInterval:1,FlightsInTrip:50,TripLength:365})
+	if err != nil {
+		t.Error("SetParams failed",err)
+	}
+	fdb.AddRule(db.FaultRule{Op:db.FOPut,Table:eventsTableName,Times:1})
+	err = engine.SubmitFlights(NewPassport("987654321","uk"),[]Flight{*createFlight(1,SecondsInDay,SecondsInDay+1)},SecondsInDay,true)
+	if err != db.EINJECTEDFAULT {
+		t.Error("Failure to record event not reported",err)
+	}
+}
+
+func TestReplayMalformed(t *testing.T) {
+	passports := []Passport{NewPassport("987654321","uk"),NewPassport("987654322","uk")}
+	for _,e := range []Event{{Type:ETAllocate,Time:SecondsInDay,Passport:passports[0],Members:passports[:1],Amounts:[]Metres{-1,1}},
+				 {Type:ETTransfer,Time:SecondsInDay,Passport:passports[0],Members:passports,Amounts:[]Metres{-1}},
+				 {Type:ETSubmitHouseholdFlights,Time:SecondsInDay,Passport:passports[0],Members:passports,Amounts:[]Metres{0}}} {
+		database := db.NewMemoryDB()
+		log := NewEventLog(database)
+		err := log.append(e)
+		if err != nil {
+			t.Error("append failed",err)
+		}
+		_,err = Replay(context.Background(),log,db.NewMemoryDB(),MaxEpochTime)
+		if err != EREPLAYDIVERGED {
+			t.Error("Replay of malformed event didnt report divergence",e.Type,err)
+		}
+		engine := NewEngine(database,0,"")
+		engine.RecordEvents(log)
+		_,err = engine.TravellerAsOf(passports[0],MaxEpochTime)
+		if err != EREPLAYDIVERGED {
+			t.Error("TravellerAsOf with malformed event didnt report divergence",e.Type,err)
+		}
+		database.Release()
+	}
+}
+
+func TestProposeNotRecorded(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	log := NewEventLog(database)
+	engine,passports,_ := recordEvents(t,database,log)
+	events,_ := log.travellerEvents(passports[0],MaxEpochTime)
+	for _,e := range events {
+		if e.Type == ETPropose {
+			t.Error("Proposal recorded",e.Seq)
+		}
+	}
+	_,err := engine.Propose(passports[0],[]Flight{*createFlight(1,SecondsInDay*20,SecondsInDay*20+1)},0,SecondsInDay*7)
+	after,_ := log.travellerEvents(passports[0],MaxEpochTime)
+	if len(after) != len(events) {
+		t.Error("Propose added to log",err)
+	}
+}
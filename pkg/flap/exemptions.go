@@ -0,0 +1,208 @@
+package flap
+
+import (
+	"github.com/richardmorrey/flap/pkg/db"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"bytes"
+	"errors"
+)
+
+var EINVALIDEXEMPTION = errors.New("Invalid exemption")
+var EEXEMPTIONOVERLAPS = errors.New("Exemption overlaps another for the traveller")
+var ENOEXEMPTION = errors.New("No such exemption")
+
+// ExemptionCategory identifies why a traveller is exempt
+type ExemptionCategory uint8
+const (
+	ECMedical	ExemptionCategory = 0x01
+	ECDiplomatic	ExemptionCategory = 0x02
+	ECHumanitarian	ExemptionCategory = 0x03
+)
+
+// ExemptionWaiver is a set of flags for the checks an exemption waives
+type ExemptionWaiver uint8
+const (
+	EWClearance	ExemptionWaiver = 0x01
+	EWDebit		ExemptionWaiver = 0x02
+	ewAll		ExemptionWaiver = EWClearance|EWDebit
+)
+
+// Exemption lets a traveller fly from Start until End without being grounded, without
+// having flights debited, or both. Each flight it makes a difference to is recorded
+// with a zero TTExemption transaction referring to it by ID. IDs are given out in turn
+// for each traveller when exemptions are granted. Authority and Reference record who
+// granted it and their reference for it.
+type Exemption struct {
+	ID		uint64
+	Category	ExemptionCategory
+	Waives		ExemptionWaiver
+	Start		EpochTime
+	End		EpochTime
+	Authority	string
+	Reference	string
+}
+
+// To implements db/Serialize
+func (self* Exemption) To(b *bytes.Buffer) error {
+	return gob.NewEncoder(b).Encode(self)
+}
+
+// From implements db/Serialize
+func (self* Exemption) From(b *bytes.Buffer) error {
+	return gob.NewDecoder(b).Decode(self)
+}
+
+// waives returns true if there is an exemption and it waives the given check
+func (self *Exemption) waives(ew ExemptionWaiver) bool {
+	return self != nil && self.Waives & ew == ew
+}
+
+// activeExemption returns the exemption from the list valid at the given time, or nil
+func activeExemption(exemptions []Exemption, now EpochTime) *Exemption {
+	for i := range exemptions {
+		if now >= exemptions[i].Start && now < exemptions[i].End {
+			return &exemptions[i]
+		}
+	}
+	return nil
+}
+
+// Exemptions is a table of the exemptions granted to travellers, keyed by the
+// key of the traveller's record followed by the exemption's ID
+const exemptionsTableName="exemptions"
+type Exemptions struct {
+	table db.Table
+}
+
+// NewExemptions opens the exemptions table in the given database, creating it if it doesnt exist
+func NewExemptions(database db.Database) *Exemptions {
+	table,err := database.OpenTable(exemptionsTableName)
+	if err == db.ETABLENOTFOUND {
+		table,err = database.CreateTable(exemptionsTableName)
+	}
+	if err != nil {
+		logError(err)
+		return nil
+	}
+	return &Exemptions{table:table}
+}
+
+// dropExemptions drops the exemptions table from the given database
+func dropExemptions(database db.Database) error {
+	return database.DropTable(exemptionsTableName)
+}
+
+// exemptionKey returns the key for the exemption with the given ID for the traveller with the given key
+func exemptionKey(traveller string, id uint64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],id)
+	return traveller+hex.EncodeToString(b[:])
+}
+
+// GetExemptions returns all the exemptions granted to the traveller with the given passport, in
+// the order they were granted
+func (self *Exemptions) GetExemptions(passport Passport) ([]Exemption,error) {
+	key,err := passport.generateKey()
+	if err != nil {
+		return nil,err
+	}
+	it,err := self.table.NewIterator(key)
+	if err != nil {
+		return nil,err
+	}
+	defer it.Release()
+	var exemptions []Exemption
+	for it.Next() {
+		var e Exemption
+		it.Value(&e)
+		exemptions = append(exemptions,e)
+	}
+	return exemptions,it.Error()
+}
+
+// active returns the exemption for the traveller with the given passport valid at the given
+// time, or nil if there isnt one
+func (self *Exemptions) active(passport Passport, now EpochTime) (*Exemption,error) {
+	exemptions,err := self.GetExemptions(passport)
+	if err != nil {
+		return nil,err
+	}
+	return activeExemption(exemptions,now),nil
+}
+
+// put writes the exemption for the traveller with the given passport
+func (self *Exemptions) put(passport Passport, e *Exemption) error {
+	key,err := passport.generateKey()
+	if err != nil {
+		return err
+	}
+	return self.table.Put(exemptionKey(key,e.ID),e)
+}
+
+// GrantExemption grants the given exemption to the traveller with the given passport,
+// returning its ID. Exemptions for the same traveller cant overlap.
+func (self *Engine) GrantExemption(passport Passport, e Exemption) (uint64,error) {
+
+	// Check args
+	if e.Category < ECMedical || e.Category > ECHumanitarian || e.Waives == 0 ||
+	   e.Waives & ^ewAll != 0 || e.Start >= e.End {
+		return 0,EINVALIDEXEMPTION
+	}
+	exemptions,err := self.Exemptions.GetExemptions(passport)
+	if err != nil {
+		return 0,logError(err)
+	}
+	for _,x := range exemptions {
+		if e.Start < x.End && x.Start < e.End {
+			return 0,EEXEMPTIONOVERLAPS
+		}
+	}
+
+	// Store
+	e.ID = uint64(len(exemptions))+1
+	err = self.Exemptions.put(passport,&e)
+	if err != nil {
+		return 0,logError(err)
+	}
+	err = self.events.record(Event{Type:ETGrantExemption,Passport:passport,Exemption:e})
+	if err != nil {
+		return 0,err
+	}
+	return e.ID,nil
+}
+
+// RevokeExemption ends the exemption with the given ID for the traveller with the given
+// passport at the given time, if it would otherwise end later
+func (self *Engine) RevokeExemption(passport Passport, id uint64, now EpochTime) error {
+	exemptions,err := self.Exemptions.GetExemptions(passport)
+	if err != nil {
+		return logError(err)
+	}
+	if id == 0 || id > uint64(len(exemptions)) {
+		return ENOEXEMPTION
+	}
+	e := &exemptions[id-1]
+	if !revoke(e,now) {
+		return nil
+	}
+	err = self.Exemptions.put(passport,e)
+	if err != nil {
+		return logError(err)
+	}
+	return self.events.record(Event{Type:ETRevokeExemption,Time:now,Passport:passport,Exemption:Exemption{ID:id}})
+}
+
+// revoke ends the exemption at the given time, or when it starts if that is later,
+// returning false if it already ends by then
+func revoke(e *Exemption, now EpochTime) bool {
+	if now >= e.End {
+		return false
+	}
+	if now < e.Start {
+		now = e.Start
+	}
+	e.End = now
+	return true
+}
@@ -0,0 +1,152 @@
+package flap
+
+import (
+	"testing"
+	"github.com/richardmorrey/flap/pkg/db"
+	"bytes"
+	"context"
+	"reflect"
+)
+
+// groundedTraveller returns an engine with a traveller back from a trip and in debit
+func groundedTraveller(t *testing.T, database db.Database) (*Engine,Passport) {
+	engine,_ := balancesEngine(t,database,FlapParams{DailyTotal:100,MinGrounded:1,FlightInterval:1,FlightsInTrip:50,TripLength:2,Threads:4},false)
+	passport := NewPassport("400000000","uk")
+	err := engine.SubmitFlights(passport,[]Flight{*createFlight(1,SecondsInDay,SecondsInDay+1)},SecondsInDay,true)
+	if err != nil {
+		t.Error("SubmitFlights failed",err)
+	}
+	for day:=2; day < 5; day++ {
+		engine.UpdateTripsAndBackfill(context.Background(),EpochTime(SecondsInDay*day))
+	}
+	params := engine.Administrator.params
+	params.DailyTotal = 0
+	engine.Administrator.SetParams(params)
+	traveller,_ := engine.Travellers.GetTraveller(passport)
+	if traveller.Cleared(SecondsInDay*5) != CRGrounded {
+		t.Error("Traveller not grounded",traveller.Balance)
+	}
+	return engine,passport
+}
+
+func TestGrantExemption(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine := NewEngine(database,0,"")
+	passport := NewPassport("400000000","uk")
+	for _,e := range []Exemption{{Category:0,Waives:EWDebit,Start:1,End:2},{Category:ECMedical,Waives:0,Start:1,End:2},
+				     {Category:ECMedical,Waives:0x04,Start:1,End:2},{Category:ECMedical,Waives:EWDebit,Start:2,End:2}} {
+		_,err := engine.GrantExemption(passport,e)
+		if err != EINVALIDEXEMPTION {
+			t.Error("Invalid exemption granted",e,err)
+		}
+	}
+	granted := []Exemption{{Category:ECMedical,Waives:EWDebit,Start:SecondsInDay,End:SecondsInDay*3,Authority:"WHO",Reference:"M1"},
+			       {Category:ECDiplomatic,Waives:EWDebit|EWClearance,Start:SecondsInDay*3,End:SecondsInDay*10,Authority:"FCDO",Reference:"D1"}}
+	for i := range granted {
+		id,err := engine.GrantExemption(passport,granted[i])
+		if err != nil || id != uint64(i+1) {
+			t.Error("GrantExemption failed",id,err)
+		}
+		granted[i].ID = id
+	}
+	_,err := engine.GrantExemption(passport,Exemption{Category:ECHumanitarian,Waives:EWDebit,Start:SecondsInDay*9,End:SecondsInDay*11})
+	if err != EEXEMPTIONOVERLAPS {
+		t.Error("Overlapping exemption granted",err)
+	}
+	exemptions,err := engine.Exemptions.GetExemptions(passport)
+	if err != nil || !reflect.DeepEqual(exemptions,granted) {
+		t.Error("GetExemptions returned wrong exemptions",exemptions,err)
+	}
+
+	// Revoke
+	err = engine.RevokeExemption(passport,2,SecondsInDay*5)
+	if err != nil {
+		t.Error("RevokeExemption failed",err)
+	}
+	ex,_ := engine.Exemptions.active(passport,SecondsInDay*5)
+	if ex != nil {
+		t.Error("Revoked exemption still active",ex)
+	}
+	ex,_ = engine.Exemptions.active(passport,SecondsInDay*4)
+	if ex == nil || ex.ID != 2 {
+		t.Error("Exemption not active before it was revoked",ex)
+	}
+	err = engine.RevokeExemption(passport,3,SecondsInDay*5)
+	if err != ENOEXEMPTION {
+		t.Error("Revoked unknown exemption",err)
+	}
+}
+
+func TestSubmitFlightsExempt(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passport := groundedTraveller(t,database)
+	flights := []Flight{*createFlight(2,SecondsInDay*5,SecondsInDay*5+1)}
+	err := engine.SubmitFlights(passport,flights,SecondsInDay*5,true)
+	if err != EGROUNDED {
+		t.Error("Grounded traveller flew without exemption",err)
+	}
+
+	// Clearance waived, flight still debited
+	id,_ := engine.GrantExemption(passport,Exemption{Category:ECMedical,Waives:EWClearance,Start:SecondsInDay*5,End:SecondsInDay*6})
+	before,_ := engine.Travellers.GetTraveller(passport)
+	err = engine.SubmitFlights(passport,flights,SecondsInDay*5,true)
+	if err != nil {
+		t.Error("Exempt traveller grounded",err)
+	}
+	traveller,_ := engine.Travellers.GetTraveller(passport)
+	if traveller.Balance != before.Balance-flights[0].Distance.Metres() {
+		t.Error("Flight not debited when only clearance waived",traveller.Balance)
+	}
+	if traveller.Transactions.entries[0] != (Transaction{Date:SecondsInDay*5,TT:TTExemption,Ref:id}) {
+		t.Error("Exemption not recorded",traveller.Transactions.entries[0])
+	}
+
+	// Debit waived
+	engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*6)
+	engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*7)
+	id,_ = engine.GrantExemption(passport,Exemption{Category:ECHumanitarian,Waives:EWClearance|EWDebit,Start:SecondsInDay*7,End:SecondsInDay*8})
+	before,_ = engine.Travellers.GetTraveller(passport)
+	err = engine.SubmitFlights(passport,[]Flight{*createFlight(3,SecondsInDay*7,SecondsInDay*7+1)},SecondsInDay*7,true)
+	if err != nil {
+		t.Error("Exempt traveller grounded",err)
+	}
+	traveller,_ = engine.Travellers.GetTraveller(passport)
+	if traveller.Balance != before.Balance || traveller.Transactions.entries[0] != (Transaction{Date:SecondsInDay*7,TT:TTExemption,Ref:id}) {
+		t.Error("Flight debited when waived",traveller.Balance,traveller.Transactions.entries[0])
+	}
+
+	// Reported in stats for the day after
+	us,err := engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*8)
+	if err != nil || us.ExemptFlights != 1 {
+		t.Error("Exempt flights not reported",us.ExemptFlights,err)
+	}
+
+	// Rebuilt with exemptions
+	ts,err := engine.TravellerAsOf(passport,MaxEpochTime)
+	traveller,_ = engine.Travellers.GetTraveller(passport)
+	if err != nil || !reflect.DeepEqual(ts.Traveller,traveller) {
+		t.Error("Exempt traveller as of now differs from record",err)
+	}
+	target := db.NewMemoryDB()
+	defer target.Release()
+	_,err = Replay(context.Background(),engine.events,target,MaxEpochTime)
+	replayed,_ := NewEngine(target,0,"").Travellers.GetTraveller(passport)
+	if err != nil || !reflect.DeepEqual(replayed,traveller) {
+		t.Error("Replayed exempt traveller differs",err)
+	}
+}
+
+func TestExemptionTransactionEncoding(t *testing.T) {
+	var traveller Traveller
+	traveller.transact(-100,SecondsInDay,TTFlight)
+	traveller.Transactions.add(Transaction{Date:SecondsInDay*2,TT:TTExemption,Ref:12345})
+	var buff bytes.Buffer
+	traveller.To(&buff)
+	var traveller2 Traveller
+	err := traveller2.From(&buff)
+	if err != nil || traveller2.Transactions != traveller.Transactions {
+		t.Error("Exemption reference not kept",traveller2.Transactions.entries[0],err)
+	}
+}
@@ -0,0 +1,109 @@
+package flap
+
+import (
+	"math"
+)
+
+// forecastBandWidth is the number of standard deviations of the daily share either
+// side of the best fit covered by a forecast's confidence band
+const forecastBandWidth=2
+
+// ClearanceForecast is a projection of when a traveller in debit will be back in credit,
+// assuming backfilling starts straight away. Earliest and Latest bound the projection
+// by how far the daily share, as smoothed by the promises predictor, has strayed from
+// its best fit. If promises aren't enabled, or the predictor cant make a prediction,
+// Predicted is false and the projection assumes the share stays as it is today, with
+// no band either side.
+type ClearanceForecast struct {
+	Balance		Metres
+	Clearance	EpochTime
+	Earliest	EpochTime
+	Latest		EpochTime
+	Predicted	bool
+}
+
+// ForecastClearance returns a forecast of when the traveller with the given passport
+// will return to credit. Travellers already in credit are forecast to be cleared now.
+func (self *Engine) ForecastClearance(passport Passport, now EpochTime) (*ClearanceForecast,error) {
+
+	// Retrieve balance
+	t,err := self.Travellers.GetTraveller(passport)
+	if err != nil {
+		return nil,err
+	}
+	f := ClearanceForecast{Balance:t.Balance,Clearance:now,Earliest:now,Latest:now}
+	if t.Balance >= 0 {
+		return &f,nil
+	}
+	debt := (-t.Balance).Kilometres()
+	start := now.toEpochDays(false)
+
+	// Predict when the debt will be backfilled, with a band from the spread of
+	// residuals over the days it takes
+	if self.Administrator.validPredictor() {
+		predictor := self.Administrator.predictor
+		clearance,err := predictor.predict(debt,start)
+		if err == nil {
+			var spread Kilometres
+			last,ok := self.lastPredictorDay()
+			if ok {
+				spread = Kilometres(forecastBandWidth*rootMeanSquare(predictor.residuals(last))*
+						    math.Sqrt(float64(clearance-start)))
+			}
+			f.Clearance = clearance.toEpochTime()
+			f.Earliest = now
+			if debt > spread {
+				earliest,err := predictor.predict(debt-spread,start)
+				if err == nil {
+					f.Earliest = earliest.toEpochTime()
+				}
+			}
+			f.Latest = MaxEpochTime
+			latest,err := predictor.predict(debt+spread,start)
+			if err == nil {
+				f.Latest = latest.toEpochTime()
+			}
+			f.Predicted = true
+			return &f,nil
+		}
+		logDebug("predict failed: ",err)
+	}
+
+	// Otherwise assume today's share carries on
+	backfillers := uint64(math.Max(float64(self.Administrator.params.MinGrounded),float64(self.Administrator.bs.totalGrounded)))
+	if backfillers == 0 {
+		return nil,ENOVALIDPREDICTION
+	}
+	share := self.Administrator.params.DailyTotal.Metres().divide(backfillers)
+	if share <= 0 {
+		return nil,ENOVALIDPREDICTION
+	}
+	days := (-t.Balance+share-1)/share
+	f.Clearance = (start+epochDays(days)).toEpochTime()
+	f.Earliest = f.Clearance
+	f.Latest = f.Clearance
+	return &f,nil
+}
+
+// lastPredictorDay returns the day of the last share added to the promises predictor,
+// or false if it isnt known
+func (self *Engine) lastPredictorDay() (epochDays,bool) {
+	var dl dayLedger
+	err := self.Administrator.table.Get(backfillShareRecordKey,&dl)
+	if err != nil || dl.Backfillers == 0 {
+		return 0,false
+	}
+	return dl.Day.toEpochDays(false),true
+}
+
+// rootMeanSquare returns the root mean square of the given values, or zero if there are none
+func rootMeanSquare(vs []float64) float64 {
+	if len(vs) == 0 {
+		return 0
+	}
+	var t float64
+	for _,v := range vs {
+		t += v*v
+	}
+	return math.Sqrt(t/float64(len(vs)))
+}
@@ -0,0 +1,104 @@
+package flap
+
+import (
+	"testing"
+	"github.com/richardmorrey/flap/pkg/db"
+)
+
+func TestResiduals(t *testing.T) {
+	bf,_ := newBestFit(PromisesConfig{MaxPoints:10})
+	if bf.residuals(3) != nil {
+		t.Error("Residuals returned without a best fit")
+	}
+	bf.ys = []float64{3,7,7}
+	bf.m = 2
+	bf.c = 1
+	rs := bf.residuals(3)
+	if len(rs) != 3 || rs[0] != 0 || rs[1] != 2 || rs[2] != 0 {
+		t.Error("Wrong residuals for best fit",rs)
+	}
+	pbf,_ := newPolyBestFit(PromisesConfig{MaxPoints:10,Degree:2})
+	pbf.ys = []float64{2,6,10}
+	pbf.consts = []float64{1,0,1}
+	rs = pbf.residuals(3)
+	if len(rs) != 3 || rs[0] != 0 || rs[1] != 1 || rs[2] != 0 {
+		t.Error("Wrong residuals for polynomial best fit",rs)
+	}
+}
+
+func TestForecastClearancePredicted(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports := balancesEngine(t,database,FlapParams{Promises:PromisesConfig{Algo:paLinearBestFit,MaxPoints:10}},false,-100000)
+	passport := passports[0]
+	bf := engine.Administrator.predictor.(*bestFit)
+	bf.m = 0
+	bf.c = 10
+	bf.ys = []float64{10,10,10,10}
+	f,err := engine.ForecastClearance(passport,SecondsInDay)
+	if err != nil || *f != (ClearanceForecast{Balance:-100000,Clearance:SecondsInDay*11,Earliest:SecondsInDay*11,Latest:SecondsInDay*11,Predicted:true}) {
+		t.Error("Wrong forecast for exact fit",f,err)
+	}
+
+	// Band widens with residuals, once the day of the last point is known
+	bf.ys = []float64{8,12,8,12}
+	f,err = engine.ForecastClearance(passport,SecondsInDay)
+	if err != nil || f.Earliest != SecondsInDay*11 || f.Latest != SecondsInDay*11 {
+		t.Error("Band given without last point",f,err)
+	}
+	engine.Administrator.table.Put(backfillShareRecordKey,&dayLedger{Day:0,Backfillers:1})
+	f,err = engine.ForecastClearance(passport,SecondsInDay)
+	if err != nil || *f != (ClearanceForecast{Balance:-100000,Clearance:SecondsInDay*11,Earliest:SecondsInDay*10,Latest:SecondsInDay*13,Predicted:true}) {
+		t.Error("Wrong forecast band",f,err)
+	}
+}
+
+func TestForecastClearanceNoPromises(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports := balancesEngine(t,database,FlapParams{DailyTotal:100,MinGrounded:10},false,-100000)
+	passport := passports[0]
+	f,err := engine.ForecastClearance(passport,SecondsInDay)
+	if err != nil || *f != (ClearanceForecast{Balance:-100000,Clearance:SecondsInDay*11,Earliest:SecondsInDay*11,Latest:SecondsInDay*11}) {
+		t.Error("Wrong forecast without promises",f,err)
+	}
+	params := engine.Administrator.params
+	params.DailyTotal = 0
+	engine.Administrator.SetParams(params)
+	_,err = engine.ForecastClearance(passport,SecondsInDay)
+	if err != ENOVALIDPREDICTION {
+		t.Error("Forecast made with no daily share",err)
+	}
+}
+
+func TestForecastClearanceInCredit(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports := balancesEngine(t,database,FlapParams{DailyTotal:100,MinGrounded:10},false,1000)
+	passport := passports[0]
+	f,err := engine.ForecastClearance(passport,SecondsInDay*2)
+	if err != nil || f.Clearance != SecondsInDay*2 || f.Latest != SecondsInDay*2 {
+		t.Error("Traveller in credit not forecast clear now",f,err)
+	}
+	_,err = engine.ForecastClearance(NewPassport("500000001","uk"),SecondsInDay*2)
+	if err != db.EKEYNOTFOUND {
+		t.Error("Forecast made for unknown traveller",err)
+	}
+}
+
+func TestLastPredictorDay(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine := NewEngine(database,0,"")
+	if _,ok := engine.lastPredictorDay(); ok {
+		t.Error("Last predictor day known before any backfill")
+	}
+	engine.Administrator.table.Put(backfillShareRecordKey,&dayLedger{Day:SecondsInDay*3})
+	if _,ok := engine.lastPredictorDay(); ok {
+		t.Error("Last predictor day known when no share was added")
+	}
+	engine.Administrator.table.Put(backfillShareRecordKey,&dayLedger{Day:SecondsInDay*3,Backfillers:1})
+	if day,ok := engine.lastPredictorDay(); !ok || day != 3 {
+		t.Error("Wrong last predictor day",day,ok)
+	}
+}
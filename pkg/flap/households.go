@@ -0,0 +1,371 @@
+package flap
+
+import (
+	"github.com/richardmorrey/flap/pkg/db"
+	"encoding/binary"
+	"encoding/gob"
+	"bytes"
+	"errors"
+)
+
+var EINHOUSEHOLD = errors.New("Traveller already belongs to another household")
+var ENOHOUSEHOLD = errors.New("No household headed by traveller")
+var ENOTINHOUSEHOLD = errors.New("Traveller doesnt belong to household")
+var ETOOMANYMEMBERS = errors.New("Too many members for household")
+var ENOTENOUGHCREDIT = errors.New("Not enough credit")
+
+// MaxHouseholdMembers is the most travellers a household can have, including its head
+const MaxHouseholdMembers=10
+
+// Household groups travellers who travel together under a head, typically a parent.
+// The head can allocate credit to other members and can submit flights taken by the
+// whole household, which are cleared for the household as a whole. If the household
+// is pooled, members in credit cover the balances of those who would otherwise be
+// grounded.
+type Household struct {
+	Head		Passport
+	Members		[]Passport
+	Pooled		bool
+}
+
+// To implements db/Serialize
+func (self* Household) To(b *bytes.Buffer) error {
+	return gob.NewEncoder(b).Encode(self)
+}
+
+// From implements db/Serialize
+func (self* Household) From(b *bytes.Buffer) error {
+	return gob.NewDecoder(b).Decode(self)
+}
+
+// all returns the head followed by the other members
+func (self *Household) all() []Passport {
+	return append([]Passport{self.Head},self.Members...)
+}
+
+// member returns true if the given traveller is the head or another member
+func (self *Household) member(passport Passport) bool {
+	for _,p := range self.all() {
+		if p == passport {
+			return true
+		}
+	}
+	return false
+}
+
+// membership is the record kept for each traveller in a household, naming the head.
+// It is written in a fixed encoding.
+type membership Passport
+
+// To implements db/Serialize
+func (self *membership) To(buff *bytes.Buffer) error {
+	return binary.Write(buff,binary.LittleEndian,self)
+}
+
+// From implements db/Serialize
+func (self *membership) From(buff *bytes.Buffer) error {
+	return binary.Read(buff,binary.LittleEndian,self)
+}
+
+// Households is a table of households, keyed by the key of the head's traveller
+// record, and of the membership of each traveller in one, keyed by the key of
+// the member's traveller record, so that no traveller belongs to two households.
+const householdsTableName="households"
+const householdKeyPrefix="h"
+const membershipKeyPrefix="m"
+type Households struct {
+	table db.Table
+}
+
+// NewHouseholds opens the households table in the given database, creating it if it doesnt exist
+func NewHouseholds(database db.Database) *Households {
+	table,err := database.OpenTable(householdsTableName)
+	if err == db.ETABLENOTFOUND {
+		table,err = database.CreateTable(householdsTableName)
+	}
+	if err != nil {
+		logError(err)
+		return nil
+	}
+	return &Households{table:table}
+}
+
+// dropHouseholds drops the households table from the given database
+func dropHouseholds(database db.Database) error {
+	return database.DropTable(householdsTableName)
+}
+
+// GetHousehold returns the household headed by the traveller with the given passport
+func (self *Households) GetHousehold(head Passport) (Household,error) {
+	var h Household
+	key,err := head.generateKey()
+	if err != nil {
+		return h,err
+	}
+	err = self.table.Get(householdKeyPrefix+key,&h)
+	if err == db.EKEYNOTFOUND {
+		err = ENOHOUSEHOLD
+	}
+	return h,err
+}
+
+// headOf returns the head of the household the traveller with the given passport
+// belongs to, and false if they dont belong to one
+func (self *Households) headOf(passport Passport) (Passport,bool,error) {
+	var m membership
+	key,err := passport.generateKey()
+	if err != nil {
+		return Passport{},false,err
+	}
+	err = self.table.Get(membershipKeyPrefix+key,&m)
+	if err == db.EKEYNOTFOUND {
+		return Passport{},false,nil
+	}
+	return Passport(m),err == nil,err
+}
+
+// put writes the household and the membership of each of its members, and removes
+// the membership of the given travellers who are no longer members
+func (self *Households) put(h *Household, leaving []Passport) error {
+	for _,p := range leaving {
+		key,err := p.generateKey()
+		if err != nil {
+			return err
+		}
+		err = self.table.Delete(membershipKeyPrefix+key)
+		if err != nil && err != db.EKEYNOTFOUND {
+			return err
+		}
+	}
+	m := membership(h.Head)
+	for _,p := range h.all() {
+		key,err := p.generateKey()
+		if err != nil {
+			return err
+		}
+		err = self.table.Put(membershipKeyPrefix+key,&m)
+		if err != nil {
+			return err
+		}
+	}
+	key,err := h.Head.generateKey()
+	if err != nil {
+		return err
+	}
+	return self.table.Put(householdKeyPrefix+key,h)
+}
+
+// remove deletes the household and the membership of each of its members
+func (self *Households) remove(h *Household) error {
+	for _,p := range h.all() {
+		key,err := p.generateKey()
+		if err != nil {
+			return err
+		}
+		err = self.table.Delete(membershipKeyPrefix+key)
+		if err != nil && err != db.EKEYNOTFOUND {
+			return err
+		}
+	}
+	key,err := h.Head.generateKey()
+	if err != nil {
+		return err
+	}
+	return self.table.Delete(householdKeyPrefix+key)
+}
+
+// SetHousehold creates or replaces the household headed by the traveller with the given
+// passport, with the given other members. Travellers can only belong to one household
+// at a time, so EINHOUSEHOLD is returned if any already belong to another. Giving no
+// members dissolves the household.
+func (self *Engine) SetHousehold(head Passport, members []Passport, pooled bool) error {
+
+	// Check args
+	if len(members)+1 > MaxHouseholdMembers {
+		return ETOOMANYMEMBERS
+	}
+	h := Household{Head:head,Members:members,Pooled:pooled}
+	for i,p := range h.all() {
+		for _,q := range h.all()[:i] {
+			if p == q {
+				return EINVALIDARGUMENT
+			}
+		}
+		hp,exists,err := self.Households.headOf(p)
+		if err != nil {
+			return logError(err)
+		}
+		if exists && hp != head {
+			return EINHOUSEHOLD
+		}
+	}
+
+	// Replace any existing household
+	old,err := self.Households.GetHousehold(head)
+	if err != nil && err != ENOHOUSEHOLD {
+		return logError(err)
+	}
+	if len(members) == 0 {
+		if err == ENOHOUSEHOLD {
+			return err
+		}
+		err = self.Households.remove(&old)
+	} else {
+		var leaving []Passport
+		for _,p := range old.Members {
+			if !h.member(p) {
+				leaving = append(leaving,p)
+			}
+		}
+		err = self.Households.put(&h,leaving)
+	}
+	if err != nil {
+		return logError(err)
+	}
+	return self.events.record(Event{Type:ETSetHousehold,Passport:head,Members:members,Pooled:pooled})
+}
+
+// Allocate moves the given distance from the balance of the head of a household to that
+// of another member, recording it with a TTHouseholdAllocation transaction for each. The
+// head must have the credit to allocate.
+func (self *Engine) Allocate(head Passport, member Passport, amount Metres, now EpochTime) error {
+
+	// Check args
+	if amount <= 0 || member == head {
+		return EINVALIDARGUMENT
+	}
+	h,err := self.Households.GetHousehold(head)
+	if err != nil {
+		return err
+	}
+	if !h.member(member) {
+		return ENOTINHOUSEHOLD
+	}
+
+	// Move credit
+	from,err := self.Travellers.GetTraveller(head)
+	if err != nil {
+		return err
+	}
+	if from.Balance < amount {
+		return ENOTENOUGHCREDIT
+	}
+	to := self.getCreateTraveller(member,now)
+	from.transact(-amount,now,TTHouseholdAllocation)
+	to.transact(amount,now,TTHouseholdAllocation)
+	err = self.putTravellers([]*Traveller{&from,to})
+	if err == nil {
+		err = self.events.record(Event{Type:ETAllocate,Time:now,Passport:head,Members:[]Passport{head,member},Amounts:[]Metres{-amount,amount}})
+	}
+	return err
+}
+
+// SubmitHouseholdFlights submits the given flights for every member of the household
+// headed by the traveller with the given passport, as SubmitFlights does for one
+// traveller. The whole household must be cleared to travel or the submission is rejected
+// with EGROUNDED. If the household is pooled, members in credit first cover the balances
+// of members who would otherwise be grounded, each movement recorded with a TTHouseholdPool
+// transaction, so that the household is cleared if its members' balances together are.
+func (self *Engine) SubmitHouseholdFlights(head Passport, flights []Flight, now EpochTime, debit bool) error {
+
+	// Check args
+	if len(flights) == 0 {
+		return EINVALIDARGUMENT
+	}
+	h,err := self.Households.GetHousehold(head)
+	if err != nil {
+		return err
+	}
+
+	// Retrieve members and any exemptions they hold, working out what each needs to be
+	// cleared within their overdraft
+	params := &self.Administrator.params
+	members := h.all()
+	travellers := make([]*Traveller,len(members))
+	exemptions := make([]*Exemption,len(members))
+	needs := make([]Metres,len(members))
+	for i,p := range members {
+		travellers[i] = self.getCreateTraveller(p,now)
+		exemptions[i],err = self.Exemptions.active(p,now)
+		if err != nil {
+			return logError(err)
+		}
+		overdraft := params.Overdraft.limit(exemptions[i])
+		if travellers[i].clearedWithin(now,overdraft) == CRGrounded && !exemptions[i].waives(EWClearance) {
+			needs[i] = -overdraft-travellers[i].Balance
+		}
+	}
+
+	// Pool balances if configured
+	amounts := make([]Metres,len(members))
+	if h.Pooled {
+		amounts = pool(travellers,needs,now)
+	}
+	for i := range travellers {
+		if needs[i] > 0 && amounts[i] < needs[i] {
+			return EGROUNDED
+		}
+	}
+
+	// Add flights to the flight history of each member
+	for i,t := range travellers {
+		err = t.submitFlights(flights,now,params,debit,&self.Administrator.pc,exemptions[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	// Store updated travellers
+	err = self.putTravellers(travellers)
+	if err == nil {
+		err = self.events.record(Event{Type:ETSubmitHouseholdFlights,Time:now,Passport:head,Members:members,Amounts:amounts,Flights:flights,Debit:debit})
+	}
+	return err
+}
+
+// pool moves credit from travellers in credit to those who need it to be cleared, in turn,
+// until each has what they need or there is no credit left. It returns the distance moved
+// to or from each traveller.
+func pool(travellers []*Traveller, needs []Metres, now EpochTime) []Metres {
+	amounts := make([]Metres,len(travellers))
+	for i := range travellers {
+		for j,d := range travellers {
+			if needs[i] <= 0 || amounts[i] >= needs[i] {
+				break
+			}
+			available := d.Balance+amounts[j]
+			if j == i || available <= 0 {
+				continue
+			}
+			move := needs[i]-amounts[i]
+			if move > available {
+				move = available
+			}
+			amounts[i] += move
+			amounts[j] -= move
+		}
+	}
+	for i,t := range travellers {
+		if amounts[i] != 0 {
+			t.transact(amounts[i],now,TTHouseholdPool)
+		}
+	}
+	return amounts
+}
+
+// putTravellers stores each of the given travellers in a single batch
+func (self *Engine) putTravellers(travellers []*Traveller) error {
+	bw,err := self.Travellers.MakeBatch(len(travellers))
+	if err != nil {
+		bw.Release()
+		return logError(err)
+	}
+	for _,t := range travellers {
+		err = bw.Put(*t)
+		if err != nil {
+			bw.Release()
+			return logError(err)
+		}
+	}
+	return bw.Release()
+}
@@ -0,0 +1,223 @@
+package flap
+
+import (
+	"testing"
+	"github.com/richardmorrey/flap/pkg/db"
+	"context"
+	"reflect"
+)
+
+// household returns an engine with a household of a head and two children, each
+// back from a trip, the head with the given balance and the children with the other
+// given balance
+func household(t *testing.T, database db.Database, headBalance Metres, childBalance Metres, pooled bool) (*Engine,[]Passport) {
+	engine,passports := balancesEngine(t,database,FlapParams{DailyTotal:100,MinGrounded:1,FlightInterval:1,FlightsInTrip:50,TripLength:365,Threads:4},
+					   true,headBalance,childBalance,childBalance)
+	err := engine.SetHousehold(passports[0],passports[1:],pooled)
+	if err != nil {
+		t.Error("SetHousehold failed",err)
+	}
+	return engine,passports
+}
+
+func TestSetHousehold(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports := household(t,database,0,0,true)
+	h,err := engine.Households.GetHousehold(passports[0])
+	if err != nil || !reflect.DeepEqual(h.Members,passports[1:]) || !h.Pooled {
+		t.Error("GetHousehold returned wrong household",h,err)
+	}
+
+	// Members can only belong to one household
+	other := NewPassport("200000000","uk")
+	err = engine.SetHousehold(other,passports[2:],false)
+	if err != EINHOUSEHOLD {
+		t.Error("Traveller joined two households",err)
+	}
+	err = engine.SetHousehold(passports[0],passports[1:2],true)
+	if err != nil {
+		t.Error("Failed to remove member",err)
+	}
+	err = engine.SetHousehold(other,passports[2:],false)
+	if err != nil {
+		t.Error("Failed to join another household after leaving",err)
+	}
+
+	// Dissolve
+	err = engine.SetHousehold(passports[0],nil,false)
+	if err != nil {
+		t.Error("Failed to dissolve household",err)
+	}
+	_,err = engine.Households.GetHousehold(passports[0])
+	if err != ENOHOUSEHOLD {
+		t.Error("Household not dissolved",err)
+	}
+	_,exists,_ := engine.Households.headOf(passports[1])
+	if exists {
+		t.Error("Membership not removed when household dissolved")
+	}
+
+	// Bad households
+	err = engine.SetHousehold(passports[0],[]Passport{passports[1],passports[1]},false)
+	if err != EINVALIDARGUMENT {
+		t.Error("Household with duplicate members allowed",err)
+	}
+	err = engine.SetHousehold(passports[0],make([]Passport,MaxHouseholdMembers),false)
+	if err != ETOOMANYMEMBERS {
+		t.Error("Household with too many members allowed",err)
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports := household(t,database,1000,-500,false)
+	err := engine.Allocate(passports[0],passports[1],600,SecondsInDay*2)
+	if err != nil {
+		t.Error("Allocate failed",err)
+	}
+	head,_ := engine.Travellers.GetTraveller(passports[0])
+	child,_ := engine.Travellers.GetTraveller(passports[1])
+	if head.Balance != 400 || child.Balance != 100 {
+		t.Error("Allocate moved wrong distance",head.Balance,child.Balance)
+	}
+	if child.Transactions.entries[0] != (Transaction{Date:SecondsInDay*2,Distance:600,TT:TTHouseholdAllocation}) ||
+	   head.Transactions.entries[0] != (Transaction{Date:SecondsInDay*2,Distance:-600,TT:TTHouseholdAllocation}) {
+		t.Error("Allocate recorded wrong transactions",head.Transactions.entries[0],child.Transactions.entries[0])
+	}
+	err = engine.Allocate(passports[0],passports[2],401,SecondsInDay*2)
+	if err != ENOTENOUGHCREDIT {
+		t.Error("Allocated more credit than head has",err)
+	}
+	err = engine.Allocate(passports[0],NewPassport("200000000","uk"),1,SecondsInDay*2)
+	if err != ENOTINHOUSEHOLD {
+		t.Error("Allocated to traveller outside household",err)
+	}
+	err = engine.Allocate(passports[1],passports[2],1,SecondsInDay*2)
+	if err != ENOHOUSEHOLD {
+		t.Error("Allocated by traveller not heading household",err)
+	}
+}
+
+func TestSubmitHouseholdFlights(t *testing.T) {
+	flights := []Flight{*createFlight(1,SecondsInDay*2,SecondsInDay*2+1)}
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports := household(t,database,1000,-400,false)
+	err := engine.SubmitHouseholdFlights(passports[0],flights,SecondsInDay*2,true)
+	if err != EGROUNDED {
+		t.Error("Household cleared with grounded member",err)
+	}
+
+	// Pooled household is cleared by the head's credit
+	database2 := db.NewMemoryDB()
+	defer database2.Release()
+	engine,passports = household(t,database2,1000,-400,true)
+	err = engine.SubmitHouseholdFlights(passports[0],flights,SecondsInDay*2,true)
+	if err != nil {
+		t.Error("Pooled household not cleared",err)
+	}
+	debit := flights[0].Distance.Metres()
+	head,_ := engine.Travellers.GetTraveller(passports[0])
+	if head.Balance != 200-debit || head.Transactions.entries[1] != (Transaction{Date:SecondsInDay*2,Distance:-800,TT:TTHouseholdPool}) {
+		t.Error("Head pooled wrong distance",head.Balance,head.Transactions.entries[1])
+	}
+	for _,passport := range passports[1:] {
+		child,_ := engine.Travellers.GetTraveller(passport)
+		if child.Balance != -debit || child.Transactions.entries[1] != (Transaction{Date:SecondsInDay*2,Distance:400,TT:TTHouseholdPool}) {
+			t.Error("Child pooled wrong distance",child.Balance,child.Transactions.entries[1])
+		}
+		if !child.MidTrip() {
+			t.Error("Flight not submitted for child")
+		}
+	}
+
+	// Not enough credit for the household as a whole
+	database3 := db.NewMemoryDB()
+	defer database3.Release()
+	engine,passports = household(t,database3,700,-400,true)
+	err = engine.SubmitHouseholdFlights(passports[0],flights,SecondsInDay*2,true)
+	if err != EGROUNDED {
+		t.Error("Pooled household cleared without enough credit",err)
+	}
+	child,_ := engine.Travellers.GetTraveller(passports[1])
+	if child.Balance != -400 {
+		t.Error("Failed submission changed balance",child.Balance)
+	}
+}
+
+func TestHouseholdReplay(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine := NewEngine(database,0,"")
+	engine.RecordEvents(NewEventLog(database))
+	params := FlapParams{DailyTotal:10000,MinGrounded:1,FlightInterval:1,FlightsInTrip:50,TripLength:2,Threads:4}
+	engine.Administrator.SetParams(params)
+	passports := []Passport{NewPassport("100000000","uk"),NewPassport("100000001","uk"),NewPassport("100000002","uk")}
+	backfill := func(from int, to int) {
+		for day:=from; day <= to; day++ {
+			_,err := engine.UpdateTripsAndBackfill(context.Background(),EpochTime(SecondsInDay*day))
+			if err != nil {
+				t.Error("UpdateTripsAndBackfill failed",err)
+			}
+		}
+	}
+
+	// Head flies and is backfilled into credit
+	err := engine.SubmitFlights(passports[0],[]Flight{*createFlight(1,SecondsInDay,SecondsInDay+1)},SecondsInDay,true)
+	if err != nil {
+		t.Error("SubmitFlights failed",err)
+	}
+	backfill(2,4)
+
+	// With a smaller daily total one child flies and is left grounded
+	params.DailyTotal = 1
+	engine.Administrator.SetParams(params)
+	err = engine.SetHousehold(passports[0],passports[1:],true)
+	if err != nil {
+		t.Error("SetHousehold failed",err)
+	}
+	err = engine.Allocate(passports[0],passports[1],1000000,SecondsInDay*4)
+	if err != nil {
+		t.Error("Allocate failed",err)
+	}
+	err = engine.SubmitFlights(passports[2],[]Flight{*createFlight(2,SecondsInDay*4,SecondsInDay*4+1)},SecondsInDay*4,true)
+	if err != nil {
+		t.Error("SubmitFlights failed",err)
+	}
+	backfill(5,8)
+	child,_ := engine.Travellers.GetTraveller(passports[2])
+	if child.Cleared(SecondsInDay*8) != CRGrounded {
+		t.Error("Child not grounded",child.Balance)
+	}
+	err = engine.SubmitHouseholdFlights(passports[0],[]Flight{*createFlight(3,SecondsInDay*8,SecondsInDay*8+1)},SecondsInDay*8,true)
+	if err != nil {
+		t.Error("SubmitHouseholdFlights failed",err)
+	}
+
+	// Rebuild all travellers and each on its own
+	target := db.NewMemoryDB()
+	defer target.Release()
+	_,err = Replay(context.Background(),engine.events,target,MaxEpochTime)
+	if err != nil {
+		t.Error("Replay failed",err)
+	}
+	replayed := NewEngine(target,0,"")
+	for _,passport := range passports {
+		traveller,_ := engine.Travellers.GetTraveller(passport)
+		traveller2,err := replayed.Travellers.GetTraveller(passport)
+		if err != nil || !reflect.DeepEqual(traveller,traveller2) {
+			t.Error("Replayed household member differs",passport.ToString(),err)
+		}
+		ts,err := engine.TravellerAsOf(passport,MaxEpochTime)
+		if err != nil || !reflect.DeepEqual(ts.Traveller,traveller) {
+			t.Error("Household member as of now differs from record",passport.ToString(),err)
+		}
+	}
+	h,_ := engine.Households.GetHousehold(passports[0])
+	h2,err := replayed.Households.GetHousehold(passports[0])
+	if err != nil || !reflect.DeepEqual(h,h2) {
+		t.Error("Replayed household differs",h2,err)
+	}
+}
@@ -0,0 +1,116 @@
+package flap
+
+import (
+	"testing"
+	"github.com/richardmorrey/flap/pkg/db"
+	"context"
+	"reflect"
+)
+
+func TestOverdraftLimit(t *testing.T) {
+	config := OverdraftConfig{Limit:10,Medical:50,Diplomatic:0}
+	for _,c := range []struct{ex *Exemption; limit Metres}{{nil,10000},{&Exemption{Category:ECMedical},50000},
+								{&Exemption{Category:ECDiplomatic},10000},{&Exemption{Category:ECHumanitarian},10000}} {
+		if config.limit(c.ex) != c.limit {
+			t.Error("Wrong overdraft limit",c.ex,config.limit(c.ex))
+		}
+	}
+}
+
+func TestClearedWithin(t *testing.T) {
+	var traveller Traveller
+	traveller.tripHistory.entries[0] = *createFlight(1,SecondsInDay,SecondsInDay+1)
+	traveller.tripHistory.entries[0].et = etTripEnd
+	traveller.transact(-1000,SecondsInDay,TTFlight)
+	for _,c := range []struct{overdraft Metres; cr ClearanceReason}{{0,CRGrounded},{999,CRGrounded},{1000,CROverdraft},{2000,CROverdraft}} {
+		if cr := traveller.clearedWithin(SecondsInDay*2,c.overdraft); cr != c.cr {
+			t.Error("Wrong clearance within overdraft",c.overdraft,cr)
+		}
+	}
+	if traveller.Cleared(SecondsInDay*2) != CRGrounded {
+		t.Error("Traveller in debit cleared without overdraft")
+	}
+}
+
+func TestEngineClearedWithinOverdraft(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports := balancesEngine(t,database,FlapParams{Overdraft:OverdraftConfig{Limit:1,Medical:2}},true,-1500)
+	traveller,_ := engine.Travellers.GetTraveller(passports[0])
+	cr,err := engine.ClearedWithinOverdraft(&traveller,SecondsInDay*2)
+	if err != nil || cr != CRGrounded {
+		t.Error("Traveller beyond overdraft cleared",cr,err)
+	}
+	_,err = engine.GrantExemption(passports[0],Exemption{Category:ECMedical,Waives:EWDebit,Start:SecondsInDay,End:SecondsInDay*3})
+	if err != nil {
+		t.Error("GrantExemption failed",err)
+	}
+	cr,err = engine.ClearedWithinOverdraft(&traveller,SecondsInDay*2)
+	if err != nil || cr != CROverdraft {
+		t.Error("Traveller within exemption's overdraft not cleared",cr,err)
+	}
+}
+
+func TestSubmitFlightsOverdraft(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passport := groundedTraveller(t,database)
+	before,_ := engine.Travellers.GetTraveller(passport)
+
+	// Grounded beyond the overdraft
+	params := engine.Administrator.params
+	params.Overdraft.Limit = (-before.Balance).Kilometres()-1
+	engine.Administrator.SetParams(params)
+	flights := []Flight{*createFlight(2,SecondsInDay*5,SecondsInDay*5+1)}
+	err := engine.SubmitFlights(passport,flights,SecondsInDay*5,true)
+	if err != EGROUNDED {
+		t.Error("Traveller beyond overdraft not grounded",err)
+	}
+
+	// Cleared within it, flight still debited
+	params.Overdraft.Limit = (-before.Balance).Kilometres()+1
+	engine.Administrator.SetParams(params)
+	err = engine.SubmitFlights(passport,flights,SecondsInDay*5,true)
+	if err != nil {
+		t.Error("Traveller within overdraft grounded",err)
+	}
+	traveller,_ := engine.Travellers.GetTraveller(passport)
+	if traveller.Balance != before.Balance-flights[0].Distance.Metres() {
+		t.Error("Flight in overdraft not debited",traveller.Balance)
+	}
+	if traveller.Transactions.entries[0] != (Transaction{Date:SecondsInDay*5,TT:TTOverdraft}) {
+		t.Error("Overdraft not recorded",traveller.Transactions.entries[0])
+	}
+
+	// Reported in stats for the day after
+	us,err := engine.UpdateTripsAndBackfill(context.Background(),SecondsInDay*6)
+	if err != nil || us.OverdraftFlights != 1 || us.Overdrawn != -traveller.Balance {
+		t.Error("Overdraft use not reported",us.OverdraftFlights,us.Overdrawn,err)
+	}
+
+	// Rebuilt with overdraft
+	ts,err := engine.TravellerAsOf(passport,MaxEpochTime)
+	traveller,_ = engine.Travellers.GetTraveller(passport)
+	if err != nil || !reflect.DeepEqual(ts.Traveller,traveller) {
+		t.Error("Overdrawn traveller as of now differs from record",err)
+	}
+}
+
+func TestSubmitHouseholdFlightsOverdraft(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports := household(t,database,1000,-1500,true)
+	params := engine.Administrator.params
+	params.Overdraft.Limit = 1
+	engine.Administrator.SetParams(params)
+	err := engine.SubmitHouseholdFlights(passports[0],[]Flight{*createFlight(2,SecondsInDay*2,SecondsInDay*2+1)},SecondsInDay*2,false)
+	if err != nil {
+		t.Error("Household within overdraft grounded",err)
+	}
+	for i,balance := range []Metres{0,-1000,-1000} {
+		traveller,_ := engine.Travellers.GetTraveller(passports[i])
+		if traveller.Balance != balance {
+			t.Error("Household pooled only to overdraft",i,traveller.Balance)
+		}
+	}
+}
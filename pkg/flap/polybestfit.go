@@ -196,6 +196,24 @@ func (self* polyBestFit) predict(d Kilometres,sd epochDays) (epochDays,error) {
 	return cd, nil
 }
 
+// residuals returns the difference between each smoothed point and the polynomial
+// best fit, taking the last point to be for the given day
+func (self* polyBestFit) residuals(xmax epochDays) []float64 {
+	if len(self.consts) == 0 {
+		return nil
+	}
+	xorigin := float64(xmax) - float64(len(self.ys)-1)
+	rs := make([]float64,len(self.ys))
+	for x,y := range self.ys {
+		var t float64
+		for i,v := range self.consts {
+			t += math.Pow(xorigin+float64(x),float64(i))*v
+		}
+		rs[x] = y - t
+	}
+	return rs
+}
+
 // version reports the current version of the polynomial best fit
 func (self* polyBestFit) version() predictVersion {
 	return self.pv
@@ -45,6 +45,29 @@ func (self *Promise) From(buff *bytes.Buffer) error {
 	return binary.Read(buff,binary.LittleEndian,self)
 }
 
+// encode writes the promise in compact form, with its trip end and clearance
+// written as differences from the trip start and end
+func (self *Promise) encode(w *compactWriter) {
+	w.uvarint(uint64(self.TripStart))
+	w.varint(int64(self.TripEnd)-int64(self.TripStart))
+	w.float(float64(self.Distance))
+	w.float(float64(self.Travelled))
+	w.varint(int64(self.Clearance)-int64(self.TripEnd))
+	w.byte(byte(self.StackIndex))
+	w.float(float64(self.CarriedOver))
+}
+
+// decode reads a promise written by encode
+func (self *Promise) decode(r *compactReader) {
+	self.TripStart = EpochTime(r.uvarint())
+	self.TripEnd = r.since(self.TripStart)
+	self.Distance = Kilometres(r.float())
+	self.Travelled = Kilometres(r.float())
+	self.Clearance = r.since(self.TripEnd)
+	self.StackIndex = StackIndex(r.byte())
+	self.CarriedOver = Kilometres(r.float())
+}
+
 // Stacked returns true if Promises is stacked i.e.
 // has a clearance date pushed earlier to accomodate 
 // the next Trip
@@ -68,22 +91,33 @@ type Proposal struct {
 // "distance" is the distance to backfill and "travelled" is the distance
 // travelled. This are different if a Taxi Overhead is set.
 func (self *Promises) propose(tripStart EpochTime,tripEnd EpochTime,distance Kilometres,travelled Kilometres, now EpochTime, predictor predictor,maxStackSize StackIndex) (*Proposal,error) {
+	pp,err := self.newProposal(tripStart,tripEnd,distance,travelled,now,predictor,maxStackSize)
+	switch err {
+		case EINVALIDARGUMENT,EINTERNAL,EOVERLAPSWITHPREVPROMISE,EOVERLAPSWITHNEXTPROMISE:
+			logError(err)
+	}
+	return pp,err
+}
+
+// newProposal works like propose but without logging why a proposal cant be made, for
+// callers that expect many attempts to fail
+func (self *Promises) newProposal(tripStart EpochTime,tripEnd EpochTime,distance Kilometres,travelled Kilometres, now EpochTime, predictor predictor,maxStackSize StackIndex) (*Proposal,error) {
 
 	// Check args
 	if predictor == nil {
-		return nil,logError(EINVALIDARGUMENT)
+		return nil,EINVALIDARGUMENT
 	}
 	if tripEnd <= tripStart {
-		return nil,logError(EINVALIDARGUMENT)
+		return nil,EINVALIDARGUMENT
 	}
 	if distance <= 0 {
-		return nil,logError(EINVALIDARGUMENT)
+		return nil,EINVALIDARGUMENT
 	}
 	if tripStart < now {
-		return nil,logError(EINVALIDARGUMENT)
+		return nil,EINVALIDARGUMENT
 	}
 	if tripStart == 0 {
-		return nil,logError(EINVALIDARGUMENT)
+		return nil,EINVALIDARGUMENT
 	}
 
 	// Check that oldest promise can be dropped if we are full
@@ -108,15 +142,15 @@ func (self *Promises) propose(tripStart EpochTime,tripEnd EpochTime,distance Kil
 	// Find index to add promise
 	i := sort.Search(MaxPromises, func(i int) bool { return self.entries[i].older(p)})
 	if  i >= MaxPromises {
-		return nil,logError(EINTERNAL)
+		return nil,EINTERNAL
 	}
 	
 	// Confirm that there is no trip overlap with promise before or after
 	if (i < MaxPromises) && (pp.entries[i].TripEnd) >= p.TripStart {
-		return nil,logError(EOVERLAPSWITHPREVPROMISE)
+		return nil,EOVERLAPSWITHPREVPROMISE
 	}
 	if i > 0 && pp.entries[i-1].TripStart <= p.TripEnd {
-		return nil,logError(EOVERLAPSWITHNEXTPROMISE)
+		return nil,EOVERLAPSWITHNEXTPROMISE
 	}
 
 	// Copy older entries down one - the oldest is dropped - and insert
@@ -133,6 +167,53 @@ func (self *Promises) propose(tripStart EpochTime,tripEnd EpochTime,distance Kil
 	}
 }
 
+// Alternative is a feasible trip found when searching for alternatives, with the proposal
+// that would promise clearance for it. Restacked is the number of existing promises whose
+// clearance date or stack index the proposal changes.
+type Alternative struct {
+	TripStart	EpochTime
+	TripEnd		EpochTime
+	Clearance	EpochTime
+	StackIndex	StackIndex
+	Restacked	int
+	Proposal	*Proposal
+}
+
+// alternatives proposes a trip of the given length starting on each day from the given
+// start time until it would end after the given end time, returning those that can be
+// promised ranked by fewest existing promises restacked, then earliest clearance, then
+// earliest start. The promises themselves are unchanged.
+func (self *Promises) alternatives(from EpochTime, to EpochTime, length EpochTime, distance Kilometres, travelled Kilometres, now EpochTime, predictor predictor, maxStackSize StackIndex) []Alternative {
+	var alts []Alternative
+	for ts := from; ts+length <= to; ts += SecondsInDay {
+		pp,err := self.newProposal(ts,ts+length,distance,travelled,now,predictor,maxStackSize)
+		if err != nil {
+			continue
+		}
+		a := Alternative{TripStart:ts,TripEnd:ts+length,Proposal:pp}
+		for _,p := range pp.entries {
+			if p.TripStart == ts {
+				a.Clearance = p.Clearance
+				a.StackIndex = p.StackIndex
+				continue
+			}
+			for _,old := range self.entries {
+				if old.TripStart == p.TripStart && old.TripStart != 0 && (old.Clearance != p.Clearance || old.StackIndex != p.StackIndex) {
+					a.Restacked++
+				}
+			}
+		}
+		alts = append(alts,a)
+	}
+	sort.SliceStable(alts,func(i, j int) bool {
+		if alts[i].Restacked != alts[j].Restacked {
+			return alts[i].Restacked < alts[j].Restacked
+		}
+		return alts[i].Clearance < alts[j].Clearance
+	})
+	return alts
+}
+
 // make enforces the given promise proposal by overwriting the current list of promises
 // with it, but only if the predictor is the same version uses to make the proposal.
 func (self *Promises) make(pp *Proposal, predictor predictor) error {
@@ -308,6 +389,23 @@ func (self *Promises) To(buff *bytes.Buffer) error {
 	return err
 }
 
+// encode writes the promises that have been made in compact form
+func (self *Promises) encode(w *compactWriter) {
+	n := sort.Search(MaxPromises,  func(i int) bool {return self.entries[i].TripStart==0})
+	w.uvarint(uint64(n))
+	for i:=0; i < n; i++ {
+		self.entries[i].encode(w)
+	}
+}
+
+// decode reads promises written by encode
+func (self *Promises) decode(r *compactReader) {
+	n := r.count(MaxPromises)
+	for i:=0; i < n; i++ {
+		self.entries[i].decode(r)
+	}
+}
+
 // From implemments db/Serialize
 func (self *Promises) From(buff *bytes.Buffer) error {
 	var n int32
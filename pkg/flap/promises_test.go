@@ -26,6 +26,7 @@ type testpredictor struct {
 
 func (self *testpredictor) add(x epochDays,y Kilometres) {}
 func (self *testpredictor) state() ([]float64,[]float64,error) {return nil,nil,ENOTIMPLEMENTED}
+func (self *testpredictor) residuals(xmax epochDays) []float64 {return nil}
 func (self *testpredictor) To(buff *bytes.Buffer) error {return ENOTIMPLEMENTED}
 func (self *testpredictor) From(buff *bytes.Buffer) error {return ENOTIMPLEMENTED}
 
@@ -244,6 +245,7 @@ func TestStackTooLong(t *testing.T) {
 type errpredictor struct { err error }
 func (self *errpredictor) add(x epochDays, y Kilometres) {}
 func (self *errpredictor) state() ([]float64,[]float64,error) {return nil,nil,ENOTIMPLEMENTED}
+func (self *errpredictor) residuals(xmax epochDays) []float64 {return nil}
 func (self *errpredictor) predict(dist Kilometres, start epochDays) (epochDays,error) { return 0, self.err }
 func (self *errpredictor) version() predictVersion { return 0 }
 func (self *errpredictor) backfilled(d1 epochDays,d2 epochDays) (Kilometres,error) { return 0, self.err }
@@ -743,3 +745,33 @@ func TestMatchWrongTripEnd(t *testing.T) {
 	}
 }
 
+
+func TestAlternatives(t *testing.T) {
+	tp := testpredictor{clearRate:1}
+	var ps Promises
+	proposal,_ := ps.propose(epochDays(10).toEpochTime(),epochDays(11).toEpochTime(),2,2,epochDays(1).toEpochTime(),&tp,3)
+	ps.make(proposal,&tp)
+	before := ps
+	alts := ps.alternatives(epochDays(2).toEpochTime(),epochDays(20).toEpochTime(),SecondsInDay,2,2,epochDays(1).toEpochTime(),&tp,3)
+	if ps != before {
+		t.Error("Searching for alternatives changed promises")
+	}
+	if len(alts) != 15 {
+		t.Error("Wrong number of alternatives",len(alts))
+		return
+	}
+	if alts[0].TripStart != epochDays(2).toEpochTime() || alts[0].Clearance != epochDays(5).toEpochTime() || alts[0].Restacked != 0 {
+		t.Error("Wrong best alternative",alts[0])
+	}
+	for i,a := range alts {
+		if a.TripStart >= epochDays(9).toEpochTime() && a.TripStart <= epochDays(11).toEpochTime() {
+			t.Error("Alternative overlaps existing promise",a)
+		}
+		if (i < 11) != (a.Restacked == 0) {
+			t.Error("Alternatives restacking promises not ranked last",i,a)
+		}
+		if a.Proposal.entries[0].TripStart != a.TripStart && a.Proposal.entries[1].TripStart != a.TripStart {
+			t.Error("Alternative proposal doesnt include trip",a)
+		}
+	}
+}
@@ -4,17 +4,60 @@ import (
 	//"errors"
 	"encoding/binary"
 	"bytes"
+	"math"
 	"sort"
 )
 
+// Metres is a distance in whole metres. Balances and transactions are kept in
+// Metres, rather than Kilometres, so that they always add up exactly.
+type Metres int64
+
+const metresPerKilometre = 1000
+
+// Metres converts a distance to whole metres, rounding half way cases away from zero
+func (self Kilometres) Metres() Metres {
+	return Metres(math.Round(float64(self)*metresPerKilometre))
+}
+
+// Kilometres converts a distance in metres to kilometres
+func (self Metres) Kilometres() Kilometres {
+	return Kilometres(self)/metresPerKilometre
+}
+
+// divide splits the distance into n equal shares, each rounded towards zero to
+// whole metres so that the shares never add up to more than the distance
+func (self Metres) divide(n uint64) Metres {
+	if n == 0 {
+		return 0
+	}
+	return self / Metres(n)
+}
+
 type TransactionType		uint8
 const (
 	TTFlight	TransactionType = 0x00
 	TTTaxiOverhead 	TransactionType = 0x01  
 	TTDailyShare	TransactionType = 0x02
 	TTBalanceAdjustment TransactionType = 0x03
+	TTHouseholdPool	TransactionType = 0x04
+	TTHouseholdAllocation TransactionType = 0x05
+	TTTransfer	TransactionType = 0x06
+	TTExemption	TransactionType = 0x07
+	TTOverdraft	TransactionType = 0x08
 )
+
+// Transaction is a single change to a traveller's balance. Ref is the ID of the
+// exemption a TTExemption transaction was made under, and zero otherwise.
 type Transaction struct {
+	Date EpochTime
+	Distance Metres
+	TT	TransactionType
+	Ref	uint64
+}
+
+// fixedTransaction is a transaction as written in the original fixed size
+// encoding, with its distance in kilometres
+type fixedTransaction struct {
 	Date EpochTime
 	Distance Kilometres
 	TT	TransactionType
@@ -22,27 +65,64 @@ type Transaction struct {
 
 // To implements db/Serialize
 func (self *Transaction) To(buff *bytes.Buffer) error {
-	return binary.Write(buff, binary.LittleEndian,self)
+	ft := fixedTransaction{self.Date,self.Distance.Kilometres(),self.TT}
+	return binary.Write(buff, binary.LittleEndian,&ft)
 }
 
 // From implemments db/Serialize
 func (self *Transaction) From(buff *bytes.Buffer) error {
-	return binary.Read(buff,binary.LittleEndian,self)
+	var ft fixedTransaction
+	err := binary.Read(buff,binary.LittleEndian,&ft)
+	if err != nil {
+		return err
+	}
+	*self = Transaction{Date:ft.Date,Distance:ft.Distance.Metres(),TT:ft.TT}
+	return nil
 }
 
 const MaxTransactions=100
 
 type Transactions struct {
 	entries			[MaxTransactions]Transaction
+	carried			Metres
 }
 
 // add adds a single transaction to the top of the list, with the oldest transaction
-// being dropped if the list is full.
+// being dropped if the list is full. The amounts of dropped transactions are carried
+// forward so that the total of all transactions ever made is kept.
 func (self *Transactions) add(t Transaction) {
+	self.carried += self.entries[MaxTransactions-1].Distance
 	copy(self.entries[1:], self.entries[0:])
 	self.entries[0]=t
 }
 
+// made returns true if a transaction of the given type was made at the given
+// time. Only transactions made at or after that time are checked.
+func (self *Transactions) made(tt TransactionType, date EpochTime) bool {
+	for i:=0; i < MaxTransactions && self.entries[i].Date >= date; i++ {
+		if self.entries[i].Date == date && self.entries[i].TT == tt {
+			return true
+		}
+	}
+	return false
+}
+
+// total returns the total of all transactions ever made, including those
+// dropped from the list
+func (self *Transactions) total() Metres {
+	t := self.carried
+	for i:=0; i < MaxTransactions && self.entries[i].Date != 0; i++ {
+		t += self.entries[i].Distance
+	}
+	return t
+}
+
+// full returns true if the list is full, in which case the next transaction
+// added will drop the oldest
+func (self *Transactions) full() bool {
+	return self.entries[MaxTransactions-1].Date != 0
+}
+
 // To implements db/Serialize
 func (self *Transactions) To(buff *bytes.Buffer) error {
 	n := int32(sort.Search(MaxTransactions,  func(i int) bool {return self.entries[i].Date==0}))
@@ -60,6 +140,52 @@ func (self *Transactions) To(buff *bytes.Buffer) error {
 	return err
 }
 
+// encode writes the transactions in compact form, each dated by the
+// difference from the date of the transaction before. Only exemption
+// transactions have their reference written.
+func (self *Transactions) encode(w *compactWriter) {
+	n := sort.Search(MaxTransactions,  func(i int) bool {return self.entries[i].Date==0})
+	w.uvarint(uint64(n))
+	var prev EpochTime
+	for i:=0; i < n; i++ {
+		t := &self.entries[i]
+		w.varint(int64(t.Date)-int64(prev))
+		w.byte(byte(t.TT))
+		w.varint(int64(t.Distance))
+		if t.TT == TTExemption {
+			w.uvarint(t.Ref)
+		}
+		prev = t.Date
+	}
+	w.varint(int64(self.carried))
+}
+
+// decode reads transactions written by encode in the given version of the
+// traveller encoding. Before travellerVersionMetres distances were written in
+// kilometres and are rounded to the nearest metre. Before travellerVersionLedger
+// the total carried forward wasnt written and is left for the caller to set.
+func (self *Transactions) decode(r *compactReader, version uint8) {
+	n := r.count(MaxTransactions)
+	var prev EpochTime
+	for i:=0; i < n; i++ {
+		t := &self.entries[i]
+		t.Date = r.since(prev)
+		t.TT = TransactionType(r.byte())
+		if version < travellerVersionMetres {
+			t.Distance = Kilometres(r.float()).Metres()
+		} else {
+			t.Distance = Metres(r.varint())
+		}
+		if t.TT == TTExemption {
+			t.Ref = r.uvarint()
+		}
+		prev = t.Date
+	}
+	if version >= travellerVersionLedger {
+		self.carried = Metres(r.varint())
+	}
+}
+
 // From implemments db/Serialize
 func (self *Transactions) From(buff *bytes.Buffer) error {
 	var n int32
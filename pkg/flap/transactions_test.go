@@ -8,9 +8,9 @@ import (
 
 func TestAddOne(t *testing.T) {
 	var ts Transactions
-	ts.add(Transaction{SecondsInDay,1234,TTTaxiOverhead})
+	ts.add(Transaction{Date:SecondsInDay,Distance:1234,TT:TTTaxiOverhead})
 	
-	if !reflect.DeepEqual(ts.entries[0],Transaction{SecondsInDay,1234,TTTaxiOverhead}) {
+	if !reflect.DeepEqual(ts.entries[0],Transaction{Date:SecondsInDay,Distance:1234,TT:TTTaxiOverhead}) {
 		t.Error("Unexpected latest transaction",ts.entries[0])
 	}
 
@@ -38,7 +38,7 @@ func TestSerializeNone(t *testing.T) {
 
 func TestSerializeOne(t *testing.T) {
 	var ts Transactions
-	ts.add(Transaction{SecondsInDay,1234,TTTaxiOverhead})
+	ts.add(Transaction{Date:SecondsInDay,Distance:1234,TT:TTTaxiOverhead})
 	var buff bytes.Buffer
 	err := ts.To(&buff)
 	if err != nil {
@@ -56,14 +56,14 @@ func TestSerializeOne(t *testing.T) {
 func TestAddLots(t *testing.T) {
 	var ts Transactions
 	for i := 1; i <= MaxTransactions+1; i+=1 {
-		ts.add(Transaction{EpochTime(SecondsInDay*i),Kilometres(i),TTDailyShare})
+		ts.add(Transaction{Date:EpochTime(SecondsInDay*i),Distance:Metres(i),TT:TTDailyShare})
 	}
 	
-	if !reflect.DeepEqual(ts.entries[0],Transaction{EpochTime(SecondsInDay*(MaxTransactions+1)),Kilometres(MaxTransactions+1),TTDailyShare}) {
+	if !reflect.DeepEqual(ts.entries[0],Transaction{Date:EpochTime(SecondsInDay*(MaxTransactions+1)),Distance:Metres(MaxTransactions+1),TT:TTDailyShare}) {
 		t.Error("Unexpected latest transaction",ts.entries[0])
 	}
 
-	if !reflect.DeepEqual(ts.entries[MaxTransactions-1],Transaction{EpochTime(SecondsInDay*2),Kilometres(2),TTDailyShare}) {
+	if !reflect.DeepEqual(ts.entries[MaxTransactions-1],Transaction{Date:EpochTime(SecondsInDay*2),Distance:Metres(2),TT:TTDailyShare}) {
 		t.Error("Unexpected oldest transaction",ts.entries[MaxTransactions-1])
 	}
 }
@@ -71,7 +71,7 @@ func TestAddLots(t *testing.T) {
 func TestSerailizeLots(t *testing.T) {
 	var ts Transactions
 	for i := 1; i <= MaxTransactions+1; i+=1 {
-		ts.add(Transaction{EpochTime(SecondsInDay*i),Kilometres(i),TTDailyShare})
+		ts.add(Transaction{Date:EpochTime(SecondsInDay*i),Distance:Metres(i),TT:TTDailyShare})
 	}
 	
 	var buff bytes.Buffer
@@ -85,12 +85,32 @@ func TestSerailizeLots(t *testing.T) {
 	if err != nil {
 		t.Error("From failed with error ",err)
 	}
-	if !reflect.DeepEqual(ts,ts2) {
+	if !reflect.DeepEqual(ts.entries,ts2.entries) {
 		t.Error("Deserialized didnt match serialized",ts2)
 	}
 
 }
 
+func TestTransactionsCarried(t *testing.T) {
+	var ts Transactions
+	for i := 1; i <= MaxTransactions+2; i+=1 {
+		if ts.full() != (i > MaxTransactions) {
+			t.Error("Transactions full at wrong point",i)
+		}
+		ts.add(Transaction{Date:EpochTime(SecondsInDay*i),Distance:Metres(i),TT:TTDailyShare})
+	}
+	if ts.carried != 3 || ts.total() != (MaxTransactions+2)*(MaxTransactions+3)/2 {
+		t.Error("Dropped transactions not carried forward",ts.carried,ts.total())
+	}
+	var buff bytes.Buffer
+	ts.encode(newCompactWriter(&buff))
+	var ts2 Transactions
+	ts2.decode(newCompactReader(&buff),travellerVersionLedger)
+	if !reflect.DeepEqual(ts,ts2) {
+		t.Error("Decoded transactions dont match encoded",ts2.carried)
+	}
+}
+
 func TestTransactionsIterateEmpty(t *testing.T) {
 	var ts Transactions
 	it := ts.NewIterator()
@@ -102,7 +122,7 @@ func TestTransactionsIterateEmpty(t *testing.T) {
 func TestTransactionsIterateFull(t *testing.T) {
 	var ts Transactions
 	for i := 1; i <= MaxTransactions+1; i+=1 {
-		ts.add(Transaction{EpochTime(SecondsInDay*i),Kilometres(i),TTDailyShare})
+		ts.add(Transaction{Date:EpochTime(SecondsInDay*i),Distance:Metres(i),TT:TTDailyShare})
 	}
 	
 
@@ -119,3 +139,28 @@ func TestTransactionsIterateFull(t *testing.T) {
 	}
 }
 
+
+func TestMetres(t *testing.T) {
+	for _,c := range []struct{km Kilometres; m Metres} {
+		{1.5,1500},{0.0625,63},{-0.0625,-63},{0.03125,31},{-0.03125,-31},{0,0}} {
+		if c.km.Metres() != c.m {
+			t.Error("Kilometres rounded to wrong number of metres",c.km,c.km.Metres())
+		}
+	}
+	if Metres(1500).Kilometres() != 1.5 {
+		t.Error("Metres converted to wrong number of kilometres",Metres(1500).Kilometres())
+	}
+}
+
+func TestMetresDivide(t *testing.T) {
+	for _,c := range []struct{m Metres; n uint64; share Metres} {
+		{1000,3,333},{-1000,3,-333},{999,1000,0},{1000,0,0},{1000,1,1000}} {
+		share := c.m.divide(c.n)
+		if share != c.share {
+			t.Error("Distance divided into wrong shares",c.m,c.n,share)
+		}
+		if c.n > 0 && (share*Metres(c.n) > c.m && c.m >= 0 || share*Metres(c.n) < c.m && c.m < 0) {
+			t.Error("Shares add up to more than distance",c.m,c.n,share)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package flap
+
+import (
+	"github.com/richardmorrey/flap/pkg/db"
+	"encoding/binary"
+	"encoding/hex"
+	"bytes"
+	"errors"
+)
+
+var ETRANSFERSNOTENABLED = errors.New("Transfers not enabled")
+var ETRANSFERTOOLARGE = errors.New("Transfer exceeds maximum allowed")
+var EYEARLYTRANSFERLIMIT = errors.New("Transfer exceeds yearly limit")
+
+// TransfersConfig regulates transfers of distance between travellers. A transfer can be
+// no more than MaxAmount, and the total a traveller transfers in any year no more than
+// MaxPerYear, unless they are zero. The donor must retain a balance of at least
+// MinRetained, which can be negative to let travellers give away credit they are yet
+// to be backfilled. If DonorInCredit is set the donor must also be in credit beforehand.
+type TransfersConfig struct {
+	Enabled		bool
+	MaxAmount	Kilometres
+	MaxPerYear	Kilometres
+	MinRetained	Kilometres
+	DonorInCredit	bool
+}
+
+// transferred is the total transferred by a traveller at one time, written in a
+// fixed encoding
+type transferred Metres
+
+// To implements db/Serialize
+func (self *transferred) To(buff *bytes.Buffer) error {
+	return binary.Write(buff,binary.BigEndian,self)
+}
+
+// From implements db/Serialize
+func (self *transferred) From(buff *bytes.Buffer) error {
+	return binary.Read(buff,binary.BigEndian,self)
+}
+
+// Transfers is a table of what each traveller has transferred to others, keyed by
+// the key of the donor's traveller record followed by the time, so that the total
+// for the last year can be found without keeping every transaction
+const transfersTableName="transfers"
+const secondsInYear=SecondsInDay*365
+type Transfers struct {
+	table db.Table
+}
+
+// NewTransfers opens the transfers table in the given database, creating it if it doesnt exist
+func NewTransfers(database db.Database) *Transfers {
+	table,err := database.OpenTable(transfersTableName)
+	if err == db.ETABLENOTFOUND {
+		table,err = database.CreateTable(transfersTableName)
+	}
+	if err != nil {
+		logError(err)
+		return nil
+	}
+	return &Transfers{table:table}
+}
+
+// dropTransfers drops the transfers table from the given database
+func dropTransfers(database db.Database) error {
+	return database.DropTable(transfersTableName)
+}
+
+// transferKey returns the key recording what the donor with the given key transferred at the given time
+func transferKey(donor string, now EpochTime) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],uint64(now))
+	return donor+hex.EncodeToString(b[:])
+}
+
+// lastYear returns the total transferred by the donor with the given key in the year up to
+// the given time, deleting records of transfers made before then
+func (self *Transfers) lastYear(donor string, now EpochTime) (Metres,error) {
+	var total Metres
+	var old []string
+	it,err := self.table.NewIterator(donor)
+	if err != nil {
+		return 0,err
+	}
+	since := transferKey(donor,0)
+	if now > secondsInYear {
+		since = transferKey(donor,now-secondsInYear)
+	}
+	for it.Next() {
+		if it.Key() <= since {
+			old = append(old,it.Key())
+			continue
+		}
+		var t transferred
+		it.Value(&t)
+		total += Metres(t)
+	}
+	err = it.Error()
+	it.Release()
+	if err != nil {
+		return 0,err
+	}
+	for _,key := range old {
+		err = self.table.Delete(key)
+		if err != nil {
+			return 0,err
+		}
+	}
+	return total,nil
+}
+
+// add records that the donor with the given key transferred the given distance at the given time
+func (self *Transfers) add(donor string, amount Metres, now EpochTime) error {
+	key := transferKey(donor,now)
+	var t transferred
+	err := self.table.Get(key,&t)
+	if err != nil && err != db.EKEYNOTFOUND {
+		return err
+	}
+	t += transferred(amount)
+	return self.table.Put(key,&t)
+}
+
+// Transfer moves the given distance from the balance of one traveller to that of another,
+// recording it with a TTTransfer transaction for each, within the limits configured in
+// FlapParams.Transfers.
+func (self *Engine) Transfer(from Passport, to Passport, amount Metres, now EpochTime) error {
+
+	// Check args
+	config := &self.Administrator.params.Transfers
+	if !config.Enabled {
+		return ETRANSFERSNOTENABLED
+	}
+	if amount <= 0 || from == to {
+		return EINVALIDARGUMENT
+	}
+	if config.MaxAmount > 0 && amount > config.MaxAmount.Metres() {
+		return ETRANSFERTOOLARGE
+	}
+
+	// Check donor can afford it
+	donor,err := self.Travellers.GetTraveller(from)
+	if err != nil {
+		return err
+	}
+	if config.DonorInCredit && donor.Balance < 0 {
+		return ENOTENOUGHCREDIT
+	}
+	if donor.Balance-amount < config.MinRetained.Metres() {
+		return ENOTENOUGHCREDIT
+	}
+	key,err := from.generateKey()
+	if err != nil {
+		return logError(err)
+	}
+	if config.MaxPerYear > 0 {
+		total,err := self.Transfers.lastYear(key,now)
+		if err != nil {
+			return logError(err)
+		}
+		if total+amount > config.MaxPerYear.Metres() {
+			return EYEARLYTRANSFERLIMIT
+		}
+	}
+
+	// Move distance, counting it towards the yearly limit first so that a failure
+	// never lets a donor exceed it
+	err = self.Transfers.add(key,amount,now)
+	if err != nil {
+		return logError(err)
+	}
+	recipient := self.getCreateTraveller(to,now)
+	donor.transact(-amount,now,TTTransfer)
+	recipient.transact(amount,now,TTTransfer)
+	err = self.putTravellers([]*Traveller{&donor,recipient})
+	if err != nil {
+		return err
+	}
+	return self.events.record(Event{Type:ETTransfer,Time:now,Passport:from,Members:[]Passport{from,to},Amounts:[]Metres{-amount,amount}})
+}
@@ -0,0 +1,117 @@
+package flap
+
+import (
+	"testing"
+	"github.com/richardmorrey/flap/pkg/db"
+	"reflect"
+)
+
+func TestTransfer(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports := balancesEngine(t,database,FlapParams{TripLength:10,FlightsInTrip:50,FlightInterval:1,Transfers:TransfersConfig{Enabled:true}},false,10000)
+	donor := passports[0]
+	recipient := NewPassport("300000001","uk")
+	err := engine.Transfer(donor,recipient,3000,SecondsInDay*2)
+	if err != nil {
+		t.Error("Transfer failed",err)
+	}
+	from,_ := engine.Travellers.GetTraveller(donor)
+	to,err := engine.Travellers.GetTraveller(recipient)
+	if err != nil || from.Balance != 7000 || to.Balance != 3000 {
+		t.Error("Transfer moved wrong distance",from.Balance,to.Balance,err)
+	}
+	if from.Transactions.entries[0] != (Transaction{Date:SecondsInDay*2,Distance:-3000,TT:TTTransfer}) ||
+	   to.Transactions.entries[0] != (Transaction{Date:SecondsInDay*2,Distance:3000,TT:TTTransfer}) {
+		t.Error("Transfer recorded wrong transactions",from.Transactions.entries[0],to.Transactions.entries[0])
+	}
+	ts,err := engine.TravellerAsOf(recipient,MaxEpochTime)
+	if err != nil || !reflect.DeepEqual(ts.Traveller,to) {
+		t.Error("Recipient as of now differs from record",err)
+	}
+	err = engine.Transfer(donor,recipient,7001,SecondsInDay*2)
+	if err != ENOTENOUGHCREDIT {
+		t.Error("Donor left in debit",err)
+	}
+	err = engine.Transfer(donor,donor,1,SecondsInDay*2)
+	if err != EINVALIDARGUMENT {
+		t.Error("Donor transferred to themselves",err)
+	}
+	err = engine.Transfer(NewPassport("300000002","uk"),recipient,1,SecondsInDay*2)
+	if err != db.EKEYNOTFOUND {
+		t.Error("Unknown donor transferred",err)
+	}
+}
+
+func TestTransferNotEnabled(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports := balancesEngine(t,database,FlapParams{TripLength:10,FlightsInTrip:50,FlightInterval:1,Transfers:TransfersConfig{}},false,10000)
+	donor := passports[0]
+	err := engine.Transfer(donor,NewPassport("300000001","uk"),1,SecondsInDay*2)
+	if err != ETRANSFERSNOTENABLED {
+		t.Error("Transfer allowed when not enabled",err)
+	}
+}
+
+func TestTransferLimits(t *testing.T) {
+	database := db.NewMemoryDB()
+	defer database.Release()
+	engine,passports := balancesEngine(t,database,FlapParams{TripLength:10,FlightsInTrip:50,FlightInterval:1,Transfers:TransfersConfig{Enabled:true,MaxAmount:2,MaxPerYear:5,MinRetained:-1}},false,3000)
+	donor := passports[0]
+	recipient := NewPassport("300000001","uk")
+	err := engine.Transfer(donor,recipient,2001,SecondsInDay*2)
+	if err != ETRANSFERTOOLARGE {
+		t.Error("Transfer over maximum allowed",err)
+	}
+
+	// Donor can go into debit down to the minimum retained
+	for _,amount := range []Metres{2000,2000} {
+		err = engine.Transfer(donor,recipient,amount,SecondsInDay*2)
+		if err != nil {
+			t.Error("Transfer within limits failed",err)
+		}
+	}
+	err = engine.Transfer(donor,recipient,1,SecondsInDay*3)
+	if err != ENOTENOUGHCREDIT {
+		t.Error("Donor left below minimum retained",err)
+	}
+
+	// Yearly limit
+	traveller,_ := engine.Travellers.GetTraveller(donor)
+	traveller.transact(10000,SecondsInDay*3,TTBalanceAdjustment)
+	engine.Travellers.PutTraveller(traveller)
+	err = engine.Transfer(donor,recipient,1001,SecondsInDay*3)
+	if err != EYEARLYTRANSFERLIMIT {
+		t.Error("Transfer over yearly limit",err)
+	}
+	err = engine.Transfer(donor,recipient,1000,SecondsInDay*3)
+	if err != nil {
+		t.Error("Transfer up to yearly limit failed",err)
+	}
+	err = engine.Transfer(donor,recipient,2000,SecondsInDay*368)
+	if err != nil {
+		t.Error("Transfer after a year failed",err)
+	}
+	key := mustKey(t,donor)
+	total,_ := engine.Transfers.lastYear(key,SecondsInDay*368)
+	if total != 2000 {
+		t.Error("Wrong total transferred in last year",total)
+	}
+	var tr transferred
+	if engine.Transfers.table.Get(transferKey(key,SecondsInDay*2),&tr) != db.EKEYNOTFOUND {
+		t.Error("Transfers over a year old not deleted")
+	}
+
+	// Donor in credit
+	params := engine.Administrator.params
+	params.Transfers.DonorInCredit = true
+	engine.Administrator.SetParams(params)
+	traveller,_ = engine.Travellers.GetTraveller(donor)
+	traveller.transact(-traveller.Balance-1,SecondsInDay*368,TTBalanceAdjustment)
+	engine.Travellers.PutTraveller(traveller)
+	err = engine.Transfer(donor,recipient,1,SecondsInDay*368)
+	if err != ENOTENOUGHCREDIT {
+		t.Error("Donor in debit transferred",err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"errors"
 	"encoding/hex"
+	"context"
 )
 
 var ETABLENOTOPEN = errors.New("Table not open")
@@ -49,7 +50,7 @@ type Traveller struct {
 	Transactions Transactions
 	Promises    Promises
 	Kept	    Promise
-	Balance	    Kilometres
+	Balance	    Metres
 }
 
 type ClearanceReason		uint8
@@ -58,12 +59,19 @@ const (
 	CRMidTrip 	ClearanceReason = 0x01  
 	CRKeptPromise	ClearanceReason = 0x02
 	CRInCredit	ClearanceReason = 0x03
+	CROverdraft	ClearanceReason = 0x04
 )
 
 // Cleared returns true if the traveller is cleared
 // to travel at the specified date/time
 // Also indicates reason for clearance
 func (self *Traveller) Cleared(now EpochTime) ClearanceReason {
+	return self.clearedWithin(now,0)
+}
+
+// clearedWithin works like Cleared but also clears a traveller in debit by no
+// more than the given overdraft
+func (self *Traveller) clearedWithin(now EpochTime, overdraft Metres) ClearanceReason {
 
 	// If we have a.Kept then update its Clearance date, which might
 	// have changed due to "stacking"
@@ -79,6 +87,8 @@ func (self *Traveller) Cleared(now EpochTime) ClearanceReason {
 		cr = CRKeptPromise 
 	} else if self.Balance >=0 {
 		cr = CRInCredit
+	} else if self.Balance >= -overdraft {
+		cr = CROverdraft
 	}
 	return cr
 }
@@ -132,13 +142,20 @@ func (self *Traveller) AsKML(a *Airports) string {
 // Also, If "debit" is true, the flight distance  is subtracted from the traveller's distance balance.
 // If traveller is not cleared for travel no action is taken and an error is returned.
 // If a promises is being applied, then current balance is returned.
-func (self *Traveller) submitFlight(flight *Flight,now EpochTime, taxiOH Kilometres, debit bool) (Kilometres,Kilometres,error) {
+// Any exemption given is consulted to waive the clearance check or debit, with a zero
+// exemption transaction recorded if either is waived. A traveller in debit by no more
+// than the given overdraft is cleared, with a zero overdraft transaction recorded.
+func (self *Traveller) submitFlight(flight *Flight,now EpochTime, taxiOH Kilometres, debit bool, ex *Exemption, overdraft Metres) (Metres,Kilometres,error) {
 
 	//  Make sure we are cleared to travel
-	cr := self.Cleared(now) 
+	exempted := false
+	cr := self.clearedWithin(now,overdraft)
 	if cr == CRGrounded {
-		logDebug("balance:",self.Balance,"cleared:",self.Kept.Clearance.ToTime())
-		return 0,0,EGROUNDED
+		if !ex.waives(EWClearance) {
+			logDebug("balance:",self.Balance,"cleared:",self.Kept.Clearance.ToTime())
+			return 0,0,EGROUNDED
+		}
+		exempted = true
 	}
 
 	// Add flight to history
@@ -150,12 +167,20 @@ func (self *Traveller) submitFlight(flight *Flight,now EpochTime, taxiOH Kilomet
 	// Debit flight distance and any taxi overhead from balance
 	bac := self.Balance
 	pd := self.Kept.Distance
-	if debit {
-		self.transact(-flight.Distance,now,TTFlight)
+	if debit && ex.waives(EWDebit) {
+		exempted = true
+	} else if debit {
+		self.transact(-flight.Distance.Metres(),now,TTFlight)
 		if (taxiOH != 0) {
-			self.transact(-taxiOH,now,TTTaxiOverhead)
+			self.transact(-taxiOH.Metres(),now,TTTaxiOverhead)
 		}
 	}
+	if exempted {
+		self.Transactions.add(Transaction{Date:now,TT:TTExemption,Ref:ex.ID})
+	}
+	if cr == CROverdraft {
+		self.Transactions.add(Transaction{Date:now,TT:TTOverdraft})
+	}
 
 	// Reset any kept promise
 	if cr == CRKeptPromise {
@@ -165,6 +190,29 @@ func (self *Traveller) submitFlight(flight *Flight,now EpochTime, taxiOH Kilomet
 	return 0,0,nil
 }
 
+// submitFlights submits each of the given flights in turn under any exemption given, with the
+// overdraft configured for it, applying any balance adjustment configured for promises and
+// reporting it to the given correction if there is one
+func (self *Traveller) submitFlights(flights []Flight, now EpochTime, params *FlapParams, debit bool, pc *promisesCorrection, ex *Exemption) error {
+	for _,flight := range flights {
+
+		// Update traveller with the new flight
+		bac,pd,err := self.submitFlight(&flight,now,params.TaxiOverhead,debit,ex,params.Overdraft.limit(ex))
+		if err != nil {
+			return err
+		}
+
+		// Apply any configured balance adjustment
+		if pc != nil {
+			pc.change(bac.Kilometres(),pd)
+		}
+		if (params.Promises.Algo & pamCorrectBalances == pamCorrectBalances) && (bac < 0) {
+			self.transact(-bac,now,TTBalanceAdjustment)
+		}
+	}
+	return nil
+}
+
 // generateKey generates a unique key based on the contents of a
 // Passport struct. as the SHA1 of fields in the passport structure.
 // Note hash algorithm is use to ensure no hotspots when iterating over
@@ -179,12 +227,84 @@ func (self *Passport) generateKey() (string,error) {
 	return hex.EncodeToString(sha1[:]), nil
 }
 
+// travellerIndex identifies one of the index tables listing the keys of
+// travellers that need attention in the daily update
+type travellerIndex int
+const (
+	tiGrounded travellerIndex = iota
+	tiMidTrip
+	tiKept
+	numTravellerIndices
+)
+
+// travellerIndexNames holds the table name for each index
+var travellerIndexNames = [numTravellerIndices]string{"grounded","midtrip","kept"}
+
+// indexed returns true if the traveller belongs in the given index:
+// (1) grounded - not travelling and with a balance to backfill, or backfilled
+// on the given day so that a repeated run for that day still counts them
+// (2) midtrip - with a trip history that the daily update may change
+// (3) kept - with a kept promise whose clearance is reported in the daily update
+// A traveller in none of them needs nothing doing by the daily update.
+func (self *Traveller) indexed(ti travellerIndex, day EpochTime) bool {
+	switch ti {
+		case tiGrounded:
+			return !self.MidTrip() && (self.Balance < 0 || (day != 0 && self.Transactions.made(TTDailyShare,day)))
+		case tiMidTrip:
+			return !self.tripHistory.empty() && (self.MidTrip() || self.tripHistory.oldestChange != 0)
+		case tiKept:
+			return self.Kept.Clearance > 0 && self.Kept.StackIndex == 0
+	}
+	return false
+}
+
+// listed returns true if the traveller is listed in any of the indices, and so
+// is visited by the next daily update
+func (self *Traveller) listed(day EpochTime) bool {
+	for ti:=travellerIndex(0); ti < numTravellerIndices; ti++ {
+		if self.indexed(ti,day) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexEntry is the value stored in an index table. It is a single byte, as
+// some databases dont store empty values.
+type indexEntry struct {}
+
+func (self *indexEntry) To(buff *bytes.Buffer) error {
+	return buff.WriteByte(0)
+}
+
+func (self *indexEntry) From(buff *bytes.Buffer) error {
+	return nil
+}
+
+// index lists the traveller with the given key in just those indices it belongs in
+func (self *Traveller) index(key string, writers [numTravellerIndices]db.Writer, day EpochTime) error {
+	for ti,w := range writers {
+		var err error
+		if self.indexed(travellerIndex(ti),day) {
+			err = w.Put(key,&indexEntry{})
+		} else {
+			err = w.Delete(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type Travellers struct {
 	table db.Table
+	indices [numTravellerIndices]db.Table
 }
 
-// NewTravellers opens a interface for the Travellers table from the 
-// given database. If the table doesnt exist it is created.
+// NewTravellers opens a interface for the Travellers table, and the index
+// tables kept alongside it, from the given database. If the tables dont
+// exist they are created, with the indices built from any existing travellers.
 const travellersTableName = "travellers"
 func NewTravellers(flapdb db.Database) *Travellers {
 	travellers := new(Travellers)
@@ -196,11 +316,153 @@ func NewTravellers(flapdb db.Database) *Travellers {
 		return nil
 	}
 	travellers.table  = table
+	created := false
+	for ti,name := range travellerIndexNames {
+		index,err := flapdb.OpenTable(name)
+		if err == db.ETABLENOTFOUND {
+			index,err = flapdb.CreateTable(name)
+			created = true
+		}
+		if err != nil {
+			return nil
+		}
+		travellers.indices[ti] = index
+	}
+	if created {
+		err = travellers.RebuildIndices()
+		if err != nil {
+			logError(err)
+			return nil
+		}
+	}
 	return travellers
 }
 
-// Drops travellers table from given database
+// RebuildIndices lists every traveller in the indices it belongs in. It is
+// only needed for tables written without indices, or if a failure left the
+// indices out of step with the travellers.
+func (self *Travellers) RebuildIndices() error {
+	it,err := self.table.NewIterator("")
+	if err != nil {
+		return err
+	}
+	defer it.Release()
+	bw,err := self.MakeBatch(10000)
+	if err != nil {
+		return err
+	}
+	for it.Next() {
+		var t Traveller
+		it.Value(&t)
+		err = t.index(it.Key(),bw.indexWriters(),0)
+		if err != nil {
+			bw.Release()
+			return err
+		}
+	}
+	err = bw.Release()
+	if err != nil {
+		return err
+	}
+	return it.Error()
+}
+
+// rawTraveller is a traveller record as stored, for checking its version
+type rawTraveller []byte
+
+// To implements db/Serialize
+func (self *rawTraveller) To(buff *bytes.Buffer) error {
+	_,err := buff.Write(*self)
+	return err
+}
+
+// From implements db/Serialize
+func (self *rawTraveller) From(buff *bytes.Buffer) error {
+	*self = append((*self)[:0],buff.Bytes()...)
+	return nil
+}
+
+// migrateBatchSize is the most travellers Migrate reads before rewriting them
+const migrateBatchSize = 10000
+
+// Migrate rewrites every traveller record written in an older encoding in the
+// current one, returning the number rewritten. Older records are converted whenever
+// they are read so migrating is only needed to convert them all in one go, for
+// instance before auditing them. Travellers are read in batches, with no iterator
+// open while they are rewritten, and written along with their indices. It stops
+// early if ctx is done.
+func (self *Travellers) Migrate(ctx context.Context) (int,error) {
+	migrated := 0
+	start := ""
+	for ctx.Err() == nil {
+		travellers,next,err := self.olderTravellers(start,migrateBatchSize)
+		if err != nil {
+			return migrated,err
+		}
+		if len(travellers) > 0 {
+			bw,err := self.MakeBatch(len(travellers))
+			if err != nil {
+				bw.Release()
+				return migrated,err
+			}
+			for _,t := range travellers {
+				err = bw.Put(t)
+				if err != nil {
+					bw.Release()
+					return migrated,err
+				}
+			}
+			err = bw.Release()
+			if err != nil {
+				return migrated,err
+			}
+			migrated += len(travellers)
+		}
+		if next == "" {
+			return migrated,nil
+		}
+		start = next
+	}
+	return migrated,ctx.Err()
+}
+
+// olderTravellers reads up to max travellers written in an older encoding from the
+// given key on. It returns them with the key to carry on from, which is empty once
+// the end of the table is reached.
+func (self *Travellers) olderTravellers(start string, max int) ([]Traveller,string,error) {
+	it,err := self.table.NewRangeIterator(db.IteratorOptions{Start:start})
+	if err != nil {
+		return nil,"",err
+	}
+	defer it.Release()
+	var travellers []Traveller
+	for it.Next() {
+		if len(travellers) == max {
+			return travellers,it.Key(),nil
+		}
+		var raw rawTraveller
+		it.Value(&raw)
+		if len(raw) > 0 && raw[0] == travellerVersionLedger {
+			continue
+		}
+		var t Traveller
+		err = t.From(bytes.NewBuffer(raw))
+		if err != nil {
+			return nil,"",err
+		}
+		travellers = append(travellers,t)
+	}
+	return travellers,"",it.Error()
+}
+
+// Drops travellers table, and its indices, from given database
 func dropTravellers(database db.Database) error {
+	for _,name := range travellerIndexNames {
+		err := database.DropTable(name)
+		if err != nil && err != db.ETABLENOTFOUND {
+			return err
+		}
+	}
 	return database.DropTable(travellersTableName)
 }
 
@@ -233,9 +495,17 @@ func (self  *Travellers) PutTraveller(traveller Traveller) error {
 	if self.table == nil {
 		return ETABLENOTOPEN
 	}
-	return traveller.put(self.table)
+	var writers [numTravellerIndices]db.Writer
+	for ti,index := range self.indices {
+		writers[ti] = index
+	}
+	return traveller.put(self.table,writers,0)
 }
-func (self* Traveller) put(writer db.Writer) error {
+
+// put writes the traveller record, after first listing it in the indices it
+// belongs in so that a failure part way through never leaves a traveller
+// needing attention out of the indices
+func (self* Traveller) put(writer db.Writer, indexWriters [numTravellerIndices]db.Writer, day EpochTime) error {
 
 	// Generate key
 	key,err := self.passport.generateKey()
@@ -243,11 +513,101 @@ func (self* Traveller) put(writer db.Writer) error {
 		return err
 	}
 
+	// Update indices
+	err = self.index(key,indexWriters,day)
+	if err != nil {
+		return err
+	}
+
 	// Put record
 	return writer.Put(key[:], self);
 }
 
+// travellerVersionCompact marks traveller records written with the compact
+// encoding. Records written before it have a version of 0 and are still read.
+const travellerVersionCompact uint8 = 1
+
+// travellerVersionMetres marks compact records with the balance and transactions
+// in whole metres. Older records have them in kilometres, which are rounded to the
+// nearest metre when read.
+const travellerVersionMetres uint8 = 2
+
+// travellerVersionLedger marks compact records with the total of transactions
+// dropped from the list, so that the balance can be reconciled with them. For older
+// records it is taken to be whatever reconciles the balance.
+const travellerVersionLedger uint8 = 3
+
+// travellerEncodeFixed makes To write the original fixed size encoding, so that
+// benchmarks can compare the two encodings
+var travellerEncodeFixed bool
+
+// To implements db/Serialize. Lists are written without their empty entries and
+// integers, including times as differences from related times, in as few bytes
+// as they need.
 func (self *Traveller) To(buff *bytes.Buffer) error {
+	if travellerEncodeFixed {
+		return self.toFixed(buff)
+	}
+	w := newCompactWriter(buff)
+	w.byte(travellerVersionLedger)
+	w.uvarint(uint64(self.Created))
+	w.bytes(self.passport.Number[:])
+	w.bytes(self.passport.Issuer[:])
+	self.tripHistory.encode(w)
+	self.Promises.encode(w)
+	self.Transactions.encode(w)
+	if self.Kept == (Promise{}) {
+		w.byte(0)
+	} else {
+		w.byte(1)
+		self.Kept.encode(w)
+	}
+	w.varint(int64(self.Balance))
+	return nil
+}
+
+// From implements db/Serialize, reading records in either the compact or the
+// original fixed size encoding
+func (self *Traveller) From(buff *bytes.Buffer) error {
+	if buff.Len() == 0 {
+		return logError(ECORRUPTRECORD)
+	}
+	version := buff.Bytes()[0]
+	switch version {
+		case 0:
+			return self.fromFixed(buff)
+		case travellerVersionCompact, travellerVersionMetres, travellerVersionLedger:
+			buff.Next(1)
+		default:
+			return logError(ECORRUPTRECORD)
+	}
+	r := newCompactReader(buff)
+	self.Created = EpochTime(r.uvarint())
+	r.bytes(self.passport.Number[:])
+	r.bytes(self.passport.Issuer[:])
+	self.tripHistory.decode(r)
+	self.Promises.decode(r)
+	self.Transactions.decode(r,version)
+	if r.byte() != 0 {
+		self.Kept.decode(r)
+	}
+	if version < travellerVersionMetres {
+		self.Balance = Kilometres(r.float()).Metres()
+	} else {
+		self.Balance = Metres(r.varint())
+	}
+	if version < travellerVersionLedger {
+		self.Transactions.carried = self.Balance - self.Transactions.total()
+	}
+	if r.err != nil {
+		return logError(r.err)
+	}
+	return nil
+}
+
+// toFixed writes the original fixed size encoding, in which every field is
+// written in full
+func (self *Traveller) toFixed(buff *bytes.Buffer) error {
 	err := binary.Write(buff,binary.LittleEndian,&(self.version))
 	if err != nil {
 		return logError(err)
@@ -277,10 +637,12 @@ func (self *Traveller) To(buff *bytes.Buffer) error {
 	if err != nil {
 		return logError(err)
 	}
-	return binary.Write(buff,binary.LittleEndian,&(self.Balance))
+	balance := self.Balance.Kilometres()
+	return binary.Write(buff,binary.LittleEndian,&balance)
 }
 
-func (self *Traveller) From(buff *bytes.Buffer) error {	
+// fromFixed reads a record written with the original fixed size encoding
+func (self *Traveller) fromFixed(buff *bytes.Buffer) error {	
 	err := binary.Read(buff,binary.LittleEndian,&(self.version))
 	if err != nil {
 		return logError(err)
@@ -309,12 +671,19 @@ func (self *Traveller) From(buff *bytes.Buffer) error {
 	if err != nil {
 		return logError(err)
 	}
-	return binary.Read(buff,binary.LittleEndian,&(self.Balance))
+	var balance Kilometres
+	err = binary.Read(buff,binary.LittleEndian,&balance)
+	if err != nil {
+		return logError(err)
+	}
+	self.Balance = balance.Metres()
+	self.Transactions.carried = self.Balance - self.Transactions.total()
+	return nil
 }
 
 // transact carries out a balance adjustment, recording the transaction for posterity
-func (self *Traveller) transact(amount Kilometres,now EpochTime, tt TransactionType) {
-	self.Transactions.add(Transaction{now,amount, tt})
+func (self *Traveller) transact(amount Metres,now EpochTime, tt TransactionType) {
+	self.Transactions.add(Transaction{Date:now,Distance:amount,TT:tt})
 	self.Balance += amount
 }
 
@@ -350,6 +719,7 @@ func (self *Travellers) NewIterator(prefix string) (*TravellersIterator,error) {
 
 type TravellersSnapshot struct {
 	ss db.Snapshot
+	indices [numTravellerIndices]db.Snapshot
 }
 
 func (self *TravellersSnapshot) Get(pp Passport) (Traveller,error) {
@@ -358,10 +728,46 @@ func (self *TravellersSnapshot) Get(pp Passport) (Traveller,error) {
 	return t,err
 }
 
+// getByKey returns the traveller with the given key
+func (self *TravellersSnapshot) getByKey(key string) (Traveller,error) {
+	var t Traveller
+	err := self.ss.Get(key,&t)
+	return t,err
+}
+
+// Release releases the snapshot along with those of its indices. Parts that were
+// never taken, because TakeSnapshot failed, are skipped.
 func (self* TravellersSnapshot) Release() error {
+	for _,index := range self.indices {
+		if index != nil {
+			index.Release()
+		}
+	}
+	if self.ss == nil {
+		return nil
+	}
 	return self.ss.Release()
 }
 
+// newIndexedIterator creates an iterator over the keys, with the given prefix,
+// of travellers listed in any of the indices
+func (self *TravellersSnapshot) newIndexedIterator(prefix string) (db.Iterator,error) {
+	var iters []db.Iterator
+	for _,index := range self.indices {
+		opts := db.PrefixRange(prefix)
+		opts.KeysOnly = true
+		it,err := index.NewRangeIterator(opts)
+		if err != nil {
+			for _,it := range iters {
+				it.Release()
+			}
+			return nil,err
+		}
+		iters = append(iters,it)
+	}
+	return db.MergeIterators(iters,false),nil
+}
+
 func (self *TravellersSnapshot) NewIterator(prefix string) (*TravellersIterator,error) {
 	iter := new(TravellersIterator)
 	var err error
@@ -369,29 +775,88 @@ func (self *TravellersSnapshot) NewIterator(prefix string) (*TravellersIterator,
 	return iter,err
 }
 
+// TakeSnapshot takes a snapshot of the travellers table and its indices. The
+// indices are taken first so that none of the travellers listed in them is missed.
 func (self *Travellers) TakeSnapshot() (*TravellersSnapshot,error) {
 	snapshot := new(TravellersSnapshot)
 	var err error
+	for ti,index := range self.indices {
+		snapshot.indices[ti],err = index.TakeSnapshot()
+		if err != nil {
+			snapshot.Release()
+			return nil,err
+		}
+	}
 	snapshot.ss,err = self.table.TakeSnapshot()
-	return snapshot,err
+	if err != nil {
+		snapshot.ss = nil
+		snapshot.Release()
+		return nil,err
+	}
+	return snapshot,nil
 }
 
 type TravellersBatchWrite struct {
 	bw db.BatchWrite
+	indices [numTravellerIndices]db.BatchWrite
+	day EpochTime
 }
 
 func (self *TravellersBatchWrite) Put(traveller Traveller) error {
-	return traveller.put(self.bw)
+	return traveller.put(self.bw,self.indexWriters(),self.day)
 }
 
+// Index lists the traveller in the indices it belongs in without writing
+// its record
+func (self *TravellersBatchWrite) Index(traveller Traveller) error {
+	key,err := traveller.passport.generateKey()
+	if err != nil {
+		return err
+	}
+	return traveller.index(key,self.indexWriters(),self.day)
+}
+
+// indexWriters returns the batches for the indices
+func (self *TravellersBatchWrite) indexWriters() [numTravellerIndices]db.Writer {
+	var writers [numTravellerIndices]db.Writer
+	for ti,bw := range self.indices {
+		writers[ti] = bw
+	}
+	return writers
+}
+
+// Release writes any remaining data, for the indices first, returning the first error
 func (self TravellersBatchWrite) Release() error {
-	return self.bw.Release()
+	var err error
+	for _,bw := range self.indices {
+		if bw == nil {
+			continue
+		}
+		if e := bw.Release(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if self.bw != nil {
+		if e := self.bw.Release(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
 }
 
 func (self *Travellers) MakeBatch(size int) (*TravellersBatchWrite,error) {
 	bw := new(TravellersBatchWrite)
 	var err error
 	bw.bw,err = self.table.MakeBatch(size)
-	return bw,err
+	if err != nil {
+		return bw,err
+	}
+	for ti,index := range self.indices {
+		bw.indices[ti],err = index.MakeBatch(size)
+		if err != nil {
+			return bw,err
+		}
+	}
+	return bw,nil
 }
 
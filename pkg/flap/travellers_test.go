@@ -7,6 +7,12 @@ import (
 	"os"
 	"github.com/richardmorrey/flap/pkg/db"
 	"reflect"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"sort"
+	"time"
 )
 
 var TRAVELLERSTESTFOLDER="travellerstest"
@@ -16,7 +22,7 @@ func travellerssetup(t *testing.T) *db.LevelDB{
 		t.Error("Failed to create test dir", err)
 	}
 	NewLogger(llDebug,".")
-	return db.NewLevelDB(TRAVELLERSTESTFOLDER)
+	return db.NewLevelDB(TRAVELLERSTESTFOLDER,db.LevelDBOptions{})
 }
 
 func travellersteardown(db *db.LevelDB) {
@@ -155,19 +161,19 @@ func TestSubmitFlight(t *testing.T) {
 	traveller.Balance=0
 	oneflight := *createFlight(1,1,2)
 	oneflight.Distance=1
-	_,_,err:=traveller.submitFlight(&oneflight,2,10,true)
+	_,_,err:=traveller.submitFlight(&oneflight,2,10,true,nil,0)
 	if err != nil {
 		t.Error("submitFlight failed for cleared traveller",traveller)
 	}
-	if (traveller.Balance !=-11) {
+	if (traveller.Balance != Kilometres(-11).Metres()) {
 		t.Error("submitFlight didnt update balance",traveller.Balance)
 	}
 	traveller.EndTrip()
-	_,_,err=traveller.submitFlight(&oneflight,1,10,true)
+	_,_,err=traveller.submitFlight(&oneflight,1,10,true,nil,0)
 	if err == nil {
 		t.Error("submitFlight accepted flight when grounded",traveller)
 	}
-	if (traveller.Balance !=-11) {
+	if (traveller.Balance != Kilometres(-11).Metres()) {
 		t.Error("submitFlight changed balance when grounded",traveller)
 	}
 }
@@ -178,7 +184,7 @@ func TestSubmitFlightNoDebit(t *testing.T) {
 	traveller.Balance=0
 	oneflight := *createFlight(1,1,2)
 	oneflight.Distance=1
-	_,_,err:=traveller.submitFlight(&oneflight,2,10,false)
+	_,_,err:=traveller.submitFlight(&oneflight,2,10,false,nil,0)
 	if err != nil {
 		t.Error("submitFlight failed for cleared traveller",traveller)
 	}
@@ -256,3 +262,362 @@ func TestPassportFromStringFail(t *testing.T) {
 		t.Error("FromString accepted string of incorrect length",err)
 	}
 }
+
+// fullTraveller returns a traveller with every list full and every field set
+func fullTraveller() Traveller {
+	var tr Traveller
+	tr.passport = NewPassport("012345678","uk")
+	tr.Created = SecondsInDay
+	populateFlights(&(tr.tripHistory),150,SecondsInDay)
+	tr.tripHistory.oldestChange = 3
+	for i:=0; i < MaxPromises; i++ {
+		start := EpochTime((MaxPromises-i)*SecondsInDay*10)
+		tr.Promises.entries[i] = Promise{TripStart:start,TripEnd:start+SecondsInDay,Distance:1234.5,Travelled:1000,
+			Clearance:start+SecondsInDay*5,StackIndex:StackIndex(i%3),CarriedOver:-12.25}
+	}
+	tr.Kept = Promise{TripStart:SecondsInDay,TripEnd:SecondsInDay*2,Distance:500,Travelled:500,Clearance:SecondsInDay,StackIndex:-1}
+	for i:=1; i <= MaxTransactions; i++ {
+		tr.transact((Kilometres(i)*1.5).Metres(),EpochTime(i*SecondsInDay),TransactionType(i%4))
+	}
+	return tr
+}
+
+func TestTravellerCompactEncoding(t *testing.T) {
+	for _,travellerin := range []Traveller{Traveller{},fullTraveller()} {
+		var compact,fixed bytes.Buffer
+		err := travellerin.To(&compact)
+		if err != nil {
+			t.Error("To failed",err)
+		}
+		travellerin.toFixed(&fixed)
+		if compact.Len() >= fixed.Len() {
+			t.Error("Compact encoding isnt smaller",compact.Len(),fixed.Len())
+		}
+		var travellerout Traveller
+		err = travellerout.From(&compact)
+		if err != nil {
+			t.Error("From failed",err)
+		}
+		if !reflect.DeepEqual(travellerin,travellerout) {
+			t.Error("Decoded traveller doesnt equal encoded traveller",travellerout)
+		}
+	}
+}
+
+func TestTravellerFixedEncoding(t *testing.T) {
+	travellerin := fullTraveller()
+	var fixed bytes.Buffer
+	travellerin.toFixed(&fixed)
+	var travellerout Traveller
+	err := travellerout.From(&fixed)
+	if err != nil {
+		t.Error("From failed for fixed size encoding",err)
+	}
+	if !reflect.DeepEqual(travellerin,travellerout) {
+		t.Error("Decoded fixed size traveller doesnt equal encoded traveller",travellerout)
+	}
+}
+
+// toCompactV1 writes a traveller in the first compact encoding, with the balance
+// and transactions in kilometres
+func toCompactV1(tr *Traveller, buff *bytes.Buffer) error {
+	w := newCompactWriter(buff)
+	w.byte(travellerVersionCompact)
+	w.uvarint(uint64(tr.Created))
+	w.bytes(tr.passport.Number[:])
+	w.bytes(tr.passport.Issuer[:])
+	tr.tripHistory.encode(w)
+	tr.Promises.encode(w)
+	n := sort.Search(MaxTransactions,  func(i int) bool {return tr.Transactions.entries[i].Date==0})
+	w.uvarint(uint64(n))
+	var prev EpochTime
+	for i:=0; i < n; i++ {
+		ts := &tr.Transactions.entries[i]
+		w.varint(int64(ts.Date)-int64(prev))
+		w.byte(byte(ts.TT))
+		w.float(float64(ts.Distance.Kilometres()))
+		prev = ts.Date
+	}
+	w.byte(1)
+	tr.Kept.encode(w)
+	w.float(float64(tr.Balance.Kilometres()))
+	return nil
+}
+
+func TestTravellerCompactV1Encoding(t *testing.T) {
+	travellerin := fullTraveller()
+	var v1 bytes.Buffer
+	toCompactV1(&travellerin,&v1)
+	var travellerout Traveller
+	err := travellerout.From(&v1)
+	if err != nil {
+		t.Error("From failed for first compact encoding",err)
+	}
+	if !reflect.DeepEqual(travellerin,travellerout) {
+		t.Error("Decoded first compact traveller doesnt equal encoded traveller",travellerout)
+	}
+}
+
+// legacyTraveller writes a traveller in one of the older encodings
+type legacyTraveller struct {
+	tr Traveller
+	to func(*Traveller,*bytes.Buffer) error
+}
+
+// To implements db/Serialize
+func (self *legacyTraveller) To(buff *bytes.Buffer) error {
+	return self.to(&self.tr,buff)
+}
+
+// From implements db/Serialize
+func (self *legacyTraveller) From(buff *bytes.Buffer) error {
+	return self.tr.From(buff)
+}
+
+func TestMigrateTravellers(t *testing.T) {
+	db:=travellerssetup(t)
+	defer travellersteardown(db)
+	travellers := NewTravellers(db)
+
+	// Write travellers in each encoding
+	var expected []Traveller
+	for i,to := range []func(*Traveller,*bytes.Buffer) error{(*Traveller).toFixed,toCompactV1,(*Traveller).To} {
+		tr := fullTraveller()
+		tr.passport = NewPassport(fmt.Sprintf("%09d",i),"uk")
+		tr.transact(Kilometres(-1.0625*float64(i+1)).Metres(),SecondsInDay*200,TTBalanceAdjustment)
+		key,_ := tr.passport.generateKey()
+		err := travellers.table.Put(key,&legacyTraveller{tr,to})
+		if err != nil {
+			t.Error("Failed to write traveller",err)
+		}
+		expected = append(expected,tr)
+	}
+
+	// Check only older records are rewritten, and without change
+	migrated,err := travellers.Migrate(context.Background())
+	if err != nil || migrated != 2 {
+		t.Error("Migrate rewrote wrong number of travellers",migrated,err)
+	}
+	for _,tr := range expected {
+		key,_ := tr.passport.generateKey()
+		var raw rawTraveller
+		err = travellers.table.Get(key,&raw)
+		if err != nil || raw[0] != travellerVersionLedger {
+			t.Error("Traveller not migrated",tr.passport.ToString(),err)
+		}
+		got,_ := travellers.GetTraveller(tr.passport)
+		if !reflect.DeepEqual(got,tr) {
+			t.Error("Migrate changed traveller",got.Balance,tr.Balance)
+		}
+	}
+
+	// Check rewritten travellers are listed in their indices
+	for _,tr := range expected[:2] {
+		key,_ := tr.passport.generateKey()
+		for ti,index := range travellers.indices {
+			err = index.Get(key,&indexEntry{})
+			if (err == nil) != tr.indexed(travellerIndex(ti),0) {
+				t.Error("Migrated traveller not indexed",tr.passport.ToString(),ti,err)
+			}
+		}
+	}
+	migrated,err = travellers.Migrate(context.Background())
+	if err != nil || migrated != 0 {
+		t.Error("Migrate rewrote migrated travellers",migrated,err)
+	}
+}
+
+func TestTravellerCorruptEncoding(t *testing.T) {
+	travellerin := fullTraveller()
+	var compact bytes.Buffer
+	travellerin.To(&compact)
+	var travellerout Traveller
+	if travellerout.From(bytes.NewBuffer(compact.Bytes()[:compact.Len()-1])) == nil {
+		t.Error("Truncated record decoded without error")
+	}
+	if travellerout.From(bytes.NewBuffer([]byte{99})) != ECORRUPTRECORD {
+		t.Error("Record of unknown version decoded without error")
+	}
+	if travellerout.From(new(bytes.Buffer)) != ECORRUPTRECORD {
+		t.Error("Empty record decoded without error")
+	}
+}
+
+func benchmarkEncoding(b *testing.B, traveller Traveller) {
+	encoders := []struct{name string; to func(*Traveller,*bytes.Buffer) error} {
+		{"compact",(*Traveller).To},
+		{"fixed",(*Traveller).toFixed},
+	}
+	for _,e := range encoders {
+		b.Run(e.name+"/To",func(b *testing.B) {
+			var buff bytes.Buffer
+			for i:=0; i < b.N; i++ {
+				buff.Reset()
+				e.to(&traveller,&buff)
+			}
+			b.ReportMetric(float64(buff.Len()),"B/record")
+		})
+		b.Run(e.name+"/From",func(b *testing.B) {
+			var buff bytes.Buffer
+			e.to(&traveller,&buff)
+			record := buff.Bytes()
+			for i:=0; i < b.N; i++ {
+				var t Traveller
+				t.From(bytes.NewBuffer(record))
+			}
+		})
+	}
+}
+
+// backfillTraveller returns a traveller with one trip that has ended in time to
+// be backfilled on day 5
+// indexedIn returns the names of the indices listing the given traveller
+func indexedIn(travellers *Travellers, traveller *Traveller) []string {
+	key,_ := traveller.passport.generateKey()
+	var names []string
+	for ti,index := range travellers.indices {
+		var entry indexEntry
+		if index.Get(key,&entry) == nil {
+			names = append(names,travellerIndexNames[ti])
+		}
+	}
+	return names
+}
+
+func TestTravellerIndices(t *testing.T) {
+	travellers := NewTravellers(db.NewMemoryDB())
+	tr := backfillTraveller(0)
+	travellers.PutTraveller(tr)
+	if names := indexedIn(travellers,&tr); !reflect.DeepEqual(names,[]string{"midtrip"}) {
+		t.Error("Traveller with new flights not listed mid trip only",names)
+	}
+	tr.tripHistory.Update(&FlapParams{FlightInterval:1,FlightsInTrip:50,TripLength:1},SecondsInDay*5)
+	travellers.PutTraveller(tr)
+	if names := indexedIn(travellers,&tr); !reflect.DeepEqual(names,[]string{"grounded"}) {
+		t.Error("Traveller at trip end with negative balance not listed grounded only",names)
+	}
+	tr.Kept = Promise{Clearance:SecondsInDay*10}
+	tr.transact(-tr.Balance,SecondsInDay*5,TTDailyShare)
+	travellers.PutTraveller(tr)
+	if names := indexedIn(travellers,&tr); !reflect.DeepEqual(names,[]string{"kept"}) {
+		t.Error("Traveller with kept promise and no balance to backfill not listed kept only",names)
+	}
+	bw,_ := travellers.MakeBatch(10)
+	bw.day = SecondsInDay*5
+	bw.Index(tr)
+	bw.Release()
+	if names := indexedIn(travellers,&tr); !reflect.DeepEqual(names,[]string{"grounded","kept"}) {
+		t.Error("Traveller backfilled on the day of the batch not listed grounded",names)
+	}
+	tr.Kept = Promise{}
+	travellers.PutTraveller(tr)
+	if names := indexedIn(travellers,&tr); len(names) != 0 {
+		t.Error("Traveller needing no update listed",names)
+	}
+}
+
+func TestRebuildIndices(t *testing.T) {
+	database := db.NewMemoryDB()
+	table,_ := database.CreateTable(travellersTableName)
+	var passports []Passport
+	for i:=0; i < 10; i++ {
+		tr := backfillTraveller(i)
+		key,_ := tr.passport.generateKey()
+		table.Put(key,&tr)
+		passports = append(passports,tr.passport)
+	}
+	travellers := NewTravellers(database)
+	if travellers == nil {
+		t.Error("Failed to open travellers without indices")
+		return
+	}
+	for _,passport := range passports {
+		tr,_ := travellers.GetTraveller(passport)
+		if names := indexedIn(travellers,&tr); !reflect.DeepEqual(names,[]string{"midtrip"}) {
+			t.Error("Existing traveller not indexed",passport.ToString(),names)
+		}
+	}
+	tables := TableNames()
+	for _,name := range travellerIndexNames {
+		found := false
+		for _,table := range tables {
+			found = found || table == name
+		}
+		if !found {
+			t.Error("Index table not listed in TableNames",name)
+		}
+	}
+}
+
+func backfillTraveller(i int) Traveller {
+	var tr Traveller
+	tr.passport = NewPassport(fmt.Sprintf("%09d",i),"uk")
+	tr.Created = SecondsInDay
+	for _,f := range []*Flight{createFlight(1+i%10,SecondsInDay,SecondsInDay+1),createFlight(1+i%10,SecondsInDay*3,SecondsInDay*3+1)} {
+		tr.tripHistory.AddFlight(f)
+		tr.transact(-f.Distance.Metres(),SecondsInDay,TTFlight)
+	}
+	return tr
+}
+
+func BenchmarkTravellerEncodingTypical(b *testing.B) {
+	benchmarkEncoding(b,backfillTraveller(0))
+}
+
+func BenchmarkTravellerEncodingFull(b *testing.B) {
+	benchmarkEncoding(b,fullTraveller())
+}
+
+var benchTravellers = flag.Int("benchtravellers",1000000,"Number of travellers for backfill benchmarks")
+
+// BenchmarkUpdateTripsAndBackfill backfills a LevelDB table of travellers, by default
+// a million, once with each encoding, reporting travellers backfilled per second and
+// bytes per traveller on disk and per record. Run with -benchtime 1x to populate the
+// table only once, and with -args -benchtravellers to change the number.
+func BenchmarkUpdateTripsAndBackfill(b *testing.B) {
+	b.Run("compact",func(b *testing.B) {benchmarkBackfill(b,false)})
+	b.Run("fixed",func(b *testing.B) {benchmarkBackfill(b,true)})
+}
+
+func benchmarkBackfill(b *testing.B, fixed bool) {
+	travellerEncodeFixed = fixed
+	defer func() {travellerEncodeFixed = false}()
+	os.RemoveAll(ENGINETESTFOLDER)
+	os.Mkdir(ENGINETESTFOLDER,0700)
+	ldb := db.NewLevelDB(ENGINETESTFOLDER,db.LevelDBOptions{})
+	defer engineteardown(ldb)
+	engine := NewEngine(ldb,0,"")
+	engine.Administrator.SetParams(FlapParams{DailyTotal:100000, MinGrounded:1,FlightInterval:1,FlightsInTrip:50,TripLength:365,Threads:16})
+
+	// Populate travellers
+	n := *benchTravellers
+	bw,_ := engine.Travellers.MakeBatch(10000)
+	var size int
+	var buff bytes.Buffer
+	for i:=0; i < n; i++ {
+		tr := backfillTraveller(i)
+		buff.Reset()
+		tr.To(&buff)
+		size += buff.Len()
+		bw.Put(tr)
+	}
+	bw.Release()
+
+	// Backfill once a day
+	b.ResetTimer()
+	start := time.Now()
+	for i:=0; i < b.N; i++ {
+		_,err := engine.UpdateTripsAndBackfill(context.Background(),EpochTime(SecondsInDay*(5+i)))
+		if err != nil {
+			b.Fatal("UpdateTripsAndBackfill failed",err)
+		}
+	}
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	ldb.CompactTable(travellersTableName)
+	stats,_ := ldb.TableStats(travellersTableName)
+	b.ReportMetric(float64(n*b.N)/elapsed.Seconds(),"travellers/s")
+	b.ReportMetric(float64(stats.Size)/float64(n),"disk-B/traveller")
+	b.ReportMetric(float64(size)/float64(n),"record-B/traveller")
+}
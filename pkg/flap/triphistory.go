@@ -638,6 +638,43 @@ func (self *TripHistory) To(buff *bytes.Buffer) error {
 	return binary.Write(buff,binary.LittleEndian,&(self.oldestChange))
 }
 
+// encode writes the trip history in compact form. Each flight's start is
+// written as the difference from the start of the flight before and its end
+// as the difference from its start.
+func (self *TripHistory) encode(w *compactWriter) {
+	n := sort.Search(MaxFlights,  func(i int) bool {return self.entries[i].Start==0})
+	w.uvarint(uint64(n))
+	var prev EpochTime
+	for i:=0; i < n; i++ {
+		f := &self.entries[i]
+		w.byte(byte(f.et))
+		w.varint(int64(f.Start)-int64(prev))
+		w.varint(int64(f.End)-int64(f.Start))
+		w.bytes(f.FromAirport[:])
+		w.bytes(f.ToAirport[:])
+		w.float(float64(f.Distance))
+		prev = f.Start
+	}
+	w.varint(int64(self.oldestChange))
+}
+
+// decode reads a trip history written by encode
+func (self *TripHistory) decode(r *compactReader) {
+	n := r.count(MaxFlights)
+	var prev EpochTime
+	for i:=0; i < n; i++ {
+		f := &self.entries[i]
+		f.et = flightType(r.byte())
+		f.Start = r.since(prev)
+		f.End = r.since(f.Start)
+		r.bytes(f.FromAirport[:])
+		r.bytes(f.ToAirport[:])
+		f.Distance = Kilometres(r.float())
+		prev = f.Start
+	}
+	self.oldestChange = tripHistoryIndex(r.varint())
+}
+
 // From implemments db/Serialize
 func (self *TripHistory) From(buff *bytes.Buffer) error {
 	var n int32
@@ -0,0 +1,311 @@
+package flap
+
+import (
+	"github.com/richardmorrey/flap/pkg/db"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"bytes"
+	"context"
+	"fmt"
+)
+
+// A ledger record is kept in the administrator table for each day backfilled, so
+// that what was shared out on the day can be reconciled with what travellers were
+// credited. Keys sort in date order.
+const dayLedgerKeyPrefix="day"
+
+// dayLedger records how the Daily Total was shared out on a day
+type dayLedger struct {
+	Day		EpochTime
+	Pool		Metres
+	Backfillers	uint64
+	Share		Metres
+	Grounded	uint64
+}
+
+// To implements db/Serialize
+func (self* dayLedger) To(b *bytes.Buffer) error {
+	return gob.NewEncoder(b).Encode(self)
+}
+
+// From implements db/Serialize
+func (self* dayLedger) From(b *bytes.Buffer) error {
+	return gob.NewDecoder(b).Decode(self)
+}
+
+// dayLedgerKey returns the key of the ledger record for the given day
+func dayLedgerKey(day EpochTime) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],uint64(day))
+	return dayLedgerKeyPrefix+hex.EncodeToString(b[:])
+}
+
+// saveDayLedger records how the Daily Total was shared out by a completed backfill
+func (self *Administrator) saveDayLedger(day EpochTime, ut *UpdateBackfillStats) error {
+	dl := dayLedger{Day:day,Pool:ut.Pool,Backfillers:ut.Backfillers,Share:ut.Share,Grounded:ut.Grounded}
+	return self.table.Put(dayLedgerKey(day),&dl)
+}
+
+// Violation describes an invariant found broken by Verify, for either a traveller
+// or a day backfilled
+type Violation struct {
+	Passport	Passport
+	Day		EpochTime
+	Check		string
+	Detail		string
+}
+
+// String describes the violation on one line
+func (self Violation) String() string {
+	if self.Day != 0 {
+		return fmt.Sprintf("day %s: %s: %s",self.Day.ToTime().UTC().Format("2006-01-02"),self.Check,self.Detail)
+	}
+	return fmt.Sprintf("traveller %s: %s: %s",self.Passport.ToString(),self.Check,self.Detail)
+}
+
+// VerifyReport lists the violations found by Verify. Days credited before the oldest
+// transaction kept by any traveller can't be reconciled and are only counted.
+type VerifyReport struct {
+	Travellers	uint64
+	Days		uint64
+	DaysUnchecked	uint64
+	Violations	[]Violation
+}
+
+// dayCredits adds up the daily shares credited to travellers on a day
+type dayCredits struct {
+	credited	Metres
+	travellers	uint64
+}
+
+// Verify scans every traveller and every day backfilled checking that:
+// (1) each traveller's balance equals the total of their transactions, each daily
+// share matches the share recorded for the day and no day is credited twice
+// (2) trip histories are in order without overlapping flights, and travellers are
+// listed in the mid-trip, kept and grounded indices as their flights say they should be
+// (3) promises are in order, without overlapping trips, cleared in time for the next
+// trip and stacked no higher than allowed
+// (4) the share for each day is the pool divided by the backfillers, and the total
+// credited to travellers is the share for each traveller counted as grounded.
+// Violations are reported rather than returned as errors. It stops early if ctx is done.
+func (self *Engine) Verify(ctx context.Context) (VerifyReport,error) {
+	var report VerifyReport
+
+	// Load day ledgers
+	ledgers := make(map[EpochTime]dayLedger)
+	it,err := self.Administrator.table.NewIterator(dayLedgerKeyPrefix)
+	if err != nil {
+		return report,logError(err)
+	}
+	for it.Next() {
+		var dl dayLedger
+		it.Value(&dl)
+		ledgers[dl.Day] = dl
+	}
+	err = it.Error()
+	it.Release()
+	if err != nil {
+		return report,logError(err)
+	}
+
+	// Check travellers, adding up what was credited each day
+	credits := make(map[EpochTime]*dayCredits)
+	var horizon EpochTime
+	it,err = self.Travellers.table.NewIterator("")
+	if err != nil {
+		return report,logError(err)
+	}
+	for ctx.Err() == nil && it.Next() {
+		var t Traveller
+		it.Value(&t)
+		report.Travellers++
+		vs,err := self.Travellers.verifyTraveller(it.Key(),&t,ledgers,&self.Administrator.params)
+		if err != nil {
+			it.Release()
+			return report,logError(err)
+		}
+		report.Violations = append(report.Violations,vs...)
+		for i:=0; i < MaxTransactions && t.Transactions.entries[i].Date != 0; i++ {
+			tr := &t.Transactions.entries[i]
+			if tr.TT != TTDailyShare {
+				continue
+			}
+			dc := credits[tr.Date]
+			if dc == nil {
+				dc = new(dayCredits)
+				credits[tr.Date] = dc
+			}
+			dc.credited += tr.Distance
+			dc.travellers++
+		}
+		if t.Transactions.full() && t.Transactions.entries[MaxTransactions-1].Date > horizon {
+			horizon = t.Transactions.entries[MaxTransactions-1].Date
+		}
+	}
+	err = it.Error()
+	it.Release()
+	if err != nil {
+		return report,logError(err)
+	}
+	if ctx.Err() != nil {
+		return report,ctx.Err()
+	}
+
+	// Check index entries all belong to travellers
+	for ti,index := range self.Travellers.indices {
+		it,err := index.NewIterator("")
+		if err != nil {
+			return report,logError(err)
+		}
+		for ctx.Err() == nil && it.Next() {
+			var raw rawTraveller
+			err = self.Travellers.table.Get(it.Key(),&raw)
+			if err == db.EKEYNOTFOUND {
+				report.Violations = append(report.Violations,Violation{Check:"index",
+					Detail:fmt.Sprintf("%s index lists missing traveller %s",travellerIndexNames[ti],it.Key())})
+			} else if err != nil {
+				it.Release()
+				return report,logError(err)
+			}
+		}
+		err = it.Error()
+		it.Release()
+		if err != nil {
+			return report,logError(err)
+		}
+	}
+
+	// Check each day backfilled, reconciling with what travellers were credited
+	// unless some traveller has dropped transactions made on the day
+	for day,dl := range ledgers {
+		report.Days++
+		if dl.Share != dl.Pool.divide(dl.Backfillers) {
+			report.Violations = append(report.Violations,Violation{Day:day,Check:"share",
+				Detail:fmt.Sprintf("share %d isnt pool %d divided by %d backfillers",dl.Share,dl.Pool,dl.Backfillers)})
+		}
+		if day <= horizon {
+			report.DaysUnchecked++
+			continue
+		}
+		var dc dayCredits
+		if credits[day] != nil {
+			dc = *credits[day]
+		}
+		if dc.travellers != dl.Grounded || dc.credited != dl.Share*Metres(dl.Grounded) {
+			report.Violations = append(report.Violations,Violation{Day:day,Check:"credited",
+				Detail:fmt.Sprintf("%d credited to %d travellers, expected %d to %d",dc.credited,dc.travellers,dl.Share*Metres(dl.Grounded),dl.Grounded)})
+		}
+	}
+	return report,ctx.Err()
+}
+
+// verifyTraveller checks the invariants for a single traveller with the given key
+func (self *Travellers) verifyTraveller(key string, t *Traveller, ledgers map[EpochTime]dayLedger, params *FlapParams) ([]Violation,error) {
+	var vs []Violation
+	violation := func(check string, format string, args ...interface{}) {
+		vs = append(vs,Violation{Passport:t.passport,Check:check,Detail:fmt.Sprintf(format,args...)})
+	}
+
+	// Ledger
+	if t.Balance != t.Transactions.total() {
+		violation("balance","balance %d doesnt equal total of transactions %d",t.Balance,t.Transactions.total())
+	}
+	for i:=0; i < MaxTransactions && t.Transactions.entries[i].Date != 0; i++ {
+		tr := &t.Transactions.entries[i]
+		if i > 0 && tr.Date > t.Transactions.entries[i-1].Date {
+			violation("transactions","transaction %d out of order",i)
+		}
+		if tr.TT != TTDailyShare {
+			continue
+		}
+		for j:=i-1; j >= 0 && t.Transactions.entries[j].Date == tr.Date; j-- {
+			if t.Transactions.entries[j].TT == TTDailyShare {
+				violation("transactions","credited twice on %s",tr.Date.ToTime().UTC().Format("2006-01-02"))
+				break
+			}
+		}
+		dl,exists := ledgers[tr.Date]
+		if exists && tr.Distance != dl.Share {
+			violation("dailyshare","credited %d on %s when share was %d",tr.Distance,tr.Date.ToTime().UTC().Format("2006-01-02"),dl.Share)
+		}
+	}
+
+	// Trip history
+	th := &t.tripHistory
+	for i:=0; i < MaxFlights; i++ {
+		f := &th.entries[i]
+		if f.Start == 0 {
+			for j:=i+1; j < MaxFlights; j++ {
+				if th.entries[j].Start != 0 {
+					violation("triphistory","gap in flights at %d",i)
+					break
+				}
+			}
+			break
+		}
+		if f.End <= f.Start {
+			violation("triphistory","flight %d ends before it starts",i)
+		}
+		if f.et > etTripReopen {
+			violation("triphistory","flight %d has unknown type %d",i,f.et)
+		}
+		if i > 0 && f.End > th.entries[i-1].Start {
+			violation("triphistory","flight %d overlaps flight %d",i,i-1)
+		}
+	}
+
+	// Indices
+	for ti,index := range self.indices {
+		err := index.Get(key,&indexEntry{})
+		if err != nil && err != db.EKEYNOTFOUND {
+			return vs,err
+		}
+		listed := err == nil
+		should := t.indexed(travellerIndex(ti),0)
+		if travellerIndex(ti) == tiGrounded {
+			if should && !listed {
+				violation("index","grounded with balance %d but not in grounded index",t.Balance)
+			}
+			if listed && t.MidTrip() {
+				violation("index","mid-trip but in grounded index")
+			}
+		} else if should != listed {
+			violation("index","listed in %s index is %t, flights and promises say %t",travellerIndexNames[ti],listed,should)
+		}
+	}
+
+	// Promises
+	ps := &t.Promises
+	for i:=0; i < MaxPromises; i++ {
+		p := &ps.entries[i]
+		if p.TripStart == 0 {
+			for j:=i+1; j < MaxPromises; j++ {
+				if ps.entries[j].TripStart != 0 {
+					violation("promises","gap in promises at %d",i)
+					break
+				}
+			}
+			break
+		}
+		if p.TripEnd <= p.TripStart {
+			violation("promises","promise %d ends before it starts",i)
+		}
+		if i > 0 {
+			next := &ps.entries[i-1]
+			if p.TripEnd >= next.TripStart {
+				violation("promises","promise %d overlaps promise %d",i,i-1)
+			}
+			if p.Clearance >= next.TripStart {
+				violation("promises","promise %d not cleared in time for promise %d",i,i-1)
+			}
+		}
+		if p.StackIndex < 0 || (params.Promises.MaxStackSize > 0 && p.StackIndex > params.Promises.MaxStackSize) {
+			violation("promises","promise %d has stack index %d",i,p.StackIndex)
+		}
+		if p.StackIndex > 0 && i < MaxPromises-1 && ps.entries[i+1].TripStart != 0 && ps.entries[i+1].StackIndex != p.StackIndex-1 {
+			violation("promises","promise %d stacked on promise %d with stack index %d",i,i+1,ps.entries[i+1].StackIndex)
+		}
+	}
+	return vs,nil
+}
@@ -0,0 +1,127 @@
+package flap
+
+import (
+	"testing"
+	"github.com/richardmorrey/flap/pkg/db"
+	"context"
+)
+
+// verifiedTravellers returns an engine with travellers backfilled over a few days
+func verifiedTravellers(t *testing.T, n int) (*Engine,[]Passport) {
+	engine,passports := backfillTravellers(t,db.NewMemoryDB(),n)
+	for day:=5; day < 8; day++ {
+		_,err := engine.UpdateTripsAndBackfill(context.Background(),EpochTime(SecondsInDay*day))
+		if err != nil {
+			t.Error("UpdateTripsAndBackfill failed",err)
+		}
+	}
+	return engine,passports
+}
+
+// checks returns the number of violations of each check in the report
+func checks(report VerifyReport) map[string]int {
+	found := make(map[string]int)
+	for _,v := range report.Violations {
+		found[v.Check]++
+	}
+	return found
+}
+
+func TestVerify(t *testing.T) {
+	engine,_ := verifiedTravellers(t,16)
+	report,err := engine.Verify(context.Background())
+	if err != nil {
+		t.Error("Verify failed",err)
+	}
+	if report.Travellers != 16 || report.Days != 3 || report.DaysUnchecked != 0 {
+		t.Error("Verify checked wrong travellers or days",report)
+	}
+	if len(report.Violations) != 0 {
+		t.Error("Verify found violations in consistent state",report.Violations)
+	}
+}
+
+func TestVerifyTravellerViolations(t *testing.T) {
+	engine,passports := verifiedTravellers(t,16)
+
+	// Break one invariant for each of a few travellers
+	traveller,_ := engine.Travellers.GetTraveller(passports[0])
+	traveller.Balance++
+	engine.Travellers.PutTraveller(traveller)
+	traveller,_ = engine.Travellers.GetTraveller(passports[1])
+	traveller.tripHistory.entries[0].Start = traveller.tripHistory.entries[1].Start
+	engine.Travellers.table.Put(mustKey(t,passports[1]),&traveller)
+	traveller,_ = engine.Travellers.GetTraveller(passports[2])
+	traveller.Promises.entries[0] = Promise{TripStart:SecondsInDay*20,TripEnd:SecondsInDay*22,Distance:10,Travelled:10,Clearance:SecondsInDay*23}
+	traveller.Promises.entries[1] = Promise{TripStart:SecondsInDay*10,TripEnd:SecondsInDay*21,Distance:10,Travelled:10,Clearance:SecondsInDay*22}
+	engine.Travellers.PutTraveller(traveller)
+	engine.Travellers.indices[tiGrounded].Delete(mustKey(t,passports[3]))
+	traveller,_ = engine.Travellers.GetTraveller(passports[4])
+	traveller.Transactions.entries[0].Distance++
+	traveller.Balance++
+	engine.Travellers.PutTraveller(traveller)
+
+	report,err := engine.Verify(context.Background())
+	if err != nil {
+		t.Error("Verify failed",err)
+	}
+	found := checks(report)
+	for check,n := range map[string]int{"balance":1,"triphistory":1,"promises":2,"index":1,"dailyshare":1,"credited":1} {
+		if found[check] != n {
+			t.Error("Verify found wrong number of violations",check,found[check],report.Violations)
+		}
+	}
+	if len(report.Violations) != 7 {
+		t.Error("Verify found unexpected violations",report.Violations)
+	}
+}
+
+func TestVerifyDayViolations(t *testing.T) {
+	engine,_ := verifiedTravellers(t,16)
+	day := EpochTime(SecondsInDay*6)
+	var dl dayLedger
+	engine.Administrator.table.Get(dayLedgerKey(day),&dl)
+	dl.Pool += Metres(dl.Backfillers)
+	dl.Grounded++
+	engine.Administrator.table.Put(dayLedgerKey(day),&dl)
+
+	report,err := engine.Verify(context.Background())
+	if err != nil {
+		t.Error("Verify failed",err)
+	}
+	found := checks(report)
+	if found["share"] != 1 || found["credited"] != 1 || len(report.Violations) != 2 {
+		t.Error("Verify found wrong violations for day",report.Violations)
+	}
+	for _,v := range report.Violations {
+		if v.Day != day {
+			t.Error("Violation reported for wrong day",v)
+		}
+	}
+}
+
+func TestVerifyDroppedTransactions(t *testing.T) {
+	engine,passports := verifiedTravellers(t,4)
+	traveller,_ := engine.Travellers.GetTraveller(passports[0])
+	for i:=0; i < MaxTransactions; i++ {
+		traveller.transact(1,SecondsInDay*7,TTBalanceAdjustment)
+	}
+	engine.Travellers.PutTraveller(traveller)
+
+	report,err := engine.Verify(context.Background())
+	if err != nil {
+		t.Error("Verify failed",err)
+	}
+	if report.DaysUnchecked != 3 || len(report.Violations) != 0 {
+		t.Error("Verify reconciled days with dropped transactions",report)
+	}
+}
+
+// mustKey returns the key for the given passport
+func mustKey(t *testing.T, passport Passport) string {
+	key,err := passport.generateKey()
+	if err != nil {
+		t.Error("generateKey failed",err)
+	}
+	return key
+}
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"sort"
 	"errors"
+	"context"
 )
 
 var ETOOMANYAIRPORTS = errors.New("Too many airports")
@@ -108,8 +109,9 @@ func (self* countryState) report() {
 // airports that operate from it. Routes for each airport are assigned with ascending weights based on the
 // size of the destination airport. Airpots are assigned ascending weights based on their size. Countries
 // are assigned ascending weights based on the total weight of all airports it contains.
-// Driven by real world data from openflights.org
-func (self *CountriesAirportsRoutes) Build(dataFolder string, cw *countryWeights) (error) {
+// Driven by real world data from openflights.org. Building stops between countries with the
+// context error if ctx is cancelled.
+func (self *CountriesAirportsRoutes) Build(ctx context.Context, dataFolder string, cw *countryWeights) (error) {
 	
 	// Load openflightsid-to-airport ICAOCode map
 	err := self.loadIDs(dataFolder)
@@ -155,6 +157,11 @@ func (self *CountriesAirportsRoutes) Build(dataFolder string, cw *countryWeights
 				return logError(err)
 			}
 
+			// Stop if cancelled
+			if ctx.Err() != nil {
+				return logError(ctx.Err())
+			}
+
 			// Create next country
 			cs = countryState{countryCode:route.FromCountry,country:newCountry()}
 			cs.airport = cs.country.getAirport(route.From)
@@ -15,7 +15,7 @@ func setup(t *testing.T) (*db.LevelDB, *CountriesAirportsRoutes) {
 	if err := os.Mkdir(COUNTRIESAIRPORTSROUTESTESTFOLDER, 0700); err != nil {
 		t.Error("Failed to create test dir", err)
 	}
-	db := db.NewLevelDB(COUNTRIESAIRPORTSROUTESTESTFOLDER)
+	db := db.NewLevelDB(COUNTRIESAIRPORTSROUTESTESTFOLDER,db.LevelDBOptions{})
 	car := NewCountriesAirportsRoutes(db)
 	if (car==nil) {
 		t.Error("Failed to create CountriesAirportRoutes instance")
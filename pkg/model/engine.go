@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"io"
 	"time"
 	"math"
 	"math/rand"
@@ -16,7 +17,10 @@ import (
 	"encoding/json"
 	"encoding/binary"
 	"bytes"
+	"context"
+	"strings"
 	"gonum.org/v1/gonum/stat"
+	_ "github.com/mattn/go-sqlite3"
 	"gonum.org/v1/gonum/floats"
 	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/plotter"
@@ -32,6 +36,8 @@ var EMODELNOTBUILT = errors.New("Failed to find model to load")
 var EINVALIDSTARTDAY = errors.New("Invalid start day")
 var ENOSUCHTRAVELLER = errors.New("No such traveller")
 var EFAILEDTOCREATECOUNTRYWEIGHTS = errors.New("Failed to create country weights")
+var EFAILEDTOOPENDB = errors.New("Failed to open database")
+var EFAILEDTOOPENEVENTLOG = errors.New("Failed to open event log")
 
 type Probability float64
 
@@ -45,11 +51,28 @@ type DBType		uint8
 const (
 	dbLevel DBType = iota
 	dbDatastore
+	dbMemory
+	dbBolt
+	dbSQL
 )
 
+const boltFileName="flap.bolt"
+
 type DBSpec struct {
 	DBType			DBType
 	ConnectionString	string
+	ChangeFeeds		[]string
+	CacheSize		int
+	ShardFolders		[]string
+	LevelDB			db.LevelDBOptions
+}
+
+// BackfillSpec configures distributed backfill, in which the daily update and
+// backfill is shared with workers in other processes using the same database.
+type BackfillSpec struct {
+	Distributed		bool
+	LeaseSeconds		uint
+	PollSeconds		uint
 }
 
 type ModelParams struct {
@@ -74,6 +97,8 @@ type ModelParams struct {
 	Deterministic		bool
 	Threads			uint
 	BotFreqFactor		float64
+	Backfill		BackfillSpec
+	Events			bool
 }
 
 type plannedFlight struct {
@@ -205,6 +230,12 @@ func NewEngine(configFilePath string) (*Engine,error) {
 	if e.ModelParams.Threads == 0 {
 		e.ModelParams.Threads = 1
 	}
+	if e.ModelParams.Backfill.LeaseSeconds == 0 {
+		e.ModelParams.Backfill.LeaseSeconds = 600
+	}
+	if e.ModelParams.Backfill.PollSeconds == 0 {
+		e.ModelParams.Backfill.PollSeconds = 1
+	}
 		
 	// Validate config
 	for _,length := range(e.ModelParams.TripLengths) {
@@ -212,6 +243,9 @@ func NewEngine(configFilePath string) (*Engine,error) {
 			return nil,logError(flap.EINVALIDARGUMENT)
 		}
 	}
+	if e.ModelParams.DBSpec.CacheSize > 0 && e.ModelParams.Backfill.Distributed {
+		return nil,logError(flap.EINVALIDARGUMENT)
+	}
 
 	// Initialize logger
 	NewLogger(e.ModelParams.LogLevel,e.ModelParams.WorkingFolder)
@@ -220,8 +254,53 @@ func NewEngine(configFilePath string) (*Engine,error) {
 	switch (e.ModelParams.DBSpec.DBType) {
 		case dbDatastore:
 			e.db = db.NewDatastoreDB(e.ModelParams.DBSpec.ConnectionString)
+		case dbMemory:
+			e.db = db.NewMemoryDB()
+		case dbBolt:
+			path := e.ModelParams.DBSpec.ConnectionString
+			if path == "" {
+				path = filepath.Join(e.ModelParams.WorkingFolder,boltFileName)
+			}
+			bdb := db.NewBoltDB(path)
+			if bdb == nil {
+				return nil,logError(EFAILEDTOOPENDB)
+			}
+			e.db = bdb
+		case dbSQL:
+			parts := strings.SplitN(e.ModelParams.DBSpec.ConnectionString,":",2)
+			if len(parts) != 2 {
+				return nil,logError(EFAILEDTOOPENDB)
+			}
+			sdb := db.NewSQLDB(parts[0],parts[1])
+			if sdb == nil {
+				return nil,logError(EFAILEDTOOPENDB)
+			}
+			e.db = sdb
 		default:
-			e.db = db.NewLevelDB(e.ModelParams.WorkingFolder)
+			folders := e.ModelParams.DBSpec.ShardFolders
+			if len(folders) == 0 {
+				folders = []string{e.ModelParams.WorkingFolder}
+			}
+			var shards []db.Database
+			for _,folder := range folders {
+				ldb := db.NewLevelDB(folder,e.ModelParams.DBSpec.LevelDB)
+				for _,name := range e.ModelParams.DBSpec.ChangeFeeds {
+					ldb.EnableChangeFeed(name)
+				}
+				shards = append(shards,ldb)
+			}
+			if len(shards) == 1 {
+				e.db = shards[0]
+			} else {
+				sdb := db.NewShardDB(shards)
+				if sdb == nil {
+					return nil,logError(EFAILEDTOOPENDB)
+				}
+				e.db = sdb
+			}
+	}
+	if e.ModelParams.DBSpec.CacheSize > 0 {
+		e.db = db.NewCacheDB(e.db,e.ModelParams.DBSpec.CacheSize)
 	}
 
 	// Create model table
@@ -253,7 +332,8 @@ const modelTableName="model"
 
 // Build prepares all persitent data files in order to be able to run the model in the configured data folder. It
 // builds the countries-airports-routes and the country weights file that drive flight selection.
-func (self *Engine) Build() error {
+// Building stops with the context error if ctx is cancelled, leaving the model unbuilt.
+func (self *Engine) Build(ctx context.Context) error {
 	
 	fmt.Printf("Building...\n")
 
@@ -261,6 +341,7 @@ func (self *Engine) Build() error {
 	self.Reset(true)
 	fe := flap.NewEngine(self.db,flap.LogLevel(self.ModelParams.LogLevel),self.ModelParams.WorkingFolder)
 	defer fe.Release()
+	self.recordEvents(fe)
 	err := fe.Administrator.SetParams(self.FlapParams)
 	if (err != nil) {
 		return logError(err)
@@ -269,6 +350,9 @@ func (self *Engine) Build() error {
 	if (err != nil) {
 		return logError(err)
 	}
+	if ctx.Err() != nil {
+		return logError(ctx.Err())
+	}
 
 	// Build countries-airports-flights table from real-world data
 	cw := newCountryWeights()
@@ -279,7 +363,7 @@ func (self *Engine) Build() error {
 	if cars  == nil {
 		return EFAILEDTOCREATECOUNTRIESAIRPORTSROUTES
 	}
-	err = cars.Build(self.ModelParams.DataFolder,cw)
+	err = cars.Build(ctx,self.ModelParams.DataFolder,cw)
 	if (err != nil) {
 		return logError(err)
 	}
@@ -358,6 +442,7 @@ func (self* Engine) prepare(ms *modelState) (*CountriesAirportsRoutes, *Travelle
 	
 	// Create engine
 	fe := flap.NewEngine(self.db,flap.LogLevel(self.ModelParams.LogLevel),self.ModelParams.WorkingFolder)
+	self.recordEvents(fe)
 
 	// Load Journey planner
 	jp,err := NewJourneyPlanner(self.db)
@@ -368,7 +453,7 @@ func (self* Engine) prepare(ms *modelState) (*CountriesAirportsRoutes, *Travelle
 }
 
 /// modelDay models a single day - planning flights, submitting flights and performing update and backfill
-func (self Engine) modelDay(currentDay flap.EpochTime,cars *CountriesAirportsRoutes, tb *TravellerBots, fe *flap.Engine, jp *journeyPlanner, fp *flightPaths,ms *modelState) (flap.UpdateBackfillStats, flap.Kilometres,error) {
+func (self Engine) modelDay(ctx context.Context,currentDay flap.EpochTime,cars *CountriesAirportsRoutes, tb *TravellerBots, fe *flap.Engine, jp *journeyPlanner, fp *flightPaths,ms *modelState) (flap.UpdateBackfillStats, flap.Kilometres,error) {
 
 	// load flap params
 	flapParams := fe.Administrator.GetParams()
@@ -379,7 +464,13 @@ func (self Engine) modelDay(currentDay flap.EpochTime,cars *CountriesAirportsRou
 	// For each travller: Update triphistory and backfill those with distance accounts in
 	// deficit.
 	fmt.Printf("\rDay %d: Backfilling       ",i)
-	us,err :=  fe.UpdateTripsAndBackfill(currentDay)
+	var us flap.UpdateBackfillStats
+	var err error
+	if self.ModelParams.Backfill.Distributed {
+		us,err = fe.UpdateTripsAndBackfillDistributed(ctx,currentDay,"model",self.backfillLease(),self.backfillPoll())
+	} else {
+		us,err = fe.UpdateTripsAndBackfill(ctx,currentDay)
+	}
 	if err != nil {
 		return flap.UpdateBackfillStats{},0,logError(err)
 	}
@@ -387,7 +478,7 @@ func (self Engine) modelDay(currentDay flap.EpochTime,cars *CountriesAirportsRou
 	// Plan flights for all travellers
 	logInfo("DAY ", i ," ", currentDay.ToTime())
 	fmt.Printf("\rDay %d: Planning Flights",i)
-	err = tb.planTrips(cars,jp,fe,currentDay,self.ModelParams.Deterministic,i,self.ModelParams.Threads)
+	err = tb.planTrips(ctx,cars,jp,fe,currentDay,self.ModelParams.Deterministic,i,self.ModelParams.Threads)
 	if err != nil {
 		return flap.UpdateBackfillStats{},0,logError(err)
 	}
@@ -457,7 +548,7 @@ func (self Engine) modelDay(currentDay flap.EpochTime,cars *CountriesAirportsRou
 			Travelled:float64(us.Distance)/float64(self.ModelParams.ReportDayDelta),
 			Flights:float64(us.Flights)/float64(self.ModelParams.ReportDayDelta),
 			Grounded:float64(us.Grounded)/float64(self.ModelParams.ReportDayDelta), 
-			Share: float64(us.Share)/float64(self.ModelParams.ReportDayDelta),
+			Share: float64(us.Share.Kilometres())/float64(self.ModelParams.ReportDayDelta),
 			Date: currentDay},
 			self.ModelParams.ReportDayDelta,self.table)
 		tb.rotateStats(currentDay,self.ModelParams.ReportDayDelta,self.table)
@@ -468,6 +559,58 @@ func (self Engine) modelDay(currentDay flap.EpochTime,cars *CountriesAirportsRou
 	return us,flapParams.DailyTotal,nil
 }
 
+// tableNames returns the names of all model and flap tables
+func tableNames() []string {
+	return append(flap.TableNames(),modelTableName,carTableName,journeyPlannerTableName)
+}
+
+// Backup writes all model and flap tables to a single archive file at the given path,
+// which can be restored into a database of any type. On failure no file is left behind.
+func (self *Engine) Backup(ctx context.Context, path string) error {
+	f,err := os.Create(path)
+	if err != nil {
+		return logError(err)
+	}
+	err = db.Backup(ctx,self.db,tableNames(),f)
+	errClose := f.Close()
+	if err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(path)
+		return logError(err)
+	}
+	return nil
+}
+
+// Restore replaces all model and flap state with the contents of the archive file at
+// the given path. The whole archive is verified before any state is changed.
+func (self *Engine) Restore(ctx context.Context, path string) error {
+	f,err := os.Open(path)
+	if err != nil {
+		return logError(err)
+	}
+	defer f.Close()
+	_,err = db.VerifyBackup(ctx,f)
+	if err != nil {
+		return logError(err)
+	}
+	_,err = f.Seek(0,io.SeekStart)
+	if err != nil {
+		return logError(err)
+	}
+	err = self.Reset(true)
+	if err != nil {
+		return logError(err)
+	}
+	names,err := db.Restore(ctx,self.db,f)
+	if err != nil {
+		return logError(err)
+	}
+	fmt.Printf("Restored %d tables\n",len(names))
+	return nil
+}
+
 // Resets state of  model and/or flap engine.
 // If destroy is true, all state is destroyed and otherwise only
 // state associated with current model run.
@@ -493,7 +636,9 @@ func (self *Engine) Reset(destroy bool) error {
 
 // Runs the model with configuration as specified in ModelParams, writing results out
 // to multiple CSV files in the specified working folder.
-func (self *Engine) Run(warmOnly bool, startDay flap.EpochTime) error {
+// If ctx is cancelled the run stops part way through the current day and the context
+// error is returned. Summary reports are still written for the days completed.
+func (self *Engine) Run(ctx context.Context, warmOnly bool, startDay flap.EpochTime) error {
 	
 	// Override start day if necessary
 	var finalStartDay = flap.EpochTime(self.ModelParams.StartDay.Unix())
@@ -552,7 +697,13 @@ func (self *Engine) Run(warmOnly bool, startDay flap.EpochTime) error {
 	for i:=flap.Days(-planDays); i < daysToRun; i++ {
 		
 		// Run model for one day
-		us,dt,err := self.modelDay(currentDay,cars,tb,fe,jp,flightPaths,&ms)
+		us,dt,err := self.modelDay(ctx,currentDay,cars,tb,fe,jp,flightPaths,&ms)
+		if err != nil && ctx.Err() != nil {
+			fmt.Printf("\nStopped on day %d of %d\n",i+planDays+1,daysToRun+planDays)
+			self.reportSummary()
+			tb.reportSummary(self.ModelParams)
+			return logError(ctx.Err())
+		}
 		if err != nil {
 			return logError(err)
 		}
@@ -639,7 +790,7 @@ func (self  *Engine) SummaryStats() (string,error) {
 }
 
 // RunOneDay runs the model for the one specified day
-func (self *Engine) RunOneDay(startOfDay flap.EpochTime) error {
+func (self *Engine) RunOneDay(ctx context.Context, startOfDay flap.EpochTime) error {
 
 	var ms modelState
 	err := ms.load(self.table)
@@ -653,10 +804,77 @@ func (self *Engine) RunOneDay(startOfDay flap.EpochTime) error {
 	}
 	defer fe.Release()
 
-	_,_,err = self.modelDay(startOfDay,cars,tb,fe,jp,nil,&ms)
+	_,_,err = self.modelDay(ctx,startOfDay,cars,tb,fe,jp,nil,&ms)
 	return err
 }
 
+// recordEvents has the flap engine record its commands in the event log if configured
+func (self *Engine) recordEvents(fe *flap.Engine) {
+	if self.ModelParams.Events {
+		fe.RecordEvents(flap.NewEventLog(self.db))
+	}
+}
+
+// Replay rebuilds the state of all travellers, and FLAP administrative state, from the
+// event log as it was at the given time. The model's own state is left as it is.
+func (self *Engine) Replay(ctx context.Context, until flap.EpochTime) (int,error) {
+	log := flap.NewEventLog(self.db)
+	if log == nil {
+		return 0,logError(EFAILEDTOOPENEVENTLOG)
+	}
+	replayed,err := flap.Replay(ctx,log,self.db,until)
+	if err != nil {
+		return replayed,logError(err)
+	}
+	return replayed,nil
+}
+
+// backfillLease returns how long a distributed backfill worker holds a range for
+func (self *Engine) backfillLease() time.Duration {
+	return time.Duration(self.ModelParams.Backfill.LeaseSeconds)*time.Second
+}
+
+// backfillPoll returns how often distributed backfill workers check for work
+func (self *Engine) backfillPoll() time.Duration {
+	return time.Duration(self.ModelParams.Backfill.PollSeconds)*time.Second
+}
+
+// ServeBackfill works as the named worker on each distributed backfill begun by a
+// model run in another process sharing the database, until ctx is done
+func (self *Engine) ServeBackfill(ctx context.Context, worker string) error {
+	fe := flap.NewEngine(self.db,flap.LogLevel(self.ModelParams.LogLevel),self.ModelParams.WorkingFolder)
+	defer fe.Release()
+	err := fe.ServeBackfill(ctx,worker,self.backfillLease(),self.backfillPoll())
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return nil
+	}
+	return logError(err)
+}
+
+// MigrateTravellers rewrites all traveller records written in older encodings
+// in the current one, returning the number rewritten
+func (self *Engine) MigrateTravellers(ctx context.Context) (int,error) {
+	fe := flap.NewEngine(self.db,flap.LogLevel(self.ModelParams.LogLevel),self.ModelParams.WorkingFolder)
+	defer fe.Release()
+	migrated,err := fe.Travellers.Migrate(ctx)
+	if err != nil {
+		return migrated,logError(err)
+	}
+	return migrated,nil
+}
+
+// Verify checks the ledgers, trip histories and promises of all travellers, and the
+// ledger for each day backfilled, reporting any invariants broken
+func (self *Engine) Verify(ctx context.Context) (flap.VerifyReport,error) {
+	fe := flap.NewEngine(self.db,flap.LogLevel(self.ModelParams.LogLevel),self.ModelParams.WorkingFolder)
+	defer fe.Release()
+	report,err := fe.Verify(ctx)
+	if err != nil {
+		return report,logError(err)
+	}
+	return report,nil
+}
+
 // bandToPassport maps a specfied band and bot number to a passport definition,
 // so thast the corresponding traveller record for the bot can be retreived
 func (self *Engine) bandToPassport(band uint64,bot uint64) (flap.Passport,error) {
@@ -794,7 +1012,7 @@ func (self *Engine) TransactionsAsJSON(band uint64,bot uint64) (string,error) {
 	it := t.Transactions.NewIterator()
 	for it.Next() {
 		t := it.Value()
-		transactions = append(transactions,jsonTransaction{Date:t.Date.ToTime(),Distance: t.Distance, Type:t.TT})
+		transactions = append(transactions,jsonTransaction{Date:t.Date.ToTime(),Distance: t.Distance.Kilometres(), Type:t.TT})
 	}
 	jsonData, _ := json.MarshalIndent(transactions, "", "    ")
 	return string(jsonData),nil
@@ -828,13 +1046,61 @@ func (self *Engine) AccountAsJSON(band uint64,bot uint64, now flap.EpochTime) (s
 
 	// Render account state as JSON
 	var account jsonAccount
-	account.Balance = t.Balance
-	account.Cleared = t.Cleared(now)
+	account.Balance = t.Balance.Kilometres()
+	account.Cleared,err = fe.ClearedWithinOverdraft(&t,now)
+	if err != nil {
+		return "",err
+	}
 	account.ClearanceDate =  t.Kept.Clearance.ToTime()
 	jsonData, _ := json.MarshalIndent(account, "", "    ")
 	return string(jsonData),nil
 }
 
+type jsonAccountAsOf struct {
+	At	time.Time
+	jsonAccount
+	Promises []jsonPromise
+}
+
+// Write out the account of the given traveller as it stood at the given time as JSON string,
+// rebuilt from the event log
+func (self *Engine) AccountAsOfJSON(band uint64,bot uint64, at flap.EpochTime) (string,error) {
+
+	// Get traveller's passport
+	p,err := self.bandToPassport(band,bot)
+	if (err != nil) {
+		return "",err
+	}
+
+	//  Initialize flap, reading from the event log
+	fe := flap.NewEngine(self.db,flap.LogLevel(self.ModelParams.LogLevel),self.ModelParams.WorkingFolder)
+	defer fe.Release()
+	log := flap.NewEventLog(self.db)
+	if log == nil {
+		return "",logError(EFAILEDTOOPENEVENTLOG)
+	}
+	fe.RecordEvents(log)
+
+	// Rebuild traveller as at the time
+	ts,err := fe.TravellerAsOf(p,at)
+	if err != nil {
+		return "",logError(err)
+	}
+
+	// Render account state and active promises as JSON
+	var account jsonAccountAsOf
+	account.At = at.ToTime()
+	account.Balance = ts.Balance.Kilometres()
+	account.Cleared = ts.Clearance
+	account.ClearanceDate = ts.Kept.Clearance.ToTime()
+	account.Promises = make([]jsonPromise,0)
+	for _,p := range ts.Active {
+		account.Promises = append(account.Promises,jsonPromise{TripStart:p.TripStart.ToTime(),TripEnd:p.TripEnd.ToTime(),Clearance:p.Clearance.ToTime(),Distance:p.Distance,Stacked:p.StackIndex,CarriedOver:p.CarriedOver})
+	}
+	jsonData, _ := json.MarshalIndent(account, "", "    ")
+	return string(jsonData),nil
+}
+
 // updateVerboseStats updates the data for verbose stats to reflect current day and outputs if it is time to do so
 func (self *Engine) updateVerboseStats(day flap.Days, currentDay flap.EpochTime, dt flap.Kilometres, us flap.UpdateBackfillStats) {
 	
@@ -13,7 +13,7 @@ func setupJP(t *testing.T) *db.LevelDB{
 	if err := os.Mkdir(JPTESTFOLDER, 0700); err != nil {
 		t.Error("Failed to create test dir", err)
 	}
-	return db.NewLevelDB(JPTESTFOLDER)
+	return db.NewLevelDB(JPTESTFOLDER,db.LevelDBOptions{})
 } 
 
 func teardownJP(db *db.LevelDB) {
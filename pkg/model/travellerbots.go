@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"encoding/gob"
 	"bytes"
+	"context"
 	"gonum.org/v1/plot"
 	"gonum.org/v1/plot/plotter"
 	"gonum.org/v1/plot/vg"
@@ -272,15 +273,16 @@ func (self *TravellerBots) Build(modelParams ModelParams,flapParams flap.FlapPar
 // planTrips "throws dice" for every traveller bot in every band according to probability
 // of travellers in the band travelling on any one day. If the dice comes up and the
 // travellerbot is not in the middle of a trip, a new trip is planned using weighted 
-// country-airports-routes model
-func (self *TravellerBots) planTrips(cars *CountriesAirportsRoutes, jp* journeyPlanner, fe *flap.Engine,currentDay flap.EpochTime,deterministic bool,dayOfModel flap.Days, threads uint) error {
+// country-airports-routes model. Planning stops with the context error if ctx is
+// cancelled.
+func (self *TravellerBots) planTrips(ctx context.Context, cars *CountriesAirportsRoutes, jp* journeyPlanner, fe *flap.Engine,currentDay flap.EpochTime,deterministic bool,dayOfModel flap.Days, threads uint) error {
 	
 	// Create configured number of threads to plan trips and wait for them to finish
 	perrs := make(chan error, threads)
 	var wg sync.WaitGroup
 	for i := uint(0); i < threads; i++ {
 		wg.Add(1)
-		t :=  func (step uint,offset uint) {perrs <- self.doPlanTrips(cars,jp,fe,currentDay,deterministic,dayOfModel,step,offset);wg.Done()}
+		t :=  func (step uint,offset uint) {perrs <- self.doPlanTrips(ctx,cars,jp,fe,currentDay,deterministic,dayOfModel,step,offset);wg.Done()}
 		go t(threads,i)
 	}
 	wg.Wait()
@@ -295,7 +297,7 @@ func (self *TravellerBots) planTrips(cars *CountriesAirportsRoutes, jp* journeyP
 	return nil
 }
 
-func (self *TravellerBots) doPlanTrips(cars *CountriesAirportsRoutes, jp* journeyPlanner, fe *flap.Engine,currentDay flap.EpochTime,deterministic bool,dayOfModel flap.Days,threads uint, offset uint) error {
+func (self *TravellerBots) doPlanTrips(ctx context.Context, cars *CountriesAirportsRoutes, jp* journeyPlanner, fe *flap.Engine,currentDay flap.EpochTime,deterministic bool,dayOfModel flap.Days,threads uint, offset uint) error {
 
 	// Iterate through each bot in each band
 	for i:=bandIndex(0); i < bandIndex(len(self.bots)); i++ {
@@ -303,6 +305,11 @@ func (self *TravellerBots) doPlanTrips(cars *CountriesAirportsRoutes, jp* journe
 		planner := self.bots[i].planner.clone()
 		for j:=botIndex(offset); j < self.bots[i].numInstances; j+=botIndex(threads) {
 
+			// Stop if cancelled
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
 			// Retrieve passport
 			p,err := self.getPassport(botId{i,j})
 			if err != nil {
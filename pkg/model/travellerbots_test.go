@@ -14,7 +14,7 @@ func setupTB(t *testing.T) (*db.LevelDB, db.Table) {
 	if err := os.Mkdir(TBTESTFOLDER, 0700); err != nil {
 		t.Error("Failed to create test dir", err)
 	}
-	db :=  db.NewLevelDB(TBTESTFOLDER); 
+	db :=  db.NewLevelDB(TBTESTFOLDER,db.LevelDBOptions{}); 
 	table,err := db.CreateTable("TESTTABLE");
 	if err != nil {
 		t.Error("Failed to create test table",err)
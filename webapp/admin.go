@@ -54,7 +54,7 @@ func (self *adminRestAPI) init(r *mux.Router,configfile string) error {
 
 	api.HandleFunc("/build",
 		func (w http.ResponseWriter, r *http.Request) {
-			err := self.engine.Build()
+			err := self.engine.Build(r.Context())
 			if err != nil {
 				logError(err)
 				http.Error(w, fmt.Sprintf("\nFailed to build model with error '%s'\n",err), http.StatusInternalServerError)
@@ -78,7 +78,7 @@ func (self *adminRestAPI) init(r *mux.Router,configfile string) error {
 				return
 			}
 			
-			err = self.engine.Run(true,flap.EpochTime(startDayTime.Unix()))
+			err = self.engine.Run(r.Context(),true,flap.EpochTime(startDayTime.Unix()))
 			if err != nil {
 				logError(err)
 				http.Error(w, fmt.Sprintf("\nFailed to warm model with error '%s'\n",err), http.StatusInternalServerError)
@@ -91,7 +91,7 @@ func (self *adminRestAPI) init(r *mux.Router,configfile string) error {
 		func (w http.ResponseWriter, r *http.Request) {
 			dayToRun := flap.EpochTime(time.Now().Unix())
 			dayToRun -= dayToRun % flap.SecondsInDay
-			err := self.engine.RunOneDay(dayToRun)
+			err := self.engine.RunOneDay(r.Context(),dayToRun)
 			if err != nil {
 				logError(err)
 				http.Error(w, fmt.Sprintf("\nFailed to run model for %s  with error '%s'\n",dayToRun.ToTime(),err), http.StatusInternalServerError)